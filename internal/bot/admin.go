@@ -0,0 +1,480 @@
+package bot
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"telegrambot/internal/storage"
+)
+
+const (
+	// broadcastInterval spaces out broadcast messages to stay below Telegram's rate limit
+	broadcastInterval = 50 * time.Millisecond
+	// defaultAuditEntries is the number of audit entries /audit shows without an argument
+	defaultAuditEntries = 20
+	// maxAuditEntries is the largest number of audit entries /audit shows
+	maxAuditEntries = 100
+)
+
+// adminCommands are only available to admins, in private chats
+var adminCommands = map[string]bool{
+	"users":         true,
+	"adduser":       true,
+	"removeuser":    true,
+	"userinfo":      true,
+	"broadcast":     true,
+	"setmodel":      true,
+	"resetexpenses": true,
+	"override":      true,
+	"audit":         true,
+	"invite":        true,
+	"invites":       true,
+	"revokeinvite":  true,
+	"stats":         true,
+}
+
+// accessRules holds the users admins have allowed or removed with /adduser and /removeuser.
+// They take precedence over allowed_users in the config.
+type accessRules struct {
+	mutex sync.Mutex
+	rules map[int64]bool
+}
+
+// newAccessRules creates the rules loaded from storage
+func newAccessRules(rules map[int64]bool) *accessRules {
+	return &accessRules{rules: rules}
+}
+
+// get returns whether an admin allowed or removed a user; ok is false if no admin did
+func (a *accessRules) get(userID int64) (allowed, ok bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	allowed, ok = a.rules[userID]
+	return allowed, ok
+}
+
+// set records that an admin allowed or removed a user
+func (a *accessRules) set(userID int64, allowed bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.rules[userID] = allowed
+}
+
+// allowed returns the users admins have allowed
+func (a *accessRules) allowed() []int64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var userIDs []int64
+	for userID, allowed := range a.rules {
+		if allowed {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs
+}
+
+// isUserAllowed checks whether a user may use the bot: admins always, others as set by
+// /adduser and /removeuser or, if no admin changed their access, as listed in allowed_users
+func (b *Bot) isUserAllowed(userID int64) bool {
+	if b.config.IsAdmin(userID) {
+		return true
+	}
+	if allowed, ok := b.access.get(userID); ok {
+		return allowed
+	}
+	return b.config.IsUserAllowed(userID)
+}
+
+// allowedUsers returns all users that may use the bot, in ascending order
+func (b *Bot) allowedUsers() []int64 {
+	candidates := append(append(append([]int64{}, b.config.AllowedUsers...), b.config.Admins...), b.access.allowed()...)
+
+	seen := make(map[int64]bool)
+	var userIDs []int64
+	for _, userID := range candidates {
+		if !seen[userID] && b.isUserAllowed(userID) {
+			seen[userID] = true
+			userIDs = append(userIDs, userID)
+		}
+	}
+	sort.Slice(userIDs, func(i, j int) bool { return userIDs[i] < userIDs[j] })
+	return userIDs
+}
+
+// audit records an admin action in the audit log
+func (b *Bot) audit(adminID int64, action string, targetID int64, details string) {
+	log.Infof("Admin %d: %s %d %s", adminID, action, targetID, details)
+
+	entry := storage.AuditEntry{
+		Timestamp: time.Now(),
+		AdminID:   adminID,
+		Action:    action,
+		TargetID:  targetID,
+		Details:   details,
+	}
+	if err := b.storage.AddAuditEntry(entry); err != nil {
+		log.Errorf("Failed to write audit log: %v", err)
+	}
+}
+
+// parseUserID parses the user ID argument of an admin command
+func parseUserID(arg string) (int64, bool) {
+	userID, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || userID == 0 {
+		return 0, false
+	}
+	return userID, true
+}
+
+// isKnownUser checks whether settings are stored for a user or chat
+func (b *Bot) isKnownUser(userID int64) (bool, error) {
+	userIDs, err := b.storage.ListUsers()
+	if err != nil {
+		return false, err
+	}
+	for _, id := range userIDs {
+		if id == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// lastActivity returns when a user last chatted, or when their settings last changed if they never did
+func lastActivity(settings *storage.UserSettings) time.Time {
+	last := settings.LastUpdated
+	for _, conversation := range settings.Conversations {
+		if conversation.LastActivity.After(last) {
+			last = conversation.LastActivity
+		}
+	}
+	return last
+}
+
+// chatKeyIcon shows whether a chat key belongs to a user, a group or a forum topic
+func chatKeyIcon(key int64) string {
+	switch {
+	case key > 0:
+		return "👤"
+	case key <= -(1 << 62):
+		return "🧵"
+	default:
+		return "👥"
+	}
+}
+
+// handleUsersCommand handles the admin /users command, which lists all users with their spending
+func (b *Bot) handleUsersCommand(userID int64) {
+	userIDs, err := b.storage.ListUsers()
+	if err != nil {
+		log.Errorf("Failed to list users: %v", err)
+		b.sendMessage(userID, "Error listing users.")
+		return
+	}
+
+	type userRow struct {
+		id       int64
+		spent    float64
+		lastSeen time.Time
+	}
+	rows := make([]userRow, 0, len(userIDs))
+	for _, id := range userIDs {
+		settings, err := b.storage.GetUserSettings(id)
+		if err != nil {
+			log.Errorf("Failed to get settings of user %d: %v", id, err)
+			continue
+		}
+		rows = append(rows, userRow{id: id, spent: settings.TotalExpenses, lastSeen: lastActivity(settings)})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].lastSeen.After(rows[j].lastSeen) })
+
+	message := fmt.Sprintf("👥 <i>Users</i> (%d)\n\n", len(rows))
+	if len(rows) == 0 {
+		message += "No one has used the bot yet."
+	}
+	for _, row := range rows {
+		status := ""
+		if row.id > 0 && !b.isUserAllowed(row.id) {
+			status = " ⛔"
+		}
+		message += fmt.Sprintf("%s <code>%d</code>%s · $%.4f · %s\n",
+			chatKeyIcon(row.id), row.id, status, row.spent, row.lastSeen.Format("Jan 2 15:04"))
+	}
+	message += "\n👤 user · 👥 group · 🧵 forum topic · ⛔ no access\n"
+	message += "<i>Details:</i> <code>/userinfo user_id</code>"
+
+	b.sendMessageWithMode(userID, message, "HTML")
+}
+
+// handleAddUserCommand handles the admin /adduser command, which allows a user without a restart
+func (b *Bot) handleAddUserCommand(userID int64, args string) {
+	targetID, ok := parseUserID(strings.TrimSpace(args))
+	if !ok || targetID < 0 {
+		b.sendMessage(userID, "<i>Usage:</i> <code>/adduser user_id</code>\n\nAllows a Telegram user to use the bot.")
+		return
+	}
+
+	if b.isUserAllowed(targetID) {
+		b.sendMessage(userID, fmt.Sprintf("ℹ️ User <code>%d</code> can already use the bot.", targetID))
+		return
+	}
+
+	if err := b.storage.SetAccess(targetID, true); err != nil {
+		log.Errorf("Failed to allow user %d: %v", targetID, err)
+		b.sendMessage(userID, "Error saving the user's access.")
+		return
+	}
+	b.access.set(targetID, true)
+	b.audit(userID, "adduser", targetID, "")
+
+	b.sendMessage(userID, fmt.Sprintf("✅ User <code>%d</code> can use the bot now.", targetID))
+}
+
+// handleRemoveUserCommand handles the admin /removeuser command, which revokes a user's access without a restart
+func (b *Bot) handleRemoveUserCommand(userID int64, args string) {
+	targetID, ok := parseUserID(strings.TrimSpace(args))
+	if !ok || targetID < 0 {
+		b.sendMessage(userID, "<i>Usage:</i> <code>/removeuser user_id</code>\n\nRevokes a Telegram user's access to the bot. Their data is kept.")
+		return
+	}
+
+	if b.config.IsAdmin(targetID) {
+		b.sendMessage(userID, "❌ Admins can't be removed. Remove them from <code>admins</code> in the config first.")
+		return
+	}
+	if !b.isUserAllowed(targetID) {
+		b.sendMessage(userID, fmt.Sprintf("ℹ️ User <code>%d</code> has no access to the bot.", targetID))
+		return
+	}
+
+	if err := b.storage.SetAccess(targetID, false); err != nil {
+		log.Errorf("Failed to remove user %d: %v", targetID, err)
+		b.sendMessage(userID, "Error saving the user's access.")
+		return
+	}
+	b.access.set(targetID, false)
+	b.audit(userID, "removeuser", targetID, "")
+
+	// Stop what the user has already started
+	b.queues.clear(targetID)
+	b.inflight.cancelUser(targetID)
+
+	b.sendMessage(userID, fmt.Sprintf("🚫 User <code>%d</code> can no longer use the bot.", targetID))
+}
+
+// handleUserInfoCommand handles the admin /userinfo command, which shows the settings and spending of a user
+func (b *Bot) handleUserInfoCommand(userID int64, args string) {
+	targetID, ok := parseUserID(strings.TrimSpace(args))
+	if !ok {
+		b.sendMessage(userID, "<i>Usage:</i> <code>/userinfo user_id</code>")
+		return
+	}
+
+	known, err := b.isKnownUser(targetID)
+	if err != nil {
+		log.Errorf("Failed to list users: %v", err)
+		b.sendMessage(userID, "Error retrieving the user's settings.")
+		return
+	}
+
+	message := fmt.Sprintf("%s <i>User</i> <code>%d</code>\n\n", chatKeyIcon(targetID), targetID)
+	if targetID > 0 {
+		access := "no access"
+		if allowed, ok := b.access.get(targetID); ok && allowed {
+			access = "allowed by an admin"
+		} else if ok {
+			access = "removed by an admin"
+		} else if b.config.IsUserAllowed(targetID) {
+			access = "allowed in the config"
+		}
+		if b.config.IsAdmin(targetID) {
+			access = "admin"
+		}
+		message += fmt.Sprintf("<i>Access:</i> %s\n", access)
+	}
+
+	if !known {
+		message += "\nThis user hasn't used the bot yet."
+		b.sendMessage(userID, message)
+		return
+	}
+
+	settings, err := b.storage.GetUserSettings(targetID)
+	if err != nil {
+		log.Errorf("Failed to get settings of user %d: %v", targetID, err)
+		b.sendMessage(userID, "Error retrieving the user's settings.")
+		return
+	}
+
+	conversation := settings.ActiveConversation()
+	message += fmt.Sprintf("<i>Model:</i> <code>%s</code>\n", html.EscapeString(settings.ActiveModel()))
+	message += fmt.Sprintf("<i>Chat mode:</i> %s\n", settings.ActiveChatMode())
+	message += fmt.Sprintf("<i>Conversations:</i> %d (active: %s, %d messages)\n",
+		len(settings.Conversations), html.EscapeString(conversation.Title), conversation.MessageCount)
+	message += fmt.Sprintf("<i>Last activity:</i> %s\n\n", lastActivity(settings).Format("Jan 2 15:04"))
+
+	expenses, err := b.storage.GetExpenses(targetID)
+	if err != nil {
+		log.Errorf("Failed to get expenses of user %d: %v", targetID, err)
+	}
+	message += fmt.Sprintf("<i>Total spent:</i> $%.4f in %d requests\n", settings.TotalExpenses, len(expenses))
+	usages, err := b.budgetUsages(targetID, settings)
+	if err != nil {
+		log.Errorf("Failed to check budget for user %d: %v", targetID, err)
+	}
+	for _, usage := range usages {
+		if !usage.global {
+			message += fmt.Sprintf("<i>%s budget:</i> $%.4f of $%.2f\n", capitalize(usage.label), usage.spent, usage.limit)
+		}
+	}
+	if time.Now().Before(settings.BudgetOverrideUntil) {
+		message += fmt.Sprintf("🔓 User limits lifted until %s\n", settings.BudgetOverrideUntil.Format("Jan 2 15:04"))
+	}
+
+	b.sendMessage(userID, message)
+}
+
+// handleBroadcastCommand handles the admin /broadcast command, which sends a message to all allowed users
+func (b *Bot) handleBroadcastCommand(userID int64, args string) {
+	text := strings.TrimSpace(args)
+	if text == "" {
+		b.sendMessage(userID, "<i>Usage:</i> <code>/broadcast text</code>\n\nSends the text to every user that may use the bot.")
+		return
+	}
+
+	recipients := b.allowedUsers()
+	b.audit(userID, "broadcast", 0, text)
+	b.sendMessage(userID, fmt.Sprintf("📢 Sending to %d users...", len(recipients)))
+
+	message := "📢 <i>Announcement</i>\n\n" + html.EscapeString(text)
+	sent := 0
+	for _, recipient := range recipients {
+		if err := b.sendMessage(recipient, message); err != nil {
+			// Users that never started a chat with the bot can't receive messages
+			log.Warnf("Failed to send broadcast to user %d: %v", recipient, err)
+		} else {
+			sent++
+		}
+
+		select {
+		case <-time.After(broadcastInterval):
+		case <-b.ctx.Done():
+			log.Warnf("Broadcast interrupted by shutdown after %d messages", sent)
+			return
+		}
+	}
+
+	b.sendMessage(userID, fmt.Sprintf("✅ Broadcast sent to %d of %d users.", sent, len(recipients)))
+}
+
+// handleSetModelCommand handles the admin /setmodel command, which changes the model of a user
+func (b *Bot) handleSetModelCommand(userID int64, args string) {
+	fields := strings.Fields(args)
+	if len(fields) != 2 {
+		b.sendMessage(userID, "<i>Usage:</i> <code>/setmodel user_id model</code>\n\nChanges the model of the user's active conversation and their default model.")
+		return
+	}
+
+	targetID, ok := parseUserID(fields[0])
+	if !ok {
+		b.sendMessage(userID, "❌ Please specify the Telegram ID of a user.")
+		return
+	}
+	model := fields[1]
+	if !b.validateModel(userID, model) {
+		return
+	}
+
+	previous, err := b.setModel(targetID, model)
+	if err != nil {
+		log.Errorf("Failed to set model of user %d: %v", targetID, err)
+		b.sendMessage(userID, "Error saving the user's settings.")
+		return
+	}
+	b.audit(userID, "setmodel", targetID, fmt.Sprintf("%s -> %s", previous, model))
+
+	b.sendMessage(userID, fmt.Sprintf("✅ Model of user <code>%d</code> changed to <code>%s</code>.", targetID, html.EscapeString(model)))
+}
+
+// handleResetExpensesCommand handles the admin /resetexpenses command, which deletes the expense history of a user
+func (b *Bot) handleResetExpensesCommand(userID int64, args string) {
+	targetID, ok := parseUserID(strings.TrimSpace(args))
+	if !ok {
+		b.sendMessage(userID, "<i>Usage:</i> <code>/resetexpenses user_id</code>\n\nDeletes the expense history of a user, which also resets their budgets.")
+		return
+	}
+
+	total, err := b.storage.GetTotalExpenses(targetID)
+	if err != nil {
+		log.Errorf("Failed to get expenses of user %d: %v", targetID, err)
+		b.sendMessage(userID, "Error retrieving the user's expenses.")
+		return
+	}
+
+	if err := b.storage.ResetExpenses(targetID); err != nil {
+		log.Errorf("Failed to reset expenses of user %d: %v", targetID, err)
+		b.sendMessage(userID, "Error resetting the user's expenses.")
+		return
+	}
+	b.audit(userID, "resetexpenses", targetID, fmt.Sprintf("$%.4f", total))
+
+	b.sendMessage(userID, fmt.Sprintf("🧹 Expenses of user <code>%d</code> reset ($%.4f deleted).", targetID, total))
+}
+
+// handleAuditCommand handles the admin /audit command, which shows the most recent admin actions
+func (b *Bot) handleAuditCommand(userID int64, args string) {
+	limit := defaultAuditEntries
+	if args = strings.TrimSpace(args); args != "" {
+		n, err := strconv.Atoi(args)
+		if err != nil || n <= 0 {
+			b.sendMessage(userID, "<i>Usage:</i> <code>/audit [count]</code>")
+			return
+		}
+		limit = min(n, maxAuditEntries)
+	}
+
+	entries, err := b.storage.GetAuditLog(limit)
+	if err != nil {
+		log.Errorf("Failed to read audit log: %v", err)
+		b.sendMessage(userID, "Error reading the audit log.")
+		return
+	}
+
+	message := "📜 <i>Audit Log</i>\n\n"
+	if len(entries) == 0 {
+		message += "No admin actions have been recorded yet."
+	}
+	for _, entry := range entries {
+		message += fmt.Sprintf("%s · <code>%d</code> %s", entry.Timestamp.Format("Jan 2 15:04"), entry.AdminID, entry.Action)
+		if entry.TargetID != 0 {
+			message += fmt.Sprintf(" <code>%d</code>", entry.TargetID)
+		}
+		if entry.Details != "" {
+			message += " · " + html.EscapeString(truncateRunes(entry.Details, 100))
+		}
+		message += "\n"
+	}
+
+	b.sendMessageWithMode(userID, message, "HTML")
+}
+
+// handleStatsCommand handles the admin /stats command, which shows how often messages had to be
+// sent with degraded formatting since the bot started
+func (b *Bot) handleStatsCommand(userID int64) {
+	message := "📊 <i>Formatting fallbacks since start</i>\n\n"
+	message += fmt.Sprintf("Sent with sanitized HTML: %d\n", fallbackCount(fallbackSanitized))
+	message += fmt.Sprintf("Sent as plain text: %d\n", fallbackCount(fallbackPlain))
+	message += fmt.Sprintf("Not delivered: %d\n\n", fallbackCount(fallbackFailed))
+	message += "Rising numbers mean Telegram rejects the HTML the bot produces; the logs show the messages."
+	b.sendMessage(userID, message)
+}
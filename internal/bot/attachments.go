@@ -0,0 +1,151 @@
+package bot
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+
+	"telegrambot/internal/storage"
+)
+
+// maxDownloadSize is the largest file the Telegram bot API lets bots download
+const maxDownloadSize = 20 << 20
+
+// messageAttachments returns the images sent with a message: photos and image documents
+func messageAttachments(message *tgbotapi.Message) []storage.Attachment {
+	var attachments []storage.Attachment
+
+	if len(message.Photo) > 0 {
+		// Photos come in several sizes, the last one is the largest
+		photo := message.Photo[len(message.Photo)-1]
+		attachments = append(attachments, storage.Attachment{
+			Type:     storage.AttachmentImage,
+			FileID:   photo.FileID,
+			MimeType: "image/jpeg",
+		})
+	}
+
+	if message.Document != nil && strings.HasPrefix(message.Document.MimeType, "image/") {
+		attachments = append(attachments, storage.Attachment{
+			Type:     storage.AttachmentImage,
+			FileID:   message.Document.FileID,
+			MimeType: message.Document.MimeType,
+		})
+	}
+
+	return attachments
+}
+
+// hasImages reports whether any of the messages has image attachments
+func hasImages(messages []storage.ChatMessage) bool {
+	for _, message := range messages {
+		for _, attachment := range message.Attachments {
+			if attachment.Type == storage.AttachmentImage {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withoutImages returns the attachments that aren't images
+func withoutImages(attachments []storage.Attachment) []storage.Attachment {
+	var rest []storage.Attachment
+	for _, attachment := range attachments {
+		if attachment.Type != storage.AttachmentImage {
+			rest = append(rest, attachment)
+		}
+	}
+	return rest
+}
+
+// modelSupportsImages reports whether a model accepts image input.
+// Models missing from the catalog are assumed to support images and left to the API to reject.
+func (b *Bot) modelSupportsImages(model string) bool {
+	info, err := b.llmClient.GetModel(model)
+	if err != nil || info == nil {
+		return true
+	}
+	return info.SupportsInput("image")
+}
+
+// loadAttachments downloads the images of the messages into their DataURL.
+// Images in the history that can't be downloaded anymore are left out; an error is returned
+// only if an image of the last (current) message fails.
+func (b *Bot) loadAttachments(userID int64, messages []storage.ChatMessage) error {
+	for i := range messages {
+		if len(messages[i].Attachments) == 0 {
+			continue
+		}
+
+		// Don't write data URLs into the caller's attachment slices
+		attachments := make([]storage.Attachment, len(messages[i].Attachments))
+		copy(attachments, messages[i].Attachments)
+		messages[i].Attachments = attachments
+
+		for j := range attachments {
+			if attachments[j].Type != storage.AttachmentImage {
+				continue
+			}
+
+			dataURL, err := b.downloadDataURL(attachments[j])
+			if err != nil {
+				if i == len(messages)-1 {
+					return err
+				}
+				log.Warnf("Failed to load image from history of user %d: %v", userID, err)
+				continue
+			}
+			attachments[j].DataURL = dataURL
+		}
+	}
+	return nil
+}
+
+// downloadDataURL downloads an attachment and encodes it as a base64 data URL
+func (b *Bot) downloadDataURL(attachment storage.Attachment) (string, error) {
+	data, err := b.downloadFile(attachment.FileID)
+	if err != nil {
+		return "", err
+	}
+
+	mimeType := attachment.MimeType
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+
+	return fmt.Sprintf("data:%s;base64,%s", mimeType, base64.StdEncoding.EncodeToString(data)), nil
+}
+
+// downloadFile downloads a file sent to the bot via the Telegram file API
+func (b *Bot) downloadFile(fileID string) ([]byte, error) {
+	fileURL, err := b.api.GetFileDirectURL(fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file URL: %w", err)
+	}
+
+	resp, err := b.httpClient.Get(fileURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download file: HTTP %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxDownloadSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	if len(data) > maxDownloadSize {
+		return nil, fmt.Errorf("file is larger than %d MB", maxDownloadSize>>20)
+	}
+
+	return data, nil
+}
@@ -2,7 +2,11 @@ package bot
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -11,8 +15,10 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"telegrambot/internal/config"
+	"telegrambot/internal/markdown"
 	"telegrambot/internal/openrouter"
 	"telegrambot/internal/storage"
+	"telegrambot/internal/transcribe"
 )
 
 // Bot represents the Telegram bot
@@ -21,7 +27,48 @@ type Bot struct {
 	config    *config.Config
 	storage   storage.Storage
 	llmClient *openrouter.Client
-	updates   tgbotapi.UpdatesChannel
+	server    *http.Server
+	// httpClient downloads files sent to the bot
+	httpClient *http.Client
+	// transcriber converts voice messages to text; nil if transcription is disabled
+	transcriber transcribe.Transcriber
+	// contextNotices records the conversations whose users were told that history was dropped
+	contextNotices map[conversationKey]bool
+	contextMutex   sync.Mutex
+	// summaries records the conversations that are being summarized
+	summaries    map[conversationKey]bool
+	summaryMutex sync.Mutex
+
+	// ctx is cancelled on shutdown and aborts all outstanding work
+	ctx    context.Context
+	cancel context.CancelFunc
+	// inflight holds the running LLM requests, which /stop can cancel
+	inflight *inflightRequests
+	// queues holds the chat messages waiting for the previous answer of their user
+	queues *chatQueues
+	// llmSlots limits the number of concurrent LLM requests; nil if unlimited
+	llmSlots chan struct{}
+
+	// inline debounces inline queries and caches their answers
+	inline *inlineQueries
+
+	// access holds the users admins have allowed or removed at runtime
+	access *accessRules
+	// accessRequests limits how often users without access can ask for it
+	accessRequests *accessRequests
+
+	// chats maps chat keys to the group chats they belong to
+	chats *chatTargets
+	// uploads holds the documents waiting for the next message of their sender
+	uploads *pendingUploads
+	// callbackValues holds the values of buttons whose callback data would be too long
+	callbackValues *callbackValues
+	// mention matches mentions of the bot in group messages
+	mention *regexp.Regexp
+	// handlers counts the goroutines handling updates, so shutdown can wait for them
+	handlers     sync.WaitGroup
+	handlerMutex sync.Mutex
+	stopping     bool
 }
 
 // New creates a new bot instance
@@ -38,24 +85,69 @@ func New(cfg *config.Config, store storage.Storage) (*Bot, error) {
 	// Initialize OpenRouter client
 	llmClient := openrouter.NewClient(cfg.OpenRouterAPIKey, cfg.OpenRouterBaseURL)
 
+	// Initialize speech-to-text client
+	var transcriber transcribe.Transcriber
+	if cfg.TranscriptionBaseURL != "" {
+		transcriber = transcribe.NewClient(cfg.TranscriptionBaseURL, cfg.TranscriptionAPIKey, cfg.TranscriptionModel, cfg.TranscriptionLanguage)
+		log.Infof("Voice transcription enabled: %s (%s)", cfg.TranscriptionBaseURL, cfg.TranscriptionModel)
+	}
+
 	log.Infof("Authorized on account %s", api.Self.UserName)
 
+	rules, err := store.GetAccessRules()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load access rules: %w", err)
+	}
+	topics, err := store.GetTopics()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load forum topics: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var llmSlots chan struct{}
+	if cfg.MaxConcurrentRequests > 0 {
+		llmSlots = make(chan struct{}, cfg.MaxConcurrentRequests)
+	}
+
 	return &Bot{
 		api:       api,
 		config:    cfg,
 		storage:   store,
 		llmClient: llmClient,
+		httpClient: &http.Client{
+			Timeout: 60 * time.Second,
+		},
+		transcriber:    transcriber,
+		contextNotices: make(map[conversationKey]bool),
+		summaries:      make(map[conversationKey]bool),
+		ctx:            ctx,
+		cancel:         cancel,
+		inflight:       newInflightRequests(),
+		queues:         newChatQueues(),
+		llmSlots:       llmSlots,
+		inline:         newInlineQueries(),
+		access:         newAccessRules(rules),
+		accessRequests: newAccessRequests(),
+		chats:          newChatTargets(topics),
+		uploads:        newPendingUploads(),
+		callbackValues: newCallbackValues(),
+		mention:        newMentionPattern(api.Self.UserName),
 	}, nil
 }
 
-// Start starts the bot
+// Start starts the bot in the configured update mode
 func (b *Bot) Start(ctx context.Context) error {
-	// Set up update configuration
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
+	if b.config.UpdateMode == "webhook" {
+		return b.startWebhook(ctx)
+	}
+
+	// getUpdates doesn't work while a webhook is registered, e.g. after switching modes
+	if _, err := b.api.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+		log.Warnf("Failed to remove webhook: %v", err)
+	}
 
-	// Get updates channel
-	b.updates = b.api.GetUpdatesChan(u)
+	updates := b.pollUpdates(ctx)
 
 	log.Info("Bot started, waiting for messages...")
 
@@ -64,23 +156,121 @@ func (b *Bot) Start(ctx context.Context) error {
 		select {
 		case <-ctx.Done():
 			return nil
-		case update := <-b.updates:
-			if update.Message != nil {
-				// Process message in goroutine to avoid blocking
-				go b.handleMessage(update.Message)
-			} else if update.CallbackQuery != nil {
-				// Handle callback query from inline buttons
-				go b.handleCallbackQuery(update.CallbackQuery)
+		case update := <-updates:
+			b.dispatchUpdate(update)
+		}
+	}
+}
+
+// pollUpdates fetches updates with long polling until ctx is done.
+// The Telegram library's update channel drops the forum topic of messages, so updates are decoded here.
+func (b *Bot) pollUpdates(ctx context.Context) <-chan update {
+	updates := make(chan update, 100)
+
+	go func() {
+		config := tgbotapi.NewUpdate(0)
+		config.Timeout = 60
+
+		for ctx.Err() == nil {
+			resp, err := b.api.Request(config)
+			if err != nil {
+				log.Errorf("Failed to get updates, retrying in 3 seconds: %v", err)
+				select {
+				case <-time.After(3 * time.Second):
+				case <-ctx.Done():
+				}
+				continue
+			}
+
+			var raw []json.RawMessage
+			if err := json.Unmarshal(resp.Result, &raw); err != nil {
+				log.Errorf("Failed to decode updates: %v", err)
+				continue
+			}
+
+			for _, data := range raw {
+				update, err := decodeUpdate(data)
+				if err != nil {
+					log.Warnf("Failed to decode update: %v", err)
+					continue
+				}
+				if update.UpdateID < config.Offset {
+					continue
+				}
+				config.Offset = update.UpdateID + 1
+
+				select {
+				case updates <- update:
+				case <-ctx.Done():
+					return
+				}
 			}
 		}
+	}()
+
+	return updates
+}
+
+// dispatchUpdate hands an update to its handler
+func (b *Bot) dispatchUpdate(update update) {
+	var handle func()
+	if update.Message != nil {
+		handle = func() { b.handleMessage(update.Message, update.threadID) }
+	} else if update.CallbackQuery != nil {
+		// Handle callback query from inline buttons
+		handle = func() { b.handleCallbackQuery(update.CallbackQuery, update.threadID) }
+	} else if update.InlineQuery != nil {
+		handle = func() { b.handleInlineQuery(update.InlineQuery) }
+	} else {
+		return
+	}
+
+	b.handlerMutex.Lock()
+	defer b.handlerMutex.Unlock()
+	if b.stopping {
+		log.Warnf("Dropping update %d received during shutdown", update.UpdateID)
+		return
 	}
+
+	// Process in a goroutine to avoid blocking
+	b.handlers.Add(1)
+	go func() {
+		defer b.handlers.Done()
+		handle()
+	}()
 }
 
-// Stop stops the bot
-func (b *Bot) Stop() {
-	if b.updates != nil {
-		b.api.StopReceivingUpdates()
+// Stop stops receiving updates and waits for running handlers until ctx is done.
+// Requests still running then are cancelled, and their handlers get a moment to save partial answers.
+func (b *Bot) Stop(ctx context.Context) {
+	// Polling ends with the context passed to Start
+	if b.server != nil {
+		b.stopWebhook()
+	}
+
+	b.handlerMutex.Lock()
+	b.stopping = true
+	b.handlerMutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		b.handlers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		log.Warnf("Shutdown timeout reached, cancelling %d running requests", b.inflight.count())
+		b.cancel()
+		select {
+		case <-drained:
+		case <-time.After(handlerCleanupTimeout):
+			log.Warn("Some handlers did not finish in time")
+		}
 	}
+
+	b.cancel()
 	log.Info("Bot stopped")
 }
 
@@ -90,7 +280,7 @@ func (b *Bot) sendTypingIndicator(ctx context.Context, userID int64) {
 	defer ticker.Stop()
 
 	// Send initial typing indicator
-	typing := tgbotapi.NewChatAction(userID, tgbotapi.ChatTyping)
+	typing := tgbotapi.NewChatAction(b.chatID(userID), tgbotapi.ChatTyping)
 	b.api.Send(typing)
 
 	for {
@@ -98,39 +288,90 @@ func (b *Bot) sendTypingIndicator(ctx context.Context, userID int64) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			typing := tgbotapi.NewChatAction(userID, tgbotapi.ChatTyping)
+			typing := tgbotapi.NewChatAction(b.chatID(userID), tgbotapi.ChatTyping)
 			b.api.Send(typing)
 		}
 	}
 }
 
-// handleMessage handles incoming messages
-func (b *Bot) handleMessage(message *tgbotapi.Message) {
+// handleMessage handles incoming messages.
+// In groups, only messages addressed to the bot are handled, and answers are threaded to them.
+func (b *Bot) handleMessage(message *tgbotapi.Message, threadID int) {
+	if message.From == nil {
+		return
+	}
+
 	// Check if user is allowed
-	if !b.config.IsUserAllowed(message.From.ID) {
-		log.Warnf("Unauthorized user %d (%s) tried to use bot", message.From.ID, message.From.UserName)
+	if !b.isAllowed(message.From, message.Chat) {
+		log.Warnf("Unauthorized user %d (%s) tried to use bot in chat %d", message.From.ID, message.From.UserName, message.Chat.ID)
+		// Invite links and access requests start with /start in a private chat
+		if message.Chat.IsPrivate() && message.IsCommand() && message.Command() == "start" {
+			b.handleUnauthorizedStart(message)
+		}
 		return
 	}
 
-	userID := message.From.ID
-	log.Infof("Message from user %d: %s", userID, message.Text)
+	replyTo := 0
+	if !message.Chat.IsPrivate() {
+		if !b.isAddressed(message) {
+			return
+		}
+		if !message.IsCommand() {
+			message = b.withoutMention(message)
+		}
+		replyTo = message.MessageID
+	}
+
+	userID := b.registerChat(message.Chat, threadID, replyTo)
+	if message.Chat.IsPrivate() {
+		log.Infof("Message from user %d: %s", userID, message.Text)
+	} else {
+		log.Infof("Message from user %d in chat %d: %s", message.From.ID, message.Chat.ID, message.Text)
+	}
 
 	// Handle commands
 	if message.IsCommand() {
-		b.handleCommand(message)
+		b.handleCommand(userID, message)
+		return
+	}
+
+	// Voice notes and audio files are transcribed first
+	if message.Voice != nil || message.Audio != nil {
+		b.handleVoiceMessage(userID, message)
+		return
+	}
+
+	// Documents other than images are read and attached to a question
+	if message.Document != nil && !strings.HasPrefix(message.Document.MimeType, "image/") {
+		b.handleDocumentMessage(userID, message)
 		return
 	}
 
 	// Handle regular messages (chat with LLM)
-	b.handleChatMessage(message)
+	b.handleChatMessage(userID, message)
 }
 
 // handleCommand handles bot commands
-func (b *Bot) handleCommand(message *tgbotapi.Message) {
-	userID := message.From.ID
+func (b *Bot) handleCommand(userID int64, message *tgbotapi.Message) {
 	command := message.Command()
 	args := message.CommandArguments()
 
+	if adminCommands[command] {
+		if !message.Chat.IsPrivate() {
+			b.sendMessage(userID, "❌ Admin commands only work in a private chat with the bot.")
+			return
+		}
+		if !b.config.IsAdmin(userID) {
+			b.sendMessage(userID, "❌ This command is only available to administrators.")
+			return
+		}
+	}
+
+	if groupSettingsCommands[command] && !b.canChangeSettings(message.From, message.Chat) {
+		b.sendMessage(userID, groupSettingsDenied)
+		return
+	}
+
 	switch command {
 	case "start", "help":
 		b.handleStartCommand(userID)
@@ -144,26 +385,92 @@ func (b *Bot) handleCommand(message *tgbotapi.Message) {
 		b.handleAddModelCommand(userID, args)
 	case "listmodels":
 		b.handleListModelsCommand(userID)
+	case "models":
+		b.handleModelsCommand(userID, args)
 	case "expenses":
-		b.handleExpensesCommand(userID)
+		b.handleExpensesCommand(userID, message.From.ID)
 	case "clear":
 		b.handleClearCommand(userID)
 	case "status":
 		b.handleStatusCommand(userID)
+	case "new":
+		b.handleNewConversationCommand(userID, args)
+	case "chats":
+		b.handleChatsCommand(userID)
+	case "switch":
+		b.handleSwitchCommand(userID, args)
+	case "rename":
+		b.handleRenameCommand(userID, args)
+	case "delete":
+		b.handleDeleteCommand(userID, args)
+	case "budget":
+		b.handleBudgetCommand(userID, message.From.ID)
+	case "override":
+		b.handleOverrideCommand(userID, args)
+	case "users":
+		b.handleUsersCommand(userID)
+	case "adduser":
+		b.handleAddUserCommand(userID, args)
+	case "removeuser":
+		b.handleRemoveUserCommand(userID, args)
+	case "userinfo":
+		b.handleUserInfoCommand(userID, args)
+	case "broadcast":
+		b.handleBroadcastCommand(userID, args)
+	case "setmodel":
+		b.handleSetModelCommand(userID, args)
+	case "resetexpenses":
+		b.handleResetExpensesCommand(userID, args)
+	case "audit":
+		b.handleAuditCommand(userID, args)
+	case "invite":
+		b.handleInviteCommand(userID, args)
+	case "invites":
+		b.handleInvitesCommand(userID)
+	case "revokeinvite":
+		b.handleRevokeInviteCommand(userID, args)
+	case "stats":
+		b.handleStatsCommand(userID)
+	case "persona":
+		b.handlePersonaCommand(userID, args)
+	case "system":
+		b.handleSystemCommand(userID, args)
+	case "params":
+		b.handleParamsCommand(userID, args)
+	case "summary":
+		b.handleSummaryCommand(userID, args)
+	case "fallback":
+		b.handleFallbackCommand(userID, args)
+	case "files":
+		b.handleFilesCommand(userID, args)
+	case "stop":
+		b.handleStopCommand(userID)
 	default:
 		b.sendMessage(userID, "Unknown command. Type /menu to see available commands.")
 	}
 }
 
 // handleCallbackQuery handles button presses from inline keyboards
-func (b *Bot) handleCallbackQuery(callback *tgbotapi.CallbackQuery) {
+func (b *Bot) handleCallbackQuery(callback *tgbotapi.CallbackQuery, threadID int) {
+	if callback.Message == nil {
+		return
+	}
+
+	// Users without access can only ask for it
+	if callback.Data == "access_request" && callback.Message.Chat.IsPrivate() && !b.isAllowed(callback.From, callback.Message.Chat) {
+		b.api.Request(tgbotapi.NewCallback(callback.ID, ""))
+		b.handleAccessRequest(callback.From)
+		return
+	}
+
 	// Check if user is allowed
-	if !b.config.IsUserAllowed(callback.From.ID) {
+	if !b.isAllowed(callback.From, callback.Message.Chat) {
 		log.Warnf("Unauthorized user %d (%s) tried to use bot buttons", callback.From.ID, callback.From.UserName)
 		return
 	}
 
-	userID := callback.From.ID
+	// New messages are threaded to the message with the buttons
+	userID := b.registerChat(callback.Message.Chat, threadID, callback.Message.MessageID)
 	data := callback.Data
 
 	log.Infof("Button pressed by user %d: %s", userID, data)
@@ -172,6 +479,11 @@ func (b *Bot) handleCallbackQuery(callback *tgbotapi.CallbackQuery) {
 	answerCallback := tgbotapi.NewCallback(callback.ID, "")
 	b.api.Request(answerCallback)
 
+	if changesGroupSettings(data) && !b.canChangeSettings(callback.From, callback.Message.Chat) {
+		b.sendMessage(userID, groupSettingsDenied)
+		return
+	}
+
 	// Handle different button actions
 	switch {
 	case data == "menu" || data == "back_to_menu":
@@ -179,7 +491,11 @@ func (b *Bot) handleCallbackQuery(callback *tgbotapi.CallbackQuery) {
 	case data == "settings":
 		b.handleSettingsMenu(userID)
 	case data == "expenses":
-		b.handleExpensesCommand(userID)
+		b.handleExpensesCommand(userID, callback.From.ID)
+	case data == "budget":
+		b.handleBudgetCommand(userID, callback.From.ID)
+	case data == "stop":
+		b.handleStopCommand(userID)
 	case data == "status":
 		b.handleStatusCommand(userID)
 	case data == "listmodels":
@@ -202,8 +518,43 @@ func (b *Bot) handleCallbackQuery(callback *tgbotapi.CallbackQuery) {
 		b.handleModeCommand(userID, "with_history")
 	case data == "mode_without_history":
 		b.handleModeCommand(userID, "without_history")
+	case data == "chats":
+		b.handleChatsCommand(userID)
+	case data == "params":
+		b.handleParamsMenu(userID)
+	case data == "params_reset":
+		b.handleParamsCommand(userID, "reset")
+	case strings.HasPrefix(data, "params_set_"):
+		b.handleParamsPreset(userID, strings.TrimPrefix(data, "params_set_"))
+	case data == "personas":
+		b.handlePersonaList(userID)
+	case data == "persona_off":
+		b.handlePersonaUse(userID, "")
+	case strings.HasPrefix(data, "persona_use_"):
+		b.handlePersonaUse(userID, strings.TrimPrefix(data, "persona_use_"))
+	case data == "conv_new":
+		b.handleNewConversationCommand(userID, "")
+	case strings.HasPrefix(data, "conv_switch_"):
+		b.handleSwitchCommand(userID, strings.TrimPrefix(data, "conv_switch_"))
+	case strings.HasPrefix(data, "confirm_conv_delete_"):
+		b.handleDeleteConversation(userID, strings.TrimPrefix(data, "confirm_conv_delete_"))
+	case strings.HasPrefix(data, "cancel_conv_delete_"):
+		b.sendMessage(userID, "❌ Delete operation cancelled.")
+	case strings.HasPrefix(data, "access_approve_"):
+		b.handleAccessDecision(userID, callback.Message.MessageID, strings.TrimPrefix(data, "access_approve_"), true)
+	case strings.HasPrefix(data, "access_deny_"):
+		b.handleAccessDecision(userID, callback.Message.MessageID, strings.TrimPrefix(data, "access_deny_"), false)
+	case strings.HasPrefix(data, "models_page_"):
+		b.handleModelsPage(userID, callback.Message.MessageID, strings.TrimPrefix(data, "models_page_"))
 	case strings.HasPrefix(data, "model_"):
 		modelName := strings.TrimPrefix(data, "model_")
+		if strings.HasPrefix(modelName, callbackValuePrefix) {
+			var ok bool
+			if modelName, ok = b.callbackValues.value(modelName); !ok {
+				b.sendMessage(userID, "⌛ This button has expired. Please select the model again with /models.")
+				return
+			}
+		}
 		b.handleModelCommand(userID, modelName)
 	default:
 		b.sendMessage(userID, "Unknown button action. Please try again.")
@@ -233,7 +584,7 @@ func (b *Bot) sendMessageWithKeyboard(userID int64, text, parseMode string, keyb
 		log.Debugf("HTML formatting applied - Original length: %d, Formatted length: %d", len(originalText), len(text))
 	}
 
-	msg := tgbotapi.NewMessage(userID, text)
+	msg := b.newMessage(userID, text)
 	if parseMode != "" {
 		msg.ParseMode = parseMode
 		log.Debugf("Sending message with parse mode: %s", parseMode)
@@ -242,37 +593,34 @@ func (b *Bot) sendMessageWithKeyboard(userID int64, text, parseMode string, keyb
 		msg.ReplyMarkup = keyboard
 	}
 
-	_, err := b.api.Send(msg)
+	var err error
+	if parseMode == "HTML" {
+		err = b.sendHTMLMessage(userID, msg)
+	} else {
+		_, err = b.api.Send(msg)
+	}
 	if err != nil {
 		log.Errorf("Failed to send message to user %d: %v", userID, err)
 	}
 	return err
 }
 
-// sendLLMResponse sends an LLM response with proper HTML formatting
-func (b *Bot) sendLLMResponse(userID int64, response string) error {
-	// Format the LLM response for HTML (most reliable for international text)
-	formattedResponse := b.convertTablesToHTML(response)
-
-	// Split message if too long
-	messages := b.splitMessage(formattedResponse, b.config.MaxMessageLength)
-
-	for _, msgText := range messages {
-		msg := tgbotapi.NewMessage(userID, msgText)
-		msg.ParseMode = "HTML"
-
-		if _, err := b.api.Send(msg); err != nil {
-			log.Errorf("Failed to send LLM response to user %d: %v", userID, err)
-			return err
-		}
-
-		// Small delay between messages to avoid rate limiting
-		if len(messages) > 1 {
-			time.Sleep(500 * time.Millisecond)
-		}
+// editMessageWithKeyboard replaces the text and inline keyboard of a message sent by the bot
+func (b *Bot) editMessageWithKeyboard(userID int64, messageID int, text string, keyboard *tgbotapi.InlineKeyboardMarkup) error {
+	edit := tgbotapi.NewEditMessageText(b.chatID(userID), messageID, text)
+	if keyboard != nil {
+		edit.ReplyMarkup = keyboard
 	}
 
-	return nil
+	err := b.sendWithFallback(userID, text, func(text, parseMode string) error {
+		edit.Text, edit.ParseMode = text, parseMode
+		_, err := b.api.Send(edit)
+		return err
+	})
+	if err != nil {
+		log.Errorf("Failed to edit message for user %d: %v", userID, err)
+	}
+	return err
 }
 
 // sendMessageWithMode sends a message with specific parse mode
@@ -290,12 +638,16 @@ func (b *Bot) sendMessageWithMode(userID int64, text, parseMode string) error {
 	messages := b.splitMessage(text, b.config.MaxMessageLength)
 
 	for _, msgText := range messages {
-		msg := tgbotapi.NewMessage(userID, msgText)
-		if parseMode != "" {
-			msg.ParseMode = parseMode
-		}
+		msg := b.newMessage(userID, msgText)
+		msg.ParseMode = parseMode
 
-		if _, err := b.api.Send(msg); err != nil {
+		var err error
+		if parseMode == "HTML" {
+			err = b.sendHTMLMessage(userID, msg)
+		} else {
+			_, err = b.api.Send(msg)
+		}
+		if err != nil {
 			log.Errorf("Failed to send message to user %d: %v", userID, err)
 			return err
 		}
@@ -309,185 +661,189 @@ func (b *Bot) sendMessageWithMode(userID int64, text, parseMode string) error {
 	return nil
 }
 
-// splitMessage splits a long message into smaller chunks while preserving structure
+// splitMessage splits a long HTML message into chunks Telegram accepts. Length is counted the way
+// Telegram does, and formatting cut at a chunk boundary continues in the next chunk.
 func (b *Bot) splitMessage(text string, maxLength int) []string {
-	if len(text) <= maxLength {
-		return []string{text}
-	}
-
-	var messages []string
-
-	// Split by paragraphs first to preserve structure
-	paragraphs := strings.Split(text, "\n\n")
-	current := ""
-
-	for _, paragraph := range paragraphs {
-		paragraph = strings.TrimSpace(paragraph)
-		if paragraph == "" {
-			continue
-		}
+	return markdown.SplitHTML(text, maxLength)
+}
 
-		// If adding this paragraph would exceed the limit
-		if len(current)+len(paragraph)+2 > maxLength {
-			if current != "" {
-				messages = append(messages, strings.TrimSpace(current))
-				current = paragraph
-			} else {
-				// Paragraph is too long, split by lines
-				lines := strings.Split(paragraph, "\n")
-				tempCurrent := ""
-
-				for _, line := range lines {
-					line = strings.TrimSpace(line)
-					if line == "" {
-						continue
-					}
-
-					if len(tempCurrent)+len(line)+1 > maxLength {
-						if tempCurrent != "" {
-							messages = append(messages, strings.TrimSpace(tempCurrent))
-							tempCurrent = line
-						} else {
-							// Line is too long, split by words as last resort
-							words := strings.Fields(line)
-							wordCurrent := ""
-
-							for _, word := range words {
-								if len(wordCurrent)+len(word)+1 > maxLength {
-									if wordCurrent != "" {
-										messages = append(messages, strings.TrimSpace(wordCurrent))
-										wordCurrent = word
-									} else {
-										// Word is too long, force split
-										messages = append(messages, word[:maxLength])
-										wordCurrent = word[maxLength:]
-									}
-								} else {
-									if wordCurrent == "" {
-										wordCurrent = word
-									} else {
-										wordCurrent += " " + word
-									}
-								}
-							}
-							if wordCurrent != "" {
-								tempCurrent = wordCurrent
-							}
-						}
-					} else {
-						if tempCurrent == "" {
-							tempCurrent = line
-						} else {
-							tempCurrent += "\n" + line
-						}
-					}
-				}
-				current = tempCurrent
-			}
-		} else {
-			if current == "" {
-				current = paragraph
-			} else {
-				current += "\n\n" + paragraph
-			}
-		}
+// handleChatMessage handles regular chat messages. They are answered one at a time through the user's queue.
+func (b *Bot) handleChatMessage(userID int64, message *tgbotapi.Message) {
+	input := chatInput{
+		text:        message.Text,
+		attachments: messageAttachments(message),
+		target:      messageTarget(message),
+		senderID:    message.From.ID,
+	}
+	if len(input.attachments) > 0 {
+		// Images carry their text in the caption
+		input.text = message.Caption
 	}
 
-	if current != "" {
-		messages = append(messages, current)
+	if strings.TrimSpace(input.text) == "" && len(input.attachments) == 0 {
+		b.sendMessage(userID, "Sorry, only text, voice messages, images and documents are supported.")
+		return
 	}
 
-	return messages
+	// Documents sent without a question belong to this message
+	input.attachments = append(b.uploads.take(uploadKey{chat: userID, sender: message.From.ID}), input.attachments...)
+
+	b.enqueueChat(userID, input)
 }
 
-// handleChatMessage handles regular chat messages
-func (b *Bot) handleChatMessage(message *tgbotapi.Message) {
-	userID := message.From.ID
-	userText := message.Text
+// answerChat sends a chat message to the LLM and replies with the answer
+func (b *Bot) answerChat(userID int64, input chatInput) {
+	userText := input.text
+	attachments := input.attachments
+	// Everything about this message goes to its target, even if newer ones arrived while it was waiting
+	target := input.target
 
 	// Get user settings
 	settings, err := b.storage.GetUserSettings(userID)
 	if err != nil {
 		log.Errorf("Failed to get user settings: %v", err)
-		b.sendMessage(userID, "Sorry, there was an error processing your request.")
+		b.sendReply(userID, target, "Sorry, there was an error processing your request.")
 		return
 	}
+	// The question and its answer belong to this conversation, even after /new or /switch
+	conversationID := settings.ActiveConversationID
 
-	// Add user message to storage
-	userMsg := storage.ChatMessage{
-		Role:      "user",
-		Content:   userText,
-		Timestamp: time.Now(),
+	// Groups share settings and history, but spending counts against the member who asked
+	senderID, senderSettings := input.senderID, settings
+	if senderID != userID {
+		senderSettings, err = b.storage.GetUserSettings(senderID)
+		if err != nil {
+			log.Errorf("Failed to get user settings: %v", err)
+			b.sendReply(userID, target, "Sorry, there was an error processing your request.")
+			return
+		}
 	}
 
-	if err := b.storage.AddChatMessage(userID, userMsg); err != nil {
-		log.Errorf("Failed to save user message: %v", err)
+	userMsg := storage.ChatMessage{
+		Role:        "user",
+		Content:     userText,
+		Attachments: attachments,
+		Timestamp:   time.Now(),
 	}
 
-	// Prepare messages for LLM
-	var messages []storage.ChatMessage
-
-	// Add system message for HTML formatting
+	// Add system message with the persona or custom prompt and HTML formatting rules
 	systemMsg := storage.ChatMessage{
 		Role:    "system",
-		Content: b.createSystemMessageForHTML(),
+		Content: b.buildSystemPrompt(settings),
 	}
-	messages = append(messages, systemMsg)
 
-	// Add chat history if mode is with_history
-	if settings.ChatMode == "with_history" {
-		history, err := b.storage.GetChatHistory(userID)
+	// Load chat history if mode is with_history; summarized messages are replaced by their summary.
+	// It is read by ID, as the active conversation may have changed since the settings were read.
+	model := settings.ActiveModel()
+	var history []storage.ChatMessage
+	if settings.ActiveChatMode() == "with_history" {
+		history, err = b.storage.GetConversationHistory(userID, conversationID)
 		if err != nil {
 			log.Errorf("Failed to get chat history: %v", err)
-		} else {
-			// Add last 10 messages for context (excluding the current message)
-			start := len(history) - 11
-			if start < 0 {
-				start = 0
+		}
+
+		conversation := settings.ActiveConversation()
+		history = pendingHistory(conversation, history)
+		if conversation.Summary != "" {
+			systemMsg.Content += "\n\n" + summaryContext(conversation.Summary)
+		}
+	}
+
+	params := b.effectiveParams(settings, model)
+
+	// Fit as much history as possible into the model's context window
+	prompt := b.buildPromptContext(model, params, systemMsg, userMsg, history)
+	if !prompt.fits() {
+		message := fmt.Sprintf("❌ Your message is too long for <code>%s</code> ", model)
+		message += fmt.Sprintf("(about %d tokens, the limit is %d).\n\n", prompt.tokens, prompt.budget)
+		message += "Shorten it or switch to a model with a larger context (/models)."
+		b.sendReply(userID, target, message)
+		return
+	}
+	messages := prompt.messages
+
+	// Refuse requests that would exceed a spending limit
+	budgetBefore, ok := b.checkBudget(senderID, target, senderSettings, model, messages, params)
+	if !ok {
+		return
+	}
+
+	// Download images; models without vision only get the text of earlier messages
+	if hasImages(messages) {
+		if !b.modelSupportsImages(model) {
+			if hasImages([]storage.ChatMessage{userMsg}) {
+				message := fmt.Sprintf("❌ The model <code>%s</code> doesn't support images.\n\n", model)
+				message += "Switch to a vision model, e.g. <code>/model openai/gpt-4o</code>, and send the image again."
+				b.sendReply(userID, target, message)
+				return
 			}
-			for i := start; i < len(history)-1; i++ {
-				messages = append(messages, history[i])
+			for i := range messages {
+				messages[i].Attachments = withoutImages(messages[i].Attachments)
 			}
+		} else if err := b.loadAttachments(userID, messages); err != nil {
+			log.Errorf("Failed to download image: %v", err)
+			b.sendReply(userID, target, "Sorry, the image could not be downloaded. Please try again.")
+			return
 		}
 	}
 
-	// Add current user message
-	messages = append(messages, userMsg)
+	b.notifyDroppedHistory(userID, target, settings, model, prompt)
 
-	// Create context for typing indicator
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	fallbacks := b.fallbackModels(settings, model, hasImages(messages))
 
-	// Start typing indicator in background
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		b.sendTypingIndicator(ctx, userID)
-	}()
+	// Add user message to storage
+	if err := b.storage.AddChatMessage(userID, conversationID, userMsg); err != nil {
+		log.Errorf("Failed to save user message: %v", err)
+	}
 
-	// Get LLM response
-	log.Infof("Starting LLM request for user %d with model %s", userID, settings.CurrentModel)
-	response, err := b.llmClient.GetChatResponse(settings.CurrentModel, messages, userID, b.storage)
+	log.Infof("Starting LLM request for user %d with model %s", userID, model)
 
-	// Stop typing indicator
-	cancel()
-	wg.Wait()
+	// Register the request, so /stop and shutdown can cancel it
+	ctx, done := b.inflight.start(b.ctx, userID)
+	defer done()
 
-	if err != nil {
-		log.Errorf("Failed to get LLM response: %v", err)
-		b.sendMessage(userID, fmt.Sprintf("Sorry, there was an error getting a response: %v", err))
-		return
+	var response string
+	if b.config.StreamResponses {
+		// Stream the response into a live-edited message
+		response, err = b.streamChatResponse(ctx, userID, senderID, target, model, fallbacks, messages, params)
+		switch {
+		case errors.Is(err, context.Canceled) && response == "":
+			log.Infof("LLM request of user %d stopped", userID)
+			return
+		case errors.Is(err, context.Canceled):
+			// Keep the part of the answer the user has already seen
+			log.Infof("LLM request of user %d stopped after %d characters", userID, len(response))
+		case err != nil:
+			log.Errorf("Failed to get LLM response: %v", err)
+			return
+		default:
+			// The answer is on screen; long code and long answers follow as files
+			if err := b.sendResponseFiles(userID, target, response, b.fileDelivery(settings)); err != nil {
+				log.Errorf("Failed to send response files: %v", err)
+			}
+		}
+	} else {
+		response, err = b.getChatResponse(ctx, userID, senderID, target, model, fallbacks, messages, params)
+		if errors.Is(err, context.Canceled) {
+			log.Infof("LLM request of user %d stopped", userID)
+			b.sendReply(userID, target, b.stoppedMessage())
+			return
+		}
+		if err != nil {
+			log.Errorf("Failed to get LLM response: %v", err)
+			b.sendReply(userID, target, llmErrorMessage(err))
+			return
+		}
+
+		// Send response with HTML formatting. The answer is saved even if it couldn't be
+		// delivered, so it stays part of the conversation.
+		if err := b.sendLLMResponse(userID, target, response, b.fileDelivery(settings)); err != nil {
+			log.Errorf("Failed to send response: %v", err)
+		}
 	}
 
 	log.Infof("LLM request completed for user %d", userID)
 
-	// Send response (format LLM response for MarkdownV2)
-	if err := b.sendLLMResponse(userID, response); err != nil {
-		log.Errorf("Failed to send response: %v", err)
-		return
-	}
-
 	// Save assistant response
 	assistantMsg := storage.ChatMessage{
 		Role:      "assistant",
@@ -495,7 +851,49 @@ func (b *Bot) handleChatMessage(message *tgbotapi.Message) {
 		Timestamp: time.Now(),
 	}
 
-	if err := b.storage.AddChatMessage(userID, assistantMsg); err != nil {
+	if err := b.storage.AddChatMessage(userID, conversationID, assistantMsg); err != nil {
 		log.Errorf("Failed to save assistant message: %v", err)
 	}
+
+	// Condense older messages before the history outgrows the context window
+	b.startSummary(userID, conversationID, senderID)
+
+	b.warnBudgetThresholds(senderID, target, senderSettings, budgetBefore)
+}
+
+// getChatResponse gets a complete LLM response while showing a typing indicator
+// and a status message with a Stop button. The cost is recorded for senderID.
+func (b *Bot) getChatResponse(ctx context.Context, userID, senderID int64, target chatTarget, model string, fallbacks []string, messages []storage.ChatMessage, params storage.GenerationParams) (string, error) {
+	status := target.message("⏳ Thinking...")
+	status.ReplyMarkup = b.createStopKeyboard()
+	if sent, err := b.api.Send(status); err == nil {
+		defer b.api.Request(tgbotapi.NewDeleteMessage(target.chatID, sent.MessageID))
+	}
+
+	release, err := b.acquireLLMSlot(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	// Create context for typing indicator
+	typingCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Start typing indicator in background
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.sendTypingIndicator(typingCtx, userID)
+	}()
+
+	// Get LLM response
+	response, err := b.llmClient.GetChatResponse(ctx, model, fallbacks, messages, params, senderID, b.storage)
+
+	// Stop typing indicator
+	cancel()
+	wg.Wait()
+
+	return response, err
 }
@@ -0,0 +1,306 @@
+package bot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"telegrambot/internal/storage"
+)
+
+const (
+	// estimatedCompletionTokens is the assumed answer length when estimating the cost of a request
+	estimatedCompletionTokens = 1000
+
+	// defaultBudgetOverride is how long an admin override lasts when no duration is given
+	defaultBudgetOverride = 24 * time.Hour
+)
+
+// budgetUsage is the spending measured against one configured limit
+type budgetUsage struct {
+	label  string
+	global bool
+	spent  float64
+	limit  float64
+}
+
+// remaining returns how much can still be spent before the limit is reached
+func (u budgetUsage) remaining() float64 {
+	return max(u.limit-u.spent, 0)
+}
+
+// budgetUsages returns the current spending for every enabled limit that applies to a user
+func (b *Bot) budgetUsages(userID int64, settings *storage.UserSettings) ([]budgetUsage, error) {
+	now := time.Now()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+
+	budget := &b.config.Budget
+	userDaily, userMonthly := b.userLimits(userID, settings)
+
+	limits := []budgetUsage{
+		{label: "daily", limit: userDaily},
+		{label: "monthly", limit: userMonthly},
+		{label: "global daily", global: true, limit: budget.GlobalDaily},
+		{label: "global monthly", global: true, limit: budget.GlobalMonthly},
+	}
+
+	var usages []budgetUsage
+	for _, usage := range limits {
+		if usage.limit <= 0 {
+			continue
+		}
+
+		since := dayStart
+		if strings.HasSuffix(usage.label, "monthly") {
+			since = monthStart
+		}
+
+		var err error
+		if usage.global {
+			usage.spent, err = b.storage.GetAllExpensesSince(since)
+		} else {
+			usage.spent, err = b.storage.GetExpensesSince(userID, since)
+		}
+		if err != nil {
+			return nil, err
+		}
+		usages = append(usages, usage)
+	}
+
+	return usages, nil
+}
+
+// enforcedUsages drops the user's own limits while an admin override lifts them; global limits always apply
+func enforcedUsages(usages []budgetUsage, settings *storage.UserSettings) []budgetUsage {
+	if !time.Now().Before(settings.BudgetOverrideUntil) {
+		return usages
+	}
+
+	var enforced []budgetUsage
+	for _, usage := range usages {
+		if usage.global {
+			enforced = append(enforced, usage)
+		}
+	}
+	return enforced
+}
+
+// userLimits returns the daily and monthly limits of a user: those in user_overrides of the config,
+// otherwise those the user got with their invite, otherwise the configured defaults
+func (b *Bot) userLimits(userID int64, settings *storage.UserSettings) (daily, monthly float64) {
+	budget := &b.config.Budget
+	if _, configured := budget.UserOverrides[userID]; !configured && settings.BudgetLimits != nil {
+		return settings.BudgetLimits.Daily, settings.BudgetLimits.Monthly
+	}
+	return budget.UserLimits(userID)
+}
+
+// estimateRequestCost estimates the cost of a request from the catalog pricing of the model.
+// Prompt tokens are estimated with the calibrated tokenizer; unknown models are estimated as free.
+func (b *Bot) estimateRequestCost(model string, messages []storage.ChatMessage, params storage.GenerationParams) float64 {
+	info, err := b.llmClient.GetModel(model)
+	if err != nil || info == nil {
+		return 0
+	}
+
+	promptTokens := b.llmClient.Tokens().CountMessages(model, messages)
+
+	completionTokens := estimatedCompletionTokens
+	if info.MaxCompletionTokens > 0 {
+		completionTokens = min(completionTokens, info.MaxCompletionTokens)
+	}
+	if params.MaxTokens != nil {
+		completionTokens = min(completionTokens, *params.MaxTokens)
+	}
+
+	return info.Cost(promptTokens, completionTokens)
+}
+
+// checkBudget verifies that a request fits into all spending limits before it is sent.
+// It returns the usages measured before the request (for threshold warnings afterwards)
+// and false if the request must not be sent; the user has been told why in that case.
+func (b *Bot) checkBudget(userID int64, target chatTarget, settings *storage.UserSettings, model string, messages []storage.ChatMessage, params storage.GenerationParams) ([]budgetUsage, bool) {
+	usages, err := b.budgetUsages(userID, settings)
+	if err != nil {
+		log.Errorf("Failed to check budget for user %d: %v", userID, err)
+		b.sendReply(userID, target, "Error checking your budget. Please try again later.")
+		return nil, false
+	}
+	usages = enforcedUsages(usages, settings)
+	if len(usages) == 0 {
+		return usages, true
+	}
+
+	estimate := b.estimateRequestCost(model, messages, params)
+	for _, usage := range usages {
+		if usage.spent+estimate <= usage.limit {
+			continue
+		}
+
+		log.Warnf("Blocked request of user %d: %s budget exceeded ($%.4f spent, $%.4f estimated, $%.2f limit)",
+			userID, usage.label, usage.spent, estimate, usage.limit)
+
+		message := fmt.Sprintf("⛔ <i>The %s budget has been reached.</i>\n\n", usage.label)
+		message += fmt.Sprintf("<i>Spent:</i> $%.4f of $%.2f\n", usage.spent, usage.limit)
+		message += fmt.Sprintf("<i>This request:</i> ~$%.4f with <code>%s</code>\n\n", estimate, model)
+		if usage.remaining() > 0 {
+			message += "Try a cheaper model (/models), start a /new conversation to send less history, or wait for the budget to reset."
+		} else {
+			message += "Please wait for the budget to reset or ask an administrator."
+		}
+		b.sendReply(userID, target, message)
+		return nil, false
+	}
+
+	return usages, true
+}
+
+// exceededBudget returns the first spending limit a request would exceed, or nil if it fits.
+// Unlike checkBudget it doesn't message the user, for requests they didn't send from a chat.
+func (b *Bot) exceededBudget(userID int64, settings *storage.UserSettings, model string, messages []storage.ChatMessage, params storage.GenerationParams) (*budgetUsage, error) {
+	usages, err := b.budgetUsages(userID, settings)
+	if err != nil {
+		return nil, err
+	}
+	usages = enforcedUsages(usages, settings)
+
+	estimate := b.estimateRequestCost(model, messages, params)
+	for _, usage := range usages {
+		if usage.spent+estimate > usage.limit {
+			return &usage, nil
+		}
+	}
+	return nil, nil
+}
+
+// warnBudgetThresholds tells the user when the last request pushed spending over the warning threshold of a limit
+func (b *Bot) warnBudgetThresholds(userID int64, target chatTarget, settings *storage.UserSettings, before []budgetUsage) {
+	if len(before) == 0 {
+		return
+	}
+
+	after, err := b.budgetUsages(userID, settings)
+	if err != nil {
+		log.Errorf("Failed to check budget for user %d: %v", userID, err)
+		return
+	}
+	after = enforcedUsages(after, settings)
+
+	threshold := b.config.Budget.WarningThreshold
+	for i, usage := range after {
+		if i >= len(before) || before[i].label != usage.label {
+			break
+		}
+
+		warnAt := usage.limit * threshold
+		if before[i].spent >= warnAt || usage.spent < warnAt {
+			continue
+		}
+
+		message := fmt.Sprintf("⚠️ <i>You have used %.0f%% of the %s budget</i> ($%.4f of $%.2f).",
+			usage.spent/usage.limit*100, usage.label, usage.spent, usage.limit)
+		b.sendReply(userID, target, message)
+	}
+}
+
+// handleBudgetCommand handles the /budget command, which shows the budget of the sender also in groups
+func (b *Bot) handleBudgetCommand(userID, senderID int64) {
+	settings, err := b.storage.GetUserSettings(senderID)
+	if err != nil {
+		log.Errorf("Failed to get user settings: %v", err)
+		b.sendMessage(userID, "Error retrieving your settings.")
+		return
+	}
+
+	usages, err := b.budgetUsages(senderID, settings)
+	if err != nil {
+		log.Errorf("Failed to check budget for user %d: %v", senderID, err)
+		b.sendMessage(userID, "Error checking your budget.")
+		return
+	}
+
+	message := "💳 <i>Your Budget</i>\n\n"
+	if len(usages) == 0 {
+		message += "No spending limits are configured."
+	}
+	for _, usage := range usages {
+		message += fmt.Sprintf("<i>%s:</i> $%.4f of $%.2f (%.0f%%)\n",
+			capitalize(usage.label), usage.spent, usage.limit, usage.spent/usage.limit*100)
+	}
+
+	if time.Now().Before(settings.BudgetOverrideUntil) {
+		message += fmt.Sprintf("\n🔓 Your own limits are lifted by an administrator until %s; global limits still apply.",
+			settings.BudgetOverrideUntil.Format("Jan 2 15:04"))
+	}
+
+	keyboard := b.createBackToMenuKeyboard()
+	b.sendMessageWithKeyboard(userID, message, "HTML", keyboard)
+}
+
+// handleOverrideCommand handles the admin /override command, which lifts the own budget limits of a user
+func (b *Bot) handleOverrideCommand(userID int64, args string) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 || len(fields) > 2 {
+		message := "🔓 <i>Budget Override</i>\n\n"
+		message += "<i>Usage:</i> <code>/override user_id [hours|off]</code>\n\n"
+		message += "Lifts the daily and monthly limits of a user, for 24 hours by default. Global limits still apply."
+		b.sendMessage(userID, message)
+		return
+	}
+
+	targetID, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || !b.isUserAllowed(targetID) {
+		b.sendMessage(userID, "❌ Unknown user. Please specify the Telegram ID of an allowed user.")
+		return
+	}
+
+	until := time.Now().Add(defaultBudgetOverride)
+	if len(fields) == 2 {
+		if fields[1] == "off" {
+			until = time.Time{}
+		} else {
+			hours, err := strconv.Atoi(fields[1])
+			if err != nil || hours <= 0 {
+				b.sendMessage(userID, "❌ The duration must be a positive number of hours or <code>off</code>.")
+				return
+			}
+			until = time.Now().Add(time.Duration(hours) * time.Hour)
+		}
+	}
+
+	settings, err := b.storage.GetUserSettings(targetID)
+	if err != nil {
+		log.Errorf("Failed to get user settings: %v", err)
+		b.sendMessage(userID, "Error retrieving the user's settings.")
+		return
+	}
+
+	settings.BudgetOverrideUntil = until
+	if err := b.storage.SaveUserSettings(settings); err != nil {
+		log.Errorf("Failed to save user settings: %v", err)
+		b.sendMessage(userID, "Error saving the user's settings.")
+		return
+	}
+
+	if until.IsZero() {
+		b.audit(userID, "override", targetID, "off")
+		b.sendMessage(userID, fmt.Sprintf("🔒 Budget limits apply to user <code>%d</code> again.", targetID))
+		return
+	}
+
+	b.audit(userID, "override", targetID, "until "+until.Format(time.RFC3339))
+	b.sendMessage(userID, fmt.Sprintf("🔓 Budget limits lifted for user <code>%d</code> until %s. Global limits still apply.",
+		targetID, until.Format("Jan 2 15:04")))
+}
+
+// capitalize upper-cases the first letter of an ASCII label
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
@@ -2,6 +2,7 @@ package bot
 
 import (
 	"fmt"
+	"html"
 	"strings"
 	"time"
 
@@ -21,6 +22,11 @@ This bot provides access to various LLM models through OpenRouter.
 
 <i>Features:</i>
 ✅ Multiple LLM models support
+✅ Named conversations (/new, /chats)
+✅ Image input for vision models
+✅ Voice messages (transcribed)
+✅ Text, code and PDF files as context
+✅ Custom system prompts and personas
 ✅ Chat history modes
 ✅ Expense tracking
 ✅ Custom model management
@@ -43,6 +49,7 @@ Welcome to your AI assistant! Choose an option below or just start typing to cha
 • ⚙️ Settings - Configure chat mode and models
 • 📊 View expenses and usage statistics
 • 🤖 Browse and change AI models
+• 💬 Switch between conversations with /chats
 
 <i>Features:</i>
 ✅ Interactive button controls
@@ -66,7 +73,7 @@ func (b *Bot) handleModeCommand(userID int64, args string) {
 			return
 		}
 
-		message := fmt.Sprintf("🔧 <i>Current chat mode:</i> <code>%s</code>\n\n", settings.ChatMode)
+		message := fmt.Sprintf("🔧 <i>Current chat mode:</i> <code>%s</code>\n\n", settings.ActiveChatMode())
 		message += "<i>Available modes:</i>\n"
 		message += "• <code>with_history</code> - AI remembers previous messages\n"
 		message += "• <code>without_history</code> - Each message is independent\n\n"
@@ -90,7 +97,7 @@ func (b *Bot) handleModeCommand(userID int64, args string) {
 		return
 	}
 
-	// Update mode
+	// Update mode as the default for new conversations
 	settings.ChatMode = mode
 	if err := b.storage.SaveUserSettings(settings); err != nil {
 		log.Errorf("Failed to save user settings: %v", err)
@@ -98,6 +105,15 @@ func (b *Bot) handleModeCommand(userID int64, args string) {
 		return
 	}
 
+	// Update mode of the active conversation
+	conversation := settings.ActiveConversation()
+	conversation.ChatMode = mode
+	if err := b.storage.UpdateConversation(userID, conversation); err != nil {
+		log.Errorf("Failed to update conversation: %v", err)
+		b.sendMessage(userID, "Error saving your settings.")
+		return
+	}
+
 	message := fmt.Sprintf("✅ Chat mode changed to: <code>%s</code>", mode)
 	if mode == "with_history" {
 		message += "\n\n<i>Note:</i> The AI will now remember your previous messages in this session."
@@ -119,14 +135,13 @@ func (b *Bot) handleModelCommand(userID int64, args string) {
 			return
 		}
 
-		message := fmt.Sprintf("🤖 <i>Current model:</i> <code>%s</code>\n\n", settings.CurrentModel)
+		message := fmt.Sprintf("🤖 <i>Current model:</i> <code>%s</code>\n\n", settings.ActiveModel())
 		message += "<i>Popular models:</i>\n"
-		message += "• <code>openai/gpt-4</code> - Most capable, higher cost\n"
-		message += "• <code>openai/gpt-3.5-turbo</code> - Fast and affordable\n"
-		message += "• <code>anthropic/claude-3-sonnet</code> - Great for analysis\n"
-		message += "• <code>google/gemini-pro</code> - Google's latest model\n\n"
-		message += "<i>Usage:</i> <code>/model openai/gpt-4</code>\n"
-		message += "<i>See all:</i> <code>/listmodels</code>"
+		for _, model := range b.popularModels() {
+			message += fmt.Sprintf("• <code>%s</code> - %s\n", model.value, html.EscapeString(model.display))
+		}
+		message += "\n<i>Usage:</i> <code>/model openai/gpt-4o</code>\n"
+		message += "<i>Browse all:</i> <code>/models [search]</code>"
 
 		b.sendMessage(userID, message)
 		return
@@ -138,18 +153,12 @@ func (b *Bot) handleModelCommand(userID int64, args string) {
 		return
 	}
 
-	// Get current settings
-	settings, err := b.storage.GetUserSettings(userID)
-	if err != nil {
-		log.Errorf("Failed to get user settings: %v", err)
-		b.sendMessage(userID, "Error retrieving your settings.")
+	if !b.validateModel(userID, model) {
 		return
 	}
 
-	// Update model
-	settings.CurrentModel = model
-	if err := b.storage.SaveUserSettings(settings); err != nil {
-		log.Errorf("Failed to save user settings: %v", err)
+	if _, err := b.setModel(userID, model); err != nil {
+		log.Errorf("Failed to set model: %v", err)
 		b.sendMessage(userID, "Error saving your settings.")
 		return
 	}
@@ -161,16 +170,38 @@ func (b *Bot) handleModelCommand(userID int64, args string) {
 	b.sendMessageWithKeyboard(userID, message, "HTML", keyboard)
 }
 
+// setModel makes a model the default for new conversations of a user and switches the active
+// conversation to it. It returns the model the conversation used before.
+func (b *Bot) setModel(userID int64, model string) (string, error) {
+	settings, err := b.storage.GetUserSettings(userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get user settings: %w", err)
+	}
+
+	settings.CurrentModel = model
+	if err := b.storage.SaveUserSettings(settings); err != nil {
+		return "", fmt.Errorf("failed to save user settings: %w", err)
+	}
+
+	conversation := settings.ActiveConversation()
+	previous := conversation.Model
+	conversation.Model = model
+	if err := b.storage.UpdateConversation(userID, conversation); err != nil {
+		return "", fmt.Errorf("failed to update conversation: %w", err)
+	}
+	return previous, nil
+}
+
 // handleAddModelCommand handles the /addmodel command
 func (b *Bot) handleAddModelCommand(userID int64, args string) {
 	if args == "" {
 		message := "🔧 <i>Add Custom Model</i>\n\n"
 		message += "<i>Usage:</i> <code>/addmodel model-provider/model-name</code>\n\n"
 		message += "<i>Examples:</i>\n"
-		message += "• <code>/addmodel mistralai/mistral-7b-instruct</code>\n"
-		message += "• <code>/addmodel meta-llama/llama-2-70b-chat</code>\n"
+		message += "• <code>/addmodel mistralai/mistral-large</code>\n"
+		message += "• <code>/addmodel meta-llama/llama-3.1-405b-instruct</code>\n"
 		message += "• <code>/addmodel cohere/command-r-plus</code>\n\n"
-		message += "<i>Note:</i> Make sure the model is available on OpenRouter."
+		message += "<i>Note:</i> The model must be available on OpenRouter. Use /models to search the catalog."
 
 		b.sendMessage(userID, message)
 		return
@@ -190,6 +221,10 @@ func (b *Bot) handleAddModelCommand(userID int64, args string) {
 		return
 	}
 
+	if !b.validateModel(userID, model) {
+		return
+	}
+
 	// Check if model already exists
 	for _, existingModel := range settings.CustomModels {
 		if existingModel == model {
@@ -222,56 +257,54 @@ func (b *Bot) handleListModelsCommand(userID int64) {
 	}
 
 	message := "🤖 <i>Available Models</i>\n\n"
-	message += fmt.Sprintf("<i>Current:</i> <code>%s</code> ✅\n\n", settings.CurrentModel)
+	currentModel := settings.ActiveModel()
+	message += fmt.Sprintf("<i>Current:</i> <code>%s</code> ✅\n\n", currentModel)
 
 	message += "<i>Popular Models:</i>\n"
-	popularModels := []string{
-		"openai/gpt-4",
-		"openai/gpt-3.5-turbo",
-		"anthropic/claude-3-sonnet",
-		"google/gemini-pro",
-		"mistralai/mistral-7b-instruct",
-		"meta-llama/llama-2-70b-chat",
-	}
-
-	for _, model := range popularModels {
-		if model == settings.CurrentModel {
+	for _, model := range b.popularModels() {
+		if model.value == currentModel {
 			continue // Skip current model as it's already shown
 		}
-		message += fmt.Sprintf("• <code>%s</code>\n", model)
+		message += fmt.Sprintf("• <code>%s</code>\n", model.value)
 	}
 
 	if len(settings.CustomModels) > 0 {
 		message += "\n<i>Your Custom Models:</i>\n"
 		for _, model := range settings.CustomModels {
-			if model == settings.CurrentModel {
+			if model == currentModel {
 				continue // Skip current model as it's already shown
 			}
 			message += fmt.Sprintf("• <code>%s</code>\n", model)
 		}
 	}
 
-	message += "\n<i>Usage:</i> Click a model button above or type <code>/model model-name</code>"
+	message += "\n<i>Usage:</i> Click a model button above or type <code>/model model-name</code>\n"
+	message += "<i>Browse all:</i> <code>/models [search]</code>"
 
 	keyboard := b.createBackToMenuKeyboard()
 	b.sendMessageWithKeyboard(userID, message, "HTML", keyboard)
 }
 
-// handleExpensesCommand handles the /expenses command
-func (b *Bot) handleExpensesCommand(userID int64) {
-	settings, err := b.storage.GetUserSettings(userID)
+// handleExpensesCommand handles the /expenses command, which shows the expenses of the sender also in groups
+func (b *Bot) handleExpensesCommand(userID, senderID int64) {
+	expenses, err := b.storage.GetExpenses(senderID)
 	if err != nil {
-		log.Errorf("Failed to get user settings: %v", err)
-		b.sendMessage(userID, "Error retrieving your settings.")
+		log.Errorf("Failed to get expenses: %v", err)
+		b.sendMessage(userID, "Error retrieving your expenses.")
 		return
 	}
 
+	var total float64
+	for _, expense := range expenses {
+		total += expense.Cost
+	}
+
 	message := "💰 <i>Your Usage Statistics</i>\n\n"
-	message += fmt.Sprintf("<i>Total Expenses:</i> $%.6f\n", settings.TotalExpenses)
-	message += fmt.Sprintf("<i>Total Requests:</i> %d\n", len(settings.ExpenseHistory))
+	message += fmt.Sprintf("<i>Total Expenses:</i> $%.6f\n", total)
+	message += fmt.Sprintf("<i>Total Requests:</i> %d\n", len(expenses))
 	message += "_Using accurate OpenRouter pricing & native token counts_\n"
 
-	if len(settings.ExpenseHistory) > 0 {
+	if len(expenses) > 0 {
 		// Calculate stats
 		var totalTokens int
 		modelUsage := make(map[string]int)
@@ -280,7 +313,7 @@ func (b *Bot) handleExpensesCommand(userID int64) {
 		// Get recent expenses (last 7 days)
 		weekAgo := time.Now().AddDate(0, 0, -7)
 
-		for _, expense := range settings.ExpenseHistory {
+		for _, expense := range expenses {
 			totalTokens += expense.InputTokens + expense.OutputTokens
 			modelUsage[expense.Model]++
 
@@ -300,13 +333,13 @@ func (b *Bot) handleExpensesCommand(userID int64) {
 
 		// Show recent transactions (last 5)
 		message += "\n<i>Recent Transactions:</i>\n"
-		start := len(settings.ExpenseHistory) - 5
+		start := len(expenses) - 5
 		if start < 0 {
 			start = 0
 		}
 
-		for i := start; i < len(settings.ExpenseHistory); i++ {
-			expense := settings.ExpenseHistory[i]
+		for i := start; i < len(expenses); i++ {
+			expense := expenses[i]
 			message += fmt.Sprintf("• %s: $%.6f (%s)\n",
 				expense.Timestamp.Format("01/02 15:04"),
 				expense.Cost,
@@ -316,7 +349,7 @@ func (b *Bot) handleExpensesCommand(userID int64) {
 		message += "\n<i>No usage data yet.</i> Start chatting to see your statistics!"
 	}
 
-	keyboard := b.createBackToMenuKeyboard()
+	keyboard := b.createExpensesKeyboard()
 	b.sendMessageWithKeyboard(userID, message, "HTML", keyboard)
 }
 
@@ -329,7 +362,7 @@ func (b *Bot) handleClearCommand(userID int64) {
 	}
 
 	message := "🗑️ <i>Chat history cleared!</i>\n\n"
-	message += "Your conversation history has been deleted. The AI will start fresh with your next message."
+	message += "The history of your current conversation has been deleted. The AI will start fresh with your next message."
 
 	keyboard := b.createBackToMenuKeyboard()
 	b.sendMessageWithKeyboard(userID, message, "HTML", keyboard)
@@ -346,15 +379,26 @@ func (b *Bot) handleStatusCommand(userID int64) {
 
 	message := "📊 <i>Your Current Settings</i>\n\n"
 	message += fmt.Sprintf("<i>User ID:</i> <code>%d</code>\n", settings.UserID)
-	message += fmt.Sprintf("<i>Current Model:</i> <code>%s</code>\n", settings.CurrentModel)
-	message += fmt.Sprintf("<i>Chat Mode:</i> <code>%s</code>\n", settings.ChatMode)
+	conversation := settings.ActiveConversation()
+	message += fmt.Sprintf("<i>Conversation:</i> %s\n", html.EscapeString(conversation.Title))
+	message += fmt.Sprintf("<i>Current Model:</i> <code>%s</code>\n", settings.ActiveModel())
+	message += fmt.Sprintf("<i>Chat Mode:</i> <code>%s</code>\n", settings.ActiveChatMode())
+	switch {
+	case conversation.Persona != "":
+		message += fmt.Sprintf("<i>Persona:</i> %s\n", html.EscapeString(conversation.Persona))
+	case conversation.SystemPrompt != "":
+		message += "<i>Persona:</i> custom system prompt\n"
+	}
 	message += fmt.Sprintf("<i>Total Expenses:</i> $%.6f\n", settings.TotalExpenses)
-	message += fmt.Sprintf("<i>Chat History:</i> %d messages\n", len(settings.ChatHistory))
+	message += fmt.Sprintf("<i>Chat History:</i> %d messages\n", conversation.MessageCount)
+	message += fmt.Sprintf("<i>Conversations:</i> %d\n", len(settings.Conversations))
 	message += fmt.Sprintf("<i>Custom Models:</i> %d\n", len(settings.CustomModels))
 	message += fmt.Sprintf("<i>Last Updated:</i> %s\n", settings.LastUpdated.Format("2006-01-02 15:04:05"))
 
-	if len(settings.ExpenseHistory) > 0 {
-		lastExpense := settings.ExpenseHistory[len(settings.ExpenseHistory)-1]
+	if expenses, err := b.storage.GetExpenses(userID); err != nil {
+		log.Errorf("Failed to get expenses: %v", err)
+	} else if len(expenses) > 0 {
+		lastExpense := expenses[len(expenses)-1]
 		message += fmt.Sprintf("<i>Last Activity:</i> %s\n", lastExpense.Timestamp.Format("2006-01-02 15:04:05"))
 	}
 
@@ -0,0 +1,109 @@
+package bot
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"telegrambot/internal/storage"
+)
+
+// fallbackContextLength is assumed for models that are missing from the catalog
+const fallbackContextLength = 8192
+
+// conversationKey identifies a conversation of a user
+type conversationKey struct {
+	userID         int64
+	conversationID int64
+}
+
+// promptContext is the prompt sent to a model: the system message, as much history as fits and the new message
+type promptContext struct {
+	messages []storage.ChatMessage
+	// tokens is the estimated size of messages
+	tokens int
+	// budget is the number of tokens the prompt may use
+	budget int
+	// dropped is the number of history messages left out because they didn't fit
+	dropped int
+}
+
+// promptTokenBudget returns the number of tokens a prompt for model may use: the configured fraction
+// of the model's context length, leaving room for max_tokens if it is set
+func (b *Bot) promptTokenBudget(model string, params storage.GenerationParams) int {
+	contextLength := fallbackContextLength
+	if info, err := b.llmClient.GetModel(model); err == nil && info != nil && info.ContextLength > 0 {
+		contextLength = info.ContextLength
+	}
+
+	budget := int(float64(contextLength) * b.config.ContextWindowFraction)
+	if params.MaxTokens != nil {
+		budget = min(budget, contextLength-*params.MaxTokens)
+	}
+	return budget
+}
+
+// buildPromptContext fits the conversation history into the model's context window.
+// History is added from the newest message backwards until the token budget is used up;
+// the system message and the new message are always included.
+func (b *Bot) buildPromptContext(model string, params storage.GenerationParams, system, current storage.ChatMessage, history []storage.ChatMessage) promptContext {
+	estimator := b.llmClient.Tokens()
+
+	prompt := promptContext{
+		budget: b.promptTokenBudget(model, params),
+		tokens: estimator.CountMessage(model, system) + estimator.CountMessage(model, current),
+	}
+
+	start := len(history)
+	for start > 0 {
+		size := estimator.CountMessage(model, history[start-1])
+		if prompt.tokens+size > prompt.budget {
+			break
+		}
+		prompt.tokens += size
+		start--
+	}
+	prompt.dropped = start
+
+	prompt.messages = make([]storage.ChatMessage, 0, len(history)-start+2)
+	prompt.messages = append(prompt.messages, system)
+	prompt.messages = append(prompt.messages, history[start:]...)
+	prompt.messages = append(prompt.messages, current)
+
+	return prompt
+}
+
+// fits reports whether the prompt is within its token budget
+func (p promptContext) fits() bool {
+	return p.tokens <= p.budget
+}
+
+// notifyDroppedHistory tells the user once per conversation that older messages no longer fit
+// into the model's context. The notice is shown again after the history fit completely.
+func (b *Bot) notifyDroppedHistory(userID int64, target chatTarget, settings *storage.UserSettings, model string, prompt promptContext) {
+	key := conversationKey{userID: userID, conversationID: settings.ActiveConversationID}
+
+	b.contextMutex.Lock()
+	notified := b.contextNotices[key]
+	if prompt.dropped == 0 {
+		delete(b.contextNotices, key)
+	} else {
+		b.contextNotices[key] = true
+	}
+	b.contextMutex.Unlock()
+
+	if prompt.dropped == 0 || notified {
+		return
+	}
+
+	log.Infof("Dropped %d history messages of user %d to fit %d tokens for %s", prompt.dropped, userID, prompt.budget, model)
+
+	message := fmt.Sprintf("ℹ️ This conversation no longer fits into the context of <code>%s</code>. ", model)
+	if prompt.dropped == 1 {
+		message += "The oldest message was left out, so the model won't remember it.\n\n"
+	} else {
+		message += fmt.Sprintf("The %d oldest messages were left out, so the model won't remember them.\n\n", prompt.dropped)
+	}
+	message += "Start a /new conversation or switch to a model with a larger context (/models) to keep everything."
+	b.sendReply(userID, target, message)
+}
@@ -0,0 +1,238 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"telegrambot/internal/storage"
+)
+
+// maxConversationTitleLength limits titles so they fit into inline keyboard buttons
+const maxConversationTitleLength = 48
+
+// handleNewConversationCommand handles the /new command
+func (b *Bot) handleNewConversationCommand(userID int64, args string) {
+	title := normalizeConversationTitle(args)
+	if title == "" {
+		title = "Chat " + time.Now().Format("Jan 2 15:04")
+	}
+
+	conversation, err := b.storage.CreateConversation(userID, title)
+	if err != nil {
+		log.Errorf("Failed to create conversation: %v", err)
+		b.sendMessage(userID, "Error creating a new conversation.")
+		return
+	}
+
+	message := fmt.Sprintf("🆕 <i>New conversation started:</i> <b>%s</b>\n\n", html.EscapeString(conversation.Title))
+	message += fmt.Sprintf("<i>Model:</i> <code>%s</code>\n", conversation.Model)
+	message += fmt.Sprintf("<i>Chat Mode:</i> <code>%s</code>\n\n", conversation.ChatMode)
+	message += "Your other conversations are kept. Use /chats to switch between them."
+
+	keyboard := b.createBackToMenuKeyboard()
+	b.sendMessageWithKeyboard(userID, message, "HTML", keyboard)
+}
+
+// handleChatsCommand handles the /chats command
+func (b *Bot) handleChatsCommand(userID int64) {
+	settings, err := b.storage.GetUserSettings(userID)
+	if err != nil {
+		log.Errorf("Failed to get user settings: %v", err)
+		b.sendMessage(userID, "Error retrieving your settings.")
+		return
+	}
+
+	conversations := sortConversationsByActivity(settings.Conversations)
+
+	message := "💬 <i>Your Conversations</i>\n\n"
+	for _, conversation := range conversations {
+		marker := "•"
+		if conversation.ID == settings.ActiveConversationID {
+			marker = "✅"
+		}
+		message += fmt.Sprintf("%s <b>%s</b> (#%d)\n   %d messages, %s, <code>%s</code>\n",
+			marker,
+			html.EscapeString(conversation.Title),
+			conversation.ID,
+			conversation.MessageCount,
+			formatRelativeTime(conversation.LastActivity),
+			conversation.Model)
+	}
+	message += "\n<i>Commands:</i> <code>/new [title]</code>, <code>/switch id</code>, <code>/rename title</code>, <code>/delete [id]</code>"
+
+	keyboard := b.createConversationsKeyboard(conversations, settings.ActiveConversationID)
+	b.sendMessageWithKeyboard(userID, message, "HTML", keyboard)
+}
+
+// handleSwitchCommand handles the /switch command
+func (b *Bot) handleSwitchCommand(userID int64, args string) {
+	if strings.TrimSpace(args) == "" {
+		b.handleChatsCommand(userID)
+		return
+	}
+
+	conversations, err := b.storage.GetConversations(userID)
+	if err != nil {
+		log.Errorf("Failed to get conversations: %v", err)
+		b.sendMessage(userID, "Error retrieving your conversations.")
+		return
+	}
+
+	conversation := findConversation(conversations, args)
+	if conversation == nil {
+		b.sendMessage(userID, "❌ Conversation not found. Use /chats to see your conversations.")
+		return
+	}
+
+	if err := b.storage.SwitchConversation(userID, conversation.ID); err != nil {
+		log.Errorf("Failed to switch conversation: %v", err)
+		b.sendMessage(userID, "Error switching conversation.")
+		return
+	}
+
+	message := fmt.Sprintf("🔀 <i>Switched to:</i> <b>%s</b>\n\n", html.EscapeString(conversation.Title))
+	message += fmt.Sprintf("<i>Model:</i> <code>%s</code>\n", conversation.Model)
+	message += fmt.Sprintf("<i>Chat Mode:</i> <code>%s</code>\n", conversation.ChatMode)
+	message += fmt.Sprintf("<i>History:</i> %d messages", conversation.MessageCount)
+
+	keyboard := b.createBackToMenuKeyboard()
+	b.sendMessageWithKeyboard(userID, message, "HTML", keyboard)
+}
+
+// handleRenameCommand handles the /rename command
+func (b *Bot) handleRenameCommand(userID int64, args string) {
+	title := normalizeConversationTitle(args)
+	if title == "" {
+		b.sendMessage(userID, "<i>Usage:</i> <code>/rename New title</code>\n\nRenames your current conversation.")
+		return
+	}
+
+	conversation, err := b.storage.GetActiveConversation(userID)
+	if err != nil {
+		log.Errorf("Failed to get active conversation: %v", err)
+		b.sendMessage(userID, "Error retrieving your conversation.")
+		return
+	}
+
+	conversation.Title = title
+	if err := b.storage.UpdateConversation(userID, conversation); err != nil {
+		log.Errorf("Failed to rename conversation: %v", err)
+		b.sendMessage(userID, "Error renaming conversation.")
+		return
+	}
+
+	b.sendMessage(userID, fmt.Sprintf("✏️ Conversation renamed to: <b>%s</b>", html.EscapeString(title)))
+}
+
+// handleDeleteCommand handles the /delete command by asking for confirmation
+func (b *Bot) handleDeleteCommand(userID int64, args string) {
+	settings, err := b.storage.GetUserSettings(userID)
+	if err != nil {
+		log.Errorf("Failed to get user settings: %v", err)
+		b.sendMessage(userID, "Error retrieving your settings.")
+		return
+	}
+
+	conversation := settings.ActiveConversation()
+	if strings.TrimSpace(args) != "" {
+		conversation = findConversation(settings.Conversations, args)
+		if conversation == nil {
+			b.sendMessage(userID, "❌ Conversation not found. Use /chats to see your conversations.")
+			return
+		}
+	}
+
+	message := "🗑️ <i>Delete Conversation</i>\n\n"
+	message += fmt.Sprintf("Are you sure you want to delete <b>%s</b> and its %d messages?\n",
+		html.EscapeString(conversation.Title), conversation.MessageCount)
+	message += "This action cannot be undone."
+
+	keyboard := b.createConfirmationKeyboard(fmt.Sprintf("conv_delete_%d", conversation.ID))
+	b.sendMessageWithKeyboard(userID, message, "HTML", keyboard)
+}
+
+// handleDeleteConversation deletes a conversation after confirmation
+func (b *Bot) handleDeleteConversation(userID int64, idText string) {
+	conversationID, err := strconv.ParseInt(idText, 10, 64)
+	if err != nil {
+		b.sendMessage(userID, "❌ Invalid conversation.")
+		return
+	}
+
+	if err := b.storage.DeleteConversation(userID, conversationID); err != nil {
+		if errors.Is(err, storage.ErrConversationNotFound) {
+			b.sendMessage(userID, "❌ Conversation not found. It may have been deleted already.")
+			return
+		}
+		log.Errorf("Failed to delete conversation: %v", err)
+		b.sendMessage(userID, "Error deleting conversation.")
+		return
+	}
+
+	message := "🗑️ <i>Conversation deleted.</i>"
+	if active, err := b.storage.GetActiveConversation(userID); err == nil {
+		message += fmt.Sprintf("\n\n<i>Current conversation:</i> <b>%s</b>", html.EscapeString(active.Title))
+	}
+
+	keyboard := b.createBackToMenuKeyboard()
+	b.sendMessageWithKeyboard(userID, message, "HTML", keyboard)
+}
+
+// findConversation finds a conversation by ID or (case-insensitive) title
+func findConversation(conversations []storage.Conversation, query string) *storage.Conversation {
+	query = strings.TrimPrefix(strings.TrimSpace(query), "#")
+
+	if id, err := strconv.ParseInt(query, 10, 64); err == nil {
+		for i := range conversations {
+			if conversations[i].ID == id {
+				return &conversations[i]
+			}
+		}
+	}
+
+	for i := range conversations {
+		if strings.EqualFold(conversations[i].Title, query) {
+			return &conversations[i]
+		}
+	}
+	return nil
+}
+
+// sortConversationsByActivity returns the conversations with the most recently used first
+func sortConversationsByActivity(conversations []storage.Conversation) []storage.Conversation {
+	sorted := make([]storage.Conversation, len(conversations))
+	copy(sorted, conversations)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].LastActivity.After(sorted[j].LastActivity)
+	})
+	return sorted
+}
+
+// normalizeConversationTitle trims a title and limits its length
+func normalizeConversationTitle(title string) string {
+	return truncateText(title, maxConversationTitleLength)
+}
+
+// formatRelativeTime formats a time as a short "x ago" string
+func formatRelativeTime(t time.Time) string {
+	elapsed := time.Since(t)
+	switch {
+	case elapsed < time.Minute:
+		return "just now"
+	case elapsed < time.Hour:
+		return fmt.Sprintf("%dm ago", int(elapsed.Minutes()))
+	case elapsed < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(elapsed.Hours()))
+	case elapsed < 7*24*time.Hour:
+		return fmt.Sprintf("%dd ago", int(elapsed.Hours()/24))
+	default:
+		return t.Format("Jan 2")
+	}
+}
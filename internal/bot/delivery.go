@@ -0,0 +1,76 @@
+package bot
+
+import (
+	"expvar"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+
+	"telegrambot/internal/markdown"
+)
+
+// Fallbacks used when Telegram rejects the formatting of a message
+const (
+	fallbackSanitized = "sanitized"
+	fallbackPlain     = "plain"
+	fallbackFailed    = "failed"
+)
+
+// formattingFallbacks counts messages Telegram couldn't parse as HTML, by the fallback that
+// delivered them, so formatting regressions show up in the metrics and in /stats
+var formattingFallbacks = expvar.NewMap("formatting_fallbacks")
+
+// isParseError reports whether Telegram rejected a message because of its formatting
+func isParseError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "can't parse entities")
+}
+
+// sendWithFallback delivers HTML text with send, which is called with the text and its parse mode.
+// When Telegram can't parse the HTML, the text is sent again with sanitized HTML and then as
+// plain text without tags. Other errors are returned right away.
+func (b *Bot) sendWithFallback(chatKey int64, text string, send func(text, parseMode string) error) error {
+	err := send(text, "HTML")
+	if !isParseError(err) {
+		return err
+	}
+	log.Warnf("Telegram rejected the formatting of a message to chat %d: %v", chatKey, err)
+
+	if sanitized := markdown.Sanitize(text); sanitized != text {
+		err = send(sanitized, "HTML")
+		if err == nil {
+			formattingFallbacks.Add(fallbackSanitized, 1)
+			log.Warnf("Sent message to chat %d with sanitized HTML", chatKey)
+			return nil
+		}
+		if !isParseError(err) {
+			return err
+		}
+	}
+
+	err = send(markdown.PlainText(text), "")
+	if err != nil {
+		formattingFallbacks.Add(fallbackFailed, 1)
+		return err
+	}
+	formattingFallbacks.Add(fallbackPlain, 1)
+	log.Warnf("Sent message to chat %d as plain text", chatKey)
+	return nil
+}
+
+// fallbackCount returns how often a formatting fallback was used since the bot started
+func fallbackCount(fallback string) int64 {
+	if counter, ok := formattingFallbacks.Get(fallback).(*expvar.Int); ok {
+		return counter.Value()
+	}
+	return 0
+}
+
+// sendHTMLMessage sends a message with HTML formatting, falling back to sanitized HTML and plain text
+func (b *Bot) sendHTMLMessage(chatKey int64, msg tgbotapi.MessageConfig) error {
+	return b.sendWithFallback(chatKey, msg.Text, func(text, parseMode string) error {
+		msg.Text, msg.ParseMode = text, parseMode
+		_, err := b.api.Send(msg)
+		return err
+	})
+}
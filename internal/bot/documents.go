@@ -0,0 +1,305 @@
+package bot
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"telegrambot/internal/markdown"
+	"telegrambot/internal/storage"
+)
+
+// answerPreviewLength is the length of the preview sent with an answer file, in UTF-16 code units
+const answerPreviewLength = 600
+
+// codeExtensions maps language tags of code blocks to file extensions; tags that are already
+// an extension, like go or py, are used as they are
+var codeExtensions = map[string]string{
+	"python": "py", "python3": "py", "javascript": "js", "typescript": "ts", "jsx": "jsx", "tsx": "tsx",
+	"bash": "sh", "shell": "sh", "zsh": "sh", "console": "sh", "powershell": "ps1", "batch": "bat",
+	"golang": "go", "rust": "rs", "ruby": "rb", "kotlin": "kt", "csharp": "cs", "c#": "cs",
+	"cpp": "cpp", "c++": "cpp", "fsharp": "fs", "perl": "pl", "haskell": "hs", "elixir": "ex",
+	"erlang": "erl", "objectivec": "m", "objc": "m", "markdown": "md", "yaml": "yml",
+	"dockerfile": "Dockerfile", "makefile": "mk", "text": "txt", "plaintext": "txt",
+}
+
+// fileDelivery is the effective policy for sending long answers as files
+type fileDelivery struct {
+	codeFiles     bool
+	codeThreshold int
+	answerFiles   string // "md", "html" or "off"
+	maxChunks     int
+}
+
+// fileDelivery returns the file delivery policy of a user: their own choices over the config
+func (b *Bot) fileDelivery(settings *storage.UserSettings) fileDelivery {
+	delivery := fileDelivery{
+		codeFiles:     b.config.Files.CodeFiles,
+		codeThreshold: b.config.Files.CodeThreshold,
+		answerFiles:   b.config.Files.AnswerFiles,
+		maxChunks:     b.config.Files.MaxChunks,
+	}
+	switch settings.FileDelivery.CodeFiles {
+	case "on":
+		delivery.codeFiles = true
+	case "off":
+		delivery.codeFiles = false
+	}
+	if settings.FileDelivery.AnswerFiles != "" {
+		delivery.answerFiles = settings.FileDelivery.AnswerFiles
+	}
+	return delivery
+}
+
+// codeFile is a code block sent as a document
+type codeFile struct {
+	name string
+	code string
+}
+
+// codeFileName returns the file name of the nth extracted code block, e.g. snippet_1.py
+func codeFileName(n int, language string) string {
+	language = strings.ToLower(language)
+	extension, ok := codeExtensions[language]
+	if !ok {
+		extension = language
+	}
+	if extension == "" {
+		extension = "txt"
+	}
+	return fmt.Sprintf("snippet_%d.%s", n, extension)
+}
+
+// extractCodeFiles replaces the code blocks of a Markdown answer that are longer than the
+// threshold with a reference to a file and returns the rest of the answer and the files
+func extractCodeFiles(response string, threshold int) (string, []codeFile) {
+	var files []codeFile
+	var out strings.Builder
+	last := 0
+	for _, block := range markdown.FencedCodeBlocks(response) {
+		if markdown.UTF16Length(block.Code) <= threshold {
+			continue
+		}
+		file := codeFile{name: codeFileName(len(files)+1, block.Language), code: block.Code + "\n"}
+		files = append(files, file)
+
+		// Keep the indentation of the fence, so a block in a list stays in the list
+		start := block.Start
+		for start < block.End && response[start] == ' ' {
+			start++
+		}
+		out.WriteString(response[last:start])
+		out.WriteString("📎 `" + file.name + "`")
+		last = block.End
+	}
+	if len(files) == 0 {
+		return response, nil
+	}
+	out.WriteString(response[last:])
+	return out.String(), files
+}
+
+// sendLLMResponse sends an LLM response with proper HTML formatting. Depending on the user's
+// file delivery, an answer that needs too many messages is sent as a single file with a preview,
+// and long code blocks are sent as files that are easy to copy and save.
+func (b *Bot) sendLLMResponse(userID int64, target chatTarget, response string, delivery fileDelivery) error {
+	// Models answer in Markdown, which is rendered as Telegram HTML
+	formattedResponse := markdown.ToTelegramHTML(response)
+
+	// Split message if too long
+	messages := b.splitMessage(formattedResponse, b.config.MaxMessageLength)
+
+	if delivery.answerFiles != "off" && len(messages) > delivery.maxChunks {
+		return b.sendAnswerFile(userID, target, response, formattedResponse, delivery.answerFiles, true)
+	}
+
+	var files []codeFile
+	if delivery.codeFiles {
+		var text string
+		text, files = extractCodeFiles(response, delivery.codeThreshold)
+		if len(files) > 0 {
+			messages = b.splitMessage(markdown.ToTelegramHTML(text), b.config.MaxMessageLength)
+		}
+	}
+
+	for _, msgText := range messages {
+		// An answer that was only code has no text left
+		if strings.TrimSpace(msgText) == "" {
+			continue
+		}
+		if err := b.sendHTMLMessage(userID, target.message(msgText)); err != nil {
+			log.Errorf("Failed to send LLM response to user %d: %v", userID, err)
+			return err
+		}
+
+		// Small delay between messages to avoid rate limiting
+		if len(messages) > 1 {
+			time.Sleep(500 * time.Millisecond)
+		}
+	}
+
+	return b.sendCodeFiles(userID, target, files)
+}
+
+// sendResponseFiles sends the files of an answer that was streamed as messages already: the
+// whole answer if it took too many messages, otherwise its long code blocks
+func (b *Bot) sendResponseFiles(userID int64, target chatTarget, response string, delivery fileDelivery) error {
+	formattedResponse := markdown.ToTelegramHTML(response)
+	if delivery.answerFiles != "off" && len(b.splitMessage(formattedResponse, b.config.MaxMessageLength)) > delivery.maxChunks {
+		return b.sendAnswerFile(userID, target, response, formattedResponse, delivery.answerFiles, false)
+	}
+	if !delivery.codeFiles {
+		return nil
+	}
+	_, files := extractCodeFiles(response, delivery.codeThreshold)
+	return b.sendCodeFiles(userID, target, files)
+}
+
+// sendCodeFiles sends extracted code blocks as documents
+func (b *Bot) sendCodeFiles(userID int64, target chatTarget, files []codeFile) error {
+	for _, file := range files {
+		if _, err := b.api.Send(target.document(file.name, []byte(file.code))); err != nil {
+			log.Errorf("Failed to send %s to user %d: %v", file.name, userID, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// sendAnswerFile sends a whole answer as answer.md or answer.html, after a short preview
+// message unless the answer was already shown
+func (b *Bot) sendAnswerFile(userID int64, target chatTarget, response, formattedResponse, format string, preview bool) error {
+	name := "answer." + format
+	data := []byte(response)
+	if format == "html" {
+		data = []byte(answerDocument(formattedResponse))
+	}
+
+	if preview {
+		text := markdown.SplitHTML(formattedResponse, answerPreviewLength)[0]
+		text += "\n\n📎 <i>The answer is too long for a few messages, the full text is in " + name + ".</i>"
+		if err := b.sendHTMLMessage(userID, target.message(text)); err != nil {
+			log.Errorf("Failed to send answer preview to user %d: %v", userID, err)
+			return err
+		}
+	}
+
+	if _, err := b.api.Send(target.document(name, data)); err != nil {
+		log.Errorf("Failed to send %s to user %d: %v", name, userID, err)
+		return err
+	}
+	return nil
+}
+
+// answerDocument wraps an answer rendered as Telegram HTML into a standalone HTML page.
+// Telegram HTML breaks lines with newlines, which the page keeps.
+func answerDocument(formattedResponse string) string {
+	var page strings.Builder
+	page.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>Answer</title>\n<style>\n")
+	page.WriteString("body { font-family: sans-serif; max-width: 50em; margin: 2em auto; padding: 0 1em; white-space: pre-wrap; }\n")
+	page.WriteString("pre { background: #f4f4f4; padding: 1em; overflow-x: auto; }\n")
+	page.WriteString("blockquote { border-left: 3px solid #ccc; margin: 0; padding-left: 1em; }\n")
+	page.WriteString("</style>\n</head>\n<body>\n")
+	page.WriteString(formattedResponse)
+	page.WriteString("\n</body>\n</html>\n")
+	return page.String()
+}
+
+// handleFilesCommand handles the /files command.
+//
+//	/files                                   show how long answers are delivered
+//	/files code on|off|default               send long code blocks as files
+//	/files answers md|html|off|default       send answers that need many messages as one file
+func (b *Bot) handleFilesCommand(userID int64, args string) {
+	subcommand, value, _ := strings.Cut(strings.TrimSpace(args), " ")
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	settings, err := b.storage.GetUserSettings(userID)
+	if err != nil {
+		log.Errorf("Failed to get user settings: %v", err)
+		b.sendMessage(userID, "Error retrieving your settings.")
+		return
+	}
+
+	var confirmation string
+	switch strings.ToLower(subcommand) {
+	case "":
+		b.sendMessage(userID, b.filesList(settings))
+		return
+	case "code":
+		switch value {
+		case "on", "off":
+			settings.FileDelivery.CodeFiles = value
+		case "default":
+			settings.FileDelivery.CodeFiles = ""
+		default:
+			b.sendMessage(userID, filesUsage())
+			return
+		}
+		confirmation = "✅ Code file setting updated."
+	case "answers":
+		switch value {
+		case "md", "html", "off":
+			settings.FileDelivery.AnswerFiles = value
+		case "default":
+			settings.FileDelivery.AnswerFiles = ""
+		default:
+			b.sendMessage(userID, filesUsage())
+			return
+		}
+		confirmation = "✅ Answer file setting updated."
+	default:
+		b.sendMessage(userID, filesUsage())
+		return
+	}
+
+	if err := b.storage.SaveUserSettings(settings); err != nil {
+		log.Errorf("Failed to save user settings: %v", err)
+		b.sendMessage(userID, "Error saving your settings.")
+		return
+	}
+
+	b.sendMessage(userID, confirmation+"\n\n"+b.filesList(settings))
+}
+
+// filesList describes how long answers are delivered to the user
+func (b *Bot) filesList(settings *storage.UserSettings) string {
+	delivery := b.fileDelivery(settings)
+
+	message := "📎 <i>File Delivery</i>\n\n"
+	if delivery.codeFiles {
+		message += fmt.Sprintf("<b>Code:</b> blocks longer than %d characters are sent as files", delivery.codeThreshold)
+	} else {
+		message += "<b>Code:</b> always sent as messages"
+	}
+	message += filesDefault(settings.FileDelivery.CodeFiles) + "\n"
+	if delivery.answerFiles == "off" {
+		message += "<b>Answers:</b> always sent as messages"
+	} else {
+		message += fmt.Sprintf("<b>Answers:</b> longer than %d messages are sent as <code>answer.%s</code>", delivery.maxChunks, html.EscapeString(delivery.answerFiles))
+	}
+	message += filesDefault(settings.FileDelivery.AnswerFiles) + "\n\n"
+	message += "<i>Usage:</i> <code>/files code on|off|default</code>, <code>/files answers md|html|off|default</code>"
+	return message
+}
+
+// filesDefault marks a setting that comes from the configuration
+func filesDefault(choice string) string {
+	if choice == "" {
+		return " (default)"
+	}
+	return ""
+}
+
+// filesUsage returns the help text of the /files command
+func filesUsage() string {
+	message := "📎 <i>File Delivery</i>\n\n"
+	message += "<code>/files</code> - show how long answers are delivered\n"
+	message += "<code>/files code on|off|default</code> - send long code blocks as files\n"
+	message += "<code>/files answers md|html|off|default</code> - send answers that need many messages as one Markdown or HTML file\n\n"
+	message += "<i>Example:</i> <code>/files answers md</code>"
+	return message
+}
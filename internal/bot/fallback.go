@@ -0,0 +1,148 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"telegrambot/internal/openrouter"
+	"telegrambot/internal/storage"
+)
+
+// maxFallbackModels is the number of fallback models a user can configure
+const maxFallbackModels = 3
+
+// fallbackModels returns the user's fallback models for a request to model.
+// The model itself is skipped, and so are models without vision when the request contains images.
+func (b *Bot) fallbackModels(settings *storage.UserSettings, model string, withImages bool) []string {
+	var fallbacks []string
+	for _, fallback := range settings.FallbackModels {
+		if fallback == model {
+			continue
+		}
+		if withImages && !b.modelSupportsImages(fallback) {
+			continue
+		}
+		fallbacks = append(fallbacks, fallback)
+	}
+	return fallbacks
+}
+
+// llmErrorMessage explains a failed LLM request to the user without exposing raw API responses
+func llmErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, openrouter.ErrRateLimited):
+		return "⏳ The model is receiving too many requests right now. Please try again in a minute or add a /fallback model."
+	case errors.Is(err, openrouter.ErrContextTooLong):
+		return "📏 The conversation is too long for this model. Start a /new conversation, /clear the history or switch to a model with a larger context."
+	case errors.Is(err, openrouter.ErrModerated):
+		return "🚫 The request was rejected by the provider's content moderation."
+	case errors.Is(err, openrouter.ErrInsufficientCredits):
+		return "💳 The bot's OpenRouter account has run out of credits. Please tell the administrator."
+	case errors.Is(err, openrouter.ErrProviderUnavailable):
+		return "🔌 The model's provider is unavailable at the moment. Please try again later or add a /fallback model."
+	}
+	return "Sorry, there was an error getting a response. Please try again."
+}
+
+// handleFallbackCommand handles the /fallback command.
+//
+//	/fallback                 show the fallback models
+//	/fallback add <model>     append a model to the list
+//	/fallback remove <model>  remove a model from the list
+//	/fallback clear           remove all fallback models
+func (b *Bot) handleFallbackCommand(userID int64, args string) {
+	subcommand, model, _ := strings.Cut(strings.TrimSpace(args), " ")
+	model = strings.TrimSpace(model)
+
+	settings, err := b.storage.GetUserSettings(userID)
+	if err != nil {
+		log.Errorf("Failed to get user settings: %v", err)
+		b.sendMessage(userID, "Error retrieving your settings.")
+		return
+	}
+
+	var confirmation string
+	switch strings.ToLower(subcommand) {
+	case "", "list":
+		b.sendMessage(userID, fallbackList(settings))
+		return
+	case "add":
+		if model == "" {
+			b.sendMessage(userID, fallbackUsage())
+			return
+		}
+		for _, existing := range settings.FallbackModels {
+			if existing == model {
+				b.sendMessage(userID, fmt.Sprintf("❌ <code>%s</code> is already a fallback model.", html.EscapeString(model)))
+				return
+			}
+		}
+		if len(settings.FallbackModels) >= maxFallbackModels {
+			b.sendMessage(userID, fmt.Sprintf("❌ You can have at most %d fallback models. Remove one first.", maxFallbackModels))
+			return
+		}
+		if !b.validateModel(userID, model) {
+			return
+		}
+		settings.FallbackModels = append(settings.FallbackModels, model)
+		confirmation = fmt.Sprintf("✅ Added fallback model <code>%s</code>.", html.EscapeString(model))
+	case "remove", "delete":
+		remaining := make([]string, 0, len(settings.FallbackModels))
+		for _, existing := range settings.FallbackModels {
+			if existing != model {
+				remaining = append(remaining, existing)
+			}
+		}
+		if len(remaining) == len(settings.FallbackModels) {
+			b.sendMessage(userID, "❌ That model is not in your fallback list.")
+			return
+		}
+		settings.FallbackModels = remaining
+		confirmation = fmt.Sprintf("🗑️ Removed fallback model <code>%s</code>.", html.EscapeString(model))
+	case "clear":
+		settings.FallbackModels = nil
+		confirmation = "🗑️ All fallback models removed."
+	default:
+		b.sendMessage(userID, fallbackUsage())
+		return
+	}
+
+	if err := b.storage.SaveUserSettings(settings); err != nil {
+		log.Errorf("Failed to save user settings: %v", err)
+		b.sendMessage(userID, "Error saving your settings.")
+		return
+	}
+
+	b.sendMessage(userID, confirmation+"\n\n"+fallbackList(settings))
+}
+
+// fallbackList describes the user's fallback models
+func fallbackList(settings *storage.UserSettings) string {
+	message := "🛟 <i>Fallback Models</i>\n\n"
+	if len(settings.FallbackModels) == 0 {
+		message += "No fallback models. If the model of a conversation fails, the request fails.\n\n"
+	} else {
+		message += "If the model of a conversation keeps failing, these are tried in order:\n"
+		for i, model := range settings.FallbackModels {
+			message += fmt.Sprintf("%d. <code>%s</code>\n", i+1, html.EscapeString(model))
+		}
+		message += "\n"
+	}
+	message += "<i>Usage:</i> <code>/fallback add model</code>, <code>/fallback remove model</code>, <code>/fallback clear</code>"
+	return message
+}
+
+// fallbackUsage returns the help text of the /fallback command
+func fallbackUsage() string {
+	message := "🛟 <i>Fallback Models</i>\n\n"
+	message += "<code>/fallback</code> - show your fallback models\n"
+	message += "<code>/fallback add model</code> - add a model to the end of the list\n"
+	message += "<code>/fallback remove model</code> - remove a model\n"
+	message += "<code>/fallback clear</code> - remove all fallback models\n\n"
+	message += "<i>Example:</i> <code>/fallback add openai/gpt-4o-mini</code>"
+	return message
+}
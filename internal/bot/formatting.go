@@ -261,65 +261,30 @@ func (b *Bot) convertTablesToHTML(text string) string {
 	return strings.Join(result, "\n")
 }
 
-// escapeHTMLEntities escapes HTML entities while preserving formatting tags
-func (b *Bot) escapeHTMLEntities(text string) string {
-	// Only escape & characters that aren't already escaped HTML entities
-	// This prevents double-escaping while fixing unescaped & characters
-	text = strings.ReplaceAll(text, "&amp;", "TEMP_AMP_PLACEHOLDER")
-	text = strings.ReplaceAll(text, "&lt;", "TEMP_LT_PLACEHOLDER")
-	text = strings.ReplaceAll(text, "&gt;", "TEMP_GT_PLACEHOLDER")
-	text = strings.ReplaceAll(text, "&", "&amp;")
-	text = strings.ReplaceAll(text, "TEMP_AMP_PLACEHOLDER", "&amp;")
-	text = strings.ReplaceAll(text, "TEMP_LT_PLACEHOLDER", "&lt;")
-	text = strings.ReplaceAll(text, "TEMP_GT_PLACEHOLDER", "&gt;")
-
-	// Don't escape < and > - we want HTML formatting tags to work
-	return text
+// createDefaultSystemMessage creates the system message used when a conversation has no prompt of its own
+func (b *Bot) createDefaultSystemMessage() string {
+	return "You are a helpful assistant. " + markdownFormattingRules
 }
 
-// createSystemMessageForHTML creates an appropriate system message for HTML formatting
-func (b *Bot) createSystemMessageForHTML() string {
-	return `You are a helpful assistant. Format your responses for Telegram using clean HTML formatting:
+// markdownFormattingRules tells the model how to format responses for Telegram.
+// It is appended to custom system prompts and personas. Answers are rendered from
+// Markdown to Telegram HTML by the markdown package.
+const markdownFormattingRules = `Format your responses in standard Markdown. They are converted for Telegram automatically.
 
 FORMATTING RULES:
-- Use <b>bold text</b> for important points and headers  
-- Use <i>italic text</i> for emphasis
-- Use <code>inline code</code> for commands and technical terms
-- Use <pre>code blocks</pre> for longer code
-- Use <u>underlined text</u> for special emphasis (optional)
-
-STRUCTURE GUIDELINES (CRITICAL):
-- ALWAYS use blank lines between sections and paragraphs
-- ALWAYS add line breaks after headers
-- Use bullet points (•) for lists with proper line breaks
-- Keep paragraphs short and separated by blank lines
-- Add extra line breaks for better readability
-
-EXAMPLE STRUCTURE:
-<b>Section Header</b>
-
-Content paragraph with proper spacing.
-
-• Bullet point 1
-• Bullet point 2
-
-<b>Next Section</b>
-
-More content with proper spacing.
-
-FOR TABLES: Use simple bullet-point format:
-• <b>Column 1</b> | <b>Column 2</b> | <b>Column 3</b>  
-• Data 1 | Data 2 | Data 3
+- Use **bold** for important points and *italic* for emphasis
+- Use ` + "`inline code`" + ` for commands and technical terms
+- Use fenced code blocks with a language for longer code, e.g. ` + "```python" + `
+- Use # headings, - or 1. lists, > quotes and [text](https://...) links as usual
+- Tables are supported, but keep them small, since they are shown as one line per row
 
-IMPORTANT: 
-- Use MANY line breaks - better too many than too few
-- This is especially important for Russian, Chinese, and other non-Latin scripts
-- Each section should be clearly separated with blank lines
-- Only use HTML tags for formatting: <b>, <i>, <code>, <pre>, <u>
-- Do NOT use < or > characters for anything other than HTML tags
+STRUCTURE GUIDELINES:
+- Use blank lines between sections and paragraphs
+- Keep paragraphs short and readable on a phone screen
 
-This HTML formatting works perfectly with all languages including Russian, Chinese, Arabic, etc.`
-}
+IMPORTANT:
+- Do NOT use HTML tags; write <, > and & as they are, they are escaped for you
+- Only put code, commands and file names into code spans and blocks`
 
 // createSystemMessageForMarkdownV2 creates an appropriate system message for MarkdownV2 formatting
 func (b *Bot) createSystemMessageForMarkdownV2() string {
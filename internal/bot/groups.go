@@ -0,0 +1,278 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strings"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+
+	"telegrambot/internal/storage"
+)
+
+// update is a Telegram update together with the forum topic of its message,
+// which the Telegram library doesn't decode
+type update struct {
+	tgbotapi.Update
+	// threadID is the forum topic of the message or pressed button; 0 outside topics
+	threadID int
+}
+
+// topicFields are the fields that place a message in a forum topic
+type topicFields struct {
+	MessageThreadID int  `json:"message_thread_id"`
+	IsTopicMessage  bool `json:"is_topic_message"`
+}
+
+// thread returns the topic of a message, or 0 if it isn't in a topic (including the General topic)
+func (t *topicFields) thread() int {
+	if t == nil || !t.IsTopicMessage {
+		return 0
+	}
+	return t.MessageThreadID
+}
+
+// decodeUpdate decodes an update received from Telegram
+func decodeUpdate(data []byte) (update, error) {
+	var u update
+	if err := json.Unmarshal(data, &u.Update); err != nil {
+		return u, err
+	}
+
+	var topics struct {
+		Message       *topicFields `json:"message"`
+		CallbackQuery *struct {
+			Message *topicFields `json:"message"`
+		} `json:"callback_query"`
+	}
+	if err := json.Unmarshal(data, &topics); err != nil {
+		return u, err
+	}
+
+	u.threadID = topics.Message.thread()
+	if topics.CallbackQuery != nil {
+		u.threadID = topics.CallbackQuery.Message.thread()
+	}
+	return u, nil
+}
+
+// chatKey returns the key the settings and history of a chat are stored under. Handlers receive it
+// as their userID: in private chats it is the user's ID, in groups the chat's ID. Forum topics get
+// a key of their own, derived from chat and topic and outside the 52 bits Telegram IDs fit in.
+func chatKey(chatID int64, threadID int) int64 {
+	if threadID == 0 {
+		return chatID
+	}
+
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%d/%d", chatID, threadID)
+	return -int64(1<<62 | hash.Sum64()&(1<<62-1))
+}
+
+// chatTarget is where the messages for a chat key are sent
+type chatTarget struct {
+	chatID int64
+	// replyTo is the message answers are threaded to in groups, which also keeps them in its topic; 0 in private chats
+	replyTo int
+}
+
+// chatTargets maps chat keys to the chats they belong to
+type chatTargets struct {
+	mutex   sync.Mutex
+	targets map[int64]chatTarget
+}
+
+// newChatTargets creates the mapping with the stored forum topics. Until a topic has a message
+// to reply to, messages reply to the topic itself, whose first message has the topic's ID.
+func newChatTargets(topics map[int64]storage.Topic) *chatTargets {
+	targets := make(map[int64]chatTarget, len(topics))
+	for key, topic := range topics {
+		targets[key] = chatTarget{chatID: topic.ChatID, replyTo: topic.ThreadID}
+	}
+	return &chatTargets{
+		targets: targets,
+	}
+}
+
+// set records where messages for a key go and reports whether the key was new
+func (c *chatTargets) set(key int64, target chatTarget) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	_, known := c.targets[key]
+	c.targets[key] = target
+	return !known
+}
+
+// get returns where messages for a key go; unknown keys are private chats
+func (c *chatTargets) get(key int64) chatTarget {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if target, ok := c.targets[key]; ok {
+		return target
+	}
+	return chatTarget{chatID: key}
+}
+
+// chatID returns the Telegram chat of a chat key
+func (b *Bot) chatID(key int64) int64 {
+	return b.chats.get(key).chatID
+}
+
+// message creates a message for the target, threaded to the message being answered in groups
+func (t chatTarget) message(text string) tgbotapi.MessageConfig {
+	msg := tgbotapi.NewMessage(t.chatID, text)
+	msg.ReplyToMessageID = t.replyTo
+	// Answer anyway if the message was deleted in the meantime
+	msg.AllowSendingWithoutReply = t.replyTo != 0
+	return msg
+}
+
+// document creates a file upload for the target, threaded like message
+func (t chatTarget) document(name string, data []byte) tgbotapi.DocumentConfig {
+	doc := tgbotapi.NewDocument(t.chatID, tgbotapi.FileBytes{Name: name, Bytes: data})
+	doc.ReplyToMessageID = t.replyTo
+	doc.AllowSendingWithoutReply = t.replyTo != 0
+	return doc
+}
+
+// messageTarget returns where the answer to a message goes: the private chat, or the message itself in groups
+func messageTarget(message *tgbotapi.Message) chatTarget {
+	if message.Chat.IsPrivate() {
+		return chatTarget{chatID: message.Chat.ID}
+	}
+	return chatTarget{chatID: message.Chat.ID, replyTo: message.MessageID}
+}
+
+// newMessage creates a message for a chat key, threaded to the last message of the chat in groups
+func (b *Bot) newMessage(key int64, text string) tgbotapi.MessageConfig {
+	return b.chats.get(key).message(text)
+}
+
+// newDocument creates a file upload for a chat key, threaded like newMessage
+func (b *Bot) newDocument(key int64, name string, data []byte) tgbotapi.DocumentConfig {
+	return b.chats.get(key).document(name, data)
+}
+
+// sendReply sends an HTML message to the target of an answer. Unlike sendMessage it doesn't look
+// up the chat key, whose last message may be a newer one than the message being answered.
+func (b *Bot) sendReply(key int64, target chatTarget, text string) error {
+	err := b.sendHTMLMessage(key, target.message(text))
+	if err != nil {
+		log.Errorf("Failed to send message to user %d: %v", key, err)
+	}
+	return err
+}
+
+// registerChat records the chat of a message or pressed button and returns its chat key.
+// In groups, answers are threaded to replyTo.
+func (b *Bot) registerChat(chat *tgbotapi.Chat, threadID, replyTo int) int64 {
+	if chat.IsPrivate() {
+		return chat.ID
+	}
+
+	key := chatKey(chat.ID, threadID)
+	if b.chats.set(key, chatTarget{chatID: chat.ID, replyTo: replyTo}) && threadID != 0 {
+		// The key of a topic can't be turned back into its chat, which broadcasts and
+		// budget warnings need after a restart
+		if err := b.storage.SaveTopic(key, storage.Topic{ChatID: chat.ID, ThreadID: threadID}); err != nil {
+			log.Errorf("Failed to save topic %d of chat %d: %v", threadID, chat.ID, err)
+		}
+	}
+	return key
+}
+
+// isAllowed checks whether a user may use the bot in a chat: allowed users everywhere,
+// and everyone in allowed group chats
+func (b *Bot) isAllowed(user *tgbotapi.User, chat *tgbotapi.Chat) bool {
+	if user != nil && b.isUserAllowed(user.ID) {
+		return true
+	}
+	return chat != nil && !chat.IsPrivate() && b.config.IsChatAllowed(chat.ID)
+}
+
+// groupSettingsCommands change the settings or history that the members of a group share
+var groupSettingsCommands = map[string]bool{
+	"mode":     true,
+	"model":    true,
+	"addmodel": true,
+	"clear":    true,
+	"new":      true,
+	"switch":   true,
+	"rename":   true,
+	"delete":   true,
+	"persona":  true,
+	"system":   true,
+	"params":   true,
+	"summary":  true,
+	"fallback": true,
+	"files":    true,
+}
+
+// changesGroupSettings reports whether a button changes the settings or history that the members of a group share
+func changesGroupSettings(data string) bool {
+	switch data {
+	case "confirm_clear", "mode_with_history", "mode_without_history", "params_reset", "persona_off", "conv_new":
+		return true
+	}
+	for _, prefix := range []string{"params_set_", "persona_use_", "conv_switch_", "confirm_conv_delete_", "model_"} {
+		if strings.HasPrefix(data, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// canChangeSettings checks whether a user may change the shared settings and history of a chat:
+// anyone in private chats, only administrators of the chat and allowed users in groups
+func (b *Bot) canChangeSettings(user *tgbotapi.User, chat *tgbotapi.Chat) bool {
+	if chat.IsPrivate() || b.isUserAllowed(user.ID) {
+		return true
+	}
+
+	member, err := b.api.GetChatMember(tgbotapi.GetChatMemberConfig{
+		ChatConfigWithUser: tgbotapi.ChatConfigWithUser{ChatID: chat.ID, UserID: user.ID},
+	})
+	if err != nil {
+		log.Errorf("Failed to get member %d of chat %d: %v", user.ID, chat.ID, err)
+		return false
+	}
+	return member.IsCreator() || member.IsAdministrator()
+}
+
+// groupSettingsDenied is the answer to members who may not change the settings of a group
+const groupSettingsDenied = "❌ In groups, only administrators of the chat and allowed users can change its settings and history."
+
+// newMentionPattern matches mentions of the bot's username
+func newMentionPattern(username string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)@` + regexp.QuoteMeta(username) + `\b`)
+}
+
+// isAddressed reports whether a group message is meant for the bot: a command that isn't
+// for another bot, a reply to one of the bot's messages or a mention of the bot
+func (b *Bot) isAddressed(message *tgbotapi.Message) bool {
+	if message.IsCommand() {
+		command := message.CommandWithAt()
+		at := strings.Index(command, "@")
+		return at == -1 || strings.EqualFold(command[at+1:], b.api.Self.UserName)
+	}
+
+	if reply := message.ReplyToMessage; reply != nil && reply.From != nil && reply.From.ID == b.api.Self.ID {
+		return true
+	}
+
+	return b.mention.MatchString(message.Text) || b.mention.MatchString(message.Caption)
+}
+
+// withoutMention returns a copy of a message with mentions of the bot removed from its text
+func (b *Bot) withoutMention(message *tgbotapi.Message) *tgbotapi.Message {
+	stripped := *message
+	stripped.Text = strings.TrimSpace(b.mention.ReplaceAllString(message.Text, ""))
+	stripped.Caption = strings.TrimSpace(b.mention.ReplaceAllString(message.Caption, ""))
+	return &stripped
+}
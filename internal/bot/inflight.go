@@ -0,0 +1,99 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// handlerCleanupTimeout is how long handlers get to finish after their requests were cancelled on shutdown
+const handlerCleanupTimeout = 5 * time.Second
+
+// inflightRequests tracks the running LLM requests of each user, so /stop and shutdown can cancel them
+type inflightRequests struct {
+	mutex    sync.Mutex
+	nextID   uint64
+	requests map[int64]map[uint64]context.CancelFunc
+}
+
+// newInflightRequests creates an empty registry
+func newInflightRequests() *inflightRequests {
+	return &inflightRequests{
+		requests: make(map[int64]map[uint64]context.CancelFunc),
+	}
+}
+
+// start registers a request of a user. The returned context is cancelled by cancel, cancelUser
+// or when parent is done; done must be called when the request has finished.
+func (r *inflightRequests) start(parent context.Context, userID int64) (ctx context.Context, done func()) {
+	ctx, cancel := context.WithCancel(parent)
+
+	r.mutex.Lock()
+	r.nextID++
+	id := r.nextID
+	if r.requests[userID] == nil {
+		r.requests[userID] = make(map[uint64]context.CancelFunc)
+	}
+	r.requests[userID][id] = cancel
+	r.mutex.Unlock()
+
+	return ctx, func() {
+		r.mutex.Lock()
+		delete(r.requests[userID], id)
+		if len(r.requests[userID]) == 0 {
+			delete(r.requests, userID)
+		}
+		r.mutex.Unlock()
+		cancel()
+	}
+}
+
+// cancelUser cancels all running requests of a user and returns how many there were
+func (r *inflightRequests) cancelUser(userID int64) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, cancel := range r.requests[userID] {
+		cancel()
+	}
+	return len(r.requests[userID])
+}
+
+// count returns the number of running requests of all users
+func (r *inflightRequests) count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	total := 0
+	for _, requests := range r.requests {
+		total += len(requests)
+	}
+	return total
+}
+
+// handleStopCommand handles the /stop command and the Stop button: cancel the user's running
+// requests and drop their queued messages
+func (b *Bot) handleStopCommand(userID int64) {
+	dropped := b.queues.clear(userID)
+	stopped := b.inflight.cancelUser(userID)
+	if stopped == 0 && dropped == 0 {
+		b.sendMessage(userID, "Nothing to stop, no response is being generated.")
+		return
+	}
+	log.Infof("User %d stopped %d running requests and %d queued messages", userID, stopped, dropped)
+
+	if dropped > 0 {
+		b.sendMessage(userID, fmt.Sprintf("🗑️ Dropped %d queued message(s).", dropped))
+	}
+}
+
+// stoppedMessage tells the user why a request was cancelled
+func (b *Bot) stoppedMessage() string {
+	if b.ctx.Err() != nil {
+		return "⏹ The bot is restarting, so the response was stopped. Please send your message again in a minute."
+	}
+	return "⏹ Stopped."
+}
@@ -0,0 +1,325 @@
+package bot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+
+	"telegrambot/internal/markdown"
+	"telegrambot/internal/storage"
+)
+
+const (
+	// inlineCacheTTL is how long answers to inline queries are reused
+	inlineCacheTTL = 10 * time.Minute
+	// maxInlineCacheEntries limits the number of cached inline answers
+	maxInlineCacheEntries = 1000
+	// inlineMaxTokens limits the length of inline answers, which have to fit into one message
+	inlineMaxTokens = 1000
+	// inlineTimeout limits the LLM request of an inline query. Telegram stops waiting for the answer
+	// after about 10 seconds; a slightly slower answer is still cached and shown when the query is
+	// sent again, but the request doesn't hold an LLM slot for long after nobody is waiting.
+	inlineTimeout = 20 * time.Second
+	// maxInlineTitleLength is the length of the result title, which repeats the question
+	maxInlineTitleLength = 60
+	// maxInlineDescriptionLength is the length of the answer preview below the title
+	maxInlineDescriptionLength = 120
+)
+
+// budgetError reports that a request was not sent because it would exceed a spending limit
+type budgetError struct {
+	usage budgetUsage
+}
+
+func (e *budgetError) Error() string {
+	return fmt.Sprintf("%s budget exceeded", e.usage.label)
+}
+
+// inlineAnswer is a cached answer to an inline query
+type inlineAnswer struct {
+	text    string
+	expires time.Time
+}
+
+// inlineRequest is the running LLM request of an inline query
+type inlineRequest struct {
+	queryID string
+	cancel  context.CancelFunc
+}
+
+// inlineQueries tracks the inline queries of each user for debouncing and caches their answers
+type inlineQueries struct {
+	mutex sync.Mutex
+	// latest is the ID of the newest query of each user; older ones are dropped after the debounce
+	latest map[int64]string
+	// running is the LLM request of each user, which is cancelled when a newer query replaces it
+	running map[int64]inlineRequest
+	cache   map[string]inlineAnswer
+}
+
+// newInlineQueries creates empty inline query state
+func newInlineQueries() *inlineQueries {
+	return &inlineQueries{
+		latest:  make(map[int64]string),
+		running: make(map[int64]inlineRequest),
+		cache:   make(map[string]inlineAnswer),
+	}
+}
+
+// track records the newest query of a user
+func (q *inlineQueries) track(userID int64, queryID string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.latest[userID] = queryID
+}
+
+// isLatest reports whether a query is still the newest of its user
+func (q *inlineQueries) isLatest(userID int64, queryID string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.latest[userID] == queryID
+}
+
+// replace registers the LLM request of a user's newest query, cancelling the request of the previous one
+func (q *inlineQueries) replace(userID int64, queryID string, cancel context.CancelFunc) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if previous, ok := q.running[userID]; ok {
+		previous.cancel()
+	}
+	q.running[userID] = inlineRequest{queryID: queryID, cancel: cancel}
+}
+
+// finish forgets a query once it has been answered, unless a newer query of the user has replaced it
+func (q *inlineQueries) finish(userID int64, queryID string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.latest[userID] == queryID {
+		delete(q.latest, userID)
+	}
+	if q.running[userID].queryID == queryID {
+		delete(q.running, userID)
+	}
+}
+
+// get returns the cached answer for a key
+func (q *inlineQueries) get(key string) (string, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	answer, ok := q.cache[key]
+	if !ok || time.Now().After(answer.expires) {
+		return "", false
+	}
+	return answer.text, true
+}
+
+// put caches an answer, evicting expired answers and, if still full, the one that expires first
+func (q *inlineQueries) put(key, text string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	now := time.Now()
+	if len(q.cache) >= maxInlineCacheEntries {
+		oldestKey := ""
+		for k, answer := range q.cache {
+			if now.After(answer.expires) {
+				delete(q.cache, k)
+			} else if oldestKey == "" || answer.expires.Before(q.cache[oldestKey].expires) {
+				oldestKey = k
+			}
+		}
+		if len(q.cache) >= maxInlineCacheEntries {
+			delete(q.cache, oldestKey)
+		}
+	}
+
+	q.cache[key] = inlineAnswer{text: text, expires: now.Add(inlineCacheTTL)}
+}
+
+// inlineCacheKey identifies an answer by user, model and question. Answers depend on the persona and
+// parameters of the user, so they are never shared with others, and another model is asked again.
+func inlineCacheKey(userID int64, model, query string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s\x00%s", userID, model, strings.ToLower(query))))
+	return hex.EncodeToString(sum[:16])
+}
+
+// handleInlineQuery answers "@bot question" from any chat with the user's current model.
+// Telegram sends a query for every change while the user types, so the LLM is only asked once
+// the query hasn't changed for the debounce interval.
+func (b *Bot) handleInlineQuery(query *tgbotapi.InlineQuery) {
+	userID := query.From.ID
+	if !b.isUserAllowed(userID) {
+		log.Warnf("Unauthorized user %d (%s) tried to use inline mode", userID, query.From.UserName)
+		b.answerInlineQuery(query.ID, nil, inlineCacheTTL)
+		return
+	}
+
+	question := strings.TrimSpace(query.Query)
+	if question == "" {
+		b.answerInlineQuery(query.ID, nil, 0)
+		return
+	}
+
+	settings, err := b.storage.GetUserSettings(userID)
+	if err != nil {
+		log.Errorf("Failed to get user settings: %v", err)
+		return
+	}
+	model := settings.ActiveModel()
+	key := inlineCacheKey(userID, model, question)
+
+	if answer, ok := b.inline.get(key); ok {
+		b.answerInlineQuery(query.ID, []interface{}{b.inlineResult(key, question, answer)}, inlineCacheTTL)
+		return
+	}
+
+	// Wait until the user has stopped typing; a newer query of the same user replaces this one
+	b.inline.track(userID, query.ID)
+	select {
+	case <-time.After(time.Duration(b.config.InlineDebounce) * time.Millisecond):
+	case <-b.ctx.Done():
+		return
+	}
+	if !b.inline.isLatest(userID, query.ID) {
+		log.Debugf("Dropping inline query of user %d, the user kept typing", userID)
+		return
+	}
+
+	answer, err := b.inlineCompletion(userID, query.ID, settings, model, question)
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if err != nil {
+		log.Errorf("Inline query of user %d failed: %v", userID, err)
+		b.answerInlineQuery(query.ID, []interface{}{inlineError(key, err)}, 0)
+		return
+	}
+
+	b.inline.put(key, answer)
+	b.answerInlineQuery(query.ID, []interface{}{b.inlineResult(key, question, answer)}, inlineCacheTTL)
+}
+
+// inlineCompletion asks the model for a short answer to an inline question.
+// The request counts against the user's budget and its cost is recorded like any other request.
+func (b *Bot) inlineCompletion(userID int64, queryID string, settings *storage.UserSettings, model, question string) (string, error) {
+	defer b.inline.finish(userID, queryID)
+
+	messages := []storage.ChatMessage{
+		{Role: "system", Content: b.buildSystemPrompt(settings) + "\n\nThe answer is inserted into a chat as one message, so keep it short."},
+		{Role: "user", Content: question, Timestamp: time.Now()},
+	}
+
+	params := b.effectiveParams(settings, model)
+	if params.MaxTokens == nil || *params.MaxTokens > inlineMaxTokens {
+		maxTokens := inlineMaxTokens
+		params.MaxTokens = &maxTokens
+	}
+
+	if usage, err := b.exceededBudget(userID, settings, model, messages, params); err != nil {
+		return "", fmt.Errorf("failed to check budget: %w", err)
+	} else if usage != nil {
+		return "", &budgetError{usage: *usage}
+	}
+
+	// Registered with the other requests of the user, so /stop and shutdown cancel it too
+	ctx, done := b.inflight.start(b.ctx, userID)
+	defer done()
+	ctx, cancel := context.WithTimeout(ctx, inlineTimeout)
+	defer cancel()
+	b.inline.replace(userID, queryID, cancel)
+
+	release, err := b.acquireLLMSlot(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	log.Infof("Answering inline query of user %d with model %s", userID, model)
+	fallbacks := b.fallbackModels(settings, model, false)
+	answer, err := b.llmClient.GetChatResponse(ctx, model, fallbacks, messages, params, userID, b.storage)
+	if err != nil {
+		return "", err
+	}
+
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return "", fmt.Errorf("the model returned an empty response")
+	}
+	return answer, nil
+}
+
+// inlineResult creates the article that sends the question and its answer to the chat
+func (b *Bot) inlineResult(id, question, answer string) tgbotapi.InlineQueryResultArticle {
+	header := fmt.Sprintf("❓ <b>%s</b>\n\n", html.EscapeString(question))
+	// The answer has to fit into a single message below the question
+	formatted := markdown.ToTelegramHTML(answer)
+	parts := b.splitMessage(formatted, b.config.MaxMessageLength-markdown.TextLength(header))
+
+	result := tgbotapi.NewInlineQueryResultArticleHTML(id, truncateRunes(question, maxInlineTitleLength), header+parts[0])
+	result.Description = truncateRunes(plainText(formatted), maxInlineDescriptionLength)
+	return result
+}
+
+// inlineError creates an article that explains why a question couldn't be answered
+func inlineError(id string, err error) tgbotapi.InlineQueryResultArticle {
+	message := llmErrorMessage(err)
+	var budgetErr *budgetError
+	if errors.As(err, &budgetErr) {
+		message = fmt.Sprintf("⛔ The %s budget has been reached.", budgetErr.usage.label)
+	}
+
+	result := tgbotapi.NewInlineQueryResultArticleHTML(id, "No answer", html.EscapeString(message))
+	result.Description = message
+	return result
+}
+
+// htmlTagPattern matches the HTML tags of formatted answers
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// plainText removes the formatting of an answer and collapses it into a single line
+func plainText(answer string) string {
+	text := html.UnescapeString(htmlTagPattern.ReplaceAllString(answer, ""))
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// truncateRunes shortens text to at most n runes, marking the cut with an ellipsis
+func truncateRunes(text string, n int) string {
+	if utf8.RuneCountInString(text) <= n {
+		return text
+	}
+	return string([]rune(text)[:n-1]) + "…"
+}
+
+// answerInlineQuery sends the results of an inline query. They are personal, since they depend on the user's model.
+func (b *Bot) answerInlineQuery(queryID string, results []interface{}, cacheTime time.Duration) {
+	if results == nil {
+		results = []interface{}{}
+	}
+
+	answer := tgbotapi.InlineConfig{
+		InlineQueryID: queryID,
+		Results:       results,
+		CacheTime:     int(cacheTime.Seconds()),
+		IsPersonal:    true,
+	}
+	if _, err := b.api.Request(answer); err != nil {
+		// Queries expire after a few seconds; the answer is cached for the next attempt
+		log.Debugf("Failed to answer inline query: %v", err)
+	}
+}
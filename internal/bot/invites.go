@@ -0,0 +1,395 @@
+package bot
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+
+	"telegrambot/internal/storage"
+)
+
+// accessRequestCooldown is how long a user has to wait before asking for access again
+const accessRequestCooldown = 24 * time.Hour
+
+// accessRequests remembers when users last asked for access, so they can't flood the admins
+type accessRequests struct {
+	mutex     sync.Mutex
+	requested map[int64]time.Time
+}
+
+// newAccessRequests creates an empty set of requests
+func newAccessRequests() *accessRequests {
+	return &accessRequests{
+		requested: make(map[int64]time.Time),
+	}
+}
+
+// add records a request; it returns false if the user asked too recently
+func (r *accessRequests) add(userID int64) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if last, ok := r.requested[userID]; ok && time.Since(last) < accessRequestCooldown {
+		return false
+	}
+	r.requested[userID] = time.Now()
+	return true
+}
+
+// resolve records the admin's decision; denied users have to wait for the cooldown again
+func (r *accessRequests) resolve(userID int64, approved bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if approved {
+		delete(r.requested, userID)
+	} else {
+		r.requested[userID] = time.Now()
+	}
+}
+
+// newInviteCode returns a random code that fits into a /start deep link
+func newInviteCode() (string, error) {
+	code := make([]byte, 8)
+	if _, err := rand.Read(code); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(code), nil
+}
+
+// inviteLink returns the deep link that starts the bot with an invite code
+func (b *Bot) inviteLink(code string) string {
+	return fmt.Sprintf("https://t.me/%s?start=%s", b.api.Self.UserName, code)
+}
+
+// userName describes a Telegram user for messages to admins
+func userName(user *tgbotapi.User) string {
+	name := html.EscapeString(strings.TrimSpace(user.FirstName + " " + user.LastName))
+	if user.UserName != "" {
+		name += " @" + html.EscapeString(user.UserName)
+	}
+	return fmt.Sprintf("%s (<code>%d</code>)", name, user.ID)
+}
+
+// parseExpiry parses durations like "7d", "12h" or "30m"
+func parseExpiry(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// describeInvite summarizes the limits and defaults of an invite
+func describeInvite(invite *storage.Invite) string {
+	message := fmt.Sprintf("<i>Uses:</i> %d of %d\n", invite.Uses(), invite.MaxUses)
+	if invite.ExpiresAt.IsZero() {
+		message += "<i>Expires:</i> never\n"
+	} else {
+		message += fmt.Sprintf("<i>Expires:</i> %s\n", invite.ExpiresAt.Format("Jan 2 15:04"))
+	}
+	if invite.Model != "" {
+		message += fmt.Sprintf("<i>Model:</i> <code>%s</code>\n", html.EscapeString(invite.Model))
+	}
+	if limits := invite.BudgetLimits; limits != nil {
+		message += fmt.Sprintf("<i>Budget:</i> $%.2f daily, $%.2f monthly\n", limits.Daily, limits.Monthly)
+	}
+	return message
+}
+
+// handleInviteCommand handles the admin /invite command, which creates an invite link
+func (b *Bot) handleInviteCommand(userID int64, args string) {
+	invite := &storage.Invite{
+		CreatedBy: userID,
+		CreatedAt: time.Now(),
+		MaxUses:   1,
+	}
+
+	usage := "<i>Usage:</i> <code>/invite [uses=N] [expires=7d] [model=name] [daily=USD] [monthly=USD]</code>\n\n"
+	usage += "Creates an invite link, single-use by default. Users who join with it get the model and budget given here."
+
+	var daily, monthly *float64
+	for _, field := range strings.Fields(args) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			b.sendMessage(userID, usage)
+			return
+		}
+
+		switch key {
+		case "uses":
+			uses, err := strconv.Atoi(value)
+			if err != nil || uses <= 0 {
+				b.sendMessage(userID, "❌ <code>uses</code> must be a positive number.")
+				return
+			}
+			invite.MaxUses = uses
+		case "expires":
+			expiry, err := parseExpiry(value)
+			if err != nil || expiry <= 0 {
+				b.sendMessage(userID, "❌ <code>expires</code> must be a duration like <code>7d</code> or <code>12h</code>.")
+				return
+			}
+			invite.ExpiresAt = invite.CreatedAt.Add(expiry)
+		case "model":
+			if !b.validateModel(userID, value) {
+				return
+			}
+			invite.Model = value
+		case "daily", "monthly":
+			limit, err := strconv.ParseFloat(value, 64)
+			if err != nil || limit < 0 {
+				b.sendMessage(userID, fmt.Sprintf("❌ <code>%s</code> must be an amount in USD, <code>0</code> for no limit.", key))
+				return
+			}
+			if key == "daily" {
+				daily = &limit
+			} else {
+				monthly = &limit
+			}
+		default:
+			b.sendMessage(userID, usage)
+			return
+		}
+	}
+
+	// A limit that isn't given stays at the configured default
+	if daily != nil || monthly != nil {
+		invite.BudgetLimits = &storage.BudgetLimits{Daily: b.config.Budget.UserDaily, Monthly: b.config.Budget.UserMonthly}
+		if daily != nil {
+			invite.BudgetLimits.Daily = *daily
+		}
+		if monthly != nil {
+			invite.BudgetLimits.Monthly = *monthly
+		}
+	}
+
+	code, err := newInviteCode()
+	if err != nil {
+		log.Errorf("Failed to generate invite code: %v", err)
+		b.sendMessage(userID, "Error creating the invite.")
+		return
+	}
+	invite.Code = code
+
+	if err := b.storage.CreateInvite(invite); err != nil {
+		log.Errorf("Failed to create invite: %v", err)
+		b.sendMessage(userID, "Error creating the invite.")
+		return
+	}
+	b.audit(userID, "invite", 0, strings.TrimSpace(code+" "+args))
+
+	message := "🎟 <i>Invite created</i>\n\n"
+	message += fmt.Sprintf("%s\n\n", b.inviteLink(code))
+	message += describeInvite(invite)
+	message += "\nShare the link; opening it starts the bot with the invite. Revoke it with <code>/revokeinvite " + code + "</code>."
+	b.sendMessage(userID, message)
+}
+
+// handleInvitesCommand handles the admin /invites command, which lists all invites
+func (b *Bot) handleInvitesCommand(userID int64) {
+	invites, err := b.storage.GetInvites()
+	if err != nil {
+		log.Errorf("Failed to get invites: %v", err)
+		b.sendMessage(userID, "Error retrieving the invites.")
+		return
+	}
+
+	message := "🎟 <i>Invites</i>\n\n"
+	if len(invites) == 0 {
+		message += "There are no invites. Create one with <code>/invite</code>."
+	}
+	now := time.Now()
+	for i := range invites {
+		invite := &invites[i]
+		status := "✅"
+		switch err := invite.Usable(now); {
+		case errors.Is(err, storage.ErrInviteExpired):
+			status = "⌛ expired"
+		case errors.Is(err, storage.ErrInviteUsedUp):
+			status = "☑️ used up"
+		}
+
+		message += fmt.Sprintf("<code>%s</code> %s\n%s", invite.Code, status, describeInvite(invite))
+		if len(invite.RedeemedBy) > 0 {
+			var users []string
+			for _, id := range invite.RedeemedBy {
+				users = append(users, fmt.Sprintf("<code>%d</code>", id))
+			}
+			message += "<i>Used by:</i> " + strings.Join(users, ", ") + "\n"
+		}
+		message += "\n"
+	}
+
+	b.sendMessageWithMode(userID, message, "HTML")
+}
+
+// handleRevokeInviteCommand handles the admin /revokeinvite command, which deletes an invite
+func (b *Bot) handleRevokeInviteCommand(userID int64, args string) {
+	code := strings.TrimSpace(args)
+	if code == "" {
+		b.sendMessage(userID, "<i>Usage:</i> <code>/revokeinvite code</code>")
+		return
+	}
+
+	err := b.storage.DeleteInvite(code)
+	if errors.Is(err, storage.ErrInviteNotFound) {
+		b.sendMessage(userID, "❌ Unknown invite code. Use /invites to list them.")
+		return
+	}
+	if err != nil {
+		log.Errorf("Failed to delete invite: %v", err)
+		b.sendMessage(userID, "Error revoking the invite.")
+		return
+	}
+	b.audit(userID, "revokeinvite", 0, code)
+
+	b.sendMessage(userID, fmt.Sprintf("🗑️ Invite <code>%s</code> revoked. Users who already joined keep their access.", html.EscapeString(code)))
+}
+
+// handleUnauthorizedStart handles /start from users without access: with an invite code it lets
+// them in, otherwise it explains how to get access
+func (b *Bot) handleUnauthorizedStart(message *tgbotapi.Message) {
+	if code := strings.TrimSpace(message.CommandArguments()); code != "" {
+		b.redeemInvite(message.From, code)
+		return
+	}
+
+	text := "🔒 <i>This bot is private.</i>\n\n"
+	if b.config.AccessRequests && len(b.config.Admins) > 0 {
+		text += "Ask an administrator for an invite link, or request access below."
+		b.sendMessageWithKeyboard(message.From.ID, text, "HTML", b.createAccessRequestKeyboard())
+		return
+	}
+	text += "Ask an administrator for an invite link."
+	b.sendMessage(message.From.ID, text)
+}
+
+// redeemInvite lets a user in with an invite code and applies the invite's defaults
+func (b *Bot) redeemInvite(user *tgbotapi.User, code string) {
+	invite, err := b.storage.RedeemInvite(code, user.ID)
+	switch {
+	case errors.Is(err, storage.ErrInviteNotFound):
+		log.Warnf("User %d (%s) tried invalid invite code %q", user.ID, user.UserName, code)
+		b.sendMessage(user.ID, "❌ This invite link is not valid. Please ask for a new one.")
+		return
+	case errors.Is(err, storage.ErrInviteExpired):
+		b.sendMessage(user.ID, "⌛ This invite link has expired. Please ask for a new one.")
+		return
+	case errors.Is(err, storage.ErrInviteUsedUp):
+		b.sendMessage(user.ID, "❌ This invite link has already been used. Please ask for a new one.")
+		return
+	case err != nil:
+		log.Errorf("Failed to redeem invite: %v", err)
+		b.sendMessage(user.ID, "Error redeeming the invite. Please try again later.")
+		return
+	}
+
+	if err := b.storage.SetAccess(user.ID, true); err != nil {
+		log.Errorf("Failed to allow user %d: %v", user.ID, err)
+		b.sendMessage(user.ID, "Error redeeming the invite. Please try again later.")
+		return
+	}
+	b.access.set(user.ID, true)
+	log.Infof("User %d (%s) joined with invite %s of admin %d", user.ID, user.UserName, invite.Code, invite.CreatedBy)
+
+	if invite.Model != "" {
+		if _, err := b.setModel(user.ID, invite.Model); err != nil {
+			log.Errorf("Failed to apply the invite model for user %d: %v", user.ID, err)
+		}
+	}
+	if invite.BudgetLimits != nil {
+		if err := b.setBudgetLimits(user.ID, invite.BudgetLimits); err != nil {
+			log.Errorf("Failed to apply the invite budget for user %d: %v", user.ID, err)
+		}
+	}
+
+	b.sendMessage(invite.CreatedBy, fmt.Sprintf("🎟 %s joined with invite <code>%s</code>.", userName(user), invite.Code))
+	b.handleStartCommand(user.ID)
+}
+
+// setBudgetLimits gives a user their own spending limits
+func (b *Bot) setBudgetLimits(userID int64, limits *storage.BudgetLimits) error {
+	settings, err := b.storage.GetUserSettings(userID)
+	if err != nil {
+		return err
+	}
+	settings.BudgetLimits = limits
+	return b.storage.SaveUserSettings(settings)
+}
+
+// handleAccessRequest forwards the access request of an unauthorized user to the admins
+func (b *Bot) handleAccessRequest(user *tgbotapi.User) {
+	if !b.config.AccessRequests || len(b.config.Admins) == 0 {
+		return
+	}
+
+	if !b.accessRequests.add(user.ID) {
+		b.sendMessage(user.ID, "⏳ You have already requested access. Please wait for an administrator to decide.")
+		return
+	}
+
+	log.Infof("User %d (%s) requested access", user.ID, user.UserName)
+	message := fmt.Sprintf("🙋 <i>Access request</i>\n\n%s would like to use the bot.", userName(user))
+	for _, adminID := range b.config.Admins {
+		if err := b.sendMessageWithKeyboard(adminID, message, "HTML", b.createAccessDecisionKeyboard(user.ID)); err != nil {
+			log.Warnf("Failed to send access request to admin %d: %v", adminID, err)
+		}
+	}
+
+	b.sendMessage(user.ID, "📨 Your request has been sent to the administrators. You'll get a message once they've decided.")
+}
+
+// handleAccessDecision approves or denies an access request from the buttons sent to admins
+func (b *Bot) handleAccessDecision(userID int64, messageID int, idStr string, approve bool) {
+	if !b.config.IsAdmin(userID) {
+		b.sendMessage(userID, "❌ This action is only available to administrators.")
+		return
+	}
+
+	targetID, ok := parseUserID(idStr)
+	if !ok {
+		return
+	}
+
+	var result string
+	switch {
+	case approve && b.isUserAllowed(targetID):
+		result = "ℹ️ This user can already use the bot."
+	case approve:
+		if err := b.storage.SetAccess(targetID, true); err != nil {
+			log.Errorf("Failed to allow user %d: %v", targetID, err)
+			b.sendMessage(userID, "Error saving the user's access.")
+			return
+		}
+		b.access.set(targetID, true)
+		b.audit(userID, "approve", targetID, "")
+		b.sendMessage(targetID, "✅ Your access request has been approved! Send /start to begin.")
+		result = "✅ Approved."
+	default:
+		b.audit(userID, "deny", targetID, "")
+		b.sendMessage(targetID, "❌ Your access request has been declined.")
+		result = "❌ Denied."
+	}
+	b.accessRequests.resolve(targetID, approve)
+
+	// Replace the buttons by the decision, so the request isn't answered twice from this message
+	edit := tgbotapi.NewEditMessageText(b.chatID(userID), messageID,
+		fmt.Sprintf("🙋 <i>Access request</i> of <code>%d</code>\n\n%s", targetID, result))
+	edit.ParseMode = "HTML"
+	if _, err := b.api.Send(edit); err != nil {
+		log.Debugf("Failed to update access request message: %v", err)
+	}
+}
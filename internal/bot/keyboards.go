@@ -1,7 +1,15 @@
 package bot
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"telegrambot/internal/openrouter"
+	"telegrambot/internal/storage"
 )
 
 // createMainMenuKeyboard creates the main menu inline keyboard
@@ -15,6 +23,10 @@ func (b *Bot) createMainMenuKeyboard() *tgbotapi.InlineKeyboardMarkup {
 			tgbotapi.NewInlineKeyboardButtonData("🤖 Models", "listmodels"),
 			tgbotapi.NewInlineKeyboardButtonData("📈 Status", "status"),
 		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("💬 Chats", "chats"),
+			tgbotapi.NewInlineKeyboardButtonData("🆕 New Chat", "conv_new"),
+		),
 		tgbotapi.NewInlineKeyboardRow(
 			tgbotapi.NewInlineKeyboardButtonData("🗑️ Clear History", "clear"),
 			tgbotapi.NewInlineKeyboardButtonData("❓ Help", "help"),
@@ -23,6 +35,48 @@ func (b *Bot) createMainMenuKeyboard() *tgbotapi.InlineKeyboardMarkup {
 	return &keyboard
 }
 
+// createExpensesKeyboard creates the keyboard shown below the usage statistics
+func (b *Bot) createExpensesKeyboard() *tgbotapi.InlineKeyboardMarkup {
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("💳 Budget", "budget"),
+			tgbotapi.NewInlineKeyboardButtonData("⬅️ Back to Menu", "back_to_menu"),
+		),
+	)
+	return &keyboard
+}
+
+// createStopKeyboard creates the keyboard that cancels a response while it is generated
+func (b *Bot) createStopKeyboard() *tgbotapi.InlineKeyboardMarkup {
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("⏹ Stop", "stop"),
+		),
+	)
+	return &keyboard
+}
+
+// createAccessRequestKeyboard creates the button unauthorized users ask for access with
+func (b *Bot) createAccessRequestKeyboard() *tgbotapi.InlineKeyboardMarkup {
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🙋 Request access", "access_request"),
+		),
+	)
+	return &keyboard
+}
+
+// createAccessDecisionKeyboard creates the buttons admins approve or deny an access request with
+func (b *Bot) createAccessDecisionKeyboard(userID int64) *tgbotapi.InlineKeyboardMarkup {
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Approve", fmt.Sprintf("access_approve_%d", userID)),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Deny", fmt.Sprintf("access_deny_%d", userID)),
+		),
+	)
+	return &keyboard
+}
+
 // createSettingsKeyboard creates the settings menu keyboard
 func (b *Bot) createSettingsKeyboard() *tgbotapi.InlineKeyboardMarkup {
 	keyboard := tgbotapi.NewInlineKeyboardMarkup(
@@ -32,6 +86,10 @@ func (b *Bot) createSettingsKeyboard() *tgbotapi.InlineKeyboardMarkup {
 		),
 		tgbotapi.NewInlineKeyboardRow(
 			tgbotapi.NewInlineKeyboardButtonData("➕ Add Custom Model", "add_model"),
+			tgbotapi.NewInlineKeyboardButtonData("🎭 Personas", "personas"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🎛️ Parameters", "params"),
 		),
 		tgbotapi.NewInlineKeyboardRow(
 			tgbotapi.NewInlineKeyboardButtonData("⬅️ Back to Menu", "back_to_menu"),
@@ -56,38 +114,142 @@ func (b *Bot) createChatModeKeyboard() *tgbotapi.InlineKeyboardMarkup {
 	return &keyboard
 }
 
+const (
+	// maxCallbackDataLength is the maximum size of inline button callback data allowed by Telegram
+	maxCallbackDataLength = 64
+
+	// maxCallbackValues is the number of values kept for buttons whose data would be too long
+	maxCallbackValues = 1000
+
+	// callbackValuePrefix marks a reference to a stored value in callback data
+	callbackValuePrefix = "#"
+)
+
+// callbackValues keeps search queries and model IDs that don't fit into callback data,
+// so buttons can refer to them by a short reference. The oldest are dropped first and
+// all are lost on a restart, which makes their buttons expire.
+type callbackValues struct {
+	mutex  sync.Mutex
+	values map[string]string
+	refs   map[string]string
+	order  []string
+	next   uint64
+}
+
+// newCallbackValues creates an empty store
+func newCallbackValues() *callbackValues {
+	return &callbackValues{
+		values: make(map[string]string),
+		refs:   make(map[string]string),
+	}
+}
+
+// ref returns the reference of a value, storing it if it isn't known yet
+func (c *callbackValues) ref(value string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if ref, ok := c.refs[value]; ok {
+		return ref
+	}
+
+	if len(c.order) >= maxCallbackValues {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		delete(c.refs, c.values[oldest])
+		delete(c.values, oldest)
+	}
+
+	c.next++
+	ref := callbackValuePrefix + strconv.FormatUint(c.next, 36)
+	c.values[ref] = value
+	c.refs[value] = ref
+	c.order = append(c.order, ref)
+	return ref
+}
+
+// value returns the value of a reference; false if it has been dropped
+func (c *callbackValues) value(ref string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	value, ok := c.values[ref]
+	return value, ok
+}
+
+// modelCallbackData returns the data of a button that selects a model. Model IDs that are too long
+// for callback data are stored and referred to.
+func (b *Bot) modelCallbackData(modelID string) string {
+	if data := "model_" + modelID; len(data) <= maxCallbackDataLength && !strings.HasPrefix(modelID, callbackValuePrefix) {
+		return data
+	}
+	return "model_" + b.callbackValues.ref(modelID)
+}
+
 // createModelSelectionKeyboard creates a model selection keyboard with popular models
 func (b *Bot) createModelSelectionKeyboard() *tgbotapi.InlineKeyboardMarkup {
 	// Popular models with shortened display names
-	models := []struct {
-		display string
-		value   string
-	}{
-		{"GPT-4", "openai/gpt-4"},
-		{"GPT-3.5 Turbo", "openai/gpt-3.5-turbo"},
-		{"Claude Sonnet", "anthropic/claude-3-sonnet"},
-		{"Gemini Pro", "google/gemini-pro"},
-		{"Mistral 7B", "mistralai/mistral-7b-instruct"},
-		{"Llama 2 70B", "meta-llama/llama-2-70b-chat"},
-	}
+	models := b.popularModels()
 
 	var rows [][]tgbotapi.InlineKeyboardButton
 
 	// Create rows of 2 buttons each
 	for i := 0; i < len(models); i += 2 {
 		var row []tgbotapi.InlineKeyboardButton
-		row = append(row, tgbotapi.NewInlineKeyboardButtonData(models[i].display, "model_"+models[i].value))
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(models[i].display, b.modelCallbackData(models[i].value)))
 
 		if i+1 < len(models) {
-			row = append(row, tgbotapi.NewInlineKeyboardButtonData(models[i+1].display, "model_"+models[i+1].value))
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData(models[i+1].display, b.modelCallbackData(models[i+1].value)))
 		}
 		rows = append(rows, row)
 	}
 
 	// Add navigation buttons
 	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
-		tgbotapi.NewInlineKeyboardButtonData("📋 All Models", "listmodels"),
+		tgbotapi.NewInlineKeyboardButtonData("🔎 Browse All", "models_page_0"),
+		tgbotapi.NewInlineKeyboardButtonData("📋 My Models", "listmodels"),
+	))
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("⬅️ Back to Settings", "settings"),
 	))
+
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return &keyboard
+}
+
+// createModelBrowserKeyboard creates the keyboard for one page of the model browser
+func (b *Bot) createModelBrowserKeyboard(models []openrouter.Model, page, totalPages int, query string) *tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+
+	for _, model := range models {
+		label := fmt.Sprintf("%s · %s", shortModelName(model), formatModelPrice(model))
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(label, b.modelCallbackData(model.ID)),
+		))
+	}
+
+	// Page navigation keeps the search query in the callback data, or a reference to a long one
+	if len(fmt.Sprintf("models_page_%d_%s", totalPages, query)) > maxCallbackDataLength || strings.HasPrefix(query, callbackValuePrefix) {
+		query = b.callbackValues.ref(query)
+	}
+	pageData := func(p int) string {
+		data := fmt.Sprintf("models_page_%d", p)
+		if query != "" {
+			data += "_" + query
+		}
+		return data
+	}
+
+	var navigation []tgbotapi.InlineKeyboardButton
+	if page > 0 {
+		navigation = append(navigation, tgbotapi.NewInlineKeyboardButtonData("◀️ Prev", pageData(page-1)))
+	}
+	navigation = append(navigation, tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%d/%d", page+1, totalPages), pageData(page)))
+	if page < totalPages-1 {
+		navigation = append(navigation, tgbotapi.NewInlineKeyboardButtonData("Next ▶️", pageData(page+1)))
+	}
+	rows = append(rows, navigation)
+
 	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
 		tgbotapi.NewInlineKeyboardButtonData("⬅️ Back to Settings", "settings"),
 	))
@@ -96,6 +258,30 @@ func (b *Bot) createModelSelectionKeyboard() *tgbotapi.InlineKeyboardMarkup {
 	return &keyboard
 }
 
+// createConversationsKeyboard creates a keyboard listing conversations with their last activity
+func (b *Bot) createConversationsKeyboard(conversations []storage.Conversation, activeID int64) *tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+
+	for _, conversation := range conversations {
+		label := fmt.Sprintf("%s · %s", conversation.Title, formatRelativeTime(conversation.LastActivity))
+		if conversation.ID == activeID {
+			label = "✅ " + label
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(label, fmt.Sprintf("conv_switch_%d", conversation.ID)),
+		))
+	}
+
+	// Add navigation buttons
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🆕 New Chat", "conv_new"),
+		tgbotapi.NewInlineKeyboardButtonData("⬅️ Back to Menu", "back_to_menu"),
+	))
+
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return &keyboard
+}
+
 // createConfirmationKeyboard creates a yes/no confirmation keyboard
 func (b *Bot) createConfirmationKeyboard(action string) *tgbotapi.InlineKeyboardMarkup {
 	keyboard := tgbotapi.NewInlineKeyboardMarkup(
@@ -107,6 +293,59 @@ func (b *Bot) createConfirmationKeyboard(action string) *tgbotapi.InlineKeyboard
 	return &keyboard
 }
 
+// createParamsKeyboard creates the generation parameter presets keyboard
+func (b *Bot) createParamsKeyboard() *tgbotapi.InlineKeyboardMarkup {
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🎯 Precise", "params_set_temperature_0.2"),
+			tgbotapi.NewInlineKeyboardButtonData("⚖️ Balanced", "params_set_temperature_0.7"),
+			tgbotapi.NewInlineKeyboardButtonData("🎨 Creative", "params_set_temperature_1.2"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("📏 1K tokens", "params_set_max_tokens_1000"),
+			tgbotapi.NewInlineKeyboardButtonData("📏 4K tokens", "params_set_max_tokens_4000"),
+			tgbotapi.NewInlineKeyboardButtonData("📏 16K tokens", "params_set_max_tokens_16000"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("♻️ Reset All", "params_reset"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("⬅️ Back to Settings", "settings"),
+		),
+	)
+	return &keyboard
+}
+
+// createPersonasKeyboard creates buttons to select a persona for the active conversation
+func (b *Bot) createPersonasKeyboard(names []string, active string) *tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+
+	// Create rows of 2 buttons each
+	for i := 0; i < len(names); i += 2 {
+		var row []tgbotapi.InlineKeyboardButton
+		for _, name := range names[i:min(i+2, len(names))] {
+			label := "🎭 " + name
+			if name == active {
+				label = "✅ " + name
+			}
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData(label, "persona_use_"+name))
+		}
+		rows = append(rows, row)
+	}
+
+	if active != "" {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🚫 No Persona", "persona_off"),
+		))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("⬅️ Back to Menu", "back_to_menu"),
+	))
+
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return &keyboard
+}
+
 // createBackToMenuKeyboard creates a simple back to menu button
 func (b *Bot) createBackToMenuKeyboard() *tgbotapi.InlineKeyboardMarkup {
 	keyboard := tgbotapi.NewInlineKeyboardMarkup(
@@ -22,7 +22,7 @@ func (b *Bot) handleChatModeMenu(userID int64) {
 	}
 
 	message := "💬 <i>Chat Mode Settings</i>\n\n"
-	message += fmt.Sprintf("<i>Current mode:</i> <code>%s</code>\n\n", settings.ChatMode)
+	message += fmt.Sprintf("<i>Current mode:</i> <code>%s</code>\n\n", settings.ActiveChatMode())
 	message += "<i>Available modes:</i>\n"
 	message += "• <b>With History</b> - AI remembers previous messages\n"
 	message += "• <b>Without History</b> - Each message is independent\n\n"
@@ -41,8 +41,8 @@ func (b *Bot) handleModelSelectionMenu(userID int64) {
 	}
 
 	message := "🤖 <i>Model Selection</i>\n\n"
-	message += fmt.Sprintf("<i>Current model:</i> <code>%s</code>\n\n", settings.CurrentModel)
-	message += "Choose from popular models or view all available models:"
+	message += fmt.Sprintf("<i>Current model:</i> <code>%s</code>\n\n", settings.ActiveModel())
+	message += "Choose from popular models or browse the full OpenRouter catalog:"
 
 	keyboard := b.createModelSelectionKeyboard()
 	b.sendMessageWithKeyboard(userID, message, "HTML", keyboard)
@@ -64,10 +64,10 @@ func (b *Bot) handleAddModelPrompt(userID int64) {
 	message += "To add a custom model, use this command format:\n"
 	message += "<code>/addmodel provider/model-name</code>\n\n"
 	message += "<i>Examples:</i>\n"
-	message += "• <code>/addmodel mistralai/mistral-7b-instruct</code>\n"
-	message += "• <code>/addmodel meta-llama/llama-2-70b-chat</code>\n"
+	message += "• <code>/addmodel mistralai/mistral-large</code>\n"
+	message += "• <code>/addmodel meta-llama/llama-3.1-405b-instruct</code>\n"
 	message += "• <code>/addmodel cohere/command-r-plus</code>\n\n"
-	message += "<i>Note:</i> Make sure the model is available on OpenRouter."
+	message += "<i>Note:</i> The model must be available on OpenRouter. Use /models to search the catalog."
 
 	keyboard := b.createBackToMenuKeyboard()
 	b.sendMessageWithKeyboard(userID, message, "HTML", keyboard)
@@ -0,0 +1,219 @@
+package bot
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+
+	"telegrambot/internal/openrouter"
+)
+
+// modelsPerPage is the number of models shown on one page of the model browser
+const modelsPerPage = 8
+
+// popularModel is a model suggested in menus
+type popularModel struct {
+	display string
+	value   string
+}
+
+// popularModels returns the configured popular models that exist in the catalog.
+// If the catalog can't be loaded, the configured list is returned unchanged.
+func (b *Bot) popularModels() []popularModel {
+	catalog, err := b.llmClient.ListModels()
+	if err != nil {
+		log.Warnf("Failed to load model catalog: %v", err)
+	}
+
+	byID := make(map[string]openrouter.Model, len(catalog))
+	for _, model := range catalog {
+		byID[model.ID] = model
+	}
+
+	var models []popularModel
+	for _, id := range b.config.PopularModels {
+		if catalog == nil {
+			models = append(models, popularModel{display: id, value: id})
+			continue
+		}
+
+		model, ok := byID[id]
+		if !ok {
+			log.Warnf("Popular model %s is not in the OpenRouter catalog", id)
+			continue
+		}
+		models = append(models, popularModel{display: shortModelName(model), value: id})
+	}
+	return models
+}
+
+// validateModel checks a model ID against the catalog and tells the user about unknown IDs,
+// suggesting similar ones. If the catalog is unavailable the model is accepted.
+func (b *Bot) validateModel(userID int64, modelID string) bool {
+	catalog, err := b.llmClient.ListModels()
+	if err != nil {
+		log.Warnf("Failed to load model catalog, skipping validation of %s: %v", modelID, err)
+		return true
+	}
+
+	for _, model := range catalog {
+		if model.ID == modelID {
+			return true
+		}
+	}
+
+	message := fmt.Sprintf("❌ Unknown model: <code>%s</code>\n\n", html.EscapeString(modelID))
+
+	suggestions := openrouter.SuggestModels(catalog, modelID, 5)
+	if len(suggestions) == 0 {
+		message += "Use /models to browse or search the available models."
+		b.sendMessage(userID, message)
+		return false
+	}
+
+	message += "<i>Did you mean:</i>\n"
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, suggestion := range suggestions {
+		message += fmt.Sprintf("• <code>%s</code>\n", suggestion)
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(suggestion, b.modelCallbackData(suggestion)),
+		))
+	}
+
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	b.sendMessageWithKeyboard(userID, message, "HTML", &keyboard)
+	return false
+}
+
+// handleModelsCommand handles the /models command (searchable model browser)
+func (b *Bot) handleModelsCommand(userID int64, query string) {
+	text, keyboard, err := b.renderModelBrowser(userID, 0, strings.TrimSpace(query))
+	if err != nil {
+		log.Errorf("Failed to load model catalog: %v", err)
+		b.sendMessage(userID, "Error loading the model catalog from OpenRouter. Please try again later.")
+		return
+	}
+
+	b.sendMessageWithKeyboard(userID, text, "HTML", keyboard)
+}
+
+// handleModelsPage shows another page of the model browser by editing the existing message
+func (b *Bot) handleModelsPage(userID int64, messageID int, data string) {
+	// Format: <page>, <page>_<query> or <page>_<reference to a long query>
+	pageText, query, _ := strings.Cut(data, "_")
+	page, err := strconv.Atoi(pageText)
+	if err != nil {
+		page = 0
+	}
+	if strings.HasPrefix(query, callbackValuePrefix) {
+		var ok bool
+		if query, ok = b.callbackValues.value(query); !ok {
+			b.sendMessage(userID, "⌛ This search has expired. Please search again with /models.")
+			return
+		}
+	}
+
+	text, keyboard, err := b.renderModelBrowser(userID, page, query)
+	if err != nil {
+		log.Errorf("Failed to load model catalog: %v", err)
+		b.sendMessage(userID, "Error loading the model catalog from OpenRouter. Please try again later.")
+		return
+	}
+
+	b.editMessageWithKeyboard(userID, messageID, text, keyboard)
+}
+
+// renderModelBrowser builds the text and keyboard for one page of the model browser
+func (b *Bot) renderModelBrowser(userID int64, page int, query string) (string, *tgbotapi.InlineKeyboardMarkup, error) {
+	catalog, err := b.llmClient.ListModels()
+	if err != nil {
+		return "", nil, err
+	}
+
+	currentModel := ""
+	if settings, err := b.storage.GetUserSettings(userID); err == nil {
+		currentModel = settings.ActiveModel()
+	}
+
+	models := openrouter.SearchModels(catalog, query)
+
+	totalPages := (len(models) + modelsPerPage - 1) / modelsPerPage
+	if page >= totalPages {
+		page = totalPages - 1
+	}
+	if page < 0 {
+		page = 0
+	}
+
+	message := "🔎 <i>Model Browser</i>\n\n"
+	if query != "" {
+		message += fmt.Sprintf("<i>Search:</i> <code>%s</code> — %d matches\n\n", html.EscapeString(query), len(models))
+	} else {
+		message += fmt.Sprintf("%d models available on OpenRouter.\n\n", len(models))
+	}
+
+	if len(models) == 0 {
+		message += "No models found. Try a different search, e.g. <code>/models claude</code>"
+		keyboard := b.createBackToMenuKeyboard()
+		return message, keyboard, nil
+	}
+
+	start := page * modelsPerPage
+	end := min(start+modelsPerPage, len(models))
+	pageModels := models[start:end]
+
+	for _, model := range pageModels {
+		marker := "•"
+		if model.ID == currentModel {
+			marker = "✅"
+		}
+		message += fmt.Sprintf("%s <b>%s</b>\n   <code>%s</code>\n   %s context, %s\n",
+			marker,
+			html.EscapeString(model.Name),
+			model.ID,
+			formatTokenCount(model.ContextLength),
+			formatModelPrice(model))
+	}
+
+	message += "\n<i>Search:</i> <code>/models query</code> — tap a button to select a model."
+
+	keyboard := b.createModelBrowserKeyboard(pageModels, page, totalPages, query)
+	return message, keyboard, nil
+}
+
+// shortModelName returns a compact display name for buttons
+func shortModelName(model openrouter.Model) string {
+	name := model.Name
+	if name == "" {
+		return model.ID
+	}
+	// Names look like "OpenAI: GPT-4o", the provider is redundant on buttons
+	if _, after, found := strings.Cut(name, ": "); found {
+		name = after
+	}
+	return name
+}
+
+// formatModelPrice formats the prompt and completion prices per million tokens
+func formatModelPrice(model openrouter.Model) string {
+	if model.IsFree() {
+		return "free"
+	}
+	return fmt.Sprintf("$%.2f/M in, $%.2f/M out", model.PromptPrice*1_000_000, model.CompletionPrice*1_000_000)
+}
+
+// formatTokenCount formats a token count compactly, e.g. 128K or 1M
+func formatTokenCount(tokens int) string {
+	switch {
+	case tokens >= 1_000_000 && tokens%1_000_000 == 0:
+		return fmt.Sprintf("%dM", tokens/1_000_000)
+	case tokens >= 1000:
+		return fmt.Sprintf("%dK", tokens/1000)
+	default:
+		return strconv.Itoa(tokens)
+	}
+}
@@ -0,0 +1,345 @@
+package bot
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"telegrambot/internal/storage"
+)
+
+// maxStopSequences is the number of stop sequences accepted by OpenAI-compatible APIs
+const maxStopSequences = 4
+
+// generationParam describes a generation parameter that can be changed with /params
+type generationParam struct {
+	name        string
+	description string
+	// set parses, validates and stores a value
+	set func(params *storage.GenerationParams, value string) error
+	// reset removes the value, so the model's default applies
+	reset func(params *storage.GenerationParams)
+	// format returns the current value, or "" if it isn't set
+	format func(params storage.GenerationParams) string
+}
+
+// generationParams lists the parameters in the order they are shown
+var generationParams = []generationParam{
+	{
+		name:        "temperature",
+		description: "randomness, 0-2",
+		set: func(p *storage.GenerationParams, value string) (err error) {
+			p.Temperature, err = parseFloatParam(value, 0, 2)
+			return err
+		},
+		reset:  func(p *storage.GenerationParams) { p.Temperature = nil },
+		format: func(p storage.GenerationParams) string { return formatFloatParam(p.Temperature) },
+	},
+	{
+		name:        "top_p",
+		description: "nucleus sampling, 0-1",
+		set: func(p *storage.GenerationParams, value string) (err error) {
+			p.TopP, err = parseFloatParam(value, 0, 1)
+			return err
+		},
+		reset:  func(p *storage.GenerationParams) { p.TopP = nil },
+		format: func(p storage.GenerationParams) string { return formatFloatParam(p.TopP) },
+	},
+	{
+		name:        "max_tokens",
+		description: "answer length limit",
+		set: func(p *storage.GenerationParams, value string) error {
+			tokens, err := strconv.Atoi(value)
+			if err != nil || tokens < 1 {
+				return fmt.Errorf("must be a positive whole number")
+			}
+			p.MaxTokens = &tokens
+			return nil
+		},
+		reset: func(p *storage.GenerationParams) { p.MaxTokens = nil },
+		format: func(p storage.GenerationParams) string {
+			if p.MaxTokens == nil {
+				return ""
+			}
+			return strconv.Itoa(*p.MaxTokens)
+		},
+	},
+	{
+		name:        "frequency_penalty",
+		description: "discourage repeated tokens, -2 to 2",
+		set: func(p *storage.GenerationParams, value string) (err error) {
+			p.FrequencyPenalty, err = parseFloatParam(value, -2, 2)
+			return err
+		},
+		reset:  func(p *storage.GenerationParams) { p.FrequencyPenalty = nil },
+		format: func(p storage.GenerationParams) string { return formatFloatParam(p.FrequencyPenalty) },
+	},
+	{
+		name:        "presence_penalty",
+		description: "encourage new topics, -2 to 2",
+		set: func(p *storage.GenerationParams, value string) (err error) {
+			p.PresencePenalty, err = parseFloatParam(value, -2, 2)
+			return err
+		},
+		reset:  func(p *storage.GenerationParams) { p.PresencePenalty = nil },
+		format: func(p storage.GenerationParams) string { return formatFloatParam(p.PresencePenalty) },
+	},
+	{
+		name:        "seed",
+		description: "for reproducible answers",
+		set: func(p *storage.GenerationParams, value string) error {
+			seed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("must be a whole number")
+			}
+			p.Seed = &seed
+			return nil
+		},
+		reset: func(p *storage.GenerationParams) { p.Seed = nil },
+		format: func(p storage.GenerationParams) string {
+			if p.Seed == nil {
+				return ""
+			}
+			return strconv.FormatInt(*p.Seed, 10)
+		},
+	},
+	{
+		name:        "stop",
+		description: "stop sequences separated by |",
+		set: func(p *storage.GenerationParams, value string) error {
+			var sequences []string
+			for _, sequence := range strings.Split(value, "|") {
+				if sequence = strings.TrimSpace(sequence); sequence != "" {
+					sequences = append(sequences, sequence)
+				}
+			}
+			if len(sequences) == 0 || len(sequences) > maxStopSequences {
+				return fmt.Errorf("must be 1 to %d sequences separated by |", maxStopSequences)
+			}
+			p.Stop = sequences
+			return nil
+		},
+		reset:  func(p *storage.GenerationParams) { p.Stop = nil },
+		format: func(p storage.GenerationParams) string { return strings.Join(p.Stop, " | ") },
+	},
+}
+
+// findGenerationParam looks up a parameter by name
+func findGenerationParam(name string) *generationParam {
+	for i := range generationParams {
+		if generationParams[i].name == name {
+			return &generationParams[i]
+		}
+	}
+	return nil
+}
+
+// parseFloatParam parses a number and checks that it is within [min, max]
+func parseFloatParam(value string, min, max float64) (*float64, error) {
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < min || number > max {
+		return nil, fmt.Errorf("must be a number from %g to %g", min, max)
+	}
+	return &number, nil
+}
+
+// formatFloatParam formats an optional number
+func formatFloatParam(value *float64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'g', -1, 64)
+}
+
+// effectiveParams returns the generation parameters for a request to model: the user's parameters
+// with the overrides of the active conversation, with max_tokens capped to the model's limit
+func (b *Bot) effectiveParams(settings *storage.UserSettings, model string) storage.GenerationParams {
+	params := settings.Params.Merge(settings.ActiveConversation().Params)
+
+	if params.MaxTokens != nil {
+		if info, err := b.llmClient.GetModel(model); err == nil && info != nil {
+			if limit := info.MaxOutputTokens(); limit > 0 && *params.MaxTokens > limit {
+				log.Infof("Capping max_tokens of user %d from %d to %d for %s", settings.UserID, *params.MaxTokens, limit, model)
+				params.MaxTokens = &limit
+			}
+		}
+	}
+
+	return params
+}
+
+// handleParamsCommand handles the /params command.
+//
+//	/params                          show parameters
+//	/params <name> <value|reset>     change a parameter for all conversations
+//	/params chat <name> <value|reset> change a parameter for the current conversation
+//	/params [chat] reset             reset all parameters
+func (b *Bot) handleParamsCommand(userID int64, args string) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		b.handleParamsMenu(userID)
+		return
+	}
+
+	conversationOnly := false
+	if strings.EqualFold(fields[0], "chat") {
+		conversationOnly = true
+		fields = fields[1:]
+	}
+
+	switch {
+	case len(fields) == 1 && strings.EqualFold(fields[0], "reset"):
+		b.updateParams(userID, conversationOnly, func(params *storage.GenerationParams) error {
+			*params = storage.GenerationParams{}
+			return nil
+		}, "♻️ All parameters reset to the model defaults.")
+	case len(fields) >= 2:
+		b.handleSetParam(userID, conversationOnly, strings.ToLower(fields[0]), strings.Join(fields[1:], " "))
+	default:
+		b.sendMessage(userID, paramsUsage())
+	}
+}
+
+// paramsUsage returns the help text of the /params command
+func paramsUsage() string {
+	message := "🎛️ <i>Generation Parameters</i>\n\n"
+	message += "<code>/params name value</code> - set for all conversations\n"
+	message += "<code>/params chat name value</code> - set for this conversation only\n"
+	message += "<code>/params name reset</code> - use the default again\n"
+	message += "<code>/params reset</code> - reset everything\n\n"
+	message += "<i>Parameters:</i>\n"
+	for _, param := range generationParams {
+		message += fmt.Sprintf("• <code>%s</code> - %s\n", param.name, param.description)
+	}
+	message += "\n<i>Example:</i> <code>/params temperature 0.2</code>"
+	return message
+}
+
+// handleSetParam validates and stores a single parameter
+func (b *Bot) handleSetParam(userID int64, conversationOnly bool, name, value string) {
+	param := findGenerationParam(name)
+	if param == nil {
+		b.sendMessage(userID, fmt.Sprintf("❌ Unknown parameter <code>%s</code>.\n\n%s", html.EscapeString(name), paramsUsage()))
+		return
+	}
+
+	if strings.EqualFold(value, "reset") {
+		b.updateParams(userID, conversationOnly, func(params *storage.GenerationParams) error {
+			param.reset(params)
+			return nil
+		}, fmt.Sprintf("♻️ <code>%s</code> reset to the model default.", param.name))
+		return
+	}
+
+	settings, err := b.storage.GetUserSettings(userID)
+	if err != nil {
+		log.Errorf("Failed to get user settings: %v", err)
+		b.sendMessage(userID, "Error retrieving your settings.")
+		return
+	}
+
+	var parsed storage.GenerationParams
+	if err := param.set(&parsed, value); err != nil {
+		b.sendMessage(userID, fmt.Sprintf("❌ <code>%s</code> %s.", param.name, err))
+		return
+	}
+
+	// Check the value against the current model
+	model := settings.ActiveModel()
+	var warning string
+	if info, err := b.llmClient.GetModel(model); err == nil && info != nil {
+		if limit := info.MaxOutputTokens(); parsed.MaxTokens != nil && limit > 0 && *parsed.MaxTokens > limit {
+			b.sendMessage(userID, fmt.Sprintf("❌ <code>%s</code> allows at most %d tokens per answer.", model, limit))
+			return
+		}
+		if !info.SupportsParameter(param.name) {
+			warning = fmt.Sprintf("\n\n⚠️ <code>%s</code> ignores this parameter.", model)
+		}
+	}
+
+	b.updateParams(userID, conversationOnly, func(params *storage.GenerationParams) error {
+		return param.set(params, value)
+	}, fmt.Sprintf("✅ <code>%s</code> set to <code>%s</code>.%s", param.name, html.EscapeString(param.format(parsed)), warning))
+}
+
+// updateParams applies a change to the user's or the active conversation's parameters and confirms it
+func (b *Bot) updateParams(userID int64, conversationOnly bool, change func(params *storage.GenerationParams) error, confirmation string) {
+	settings, err := b.storage.GetUserSettings(userID)
+	if err != nil {
+		log.Errorf("Failed to get user settings: %v", err)
+		b.sendMessage(userID, "Error retrieving your settings.")
+		return
+	}
+
+	if conversationOnly {
+		conversation := settings.ActiveConversation()
+		if err := change(&conversation.Params); err != nil {
+			b.sendMessage(userID, fmt.Sprintf("❌ %s", err))
+			return
+		}
+		if err := b.storage.UpdateConversation(userID, conversation); err != nil {
+			log.Errorf("Failed to update conversation: %v", err)
+			b.sendMessage(userID, "Error saving your settings.")
+			return
+		}
+		confirmation += fmt.Sprintf("\n<i>Applies to:</i> %s", html.EscapeString(conversation.Title))
+	} else {
+		if err := change(&settings.Params); err != nil {
+			b.sendMessage(userID, fmt.Sprintf("❌ %s", err))
+			return
+		}
+		if err := b.storage.SaveUserSettings(settings); err != nil {
+			log.Errorf("Failed to save user settings: %v", err)
+			b.sendMessage(userID, "Error saving your settings.")
+			return
+		}
+	}
+
+	keyboard := b.createParamsKeyboard()
+	b.sendMessageWithKeyboard(userID, confirmation, "HTML", keyboard)
+}
+
+// handleParamsMenu shows the current generation parameters
+func (b *Bot) handleParamsMenu(userID int64) {
+	settings, err := b.storage.GetUserSettings(userID)
+	if err != nil {
+		log.Errorf("Failed to get user settings: %v", err)
+		b.sendMessage(userID, "Error retrieving your settings.")
+		return
+	}
+
+	conversation := settings.ActiveConversation()
+	effective := b.effectiveParams(settings, settings.ActiveModel())
+
+	message := "🎛️ <i>Generation Parameters</i>\n\n"
+	message += fmt.Sprintf("<i>Model:</i> <code>%s</code>\n\n", settings.ActiveModel())
+	for _, param := range generationParams {
+		value := param.format(effective)
+		if value == "" {
+			value = "default"
+		}
+		line := fmt.Sprintf("• <code>%s</code>: %s", param.name, html.EscapeString(value))
+		if param.format(conversation.Params) != "" {
+			line += " <i>(this conversation)</i>"
+		}
+		message += line + "\n"
+	}
+
+	message += "\nUse the presets below or <code>/params name value</code>. Send <code>/params help</code> for all options."
+
+	keyboard := b.createParamsKeyboard()
+	b.sendMessageWithKeyboard(userID, message, "HTML", keyboard)
+}
+
+// handleParamsPreset applies a preset button; data has the form <name>_<value>
+func (b *Bot) handleParamsPreset(userID int64, data string) {
+	separator := strings.LastIndex(data, "_")
+	if separator <= 0 {
+		b.sendMessage(userID, "Unknown button action. Please try again.")
+		return
+	}
+	b.handleSetParam(userID, false, data[:separator], data[separator+1:])
+}
@@ -0,0 +1,335 @@
+package bot
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+
+	"telegrambot/internal/storage"
+)
+
+const (
+	// maxPersonas is the number of personas a user can define
+	maxPersonas = 20
+
+	// maxSystemPromptLength limits custom system prompts and persona prompts (in characters)
+	maxSystemPromptLength = 4000
+)
+
+// personaNamePattern matches valid persona names; they are used in commands and callback data
+var personaNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// findPersona looks up a persona by name, preferring the user's own over global ones
+func (b *Bot) findPersona(settings *storage.UserSettings, name string) (*storage.Persona, bool) {
+	for i := range settings.Personas {
+		if strings.EqualFold(settings.Personas[i].Name, name) {
+			return &settings.Personas[i], false
+		}
+	}
+	for _, persona := range b.config.Personas {
+		if strings.EqualFold(persona.Name, name) {
+			return &storage.Persona{Name: strings.ToLower(persona.Name), Prompt: persona.Prompt}, true
+		}
+	}
+	return nil, false
+}
+
+// buildSystemPrompt composes the system message for the active conversation:
+// its persona or custom system prompt followed by the HTML formatting instructions
+func (b *Bot) buildSystemPrompt(settings *storage.UserSettings) string {
+	conversation := settings.ActiveConversation()
+
+	prompt := conversation.SystemPrompt
+	if conversation.Persona != "" {
+		if persona, _ := b.findPersona(settings, conversation.Persona); persona != nil {
+			prompt = persona.Prompt
+		} else {
+			log.Warnf("Persona %s of user %d no longer exists", conversation.Persona, settings.UserID)
+		}
+	}
+
+	if prompt == "" {
+		return b.createDefaultSystemMessage()
+	}
+	return prompt + "\n\n" + markdownFormattingRules
+}
+
+// handlePersonaCommand handles the /persona command and its subcommands
+func (b *Bot) handlePersonaCommand(userID int64, args string) {
+	subcommand, rest, _ := strings.Cut(strings.TrimSpace(args), " ")
+	rest = strings.TrimSpace(rest)
+
+	switch strings.ToLower(subcommand) {
+	case "", "list":
+		b.handlePersonaList(userID)
+	case "add":
+		b.handlePersonaAdd(userID, rest)
+	case "use":
+		b.handlePersonaUse(userID, rest)
+	case "off", "none":
+		b.handlePersonaUse(userID, "")
+	case "delete", "remove":
+		b.handlePersonaDelete(userID, rest)
+	default:
+		b.sendMessage(userID, personaUsage())
+	}
+}
+
+// personaUsage returns the help text of the /persona command
+func personaUsage() string {
+	message := "🎭 <i>Personas</i>\n\n"
+	message += "<code>/persona list</code> - show all personas\n"
+	message += "<code>/persona add name prompt</code> - create or replace a persona\n"
+	message += "<code>/persona use name</code> - use a persona in this conversation\n"
+	message += "<code>/persona off</code> - stop using a persona\n"
+	message += "<code>/persona delete name</code> - delete one of your personas\n\n"
+	message += "<i>Example:</i> <code>/persona add translator Translate everything I write into English.</code>"
+	return message
+}
+
+// handlePersonaList shows the user's and the global personas
+func (b *Bot) handlePersonaList(userID int64) {
+	settings, err := b.storage.GetUserSettings(userID)
+	if err != nil {
+		log.Errorf("Failed to get user settings: %v", err)
+		b.sendMessage(userID, "Error retrieving your settings.")
+		return
+	}
+
+	active := strings.ToLower(settings.ActiveConversation().Persona)
+
+	var names []string
+	formatPersona := func(name, prompt string) string {
+		names = append(names, name)
+		marker := "•"
+		if name == active {
+			marker = "✅"
+		}
+		return fmt.Sprintf("%s <b>%s</b>: <i>%s</i>\n", marker, html.EscapeString(name), html.EscapeString(truncateText(prompt, 80)))
+	}
+
+	message := "🎭 <i>Personas</i>\n\n"
+	if len(settings.Personas) > 0 {
+		message += "<i>Your personas:</i>\n"
+		for _, persona := range settings.Personas {
+			message += formatPersona(persona.Name, persona.Prompt)
+		}
+		message += "\n"
+	}
+
+	var global string
+	for _, persona := range b.config.Personas {
+		name := strings.ToLower(persona.Name)
+		if found, isGlobal := b.findPersona(settings, name); found != nil && !isGlobal {
+			continue // Replaced by a persona of the user
+		}
+		global += formatPersona(name, persona.Prompt)
+	}
+	if global != "" {
+		message += "<i>Shared personas:</i>\n" + global + "\n"
+	}
+
+	if len(names) == 0 {
+		message += "No personas yet.\n\n"
+	}
+
+	if prompt := settings.ActiveConversation().SystemPrompt; prompt != "" && active == "" {
+		message += fmt.Sprintf("<i>Custom system prompt:</i> %s\n\n", html.EscapeString(truncateText(prompt, 80)))
+	}
+
+	message += "<i>Usage:</i> <code>/persona add name prompt</code>, <code>/persona use name</code>, <code>/persona off</code>"
+
+	keyboard := b.createPersonasKeyboard(names, active)
+	b.sendMessageWithKeyboard(userID, message, "HTML", keyboard)
+}
+
+// handlePersonaAdd creates or replaces a persona of the user
+func (b *Bot) handlePersonaAdd(userID int64, args string) {
+	name, prompt, _ := strings.Cut(args, " ")
+	name = strings.ToLower(strings.TrimSpace(name))
+	prompt = strings.TrimSpace(prompt)
+
+	if !personaNamePattern.MatchString(name) || prompt == "" {
+		message := "<i>Usage:</i> <code>/persona add name prompt</code>\n\n"
+		message += "Names may contain up to 32 lowercase letters, digits, <code>-</code> and <code>_</code>."
+		b.sendMessage(userID, message)
+		return
+	}
+	if utf8.RuneCountInString(prompt) > maxSystemPromptLength {
+		b.sendMessage(userID, fmt.Sprintf("❌ The prompt is too long (maximum %d characters).", maxSystemPromptLength))
+		return
+	}
+
+	settings, err := b.storage.GetUserSettings(userID)
+	if err != nil {
+		log.Errorf("Failed to get user settings: %v", err)
+		b.sendMessage(userID, "Error retrieving your settings.")
+		return
+	}
+
+	replaced := false
+	for i := range settings.Personas {
+		if settings.Personas[i].Name == name {
+			settings.Personas[i].Prompt = prompt
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		if len(settings.Personas) >= maxPersonas {
+			b.sendMessage(userID, fmt.Sprintf("❌ You can have at most %d personas. Delete one first.", maxPersonas))
+			return
+		}
+		settings.Personas = append(settings.Personas, storage.Persona{Name: name, Prompt: prompt})
+	}
+
+	if err := b.storage.SaveUserSettings(settings); err != nil {
+		log.Errorf("Failed to save user settings: %v", err)
+		b.sendMessage(userID, "Error saving your settings.")
+		return
+	}
+
+	action := "created"
+	if replaced {
+		action = "updated"
+	}
+	message := fmt.Sprintf("✅ Persona <b>%s</b> %s.\n\n", html.EscapeString(name), action)
+	message += fmt.Sprintf("Use it with: <code>/persona use %s</code>", html.EscapeString(name))
+	b.sendMessage(userID, message)
+}
+
+// handlePersonaUse selects a persona for the active conversation; an empty name turns personas off
+func (b *Bot) handlePersonaUse(userID int64, name string) {
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	settings, err := b.storage.GetUserSettings(userID)
+	if err != nil {
+		log.Errorf("Failed to get user settings: %v", err)
+		b.sendMessage(userID, "Error retrieving your settings.")
+		return
+	}
+
+	if name != "" {
+		if persona, _ := b.findPersona(settings, name); persona == nil {
+			b.sendMessage(userID, "❌ Persona not found. Use <code>/persona list</code> to see all personas.")
+			return
+		}
+	}
+
+	// A persona replaces the custom system prompt of the conversation
+	conversation := settings.ActiveConversation()
+	conversation.Persona = name
+	conversation.SystemPrompt = ""
+	if err := b.storage.UpdateConversation(userID, conversation); err != nil {
+		log.Errorf("Failed to update conversation: %v", err)
+		b.sendMessage(userID, "Error saving your settings.")
+		return
+	}
+
+	if name == "" {
+		b.sendMessage(userID, fmt.Sprintf("🎭 Persona turned off for <b>%s</b>.", html.EscapeString(conversation.Title)))
+		return
+	}
+	b.sendMessage(userID, fmt.Sprintf("🎭 <b>%s</b> now uses the persona <b>%s</b>.",
+		html.EscapeString(conversation.Title), html.EscapeString(name)))
+}
+
+// handlePersonaDelete deletes one of the user's personas
+func (b *Bot) handlePersonaDelete(userID int64, name string) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		b.sendMessage(userID, "<i>Usage:</i> <code>/persona delete name</code>")
+		return
+	}
+
+	settings, err := b.storage.GetUserSettings(userID)
+	if err != nil {
+		log.Errorf("Failed to get user settings: %v", err)
+		b.sendMessage(userID, "Error retrieving your settings.")
+		return
+	}
+
+	remaining := make([]storage.Persona, 0, len(settings.Personas))
+	for _, persona := range settings.Personas {
+		if persona.Name != name {
+			remaining = append(remaining, persona)
+		}
+	}
+	if len(remaining) == len(settings.Personas) {
+		b.sendMessage(userID, "❌ Persona not found. Shared personas can't be deleted.")
+		return
+	}
+
+	settings.Personas = remaining
+	if err := b.storage.SaveUserSettings(settings); err != nil {
+		log.Errorf("Failed to save user settings: %v", err)
+		b.sendMessage(userID, "Error saving your settings.")
+		return
+	}
+
+	b.sendMessage(userID, fmt.Sprintf("🗑️ Persona <b>%s</b> deleted.", html.EscapeString(name)))
+}
+
+// handleSystemCommand handles the /system command (custom system prompt of the active conversation)
+func (b *Bot) handleSystemCommand(userID int64, args string) {
+	prompt := strings.TrimSpace(args)
+
+	settings, err := b.storage.GetUserSettings(userID)
+	if err != nil {
+		log.Errorf("Failed to get user settings: %v", err)
+		b.sendMessage(userID, "Error retrieving your settings.")
+		return
+	}
+	conversation := settings.ActiveConversation()
+
+	if prompt == "" {
+		message := "🧭 <i>System Prompt</i>\n\n"
+		switch {
+		case conversation.Persona != "":
+			message += fmt.Sprintf("This conversation uses the persona <b>%s</b>.\n\n", html.EscapeString(conversation.Persona))
+		case conversation.SystemPrompt != "":
+			message += fmt.Sprintf("<i>Current:</i> %s\n\n", html.EscapeString(conversation.SystemPrompt))
+		default:
+			message += "This conversation uses the default prompt.\n\n"
+		}
+		message += "<i>Usage:</i> <code>/system prompt</code> to set, <code>/system clear</code> to remove"
+		b.sendMessage(userID, message)
+		return
+	}
+
+	if strings.EqualFold(prompt, "clear") {
+		prompt = ""
+	}
+	if utf8.RuneCountInString(prompt) > maxSystemPromptLength {
+		b.sendMessage(userID, fmt.Sprintf("❌ The prompt is too long (maximum %d characters).", maxSystemPromptLength))
+		return
+	}
+
+	// A custom system prompt replaces the persona of the conversation
+	conversation.SystemPrompt = prompt
+	conversation.Persona = ""
+	if err := b.storage.UpdateConversation(userID, conversation); err != nil {
+		log.Errorf("Failed to update conversation: %v", err)
+		b.sendMessage(userID, "Error saving your settings.")
+		return
+	}
+
+	if prompt == "" {
+		b.sendMessage(userID, "🧭 System prompt removed. The default prompt is used again.")
+		return
+	}
+	b.sendMessage(userID, fmt.Sprintf("🧭 System prompt set for <b>%s</b>.", html.EscapeString(conversation.Title)))
+}
+
+// truncateText shortens text to at most limit characters for previews
+func truncateText(text string, limit int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) <= limit {
+		return text
+	}
+	return string([]rune(text)[:limit-1]) + "…"
+}
@@ -0,0 +1,196 @@
+package bot
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"telegrambot/internal/storage"
+)
+
+// Queue modes for chat messages that arrive while the previous message of the user is still being answered
+const (
+	// queueModeQueue answers the messages one after another
+	queueModeQueue = "queue"
+	// queueModeMerge answers all waiting messages together as one prompt
+	queueModeMerge = "merge"
+	// queueModeReject drops the message and tells the user to wait
+	queueModeReject = "reject"
+)
+
+// maxQueuedMessages is the number of messages a user can have waiting
+const maxQueuedMessages = 10
+
+// chatInput is the content of a chat message: its text and attached images
+type chatInput struct {
+	text        string
+	attachments []storage.Attachment
+	// target is where the answer goes, threaded to this message in groups
+	target chatTarget
+	// senderID is the user who sent the message; the answer counts against their budget
+	senderID int64
+}
+
+// chatQueues holds the waiting chat messages of each user. A user has an entry while one of
+// their messages is being answered, so messages of the same user never run concurrently.
+type chatQueues struct {
+	mutex  sync.Mutex
+	queues map[int64][]chatInput
+}
+
+// newChatQueues creates an empty set of queues
+func newChatQueues() *chatQueues {
+	return &chatQueues{
+		queues: make(map[int64][]chatInput),
+	}
+}
+
+// start marks the user as busy; it returns false if a message of the user is already being answered
+func (q *chatQueues) start(userID int64) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, busy := q.queues[userID]; busy {
+		return false
+	}
+	q.queues[userID] = nil
+	return true
+}
+
+// add appends a message to the queue of a busy user; it returns false if the queue is full
+func (q *chatQueues) add(userID int64, input chatInput) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.queues[userID]) >= maxQueuedMessages {
+		return false
+	}
+	q.queues[userID] = append(q.queues[userID], input)
+	return true
+}
+
+// next takes the next message of a user, or all waiting messages combined into one if merge is set.
+// If nothing is waiting, the user is no longer busy and false is returned.
+func (q *chatQueues) next(userID int64, merge bool) (chatInput, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	pending := q.queues[userID]
+	if len(pending) == 0 {
+		delete(q.queues, userID)
+		return chatInput{}, false
+	}
+
+	if !merge {
+		q.queues[userID] = pending[1:]
+		return pending[0], true
+	}
+
+	q.queues[userID] = nil
+	return mergeChatInputs(pending), true
+}
+
+// clear drops the waiting messages of a user and returns how many there were
+func (q *chatQueues) clear(userID int64) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	dropped := len(q.queues[userID])
+	if _, busy := q.queues[userID]; busy {
+		q.queues[userID] = nil
+	}
+	return dropped
+}
+
+// finish drops the waiting messages of a user and marks the user as no longer busy
+func (q *chatQueues) finish(userID int64) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	dropped := len(q.queues[userID])
+	delete(q.queues, userID)
+	return dropped
+}
+
+// mergeChatInputs combines messages into one, separating their texts by blank lines
+func mergeChatInputs(inputs []chatInput) chatInput {
+	var texts []string
+	var merged chatInput
+	for _, input := range inputs {
+		if text := strings.TrimSpace(input.text); text != "" {
+			texts = append(texts, text)
+		}
+		merged.attachments = append(merged.attachments, input.attachments...)
+		merged.target = input.target
+		merged.senderID = input.senderID
+	}
+	merged.text = strings.Join(texts, "\n\n")
+	return merged
+}
+
+// enqueueChat answers a chat message in order with the other messages of the user.
+// If no message of the user is being answered, the calling goroutine answers it and then works
+// through the messages that arrived in the meantime. Otherwise the message is handled according
+// to the configured queue mode.
+func (b *Bot) enqueueChat(userID int64, input chatInput) {
+	if !b.queues.start(userID) {
+		switch b.config.QueueMode {
+		case queueModeReject:
+			b.sendMessage(userID, "⏳ Please wait until the current answer is finished, or /stop it.")
+		case queueModeMerge:
+			if !b.queues.add(userID, input) {
+				b.sendMessage(userID, "❌ Too many messages are waiting. Please wait for the current answer.")
+				return
+			}
+			b.sendMessage(userID, "🕐 I'll answer this together with your other new messages once the current answer is finished.")
+		default:
+			if !b.queues.add(userID, input) {
+				b.sendMessage(userID, "❌ Too many messages are waiting. Please wait for the current answer.")
+				return
+			}
+			b.sendMessage(userID, "🕐 Queued. I'll answer this once the current answer is finished.")
+		}
+		return
+	}
+
+	for {
+		b.answerChat(userID, input)
+
+		if b.ctx.Err() != nil {
+			if dropped := b.queues.finish(userID); dropped > 0 {
+				log.Infof("Dropped %d queued messages of user %d on shutdown", dropped, userID)
+			}
+			return
+		}
+
+		next, ok := b.queues.next(userID, b.config.QueueMode == queueModeMerge)
+		if !ok {
+			return
+		}
+		input = next
+	}
+}
+
+// acquireLLMSlot waits until the number of concurrent LLM requests is below the configured limit.
+// release must be called when the request has finished.
+func (b *Bot) acquireLLMSlot(ctx context.Context) (release func(), err error) {
+	if b.llmSlots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case b.llmSlots <- struct{}{}:
+		return func() { <-b.llmSlots }, nil
+	default:
+	}
+
+	log.Debugf("All %d LLM request slots are in use, waiting", cap(b.llmSlots))
+	select {
+	case b.llmSlots <- struct{}{}:
+		return func() { <-b.llmSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
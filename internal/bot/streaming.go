@@ -0,0 +1,298 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+
+	"telegrambot/internal/markdown"
+	"telegrambot/internal/storage"
+)
+
+// streamCursor is appended to the message while the response is still being generated
+const streamCursor = " ▌"
+
+// streamRenderer progressively renders a streamed LLM response into Telegram messages.
+// It sends a placeholder message, edits it as deltas arrive (throttled to respect
+// Telegram's edit rate limits) and rolls over into a new message when the current
+// one reaches the maximum message length.
+type streamRenderer struct {
+	bot       *Bot
+	key       int64      // chat key the response belongs to
+	target    chatTarget // where the messages of the response go
+	interval  time.Duration
+	maxLength int
+
+	mutex        sync.Mutex
+	text         string    // full response received so far
+	segmentStart int       // offset in text where the current message starts
+	fence        string    // opening line of a code block the previous message ended in
+	messageID    int       // current message being edited
+	lastText     string    // last text shown in the current message
+	lastEdit     time.Time // time of the last edit
+
+	// stopKeyboard is shown below the message while the response is being generated
+	stopKeyboard *tgbotapi.InlineKeyboardMarkup
+}
+
+// streamChatResponse streams an LLM response into a live-edited message and returns the full text.
+// Errors are reported to the user by the renderer. When the request is cancelled, the part of the
+// response received so far is returned along with the context's error. The cost is recorded for senderID.
+func (b *Bot) streamChatResponse(ctx context.Context, userID, senderID int64, target chatTarget, model string, fallbacks []string, messages []storage.ChatMessage, params storage.GenerationParams) (string, error) {
+	renderer := b.newStreamRenderer(userID, target)
+	if err := renderer.Start(); err != nil {
+		log.Errorf("Failed to send placeholder message to user %d: %v", userID, err)
+		return "", err
+	}
+
+	release, err := b.acquireLLMSlot(ctx)
+	if err != nil {
+		renderer.Stop(b.stoppedMessage())
+		return "", err
+	}
+	defer release()
+
+	response, err := b.llmClient.GetChatResponseStream(ctx, model, fallbacks, messages, params, senderID, b.storage, renderer.OnDelta)
+	if errors.Is(err, context.Canceled) {
+		renderer.Stop(b.stoppedMessage())
+		return response, err
+	}
+	if err != nil {
+		renderer.Fail(llmErrorMessage(err))
+		return "", err
+	}
+
+	renderer.Finish()
+	return response, nil
+}
+
+// newStreamRenderer creates a renderer for the answer to a message of a chat
+func (b *Bot) newStreamRenderer(key int64, target chatTarget) *streamRenderer {
+	interval := time.Duration(b.config.StreamEditInterval) * time.Millisecond
+	if interval < 500*time.Millisecond {
+		interval = 500 * time.Millisecond
+	}
+
+	// Leave room for the cursor
+	maxLength := b.config.MaxMessageLength - markdown.UTF16Length(streamCursor)
+	if maxLength <= 0 {
+		maxLength = 4000
+	}
+
+	return &streamRenderer{
+		bot:       b,
+		key:       key,
+		target:    target,
+		interval:  interval,
+		maxLength: maxLength,
+
+		stopKeyboard: b.createStopKeyboard(),
+	}
+}
+
+// Start sends the placeholder message that will be edited as the response streams in
+func (r *streamRenderer) Start() error {
+	msg := r.target.message("⏳ Thinking...")
+	msg.ReplyMarkup = r.stopKeyboard
+	sent, err := r.bot.api.Send(msg)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	r.messageID = sent.MessageID
+	r.lastEdit = time.Now()
+	r.mutex.Unlock()
+	return nil
+}
+
+// OnDelta appends a piece of the response and updates the message if the throttle allows it
+func (r *streamRenderer) OnDelta(delta string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.text += delta
+
+	// Roll over into new messages as soon as the current one is full
+	for markdown.UTF16Length(r.text[r.segmentStart:]) > r.maxLength {
+		cut := r.segmentStart + findSplitPoint(r.text[r.segmentStart:], r.maxLength)
+		segment := r.text[r.segmentStart:cut]
+		r.finalizeSegment(segment)
+		// A code block cut in half continues as a code block in the next message
+		r.fence = markdown.OpenFence(r.withFence(segment))
+		r.segmentStart = cut
+
+		next := r.text[r.segmentStart:]
+		if markdown.UTF16Length(next) > r.maxLength {
+			// The loop will fill this message right away
+			next = "⏳"
+		}
+		r.startNewMessage(next + streamCursor)
+	}
+
+	if time.Since(r.lastEdit) < r.interval {
+		return
+	}
+
+	r.editPlain(r.text[r.segmentStart:] + streamCursor)
+}
+
+// Finish renders the final text of the current message with HTML formatting
+func (r *streamRenderer) Finish() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.stopKeyboard = nil
+
+	segment := strings.TrimSpace(r.text[r.segmentStart:])
+	if segment == "" {
+		if r.segmentStart == 0 {
+			r.editPlain("⚠️ The model returned an empty response.")
+		}
+		return
+	}
+
+	// Formatting may change the length, so split the final segment again
+	formatted := markdown.ToTelegramHTML(r.withFence(segment))
+	parts := r.bot.splitMessage(formatted, r.bot.config.MaxMessageLength)
+	for i, part := range parts {
+		if i == 0 {
+			r.editHTML(part, segment)
+			continue
+		}
+		if err := r.bot.sendHTMLMessage(r.key, r.target.message(part)); err != nil {
+			log.Errorf("Failed to send streamed response part to chat %d: %v", r.key, err)
+		}
+	}
+}
+
+// Stop ends a cancelled response, keeping the part that was received and adding a note
+func (r *streamRenderer) Stop(note string) {
+	r.mutex.Lock()
+	empty := strings.TrimSpace(r.text) == ""
+	if empty {
+		r.stopKeyboard = nil
+		r.editPlain(note)
+	}
+	r.mutex.Unlock()
+
+	if !empty {
+		r.Finish()
+		r.bot.sendReply(r.key, r.target, note)
+	}
+}
+
+// Fail reports an error in the streamed message
+func (r *streamRenderer) Fail(errText string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.stopKeyboard = nil
+
+	if strings.TrimSpace(r.text) == "" {
+		r.editPlain(errText)
+		return
+	}
+
+	// Keep the partial answer and report the error separately
+	r.editPlain(r.text[r.segmentStart:])
+	r.bot.sendReply(r.key, r.target, errText)
+}
+
+// finalizeSegment renders a completed message with HTML formatting
+func (r *streamRenderer) finalizeSegment(segment string) {
+	r.editHTML(markdown.ToTelegramHTML(r.withFence(segment)), segment)
+}
+
+// withFence reopens the code block the previous message ended in, so the segment renders as code
+func (r *streamRenderer) withFence(segment string) string {
+	if r.fence == "" {
+		return segment
+	}
+	return r.fence + "\n" + strings.TrimLeft(segment, "\n")
+}
+
+// startNewMessage sends a new message that subsequent deltas will be rendered into
+func (r *streamRenderer) startNewMessage(text string) {
+	msg := r.target.message(text)
+	msg.ReplyMarkup = r.stopKeyboard
+	sent, err := r.bot.api.Send(msg)
+	if err != nil {
+		log.Errorf("Failed to send continuation message to chat %d: %v", r.key, err)
+		return
+	}
+
+	r.messageID = sent.MessageID
+	r.lastText = text
+	r.lastEdit = time.Now()
+}
+
+// editPlain edits the current message without parse mode, so partial markup can't break it
+func (r *streamRenderer) editPlain(text string) {
+	if text == r.lastText || strings.TrimSpace(text) == "" {
+		return
+	}
+
+	edit := tgbotapi.NewEditMessageText(r.target.chatID, r.messageID, text)
+	edit.ReplyMarkup = r.stopKeyboard
+	if _, err := r.bot.api.Send(edit); err != nil {
+		log.Debugf("Failed to edit streamed message in chat %d: %v", r.key, err)
+	}
+
+	r.lastText = text
+	r.lastEdit = time.Now()
+}
+
+// editHTML edits the current message with HTML formatting. Formatting Telegram rejects is
+// sanitized or dropped; on other errors the raw text is shown.
+func (r *streamRenderer) editHTML(html, plain string) {
+	edit := tgbotapi.NewEditMessageText(r.target.chatID, r.messageID, html)
+	err := r.bot.sendWithFallback(r.key, html, func(text, parseMode string) error {
+		edit.Text, edit.ParseMode = text, parseMode
+		_, err := r.bot.api.Send(edit)
+		return err
+	})
+	if err != nil {
+		log.Warnf("Failed to edit streamed message in chat %d: %v", r.key, err)
+		r.editPlain(plain)
+		return
+	}
+
+	r.lastText = html
+	r.lastEdit = time.Now()
+}
+
+// findSplitPoint returns the byte offset at which text should be cut so the first part fits
+// into maxLength UTF-16 code units, preferring paragraph, line and word boundaries
+func findSplitPoint(text string, maxLength int) int {
+	// Find the longest prefix that fits; it always ends between two runes
+	limit, length := 0, 0
+	for i, r := range text {
+		if r >= 0x10000 {
+			length += 2
+		} else {
+			length++
+		}
+		if length > maxLength {
+			break
+		}
+		limit = i + utf8.RuneLen(r)
+	}
+	if limit == len(text) {
+		return limit
+	}
+
+	window := text[:limit]
+	for _, sep := range []string{"\n\n", "\n", " "} {
+		if idx := strings.LastIndex(window, sep); idx > limit/2 {
+			return idx + len(sep)
+		}
+	}
+	return limit
+}
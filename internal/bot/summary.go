@@ -0,0 +1,271 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"telegrambot/internal/storage"
+)
+
+// summaryMaxTokens limits the length of a summary
+const summaryMaxTokens = 1000
+
+// summarizerPrompt instructs the summarizer model
+const summarizerPrompt = `You maintain the running summary of a conversation between a user and an AI assistant.
+Combine the previous summary (if any) and the new messages into one updated summary.
+Keep facts, decisions, names, numbers, code identifiers, open questions and the user's preferences;
+drop greetings and repetition. Write in the language of the conversation, in plain text without
+markup, as concise notes of at most 400 words. Reply with the summary only.`
+
+// pendingHistory returns the messages of a conversation that are not covered by its summary
+func pendingHistory(conversation *storage.Conversation, history []storage.ChatMessage) []storage.ChatMessage {
+	if conversation.SummaryUntil.IsZero() {
+		return history
+	}
+	for i, message := range history {
+		if message.Timestamp.After(conversation.SummaryUntil) {
+			return history[i:]
+		}
+	}
+	return nil
+}
+
+// summaryContext returns the part of the system message that carries the conversation summary
+func summaryContext(summary string) string {
+	return "Summary of the earlier conversation, which is no longer shown in full:\n" + summary
+}
+
+// startSummary updates the summary of a conversation in the background, so the next message
+// of the user doesn't wait for it. Shutdown waits for it like for a handler, and it is registered
+// as a running request, so /stop cancels it. A conversation is summarized once at a time.
+// The summary is charged to senderID, who sent the message that made it necessary.
+func (b *Bot) startSummary(userID, conversationID, senderID int64) {
+	if !b.config.Summary.Enabled {
+		return
+	}
+
+	key := conversationKey{userID: userID, conversationID: conversationID}
+	b.summaryMutex.Lock()
+	if b.summaries[key] {
+		b.summaryMutex.Unlock()
+		return
+	}
+	b.summaries[key] = true
+	b.summaryMutex.Unlock()
+
+	// Called from a handler, so the counter can't be zero while shutdown waits for it
+	b.handlers.Add(1)
+	go func() {
+		defer b.handlers.Done()
+		defer func() {
+			b.summaryMutex.Lock()
+			delete(b.summaries, key)
+			b.summaryMutex.Unlock()
+		}()
+
+		ctx, done := b.inflight.start(b.ctx, userID)
+		defer done()
+		b.updateSummary(ctx, userID, conversationID, senderID)
+	}()
+}
+
+// updateSummary condenses older messages of a conversation into its summary once the messages
+// not yet summarized exceed the configured threshold. The newest messages are kept verbatim.
+// It runs after an answer has been sent, so the next request benefits from the shorter history.
+func (b *Bot) updateSummary(ctx context.Context, userID, conversationID, senderID int64) {
+	settings, err := b.storage.GetUserSettings(userID)
+	if err != nil {
+		log.Errorf("Failed to get user settings: %v", err)
+		return
+	}
+	// The user may have switched conversations since; the settings of the one to summarize apply
+	settings.ActiveConversationID = conversationID
+	conversation := settings.ActiveConversation()
+	if conversation.ID != conversationID || settings.ActiveChatMode() != "with_history" {
+		return
+	}
+
+	history, err := b.storage.GetConversationHistory(userID, conversationID)
+	if err != nil {
+		log.Errorf("Failed to get chat history: %v", err)
+		return
+	}
+	pending := pendingHistory(conversation, history)
+
+	// Summarize before a small context window would force messages out
+	model := settings.ActiveModel()
+	estimator := b.llmClient.Tokens()
+	threshold := min(b.config.Summary.ThresholdTokens, b.promptTokenBudget(model, b.effectiveParams(settings, model))/2)
+	if estimator.CountMessages(model, pending) <= threshold {
+		return
+	}
+
+	// Keep the newest messages up to half the threshold, and at least the last exchange
+	keep, kept := len(pending), 0
+	for keep > 0 {
+		size := estimator.CountMessage(model, pending[keep-1])
+		if kept+size > threshold/2 {
+			break
+		}
+		kept += size
+		keep--
+	}
+	split := min(keep, len(pending)-2)
+	if split <= 0 {
+		return
+	}
+	older := pending[:split]
+
+	senderSettings := settings
+	if senderID != userID {
+		senderSettings, err = b.storage.GetUserSettings(senderID)
+		if err != nil {
+			log.Errorf("Failed to get user settings: %v", err)
+			return
+		}
+	}
+
+	summary, err := b.summarize(ctx, senderID, senderSettings, conversation.Summary, older)
+	if errors.Is(err, context.Canceled) {
+		log.Infof("Summary of conversation %d of user %d stopped", conversation.ID, userID)
+		return
+	}
+	if err != nil {
+		log.Errorf("Failed to summarize conversation %d of user %d: %v", conversation.ID, userID, err)
+		return
+	}
+
+	// Reload the conversation, which may have been changed while the summary was written
+	conversations, err := b.storage.GetConversations(userID)
+	if err != nil {
+		log.Errorf("Failed to get conversations: %v", err)
+		return
+	}
+	var current *storage.Conversation
+	for i := range conversations {
+		if conversations[i].ID == conversation.ID {
+			current = &conversations[i]
+		}
+	}
+	if current == nil {
+		return // Deleted in the meantime
+	}
+
+	current.Summary = summary
+	current.SummaryUntil = older[len(older)-1].Timestamp
+	if err := b.storage.UpdateConversation(userID, current); err != nil {
+		log.Errorf("Failed to save summary: %v", err)
+		return
+	}
+
+	log.Infof("Summarized %d messages of conversation %d of user %d", len(older), conversation.ID, userID)
+}
+
+// summarize asks the summarizer model to merge messages into the previous summary.
+// The cost is recorded as an expense of the user; if it would exceed a spending limit, nothing is summarized.
+func (b *Bot) summarize(ctx context.Context, userID int64, settings *storage.UserSettings, previous string, messages []storage.ChatMessage) (string, error) {
+	var transcript strings.Builder
+	if previous != "" {
+		transcript.WriteString("Previous summary:\n" + previous + "\n\n")
+	}
+	transcript.WriteString("New messages:\n")
+	for _, message := range messages {
+		role := "User"
+		if message.Role == "assistant" {
+			role = "Assistant"
+		}
+		content := message.Content
+		for _, attachment := range message.Attachments {
+			if attachment.Type == storage.AttachmentDocument {
+				content = fmt.Sprintf("[file %s] %s", attachment.Name, content)
+			} else {
+				content = "[image] " + content
+			}
+		}
+		content = strings.TrimSpace(content)
+		transcript.WriteString(fmt.Sprintf("%s: %s\n\n", role, content))
+	}
+
+	model := b.config.Summary.Model
+	maxTokens := summaryMaxTokens
+	params := storage.GenerationParams{MaxTokens: &maxTokens}
+	request := []storage.ChatMessage{
+		{Role: "system", Content: summarizerPrompt},
+		{Role: "user", Content: transcript.String()},
+	}
+
+	if usage, err := b.exceededBudget(userID, settings, model, request, params); err != nil {
+		return "", fmt.Errorf("failed to check budget: %w", err)
+	} else if usage != nil {
+		return "", fmt.Errorf("%s budget exceeded", usage.label)
+	}
+
+	release, err := b.acquireLLMSlot(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	summary, err := b.llmClient.GetChatResponse(ctx, model, nil, request, params, userID, b.storage)
+	if err != nil {
+		return "", err
+	}
+
+	summary = strings.TrimSpace(summary)
+	if summary == "" {
+		return "", fmt.Errorf("empty summary")
+	}
+	return summary, nil
+}
+
+// handleSummaryCommand handles the /summary command: show the summary of the active conversation or reset it
+func (b *Bot) handleSummaryCommand(userID int64, args string) {
+	settings, err := b.storage.GetUserSettings(userID)
+	if err != nil {
+		log.Errorf("Failed to get user settings: %v", err)
+		b.sendMessage(userID, "Error retrieving your settings.")
+		return
+	}
+	conversation := settings.ActiveConversation()
+
+	switch strings.ToLower(strings.TrimSpace(args)) {
+	case "":
+	case "reset", "clear":
+		// The summarized messages are still stored, so they are sent again as far as they fit
+		conversation.Summary = ""
+		conversation.SummaryUntil = time.Time{}
+		if err := b.storage.UpdateConversation(userID, conversation); err != nil {
+			log.Errorf("Failed to update conversation: %v", err)
+			b.sendMessage(userID, "Error saving your settings.")
+			return
+		}
+		b.sendMessage(userID, fmt.Sprintf("♻️ Summary of <b>%s</b> removed.", html.EscapeString(conversation.Title)))
+		return
+	default:
+		b.sendMessage(userID, "<i>Usage:</i> <code>/summary</code> to view, <code>/summary reset</code> to remove")
+		return
+	}
+
+	message := fmt.Sprintf("📝 <i>Summary of</i> <b>%s</b>\n\n", html.EscapeString(conversation.Title))
+	if conversation.Summary == "" {
+		if b.config.Summary.Enabled {
+			message += "No summary yet. Older messages are summarized automatically once the conversation gets long "
+			message += "(in <code>with_history</code> mode)."
+		} else {
+			message += "Summarization is disabled on this bot. Older messages are left out when the conversation gets too long."
+		}
+		b.sendMessage(userID, message)
+		return
+	}
+
+	message += html.EscapeString(conversation.Summary) + "\n\n"
+	message += fmt.Sprintf("<i>Covers messages up to:</i> %s\n", conversation.SummaryUntil.Format("2006-01-02 15:04"))
+	message += "<i>Reset with:</i> <code>/summary reset</code>"
+	b.sendMessageWithMode(userID, message, "HTML")
+}
@@ -0,0 +1,215 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+
+	"telegrambot/internal/extract"
+	"telegrambot/internal/storage"
+)
+
+const (
+	// maxPendingUploads is the number of documents that can wait for the next message of a sender
+	maxPendingUploads = 5
+
+	// pendingUploadTimeout is how long documents wait for the question about them
+	pendingUploadTimeout = 10 * time.Minute
+)
+
+// uploadKey identifies the documents of one sender in a chat, so in groups they only
+// belong to the next message of the member who sent them
+type uploadKey struct {
+	chat   int64
+	sender int64
+}
+
+// waitingUploads are the documents of one sender and when they expire
+type waitingUploads struct {
+	documents []storage.Attachment
+	deadline  time.Time
+	timer     *time.Timer
+	// expired is called with the documents when nobody asked about them in time
+	expired func(documents []storage.Attachment)
+}
+
+// pendingUploads holds the documents sent without a question until the next message of their sender
+type pendingUploads struct {
+	mutex   sync.Mutex
+	waiting map[uploadKey]*waitingUploads
+}
+
+// newPendingUploads creates an empty store
+func newPendingUploads() *pendingUploads {
+	return &pendingUploads{
+		waiting: make(map[uploadKey]*waitingUploads),
+	}
+}
+
+// add keeps a document for the next message of a sender; false if too many are waiting.
+// The documents expire pendingUploadTimeout after the last one was added, and are then passed to expired.
+func (p *pendingUploads) add(key uploadKey, document storage.Attachment, expired func(documents []storage.Attachment)) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	waiting := p.waiting[key]
+	if waiting == nil {
+		waiting = &waitingUploads{}
+		waiting.timer = time.AfterFunc(pendingUploadTimeout, func() { p.expire(key, waiting) })
+		p.waiting[key] = waiting
+	}
+	if len(waiting.documents) >= maxPendingUploads {
+		return false
+	}
+
+	waiting.documents = append(waiting.documents, document)
+	waiting.deadline = time.Now().Add(pendingUploadTimeout)
+	waiting.timer.Reset(pendingUploadTimeout)
+	waiting.expired = expired
+	return true
+}
+
+// expire drops documents that are still waiting after their deadline
+func (p *pendingUploads) expire(key uploadKey, waiting *waitingUploads) {
+	p.mutex.Lock()
+	// The documents may have been taken, or more were added while the timer fired
+	if p.waiting[key] != waiting || time.Now().Before(waiting.deadline) {
+		p.mutex.Unlock()
+		return
+	}
+	delete(p.waiting, key)
+	p.mutex.Unlock()
+
+	waiting.expired(waiting.documents)
+}
+
+// take returns and removes the documents waiting for a sender
+func (p *pendingUploads) take(key uploadKey) []storage.Attachment {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	waiting := p.waiting[key]
+	if waiting == nil {
+		return nil
+	}
+	waiting.timer.Stop()
+	delete(p.waiting, key)
+	return waiting.documents
+}
+
+// handleDocumentMessage reads the text of a text, code or PDF file. A caption is answered
+// right away with the document as context; without one, the document waits for the next message.
+func (b *Bot) handleDocumentMessage(userID int64, message *tgbotapi.Message) {
+	document := message.Document
+	if !extract.Supported(document.FileName, document.MimeType) {
+		b.sendMessage(userID, "❌ This file type is not supported. Send text, code, Markdown, CSV, JSON or PDF files.")
+		return
+	}
+	maxSize := b.config.Documents.MaxSizeMB << 20
+	if document.FileSize > maxSize {
+		b.sendMessage(userID, fmt.Sprintf("❌ The file is too large. Documents can have at most %d MB.", b.config.Documents.MaxSizeMB))
+		return
+	}
+
+	text, err := b.extractDocument(userID, document, maxSize)
+	if err != nil {
+		log.Errorf("Failed to read document %q of user %d: %v", document.FileName, userID, err)
+		b.sendMessage(userID, documentErrorMessage(err))
+		return
+	}
+
+	limit := b.config.Documents.MaxCharacters
+	characters := utf8.RuneCountInString(text)
+	if characters > limit {
+		text = string([]rune(text)[:limit])
+	}
+	log.Infof("Read document %q of user %d: %d characters", document.FileName, userID, characters)
+
+	attachment := storage.Attachment{
+		Type:     storage.AttachmentDocument,
+		FileID:   document.FileID,
+		MimeType: document.MimeType,
+		Name:     document.FileName,
+		Text:     text,
+	}
+	target := messageTarget(message)
+	expired := func(documents []storage.Attachment) {
+		names := make([]string, len(documents))
+		for i, document := range documents {
+			names[i] = "<b>" + html.EscapeString(document.Name) + "</b>"
+		}
+		log.Infof("Dropped %d unused documents of user %d", len(documents), message.From.ID)
+		b.sendReply(userID, target, fmt.Sprintf("⌛ No question came within %d minutes, so these files were dropped: %s. Send them again together with your question.",
+			int(pendingUploadTimeout.Minutes()), strings.Join(names, ", ")))
+	}
+	if !b.uploads.add(uploadKey{chat: userID, sender: message.From.ID}, attachment, expired) {
+		b.sendMessage(userID, fmt.Sprintf("❌ At most %d files can wait for your question. Ask it first, then send more files.", maxPendingUploads))
+		return
+	}
+
+	if characters > limit {
+		b.sendMessage(userID, fmt.Sprintf("✂️ <b>%s</b> is long, only its first %d of %d characters are used.", html.EscapeString(document.FileName), limit, characters))
+	}
+
+	if message.Caption == "" {
+		b.sendMessage(userID, fmt.Sprintf("📄 <b>%s</b> is ready (%d characters). Ask your question about it.", html.EscapeString(document.FileName), min(characters, limit)))
+		return
+	}
+
+	// The caption is the question, and the document is taken from the pending uploads
+	question := *message
+	question.Text = message.Caption
+	question.Caption = ""
+	question.Document = nil
+	b.handleChatMessage(userID, &question)
+}
+
+// extractDocument downloads a document and extracts its text while showing a typing indicator
+func (b *Bot) extractDocument(userID int64, document *tgbotapi.Document, maxSize int) (string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.sendTypingIndicator(ctx, userID)
+	}()
+
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	data, err := b.downloadFile(document.FileID)
+	if err != nil {
+		return "", err
+	}
+	// The size in the message is optional
+	if len(data) > maxSize {
+		return "", fmt.Errorf("file is larger than %d MB", maxSize>>20)
+	}
+
+	return extract.Text(document.FileName, document.MimeType, data)
+}
+
+// documentErrorMessage explains to the user why a document couldn't be read
+func documentErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, extract.ErrEncrypted):
+		return "🔒 The PDF is password protected. Please send it without a password."
+	case errors.Is(err, extract.ErrNoText):
+		return "📄 The file contains no text. Scanned PDFs have to be converted to text first."
+	case errors.Is(err, extract.ErrBinary):
+		return "❌ The file doesn't look like a text file."
+	}
+	return "Sorry, the file could not be read. Please try again."
+}
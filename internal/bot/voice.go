@@ -0,0 +1,98 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"path"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// handleVoiceMessage transcribes a voice or audio message, shows the transcript
+// and then handles it like a typed message
+func (b *Bot) handleVoiceMessage(userID int64, message *tgbotapi.Message) {
+	if b.transcriber == nil {
+		b.sendMessage(userID, "Sorry, voice messages are not enabled on this bot.")
+		return
+	}
+
+	fileID, filename := voiceFile(message)
+
+	transcript, err := b.transcribeFile(userID, fileID, filename)
+	if errors.Is(err, context.Canceled) {
+		log.Infof("Transcription of user %d stopped", userID)
+		b.sendMessage(userID, b.stoppedMessage())
+		return
+	}
+	if err != nil {
+		log.Errorf("Failed to transcribe voice message of user %d: %v", userID, err)
+		b.sendMessage(userID, "Sorry, the voice message could not be transcribed. Please try again.")
+		return
+	}
+	if transcript == "" {
+		b.sendMessage(userID, "🎙️ No speech was recognized in the voice message.")
+		return
+	}
+
+	log.Infof("Transcribed voice message from user %d: %s", userID, transcript)
+	// A long recording can give a transcript longer than a message
+	echo := fmt.Sprintf("🎙️ <i>Transcript:</i>\n%s", html.EscapeString(transcript))
+	for _, part := range b.splitMessage(echo, b.config.MaxMessageLength) {
+		b.sendMessage(userID, part)
+	}
+
+	// Continue as if the transcript had been typed
+	transcribed := *message
+	transcribed.Text = transcript
+	transcribed.Voice = nil
+	transcribed.Audio = nil
+	transcribed.Caption = ""
+	b.handleChatMessage(userID, &transcribed)
+}
+
+// transcribeFile downloads an audio file and transcribes it while showing a typing indicator.
+// The transcription is registered as a running request, so /stop and shutdown can cancel it.
+func (b *Bot) transcribeFile(userID int64, fileID, filename string) (string, error) {
+	requestCtx, done := b.inflight.start(b.ctx, userID)
+	defer done()
+
+	ctx, cancel := context.WithCancel(requestCtx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.sendTypingIndicator(ctx, userID)
+	}()
+
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	audio, err := b.downloadFile(fileID)
+	if err != nil {
+		return "", err
+	}
+
+	return b.transcriber.Transcribe(requestCtx, audio, filename)
+}
+
+// voiceFile returns the file ID and a file name with the right extension for a voice or audio message
+func voiceFile(message *tgbotapi.Message) (fileID, filename string) {
+	if message.Voice != nil {
+		// Voice notes are always OGG/Opus
+		return message.Voice.FileID, "voice.ogg"
+	}
+
+	filename = "audio.mp3"
+	if message.Audio.FileName != "" {
+		filename = path.Base(message.Audio.FileName)
+	}
+	return message.Audio.FileID, filename
+}
@@ -0,0 +1,140 @@
+package bot
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// webhookSecretHeader carries the secret token Telegram was given in setWebhook
+	webhookSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+	// maxWebhookBodySize limits the size of an update request body
+	maxWebhookBodySize = 1 << 20
+
+	// webhookShutdownTimeout is how long in-flight webhook requests get to finish on shutdown
+	webhookShutdownTimeout = 5 * time.Second
+)
+
+// startWebhook serves updates over HTTP and registers the webhook with Telegram.
+// It blocks until the context is cancelled or the server fails.
+func (b *Bot) startWebhook(ctx context.Context) error {
+	webhookURL, err := url.Parse(b.config.WebhookURL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook URL: %w", err)
+	}
+
+	path := webhookURL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, b.handleWebhook)
+
+	b.server = &http.Server{
+		Addr:              b.config.WebhookListenAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	// Listen before registering, so Telegram's first delivery doesn't fail
+	listener, err := net.Listen("tcp", b.config.WebhookListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", b.config.WebhookListenAddr, err)
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- b.server.Serve(listener)
+	}()
+
+	if err := b.registerWebhook(); err != nil {
+		b.server.Close()
+		return err
+	}
+
+	log.Infof("Bot started in webhook mode, listening on %s%s", b.config.WebhookListenAddr, path)
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-serverErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return fmt.Errorf("webhook server failed: %w", err)
+	}
+}
+
+// registerWebhook tells Telegram to deliver updates to the configured URL
+func (b *Bot) registerWebhook() error {
+	// WebhookConfig of the Telegram library has no secret token, so the request is built by hand
+	params := make(tgbotapi.Params)
+	params["url"] = b.config.WebhookURL
+	params["secret_token"] = b.config.WebhookSecret
+
+	if _, err := b.api.MakeRequest("setWebhook", params); err != nil {
+		return fmt.Errorf("failed to register webhook: %w", err)
+	}
+
+	log.Infof("Webhook registered: %s", b.config.WebhookURL)
+	return nil
+}
+
+// stopWebhook shuts down the webhook server and removes the webhook from Telegram
+func (b *Bot) stopWebhook() {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookShutdownTimeout)
+	defer cancel()
+
+	if err := b.server.Shutdown(ctx); err != nil {
+		log.Errorf("Failed to shut down webhook server: %v", err)
+	}
+
+	if _, err := b.api.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+		log.Errorf("Failed to remove webhook: %v", err)
+		return
+	}
+	log.Info("Webhook removed")
+}
+
+// handleWebhook receives a single update from Telegram
+func (b *Bot) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	secret := r.Header.Get(webhookSecretHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(b.config.WebhookSecret)) != 1 {
+		log.Warnf("Rejected webhook request from %s: invalid secret token", r.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodySize))
+	if err != nil {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	update, err := decodeUpdate(data)
+	if err != nil {
+		log.Warnf("Failed to decode webhook update: %v", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	// Handlers run in their own goroutines, so Telegram gets its answer right away
+	b.dispatchUpdate(update)
+	w.WriteHeader(http.StatusOK)
+}
@@ -3,9 +3,16 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 )
 
+// webhookSecretPattern matches the secret tokens accepted by Telegram
+var webhookSecretPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
 // Config holds all configuration for the bot
 type Config struct {
 	// Telegram Bot Token
@@ -20,20 +27,163 @@ type Config struct {
 	// List of allowed Telegram user IDs
 	AllowedUsers []int64 `json:"allowed_users"`
 
+	// Group chat IDs whose members may all use the bot (allowed users can use it in any group)
+	AllowedChats []int64 `json:"allowed_chats,omitempty"`
+
+	// Telegram user IDs allowed to use admin commands; admins can always use the bot
+	Admins []int64 `json:"admins"`
+
+	// Let users without access ask the admins for it from /start
+	AccessRequests bool `json:"access_requests"`
+
 	// Default model for new users
 	DefaultModel string `json:"default_model"`
 
+	// Models suggested in menus and the model selection keyboard
+	PopularModels []string `json:"popular_models"`
+
 	// Default chat mode (with_history or without_history)
 	DefaultChatMode string `json:"default_chat_mode"`
 
 	// Maximum message length before splitting
 	MaxMessageLength int `json:"max_message_length"`
 
+	// Stream LLM responses by progressively editing the reply message
+	StreamResponses bool `json:"stream_responses"`
+
+	// Minimum interval between message edits while streaming (milliseconds)
+	StreamEditInterval int `json:"stream_edit_interval_ms"`
+
+	// What happens to messages sent while the previous answer is pending: "queue", "merge" or "reject"
+	QueueMode string `json:"queue_mode"`
+
+	// Maximum number of LLM requests running at the same time across all users; 0 is unlimited
+	MaxConcurrentRequests int `json:"max_concurrent_requests"`
+
+	// Milliseconds an inline query must stay unchanged before it is sent to the model
+	InlineDebounce int `json:"inline_debounce_ms"`
+
+	// Fraction of the model's context length that prompts (system prompt, history and message) may use
+	ContextWindowFraction float64 `json:"context_window_fraction"`
+
+	// Rolling summarization of long conversations
+	Summary SummaryConfig `json:"summary"`
+
+	// Delivery of long code blocks and answers as files; users can change it with /files
+	Files FilesConfig `json:"files"`
+
+	// Limits for documents sent to the bot as context
+	Documents DocumentsConfig `json:"documents"`
+
+	// OpenAI-compatible speech-to-text API for voice messages; empty disables transcription
+	TranscriptionBaseURL string `json:"transcription_base_url"`
+
+	// API key of the speech-to-text API (may be empty for local servers)
+	TranscriptionAPIKey string `json:"transcription_api_key"`
+
+	// Speech-to-text model
+	TranscriptionModel string `json:"transcription_model"`
+
+	// Spoken language as an ISO-639-1 code; empty lets the server detect it
+	TranscriptionLanguage string `json:"transcription_language,omitempty"`
+
+	// How updates are received: "polling" (long polling) or "webhook"
+	UpdateMode string `json:"update_mode"`
+
+	// Address the webhook HTTP server listens on
+	WebhookListenAddr string `json:"webhook_listen_addr"`
+
+	// Public HTTPS URL Telegram sends updates to; its path is served by the webhook server
+	WebhookURL string `json:"webhook_url"`
+
+	// Secret Telegram sends in the X-Telegram-Bot-Api-Secret-Token header (1-256 characters A-Z, a-z, 0-9, _ and -)
+	WebhookSecret string `json:"webhook_secret"`
+
+	// Seconds to wait for running requests on shutdown before they are cancelled
+	ShutdownTimeout int `json:"shutdown_timeout_seconds"`
+
 	// Log level
 	LogLevel string `json:"log_level"`
 
 	// Data directory for persistence
 	DataDirectory string `json:"data_directory"`
+
+	// Storage backend: "file" (one JSON file per user) or "sqlite"
+	StorageBackend string `json:"storage_backend"`
+
+	// Path to the SQLite database (defaults to bot.db in the data directory)
+	SQLitePath string `json:"sqlite_path,omitempty"`
+
+	// Spending limits
+	Budget BudgetConfig `json:"budget"`
+
+	// Personas available to all users
+	Personas []Persona `json:"personas,omitempty"`
+}
+
+// Persona is a named system prompt defined by the administrator
+type Persona struct {
+	Name   string `json:"name"`
+	Prompt string `json:"prompt"`
+}
+
+// SummaryConfig controls the summarization of older messages in with_history mode
+type SummaryConfig struct {
+	// Summarize older messages instead of leaving them out when the history gets long
+	Enabled bool `json:"enabled"`
+
+	// Model that writes the summaries; a cheap and fast model is enough
+	Model string `json:"model"`
+
+	// History size in tokens above which older messages are summarized
+	ThresholdTokens int `json:"threshold_tokens"`
+}
+
+// FilesConfig holds the defaults for sending long code blocks and answers as documents
+type FilesConfig struct {
+	// Send fenced code blocks longer than code_threshold characters as files instead of messages
+	CodeFiles bool `json:"code_files"`
+
+	// Length in characters above which a code block is sent as a file
+	CodeThreshold int `json:"code_threshold"`
+
+	// Send answers that need more than max_chunks messages as a single file: "md", "html" or "off"
+	AnswerFiles string `json:"answer_files"`
+
+	// Number of messages above which an answer is sent as a file
+	MaxChunks int `json:"max_chunks"`
+}
+
+// DocumentsConfig limits the text, code and PDF files users can send as context
+type DocumentsConfig struct {
+	// Largest document accepted, in MB; bots can't download files larger than 20 MB
+	MaxSizeMB int `json:"max_size_mb"`
+
+	// Characters of text kept per document; the rest is cut off
+	MaxCharacters int `json:"max_characters"`
+}
+
+// BudgetConfig holds spending limits in USD. A limit of zero is disabled.
+type BudgetConfig struct {
+	// Limits for each user, who is also charged for what they ask in groups
+	UserDaily   float64 `json:"user_daily"`
+	UserMonthly float64 `json:"user_monthly"`
+
+	// Limits for all users together
+	GlobalDaily   float64 `json:"global_daily"`
+	GlobalMonthly float64 `json:"global_monthly"`
+
+	// Fraction of a limit at which users are warned (e.g. 0.8 for 80%)
+	WarningThreshold float64 `json:"warning_threshold"`
+
+	// Per-user limits replacing user_daily and user_monthly, keyed by Telegram user ID
+	UserOverrides map[int64]UserBudget `json:"user_overrides,omitempty"`
+}
+
+// UserBudget holds the spending limits of a single user in USD
+type UserBudget struct {
+	Daily   float64 `json:"daily"`
+	Monthly float64 `json:"monthly"`
 }
 
 // Load loads configuration from a JSON file
@@ -43,9 +193,45 @@ func Load(filename string) (*Config, error) {
 		OpenRouterBaseURL: "https://openrouter.ai/api/v1",
 		DefaultModel:      "openai/gpt-3.5-turbo",
 		DefaultChatMode:   "without_history",
-		MaxMessageLength:  4096,
-		LogLevel:          "info",
-		DataDirectory:     "data",
+		PopularModels: []string{
+			"openai/gpt-4o",
+			"openai/gpt-4o-mini",
+			"anthropic/claude-3.5-sonnet",
+			"google/gemini-flash-1.5",
+			"meta-llama/llama-3.1-70b-instruct",
+			"mistralai/mistral-nemo",
+		},
+		MaxMessageLength:      4096,
+		StreamResponses:       true,
+		StreamEditInterval:    1000,
+		QueueMode:             "queue",
+		MaxConcurrentRequests: 10,
+		InlineDebounce:        1000,
+		ContextWindowFraction: 0.75,
+		TranscriptionModel:    "whisper-1",
+		UpdateMode:            "polling",
+		WebhookListenAddr:     ":8080",
+		ShutdownTimeout:       30,
+		LogLevel:              "info",
+		DataDirectory:         "data",
+		StorageBackend:        "file",
+		Budget: BudgetConfig{
+			WarningThreshold: 0.8,
+		},
+		Summary: SummaryConfig{
+			Model:           "openai/gpt-4o-mini",
+			ThresholdTokens: 4000,
+		},
+		Files: FilesConfig{
+			CodeFiles:     true,
+			CodeThreshold: 3000,
+			AnswerFiles:   "off",
+			MaxChunks:     3,
+		},
+		Documents: DocumentsConfig{
+			MaxSizeMB:     10,
+			MaxCharacters: 100000,
+		},
 	}
 
 	// Check if file exists
@@ -75,8 +261,44 @@ func Load(filename string) (*Config, error) {
 	if config.OpenRouterAPIKey == "" {
 		return nil, fmt.Errorf("openrouter_api_key is required")
 	}
-	if len(config.AllowedUsers) == 0 {
-		return nil, fmt.Errorf("allowed_users list cannot be empty")
+	if len(config.AllowedUsers) == 0 && len(config.AllowedChats) == 0 && len(config.Admins) == 0 {
+		return nil, fmt.Errorf("allowed_users, allowed_chats and admins cannot all be empty")
+	}
+	if config.StorageBackend != "file" && config.StorageBackend != "sqlite" {
+		return nil, fmt.Errorf("storage_backend must be \"file\" or \"sqlite\", got %q", config.StorageBackend)
+	}
+	if config.ContextWindowFraction <= 0 || config.ContextWindowFraction > 1 {
+		return nil, fmt.Errorf("context_window_fraction must be greater than 0 and at most 1, got %g", config.ContextWindowFraction)
+	}
+	if err := config.validateQueue(); err != nil {
+		return nil, err
+	}
+	if config.InlineDebounce < 0 {
+		return nil, fmt.Errorf("inline_debounce_ms must not be negative, got %d", config.InlineDebounce)
+	}
+	if config.ShutdownTimeout < 0 {
+		return nil, fmt.Errorf("shutdown_timeout_seconds must not be negative, got %d", config.ShutdownTimeout)
+	}
+	if err := config.Summary.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Files.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Documents.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.validateWebhook(); err != nil {
+		return nil, err
+	}
+	if err := config.Budget.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.validatePersonas(); err != nil {
+		return nil, err
+	}
+	if config.SQLitePath == "" {
+		config.SQLitePath = filepath.Join(config.DataDirectory, "bot.db")
 	}
 
 	return config, nil
@@ -105,3 +327,144 @@ func (c *Config) IsUserAllowed(userID int64) bool {
 	}
 	return false
 }
+
+// IsChatAllowed checks if a group chat ID is in the allowed chats list
+func (c *Config) IsChatAllowed(chatID int64) bool {
+	for _, id := range c.AllowedChats {
+		if id == chatID {
+			return true
+		}
+	}
+	return false
+}
+
+// validateWebhook checks the webhook settings when webhook mode is enabled
+func (c *Config) validateWebhook() error {
+	switch c.UpdateMode {
+	case "polling":
+		return nil
+	case "webhook":
+	default:
+		return fmt.Errorf("update_mode must be \"polling\" or \"webhook\", got %q", c.UpdateMode)
+	}
+
+	webhookURL, err := url.Parse(c.WebhookURL)
+	if err != nil || webhookURL.Scheme != "https" || webhookURL.Host == "" {
+		return fmt.Errorf("webhook_url must be a public https URL, got %q", c.WebhookURL)
+	}
+	if !webhookSecretPattern.MatchString(c.WebhookSecret) {
+		return fmt.Errorf("webhook_secret is required in webhook mode and may only contain A-Z, a-z, 0-9, _ and - (1-256 characters)")
+	}
+	if c.WebhookListenAddr == "" {
+		return fmt.Errorf("webhook_listen_addr is required in webhook mode")
+	}
+	return nil
+}
+
+// validateQueue checks the queueing of chat messages and the concurrency limit
+func (c *Config) validateQueue() error {
+	switch c.QueueMode {
+	case "queue", "merge", "reject":
+	default:
+		return fmt.Errorf("queue_mode must be \"queue\", \"merge\" or \"reject\", got %q", c.QueueMode)
+	}
+	if c.MaxConcurrentRequests < 0 {
+		return fmt.Errorf("max_concurrent_requests must not be negative, got %d", c.MaxConcurrentRequests)
+	}
+	return nil
+}
+
+// validatePersonas checks that global personas have a unique name and a prompt
+func (c *Config) validatePersonas() error {
+	seen := make(map[string]bool)
+	for _, persona := range c.Personas {
+		name := strings.ToLower(persona.Name)
+		if name == "" || strings.ContainsAny(name, " \t\n") {
+			return fmt.Errorf("persona names must be single words, got %q", persona.Name)
+		}
+		if persona.Prompt == "" {
+			return fmt.Errorf("persona %q has no prompt", persona.Name)
+		}
+		if seen[name] {
+			return fmt.Errorf("persona %q is defined more than once", persona.Name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// validate checks the summarizer settings when summarization is enabled
+func (s *SummaryConfig) validate() error {
+	if !s.Enabled {
+		return nil
+	}
+	if s.Model == "" {
+		return fmt.Errorf("summary.model is required when summarization is enabled")
+	}
+	if s.ThresholdTokens < 1000 {
+		return fmt.Errorf("summary.threshold_tokens must be at least 1000, got %d", s.ThresholdTokens)
+	}
+	return nil
+}
+
+// validate checks the thresholds and the format of answer files
+func (f *FilesConfig) validate() error {
+	if f.CodeThreshold < 1 {
+		return fmt.Errorf("files.code_threshold must be positive, got %d", f.CodeThreshold)
+	}
+	switch f.AnswerFiles {
+	case "md", "html", "off":
+	default:
+		return fmt.Errorf("files.answer_files must be \"md\", \"html\" or \"off\", got %q", f.AnswerFiles)
+	}
+	if f.MaxChunks < 1 {
+		return fmt.Errorf("files.max_chunks must be at least 1, got %d", f.MaxChunks)
+	}
+	return nil
+}
+
+// validate checks the document limits
+func (d *DocumentsConfig) validate() error {
+	if d.MaxSizeMB < 1 || d.MaxSizeMB > 20 {
+		return fmt.Errorf("documents.max_size_mb must be between 1 and 20, got %d", d.MaxSizeMB)
+	}
+	if d.MaxCharacters < 1 {
+		return fmt.Errorf("documents.max_characters must be positive, got %d", d.MaxCharacters)
+	}
+	return nil
+}
+
+// IsAdmin checks if a user ID is in the admins list
+func (c *Config) IsAdmin(userID int64) bool {
+	for _, id := range c.Admins {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// UserLimits returns the daily and monthly spending limits of a user
+func (b *BudgetConfig) UserLimits(userID int64) (daily, monthly float64) {
+	if override, ok := b.UserOverrides[userID]; ok {
+		return override.Daily, override.Monthly
+	}
+	return b.UserDaily, b.UserMonthly
+}
+
+// validate checks that limits are not negative and the warning threshold is a fraction
+func (b *BudgetConfig) validate() error {
+	limits := []float64{b.UserDaily, b.UserMonthly, b.GlobalDaily, b.GlobalMonthly}
+	for _, override := range b.UserOverrides {
+		limits = append(limits, override.Daily, override.Monthly)
+	}
+	for _, limit := range limits {
+		if limit < 0 {
+			return fmt.Errorf("budget limits cannot be negative")
+		}
+	}
+	if b.WarningThreshold <= 0 || b.WarningThreshold > 1 {
+		return fmt.Errorf("budget.warning_threshold must be between 0 and 1, got %v", b.WarningThreshold)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+// Package extract turns uploaded documents into plain text for the model: text and source
+// files, Markdown, CSV and JSON as they are, and PDF files with a small pure-Go text extractor.
+package extract
+
+import (
+	"bytes"
+	"errors"
+	"path"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+var (
+	// ErrUnsupported is returned for documents that aren't text or PDF
+	ErrUnsupported = errors.New("unsupported file type")
+	// ErrBinary is returned for a supposed text file with binary content
+	ErrBinary = errors.New("file is not a text file")
+	// ErrNoText is returned for documents without any text, like scanned PDF files
+	ErrNoText = errors.New("document contains no text")
+	// ErrEncrypted is returned for password protected PDF files
+	ErrEncrypted = errors.New("PDF file is encrypted")
+)
+
+// Document formats
+const (
+	formatText = "text"
+	formatPDF  = "pdf"
+)
+
+// textExtensions are the extensions of files that are read as text
+var textExtensions = map[string]bool{
+	".txt": true, ".text": true, ".md": true, ".markdown": true, ".rst": true, ".log": true,
+	".csv": true, ".tsv": true, ".json": true, ".jsonl": true, ".ndjson": true, ".ipynb": true,
+	".xml": true, ".yaml": true, ".yml": true, ".toml": true, ".ini": true, ".cfg": true, ".conf": true,
+	".env": true, ".properties": true, ".sql": true, ".graphql": true, ".proto": true,
+	".html": true, ".htm": true, ".css": true, ".scss": true, ".tex": true, ".srt": true, ".vtt": true,
+	".diff": true, ".patch": true, ".gitignore": true, ".dockerfile": true, ".mk": true, ".cmake": true,
+	".go": true, ".py": true, ".js": true, ".mjs": true, ".cjs": true, ".ts": true, ".tsx": true, ".jsx": true,
+	".vue": true, ".svelte": true, ".java": true, ".kt": true, ".kts": true, ".scala": true, ".gradle": true,
+	".c": true, ".h": true, ".cc": true, ".cpp": true, ".cxx": true, ".hpp": true, ".cs": true, ".m": true,
+	".rs": true, ".rb": true, ".php": true, ".swift": true, ".dart": true, ".lua": true, ".pl": true, ".r": true,
+	".ex": true, ".exs": true, ".erl": true, ".hs": true, ".clj": true, ".tf": true,
+	".sh": true, ".bash": true, ".zsh": true, ".ps1": true, ".bat": true,
+}
+
+// textNames are file names without an extension that are read as text
+var textNames = map[string]bool{
+	"dockerfile": true, "makefile": true, "readme": true, "license": true, "changelog": true,
+}
+
+// textMimeTypes are MIME types outside of text/* that are read as text
+var textMimeTypes = map[string]bool{
+	"application/json": true, "application/ld+json": true, "application/x-ndjson": true,
+	"application/xml": true, "application/yaml": true, "application/x-yaml": true, "application/toml": true,
+	"application/javascript": true, "application/x-javascript": true, "application/typescript": true,
+	"application/x-sh": true, "application/x-python": true, "application/sql": true,
+	"application/x-httpd-php": true, "application/x-tex": true,
+}
+
+// Supported reports whether Text can extract a document with the given file name and MIME type
+func Supported(name, mimeType string) bool {
+	return format(name, mimeType) != ""
+}
+
+// format returns the format of a document from its file name and MIME type, or an empty
+// string if it isn't supported
+func format(name, mimeType string) string {
+	mimeType, _, _ = strings.Cut(strings.ToLower(mimeType), ";")
+	mimeType = strings.TrimSpace(mimeType)
+	extension := strings.ToLower(path.Ext(name))
+
+	switch {
+	case extension == ".pdf" || mimeType == "application/pdf":
+		return formatPDF
+	case textExtensions[extension] || textNames[strings.ToLower(name)]:
+		return formatText
+	case strings.HasPrefix(mimeType, "text/") || textMimeTypes[mimeType]:
+		return formatText
+	}
+	return ""
+}
+
+// Text extracts the text of a document. The format is chosen by the file name and MIME type,
+// and files starting with a PDF header are always read as PDF.
+func Text(name, mimeType string, data []byte) (string, error) {
+	if bytes.HasPrefix(data, []byte("%PDF-")) {
+		return pdfText(data)
+	}
+
+	switch format(name, mimeType) {
+	case formatPDF:
+		return pdfText(data)
+	case formatText:
+		return decodeText(data)
+	}
+	return "", ErrUnsupported
+}
+
+// decodeText decodes a text file. UTF-8 and UTF-16 with a byte order mark are recognized;
+// other files that aren't valid UTF-8 are read as Windows-1252, which most legacy files are.
+func decodeText(data []byte) (string, error) {
+	var text string
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		data = data[3:]
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		text = decodeUTF16(data[2:], false)
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		text = decodeUTF16(data[2:], true)
+	}
+
+	if text == "" {
+		if bytes.IndexByte(data, 0) >= 0 {
+			return "", ErrBinary
+		}
+		if utf8.Valid(data) {
+			text = string(data)
+		} else {
+			text = decodeWinAnsi(data)
+		}
+	}
+
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	if strings.TrimSpace(text) == "" {
+		return "", ErrNoText
+	}
+	return text, nil
+}
+
+// decodeUTF16 decodes UTF-16 text without its byte order mark
+func decodeUTF16(data []byte, bigEndian bool) string {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+		} else {
+			units[i] = uint16(data[2*i+1])<<8 | uint16(data[2*i])
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// decodeWinAnsi decodes Windows-1252 text
+func decodeWinAnsi(data []byte) string {
+	var out strings.Builder
+	for _, c := range data {
+		if r := winAnsiEncoding[c]; r != 0 {
+			out.WriteRune(r)
+		} else {
+			out.WriteRune(rune(c))
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,58 @@
+package extract
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSupported(t *testing.T) {
+	tests := []struct {
+		name, mimeType string
+		want           bool
+	}{
+		{"main.go", "", true},
+		{"data.csv", "text/csv", true},
+		{"report.PDF", "", true},
+		{"scan", "application/pdf", true},
+		{"notes", "text/plain; charset=utf-8", true},
+		{"config", "application/json", true},
+		{"Dockerfile", "", true},
+		{"photo.png", "image/png", false},
+		{"archive.zip", "application/zip", false},
+		{"program", "application/octet-stream", false},
+	}
+	for _, tt := range tests {
+		if got := Supported(tt.name, tt.mimeType); got != tt.want {
+			t.Errorf("Supported(%q, %q) = %v, want %v", tt.name, tt.mimeType, got, tt.want)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		data    string
+		want    string
+		wantErr error
+	}{
+		{name: "utf-8", file: "a.md", data: "# Title\r\n\r\nText ✓\r\n", want: "# Title\n\nText ✓\n"},
+		{name: "byte order mark", file: "a.csv", data: "\xef\xbb\xbfa,b\n1,2", want: "a,b\n1,2"},
+		{name: "utf-16", file: "a.txt", data: "\xff\xfeh\x00i\x00 \x00\x3d\xd8\x00\xde", want: "hi 😀"},
+		{name: "windows-1252", file: "a.txt", data: "caf\xe9 \x93quoted\x94", want: "café “quoted”"},
+		{name: "binary", file: "a.json", data: "{\x00\x01}", wantErr: ErrBinary},
+		{name: "empty", file: "a.py", data: " \n\n", wantErr: ErrNoText},
+		{name: "unsupported", file: "a.zip", data: "PK\x03\x04", wantErr: ErrUnsupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Text(tt.file, "", []byte(tt.data))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Text() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Text() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
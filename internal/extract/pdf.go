@@ -0,0 +1,675 @@
+package extract
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/ascii85"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// PDF files are read without relying on the cross-reference table, which is often broken:
+// the file is scanned for "n g obj" definitions, skipping stream data, and objects packed into
+// object streams are added afterwards. This is enough to find the pages, their fonts and
+// their content streams, which is all text extraction needs.
+
+// Objects of a PDF file. Numbers are float64, strings are pdfString and dictionaries map
+// names without the slash to values.
+type (
+	pdfName    string
+	pdfString  []byte
+	pdfKeyword string
+	pdfArray   []any
+	pdfDict    map[pdfName]any
+	pdfRef     struct{ num, gen int }
+	pdfStream  struct {
+		dict pdfDict
+		raw  []byte
+	}
+)
+
+const (
+	// maxNesting limits the nesting of arrays and dictionaries and the depth of page trees and forms
+	maxNesting = 64
+	// maxStreamSize limits the decompressed size of a stream
+	maxStreamSize = 16 << 20
+	// maxDecodedSize limits the decompressed size of all streams of a file. Streams are decoded
+	// again wherever they are used, so a small file could otherwise expand to gigabytes.
+	maxDecodedSize = 64 << 20
+)
+
+var (
+	objectPattern     = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+	trailerPattern    = regexp.MustCompile(`trailer\s*<<`)
+	errEndOfData      = errors.New("unexpected end of data")
+	errStreamTooLarge = errors.New("stream too large")
+)
+
+// lexer reads the tokens and objects of PDF files and content streams
+type lexer struct {
+	data []byte
+	pos  int
+}
+
+func isWhite(c byte) bool {
+	return c == 0 || c == '\t' || c == '\n' || c == '\f' || c == '\r' || c == ' '
+}
+
+func isDelimiter(c byte) bool {
+	return bytes.IndexByte([]byte("()<>[]{}/%"), c) >= 0
+}
+
+// skipSpace skips whitespace and comments
+func (l *lexer) skipSpace() {
+	for l.pos < len(l.data) {
+		switch c := l.data[l.pos]; {
+		case isWhite(c):
+			l.pos++
+		case c == '%':
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// hasPrefix reports whether the data continues with prefix
+func (l *lexer) hasPrefix(prefix string) bool {
+	return bytes.HasPrefix(l.data[l.pos:], []byte(prefix))
+}
+
+// token reads the next token: a number, name, string, keyword or one of the delimiters
+// [ ] << >> { }, which are returned as keywords
+func (l *lexer) token() (any, error) {
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil, errEndOfData
+	}
+
+	switch c := l.data[l.pos]; c {
+	case '/':
+		return l.name(), nil
+	case '(':
+		return l.literalString(), nil
+	case '<':
+		if l.hasPrefix("<<") {
+			l.pos += 2
+			return pdfKeyword("<<"), nil
+		}
+		return l.hexString(), nil
+	case '>':
+		l.pos++
+		if l.hasPrefix(">") {
+			l.pos++
+		}
+		return pdfKeyword(">>"), nil
+	case '[', ']', '{', '}':
+		l.pos++
+		return pdfKeyword(c), nil
+	case ')':
+		// A stray closing parenthesis is skipped by the callers like any unknown keyword
+		l.pos++
+		return pdfKeyword(")"), nil
+	}
+
+	start := l.pos
+	for l.pos < len(l.data) && !isWhite(l.data[l.pos]) && !isDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+	word := string(l.data[start:l.pos])
+	if c := word[0]; c >= '0' && c <= '9' || c == '-' || c == '+' || c == '.' {
+		if number, err := strconv.ParseFloat(word, 64); err == nil {
+			return number, nil
+		}
+	}
+	return pdfKeyword(word), nil
+}
+
+// name reads a name, decoding #xx escapes
+func (l *lexer) name() pdfName {
+	l.pos++
+	var out []byte
+	for l.pos < len(l.data) && !isWhite(l.data[l.pos]) && !isDelimiter(l.data[l.pos]) {
+		c := l.data[l.pos]
+		if c == '#' && l.pos+2 < len(l.data) {
+			if decoded, err := hex.DecodeString(string(l.data[l.pos+1 : l.pos+3])); err == nil {
+				out = append(out, decoded[0])
+				l.pos += 3
+				continue
+			}
+		}
+		out = append(out, c)
+		l.pos++
+	}
+	return pdfName(out)
+}
+
+// literalString reads a string in parentheses, which may contain balanced parentheses and escapes
+func (l *lexer) literalString() pdfString {
+	l.pos++
+	var out []byte
+	depth := 1
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return out
+			}
+		case '\\':
+			if l.pos >= len(l.data) {
+				return out
+			}
+			c = l.data[l.pos]
+			l.pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				// A backslash at the end of a line continues the string
+				if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if c >= '0' && c <= '7' {
+					value := int(c - '0')
+					for i := 0; i < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+						value = value*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					c = byte(value)
+				}
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// hexString reads a string of hex digits in angle brackets
+func (l *lexer) hexString() pdfString {
+	l.pos++
+	var digits []byte
+	for l.pos < len(l.data) && l.data[l.pos] != '>' {
+		if c := l.data[l.pos]; !isWhite(c) {
+			digits = append(digits, c)
+		}
+		l.pos++
+	}
+	if l.pos < len(l.data) {
+		l.pos++
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	out := make([]byte, len(digits)/2)
+	n, _ := hex.Decode(out, digits)
+	return out[:n]
+}
+
+// object reads an object: a number or reference, name, string, array, dictionary or keyword
+func (l *lexer) object(depth int) (any, error) {
+	if depth > maxNesting {
+		return nil, errors.New("objects nested too deeply")
+	}
+	token, err := l.token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := token.(type) {
+	case float64:
+		// Two integers followed by R are a reference
+		start := l.pos
+		if gen, err := l.token(); err == nil {
+			if gen, ok := gen.(float64); ok {
+				if r, err := l.token(); err == nil && r == pdfKeyword("R") {
+					return pdfRef{num: int(t), gen: int(gen)}, nil
+				}
+			}
+		}
+		l.pos = start
+		return t, nil
+
+	case pdfKeyword:
+		switch t {
+		case "[":
+			var array pdfArray
+			for {
+				l.skipSpace()
+				if l.pos >= len(l.data) {
+					return array, errEndOfData
+				}
+				if l.data[l.pos] == ']' {
+					l.pos++
+					return array, nil
+				}
+				value, err := l.object(depth + 1)
+				if err != nil {
+					return array, err
+				}
+				array = append(array, value)
+			}
+		case "<<":
+			dict := pdfDict{}
+			for {
+				key, err := l.object(depth + 1)
+				if err != nil {
+					return dict, err
+				}
+				if key == pdfKeyword(">>") {
+					return dict, nil
+				}
+				name, ok := key.(pdfName)
+				if !ok {
+					continue
+				}
+				value, err := l.object(depth + 1)
+				if err != nil {
+					return dict, err
+				}
+				if value == pdfKeyword(">>") {
+					return dict, nil
+				}
+				dict[name] = value
+			}
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+	}
+	return token, nil
+}
+
+// pdfDocument holds the objects of a PDF file by object number
+type pdfDocument struct {
+	data    []byte
+	objects map[int]any
+	// decoded counts the decompressed bytes against maxDecodedSize; limited is set once a stream was too large
+	decoded int
+	limited bool
+}
+
+// parsePDF reads the objects of a PDF file
+func parsePDF(data []byte) (*pdfDocument, error) {
+	if !bytes.Contains(data[:min(len(data), 1024)], []byte("%PDF-")) {
+		return nil, errors.New("not a PDF file")
+	}
+
+	doc := &pdfDocument{data: data, objects: make(map[int]any)}
+	for pos := 0; ; {
+		loc := objectPattern.FindSubmatchIndex(data[pos:])
+		if loc == nil {
+			break
+		}
+		num, _ := strconv.Atoi(string(data[pos+loc[2] : pos+loc[3]]))
+		l := &lexer{data: data, pos: pos + loc[1]}
+		value, err := l.object(0)
+		if err != nil {
+			pos += loc[1]
+			continue
+		}
+
+		l.skipSpace()
+		if dict, ok := value.(pdfDict); ok && l.hasPrefix("stream") {
+			value = doc.readStream(l, dict)
+		}
+		// A later definition replaces an earlier one in incrementally updated files
+		doc.objects[num] = value
+		pos = l.pos
+	}
+
+	// Objects in object streams don't replace objects defined directly
+	var streams []*pdfStream
+	for _, num := range doc.numbers() {
+		if stream, ok := doc.objects[num].(*pdfStream); ok && stream.dict["Type"] == pdfName("ObjStm") {
+			streams = append(streams, stream)
+		}
+	}
+	for _, stream := range streams {
+		doc.loadObjectStream(stream)
+	}
+	return doc, nil
+}
+
+// readStream reads the data of a stream whose dictionary was just read
+func (d *pdfDocument) readStream(l *lexer, dict pdfDict) *pdfStream {
+	l.pos += len("stream")
+	if l.hasPrefix("\r\n") {
+		l.pos += 2
+	} else if l.hasPrefix("\n") || l.hasPrefix("\r") {
+		l.pos++
+	}
+	start := l.pos
+
+	// Trust a direct length only if it ends where endstream follows
+	end := -1
+	if length, ok := dict["Length"].(float64); ok && length >= 0 && start+int(length) <= len(d.data) {
+		after := &lexer{data: d.data, pos: start + int(length)}
+		after.skipSpace()
+		if after.hasPrefix("endstream") {
+			end = start + int(length)
+		}
+	}
+	if end < 0 {
+		end = len(d.data)
+		if i := bytes.Index(d.data[start:], []byte("endstream")); i >= 0 {
+			end = start + i
+		}
+	}
+
+	l.pos = end
+	return &pdfStream{dict: dict, raw: d.data[start:end]}
+}
+
+// loadObjectStream adds the objects packed into an object stream
+func (d *pdfDocument) loadObjectStream(stream *pdfStream) {
+	data, err := d.decode(stream)
+	if err != nil {
+		return
+	}
+	count, first := d.integer(stream.dict["N"]), d.integer(stream.dict["First"])
+
+	header := &lexer{data: data}
+	for i := 0; i < count; i++ {
+		num, err1 := header.token()
+		offset, err2 := header.token()
+		if err1 != nil || err2 != nil {
+			return
+		}
+		num2, ok1 := num.(float64)
+		offset2, ok2 := offset.(float64)
+		if !ok1 || !ok2 || first+int(offset2) >= len(data) {
+			return
+		}
+		if _, exists := d.objects[int(num2)]; exists {
+			continue
+		}
+		l := &lexer{data: data, pos: first + int(offset2)}
+		if value, err := l.object(0); err == nil {
+			d.objects[int(num2)] = value
+		}
+	}
+}
+
+// numbers returns the object numbers in ascending order
+func (d *pdfDocument) numbers() []int {
+	numbers := make([]int, 0, len(d.objects))
+	for num := range d.objects {
+		numbers = append(numbers, num)
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+// resolve follows references to the object they point to
+func (d *pdfDocument) resolve(value any) any {
+	for i := 0; i < maxNesting; i++ {
+		ref, ok := value.(pdfRef)
+		if !ok {
+			return value
+		}
+		value = d.objects[ref.num]
+	}
+	return nil
+}
+
+// dict resolves a value that should be a dictionary; the dictionary of a stream is returned too
+func (d *pdfDocument) dict(value any) pdfDict {
+	switch v := d.resolve(value).(type) {
+	case pdfDict:
+		return v
+	case *pdfStream:
+		return v.dict
+	}
+	return nil
+}
+
+// array resolves a value that should be an array
+func (d *pdfDocument) array(value any) pdfArray {
+	array, _ := d.resolve(value).(pdfArray)
+	return array
+}
+
+// stream resolves a value that should be a stream
+func (d *pdfDocument) stream(value any) *pdfStream {
+	stream, _ := d.resolve(value).(*pdfStream)
+	return stream
+}
+
+// number resolves a value that should be a number
+func (d *pdfDocument) number(value any) (float64, bool) {
+	number, ok := d.resolve(value).(float64)
+	return number, ok
+}
+
+// integer resolves a value that should be an integer, 0 if it isn't
+func (d *pdfDocument) integer(value any) int {
+	number, _ := d.number(value)
+	return int(number)
+}
+
+// name resolves a value that should be a name
+func (d *pdfDocument) name(value any) pdfName {
+	name, _ := d.resolve(value).(pdfName)
+	return name
+}
+
+// decode returns the data of a stream with its filters applied
+func (d *pdfDocument) decode(stream *pdfStream) ([]byte, error) {
+	var filters []pdfName
+	switch filter := d.resolve(stream.dict["Filter"]).(type) {
+	case pdfName:
+		filters = []pdfName{filter}
+	case pdfArray:
+		for _, f := range filter {
+			filters = append(filters, d.name(f))
+		}
+	}
+
+	data := stream.raw
+	for _, filter := range filters {
+		var err error
+		switch filter {
+		case "FlateDecode", "Fl":
+			data, err = inflate(data, min(maxStreamSize, maxDecodedSize-d.decoded))
+			d.decoded += len(data)
+		case "ASCIIHexDecode", "AHx":
+			l := &lexer{data: append([]byte{'<'}, data...)}
+			data = l.hexString()
+		case "ASCII85Decode", "A85":
+			data, err = decodeASCII85(data)
+		default:
+			err = fmt.Errorf("unsupported filter %s", filter)
+		}
+		if errors.Is(err, errStreamTooLarge) {
+			d.limited = true
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// inflate decompresses Flate data to at most limit bytes. Truncated or slightly corrupt streams
+// are common, so whatever could be decompressed is returned.
+func inflate(data []byte, limit int) ([]byte, error) {
+	var reader io.Reader
+	if zr, err := zlib.NewReader(bytes.NewReader(data)); err == nil {
+		reader = zr
+	} else {
+		reader = flate.NewReader(bytes.NewReader(data))
+	}
+	out, err := io.ReadAll(io.LimitReader(reader, int64(max(limit, 0))+1))
+	if len(out) > limit {
+		return nil, errStreamTooLarge
+	}
+	if err != nil && len(out) == 0 {
+		return nil, fmt.Errorf("failed to decompress stream: %w", err)
+	}
+	return out, nil
+}
+
+// decodeASCII85 decodes ASCII85 data up to its ~> end marker
+func decodeASCII85(data []byte) ([]byte, error) {
+	data = bytes.TrimPrefix(bytes.TrimSpace(data), []byte("<~"))
+	if end := bytes.Index(data, []byte("~>")); end >= 0 {
+		data = data[:end]
+	}
+	out := make([]byte, 4*len(data)/5+4)
+	n, _, err := ascii85.Decode(out, data, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ASCII85 stream: %w", err)
+	}
+	return out[:n], nil
+}
+
+// trailers returns the trailer dictionaries of the file, from classic trailers and
+// cross-reference streams
+func (d *pdfDocument) trailers() []pdfDict {
+	var trailers []pdfDict
+	for _, loc := range trailerPattern.FindAllIndex(d.data, -1) {
+		l := &lexer{data: d.data, pos: loc[1] - 2}
+		if dict, ok := ignoreError(l.object(0)).(pdfDict); ok {
+			trailers = append(trailers, dict)
+		}
+	}
+	for _, num := range d.numbers() {
+		if stream, ok := d.objects[num].(*pdfStream); ok && stream.dict["Type"] == pdfName("XRef") {
+			trailers = append(trailers, stream.dict)
+		}
+	}
+	return trailers
+}
+
+// ignoreError returns a value read even if an error followed it
+func ignoreError(value any, _ error) any {
+	return value
+}
+
+// pdfPage is a page with the resources it inherits from the page tree
+type pdfPage struct {
+	dict      pdfDict
+	resources pdfDict
+}
+
+// pages returns the pages in order. If the page tree can't be found, all page objects are
+// returned in the order of their object numbers.
+func (d *pdfDocument) pages() []pdfPage {
+	var root pdfDict
+	trailers := d.trailers()
+	for i := len(trailers) - 1; i >= 0 && root == nil; i-- {
+		root = d.dict(trailers[i]["Root"])
+	}
+	if root == nil {
+		for _, num := range d.numbers() {
+			if dict, ok := d.objects[num].(pdfDict); ok && dict["Type"] == pdfName("Catalog") {
+				root = dict
+			}
+		}
+	}
+
+	var pages []pdfPage
+	if root != nil {
+		d.walkPages(root["Pages"], nil, make(map[pdfRef]bool), 0, &pages)
+	}
+	if len(pages) > 0 {
+		return pages
+	}
+
+	for _, num := range d.numbers() {
+		if dict, ok := d.objects[num].(pdfDict); ok && dict["Type"] == pdfName("Page") {
+			pages = append(pages, pdfPage{dict: dict, resources: d.dict(dict["Resources"])})
+		}
+	}
+	return pages
+}
+
+// walkPages collects the pages of a page tree node
+func (d *pdfDocument) walkPages(node any, resources pdfDict, visited map[pdfRef]bool, depth int, pages *[]pdfPage) {
+	if ref, ok := node.(pdfRef); ok {
+		if visited[ref] {
+			return
+		}
+		visited[ref] = true
+	}
+	dict := d.dict(node)
+	if dict == nil || depth > maxNesting {
+		return
+	}
+	if own := d.dict(dict["Resources"]); own != nil {
+		resources = own
+	}
+
+	kids, isTree := dict["Kids"]
+	if dict["Type"] == pdfName("Pages") || isTree && dict["Type"] != pdfName("Page") {
+		for _, kid := range d.array(kids) {
+			d.walkPages(kid, resources, visited, depth+1, pages)
+		}
+		return
+	}
+	*pages = append(*pages, pdfPage{dict: dict, resources: resources})
+}
+
+// contents returns the concatenated content streams of a page
+func (d *pdfDocument) contents(page pdfPage) []byte {
+	var streams []*pdfStream
+	switch contents := d.resolve(page.dict["Contents"]).(type) {
+	case *pdfStream:
+		streams = append(streams, contents)
+	case pdfArray:
+		for _, item := range contents {
+			if stream := d.stream(item); stream != nil {
+				streams = append(streams, stream)
+			}
+		}
+	}
+
+	var out []byte
+	for _, stream := range streams {
+		data, err := d.decode(stream)
+		if err != nil {
+			continue
+		}
+		out = append(out, data...)
+		out = append(out, '\n')
+	}
+	return out
+}
+
+// encrypted reports whether the file is encrypted
+func (d *pdfDocument) encrypted() bool {
+	for _, trailer := range d.trailers() {
+		if _, ok := trailer["Encrypt"]; ok {
+			return true
+		}
+	}
+	return false
+}
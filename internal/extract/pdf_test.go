@@ -0,0 +1,220 @@
+package extract
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// buildPDF writes a PDF file with the objects numbered from 1; object 1 is the catalog and
+// empty objects are left out, e.g. because they are in an object stream
+func buildPDF(objects ...string) []byte {
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		if object == "" {
+			continue
+		}
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		if offset == 0 {
+			out.WriteString("0000000000 65535 f \n")
+		} else {
+			fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+		}
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
+
+// stream returns a stream object
+func stream(dict, data string) string {
+	return fmt.Sprintf("<< %s /Length %d >>\nstream\n%s\nendstream", dict, len(data), data)
+}
+
+// flateStream returns a compressed stream object
+func flateStream(dict, data string) string {
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	w.Write([]byte(data))
+	w.Close()
+	return stream("/Filter /FlateDecode "+dict, compressed.String())
+}
+
+func TestPDFText(t *testing.T) {
+	content := `BT /F1 12 Tf 14 TL 72 720 Td (Hello, World!) Tj
+0 -14 Td (Second line \(with parens\)) Tj
+T* [(Spaced)-1000(words)] TJ
+T* (caf\351) Tj ET
+q BI /W 4 /H 1 /BPC 8 /CS /G ID ab)( EI Q
+/Fm1 Do`
+	form := stream("/Type /XObject /Subtype /Form /BBox [0 0 100 100]", "BT /F1 12 Tf 72 600 Td (In a form) Tj ET")
+	differences := "<< /Type /Font /Subtype /Type1 /BaseFont /Custom /Encoding << /Differences [65 /H /i 67 /quoteright /uni00E9] >> >>"
+
+	data := buildPDF(
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R 8 0 R] /Count 2 /Resources << /Font << /F1 4 0 R /F2 7 0 R >> /XObject << /Fm1 6 0 R >> >> >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 5 0 R >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+		stream("", content),
+		form,
+		differences,
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents [9 0 R] >>",
+		// A wrong length is ignored, the stream ends at endstream
+		"<< /Length 3 >>\nstream\nBT /F2 12 Tf 72 720 Td (AB) Tj 0 -14 Td (CD) Tj ET\nendstream",
+	)
+
+	got, err := Text("document.pdf", "application/pdf", data)
+	if err != nil {
+		t.Fatalf("Text() error: %v", err)
+	}
+	want := "Hello, World!\nSecond line (with parens)\nSpaced words\ncafé\nIn a form\n\nHi\n’é"
+	if got != want {
+		t.Errorf("Text()\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestPDFTextUnicodeFont(t *testing.T) {
+	font := "<< /Type /Font /Subtype /Type0 /BaseFont /Noto /Encoding /Identity-H /DescendantFonts [6 0 R] /ToUnicode 7 0 R >>"
+	cidFont := "<< /Type /Font /Subtype /CIDFontType2 /DW 1000 /W [1 [500 500] 3 4 250] >>"
+	header := fmt.Sprintf("4 0 6 %d ", len(font)+1)
+	objects := flateStream(fmt.Sprintf("/Type /ObjStm /N 2 /First %d", len(header)), header+font+" "+cidFont)
+
+	cmap := `/CIDInit /ProcSet findresource begin
+12 dict begin
+begincmap
+/CMapName /Adobe-Identity-UCS def
+1 begincodespacerange
+<0000> <FFFF>
+endcodespacerange
+2 beginbfchar
+<0001> <0041>
+<0002> <00E9>
+endbfchar
+2 beginbfrange
+<0003> <0005> <0061>
+<0010> <0011> [<D83DDE00> <00660069>]
+endbfrange
+endcmap
+CMapName currentdict /CMap defineresource pop
+end
+end`
+	content := "BT /F1 10 Tf 1 0 0 1 50 700 Tm <000100020003> Tj [<0004> -600 <0005>] TJ 1 0 0 1 50 680 Tm <00100011> Tj ET"
+
+	data := buildPDF(
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /Resources << /Font << /F1 4 0 R >> >> /Contents 5 0 R >>",
+		"",
+		flateStream("", content),
+		"",
+		flateStream("", cmap),
+		objects,
+	)
+
+	got, err := Text("unicode.pdf", "", data)
+	if err != nil {
+		t.Fatalf("Text() error: %v", err)
+	}
+	if want := "Aéab c\n😀fi"; got != want {
+		t.Errorf("Text() = %q, want %q", got, want)
+	}
+}
+
+func TestPDFTextErrors(t *testing.T) {
+	drawing := buildPDF(
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /Contents 4 0 R >>",
+		stream("", "0 0 m 100 100 l S"),
+	)
+	encrypted := bytes.Replace(drawing, []byte("/Root 1 0 R"), []byte("/Root 1 0 R /Encrypt 5 0 R"), 1)
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"no text", drawing, ErrNoText},
+		{"encrypted", encrypted, ErrEncrypted},
+	}
+	for _, tt := range tests {
+		if _, err := Text("file.pdf", "application/pdf", tt.data); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Text() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	if _, err := Text("file.pdf", "application/pdf", []byte("not a pdf")); err == nil {
+		t.Error("Text() of an invalid PDF file succeeded")
+	}
+}
+
+func TestPDFDecompressionLimits(t *testing.T) {
+	// A page whose content is a small stream that decompresses to more than a stream may have
+	text := "BT /F1 12 Tf 72 720 Td (Hello) Tj ET\n"
+	pdf := func(contents, data string) []byte {
+		return buildPDF(
+			"<< /Type /Catalog /Pages 2 0 R >>",
+			"<< /Type /Pages /Kids [3 0 R] /Count 1 /Resources << /Font << /F1 4 0 R >> >> >>",
+			"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents "+contents+" >>",
+			"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+			flateStream("", data),
+		)
+	}
+
+	bomb := pdf("5 0 R", text+strings.Repeat(" ", maxStreamSize))
+	if len(bomb) > 64<<10 {
+		t.Fatalf("test file has %d bytes, want a highly compressed stream", len(bomb))
+	}
+	if _, err := Text("bomb.pdf", "application/pdf", bomb); err == nil || errors.Is(err, ErrNoText) {
+		t.Errorf("Text() of an oversized stream: error = %v, want a size error", err)
+	}
+
+	// Streams within the limit count against the limit of the file each time they are used
+	contents := "[" + strings.Repeat("5 0 R ", 2*maxDecodedSize/maxStreamSize) + "]"
+	doc, err := parsePDF(pdf(contents, text+strings.Repeat(" ", maxStreamSize/2)))
+	if err != nil {
+		t.Fatalf("parsePDF() error: %v", err)
+	}
+	content := doc.contents(doc.pages()[0])
+	if !doc.limited || doc.decoded > maxDecodedSize || len(content) > maxDecodedSize+2*maxDecodedSize/maxStreamSize {
+		t.Errorf("decoded %d bytes into %d bytes of content (limited %v), want at most %d", doc.decoded, len(content), doc.limited, maxDecodedSize)
+	}
+	if !bytes.Contains(content, []byte("(Hello) Tj")) {
+		t.Error("content of the streams within the limit is missing")
+	}
+}
+
+func TestEncodings(t *testing.T) {
+	runes := []struct {
+		got, want rune
+	}{
+		{winAnsiEncoding[0x80], '€'},
+		{winAnsiEncoding[0x9F], 'Ÿ'},
+		{winAnsiEncoding[0xE9], 'é'},
+		{macRomanEncoding[0x8E], 'é'},
+		{macRomanEncoding[0xCA], '\u00a0'},
+		{macRomanEncoding[0xFF], 'ˇ'},
+		{glyphRune("eacute"), 'é'},
+		{glyphRune("ydieresis"), 'ÿ'},
+		{glyphRune("asciitilde"), '~'},
+		{glyphRune("zero"), '0'},
+		{glyphRune("uni20AC"), '€'},
+		{glyphRune("u1F600"), '😀'},
+		{glyphRune("unknown"), 0},
+	}
+	for i, r := range runes {
+		if r.got != r.want {
+			t.Errorf("case %d: got %q, want %q", i, r.got, r.want)
+		}
+	}
+}
@@ -0,0 +1,608 @@
+package extract
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+var blankLines = regexp.MustCompile(`\n{3,}`)
+
+// pdfText extracts the text of a PDF file, page by page
+func pdfText(data []byte) (string, error) {
+	doc, err := parsePDF(data)
+	if err != nil {
+		return "", err
+	}
+	if doc.encrypted() {
+		return "", ErrEncrypted
+	}
+
+	// Fonts are shared by the pages, so their CMaps are read once
+	fonts := make(map[pdfRef]*pdfFont)
+	var pages []string
+	for _, page := range doc.pages() {
+		e := &textExtractor{doc: doc, fonts: fonts}
+		e.run(doc.contents(page), page.resources, 0)
+		if text := cleanText(e.out.String()); text != "" {
+			pages = append(pages, text)
+		}
+	}
+
+	text := strings.Join(pages, "\n\n")
+	if text == "" && doc.limited {
+		return "", fmt.Errorf("PDF streams decompress to more than %d MB", maxDecodedSize>>20)
+	}
+	if text == "" {
+		return "", ErrNoText
+	}
+	return text, nil
+}
+
+// cleanText removes trailing spaces and runs of blank lines
+func cleanText(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+// matrix is a PDF transformation matrix [a b c d e f]
+type matrix [6]float64
+
+var identity = matrix{1, 0, 0, 1, 0, 0}
+
+// translate returns the matrix moved by tx and ty in its own coordinates
+func (m matrix) translate(tx, ty float64) matrix {
+	return matrix{m[0], m[1], m[2], m[3], tx*m[0] + ty*m[2] + m[4], tx*m[1] + ty*m[3] + m[5]}
+}
+
+// textExtractor interprets content streams and writes the text they show. Only the position
+// of the text matters: a change of line starts a new line and a gap between two pieces of
+// text on the same line becomes a space.
+type textExtractor struct {
+	doc   *pdfDocument
+	fonts map[pdfRef]*pdfFont
+	out   strings.Builder
+
+	// Text state
+	font                     *pdfFont
+	fontSize                 float64
+	charSpacing, wordSpacing float64
+	scale, leading           float64
+	tm, tlm                  matrix
+
+	// Position after the last text shown
+	shown        bool
+	lastX, lastY float64
+}
+
+// run interprets a content stream with the given resources; forms are run recursively
+func (e *textExtractor) run(content []byte, resources pdfDict, depth int) {
+	if depth == 0 {
+		e.scale, e.tm, e.tlm = 1, identity, identity
+	}
+
+	l := &lexer{data: content}
+	var operands []any
+	for {
+		value, err := l.object(0)
+		if err != nil {
+			return
+		}
+		op, ok := value.(pdfKeyword)
+		if !ok {
+			operands = append(operands, value)
+			continue
+		}
+
+		switch op {
+		case "BT":
+			e.tm, e.tlm = identity, identity
+		case "Tf":
+			if len(operands) >= 2 {
+				name, _ := operands[len(operands)-2].(pdfName)
+				e.font = e.loadFont(resources, name)
+				e.fontSize, _ = operands[len(operands)-1].(float64)
+			}
+		case "Tc":
+			e.charSpacing = lastNumber(operands)
+		case "Tw":
+			e.wordSpacing = lastNumber(operands)
+		case "Tz":
+			e.scale = lastNumber(operands) / 100
+		case "TL":
+			e.leading = lastNumber(operands)
+		case "Td", "TD":
+			if len(operands) >= 2 {
+				tx, _ := operands[len(operands)-2].(float64)
+				ty, _ := operands[len(operands)-1].(float64)
+				if op == "TD" {
+					e.leading = -ty
+				}
+				e.tlm = e.tlm.translate(tx, ty)
+				e.tm = e.tlm
+			}
+		case "Tm":
+			if len(operands) >= 6 {
+				for i := range e.tlm {
+					e.tlm[i], _ = operands[len(operands)-6+i].(float64)
+				}
+				e.tm = e.tlm
+			}
+		case "T*":
+			e.nextLine()
+		case "Tj":
+			if len(operands) > 0 {
+				e.show(operands[len(operands)-1])
+			}
+		case "'", "\"":
+			if op == "\"" && len(operands) >= 3 {
+				e.wordSpacing, _ = operands[len(operands)-3].(float64)
+				e.charSpacing, _ = operands[len(operands)-2].(float64)
+			}
+			e.nextLine()
+			if len(operands) > 0 {
+				e.show(operands[len(operands)-1])
+			}
+		case "TJ":
+			if len(operands) > 0 {
+				array, _ := operands[len(operands)-1].(pdfArray)
+				for _, item := range array {
+					if adjustment, ok := item.(float64); ok {
+						e.tm = e.tm.translate(-adjustment/1000*e.fontSize*e.scale, 0)
+					} else {
+						e.show(item)
+					}
+				}
+			}
+		case "Do":
+			if len(operands) > 0 && depth < maxNesting {
+				name, _ := operands[len(operands)-1].(pdfName)
+				e.runForm(resources, name, depth)
+			}
+		case "BI":
+			l.skipInlineImage()
+		}
+		operands = operands[:0]
+	}
+}
+
+// lastNumber returns the last operand as a number
+func lastNumber(operands []any) float64 {
+	if len(operands) == 0 {
+		return 0
+	}
+	number, _ := operands[len(operands)-1].(float64)
+	return number
+}
+
+// nextLine moves to the start of the next line
+func (e *textExtractor) nextLine() {
+	e.tlm = e.tlm.translate(0, -e.leading)
+	e.tm = e.tlm
+}
+
+// runForm runs a form XObject, which can contain text of its own
+func (e *textExtractor) runForm(resources pdfDict, name pdfName, depth int) {
+	form := e.doc.stream(e.doc.dict(resources["XObject"])[name])
+	if form == nil || form.dict["Subtype"] != pdfName("Form") {
+		return
+	}
+	content, err := e.doc.decode(form)
+	if err != nil {
+		return
+	}
+	if own := e.doc.dict(form.dict["Resources"]); own != nil {
+		resources = own
+	}
+	e.run(content, resources, depth+1)
+}
+
+// show writes a string shown at the current position and moves past it
+func (e *textExtractor) show(value any) {
+	s, ok := value.(pdfString)
+	if !ok {
+		return
+	}
+	font := e.font
+	if font == nil {
+		font = defaultFont
+	}
+
+	size := e.fontSize * math.Hypot(e.tm[2], e.tm[3])
+	if size == 0 {
+		size = 1
+	}
+	x, y := e.tm[4], e.tm[5]
+	if e.shown {
+		switch {
+		case math.Abs(y-e.lastY) > size/2:
+			e.out.WriteByte('\n')
+		case math.Abs(x-e.lastX) > size/5:
+			e.writeSpace()
+		}
+	}
+
+	advance := 0.0
+	for _, code := range font.codes(s) {
+		e.out.WriteString(font.text(code))
+		advance += font.width(code)/1000*e.fontSize + e.charSpacing
+		if code == ' ' && font.codeLength == 1 {
+			advance += e.wordSpacing
+		}
+	}
+	e.tm = e.tm.translate(advance*e.scale, 0)
+	e.shown, e.lastX, e.lastY = true, e.tm[4], e.tm[5]
+}
+
+// writeSpace writes a space unless the text already ends with whitespace
+func (e *textExtractor) writeSpace() {
+	text := e.out.String()
+	if text != "" && !strings.HasSuffix(text, " ") && !strings.HasSuffix(text, "\n") {
+		e.out.WriteByte(' ')
+	}
+}
+
+// skipInlineImage skips the data of an inline image up to its EI operator
+func (l *lexer) skipInlineImage() {
+	for {
+		token, err := l.token()
+		if err != nil || token == pdfKeyword("ID") {
+			break
+		}
+	}
+	l.pos++
+	for l.pos+2 <= len(l.data) {
+		if l.hasPrefix("EI") && isWhite(l.data[l.pos-1]) && (l.pos+2 == len(l.data) || isWhite(l.data[l.pos+2])) {
+			l.pos += 2
+			return
+		}
+		l.pos++
+	}
+	l.pos = len(l.data)
+}
+
+// pdfFont decodes the strings shown with a font
+type pdfFont struct {
+	codeLength   int               // bytes per character code
+	toUnicode    map[uint32]string // from the ToUnicode CMap
+	encoding     *[256]rune        // for simple fonts without a mapping
+	widths       map[uint32]float64
+	defaultWidth float64
+}
+
+// defaultFont is used when a font is missing
+var defaultFont = &pdfFont{codeLength: 1, encoding: &winAnsiEncoding, defaultWidth: 500}
+
+// codes splits a string into character codes
+func (f *pdfFont) codes(s pdfString) []uint32 {
+	codes := make([]uint32, 0, len(s)/f.codeLength)
+	for i := 0; i+f.codeLength <= len(s); i += f.codeLength {
+		var code uint32
+		for _, c := range s[i : i+f.codeLength] {
+			code = code<<8 | uint32(c)
+		}
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+// text returns the text of a character code
+func (f *pdfFont) text(code uint32) string {
+	if text, ok := f.toUnicode[code]; ok {
+		return text
+	}
+	if f.encoding != nil && code < 256 {
+		if r := f.encoding[code]; r != 0 {
+			return string(r)
+		}
+	}
+	return ""
+}
+
+// width returns the width of a character code in thousandths of a text space unit
+func (f *pdfFont) width(code uint32) float64 {
+	if width, ok := f.widths[code]; ok {
+		return width
+	}
+	return f.defaultWidth
+}
+
+// loadFont returns the font with the given name in the resources
+func (e *textExtractor) loadFont(resources pdfDict, name pdfName) *pdfFont {
+	value := e.doc.dict(resources["Font"])[name]
+	ref, isRef := value.(pdfRef)
+	if font, ok := e.fonts[ref]; isRef && ok {
+		return font
+	}
+
+	font := e.doc.newFont(e.doc.dict(value))
+	if isRef {
+		e.fonts[ref] = font
+	}
+	return font
+}
+
+// newFont reads the encoding and widths of a font dictionary
+func (d *pdfDocument) newFont(dict pdfDict) *pdfFont {
+	if dict == nil {
+		return nil
+	}
+	font := &pdfFont{codeLength: 1, widths: make(map[uint32]float64), defaultWidth: 500}
+
+	if d.name(dict["Subtype"]) == "Type0" {
+		font.codeLength = 2
+		font.defaultWidth = 1000
+		if descendants := d.array(dict["DescendantFonts"]); len(descendants) > 0 {
+			d.readCIDWidths(font, d.dict(descendants[0]))
+		}
+	} else {
+		font.encoding = d.simpleEncoding(dict["Encoding"])
+		first := d.integer(dict["FirstChar"])
+		for i, width := range d.array(dict["Widths"]) {
+			if w, ok := d.number(width); ok {
+				font.widths[uint32(first+i)] = w
+			}
+		}
+		if missing, ok := d.number(d.dict(dict["FontDescriptor"])["MissingWidth"]); ok && missing > 0 {
+			font.defaultWidth = missing
+		}
+	}
+
+	if stream := d.stream(dict["ToUnicode"]); stream != nil {
+		if data, err := d.decode(stream); err == nil {
+			font.toUnicode, font.codeLength = parseToUnicode(data, font.codeLength)
+		}
+	}
+	return font
+}
+
+// readCIDWidths reads the widths of a CID font: W holds "c [w1 w2 ...]" and "cfirst clast w" entries
+func (d *pdfDocument) readCIDWidths(font *pdfFont, cidFont pdfDict) {
+	if width, ok := d.number(cidFont["DW"]); ok {
+		font.defaultWidth = width
+	}
+	w := d.array(cidFont["W"])
+	for i := 0; i+1 < len(w); {
+		first, ok := d.number(w[i])
+		if !ok {
+			return
+		}
+		if widths := d.array(w[i+1]); widths != nil {
+			for j, width := range widths {
+				if value, ok := d.number(width); ok {
+					font.widths[uint32(int(first)+j)] = value
+				}
+			}
+			i += 2
+			continue
+		}
+		if i+2 >= len(w) {
+			return
+		}
+		last, _ := d.number(w[i+1])
+		width, _ := d.number(w[i+2])
+		for code := first; code <= last && code-first < 65536; code++ {
+			font.widths[uint32(code)] = width
+		}
+		i += 3
+	}
+}
+
+// simpleEncoding returns the encoding of a simple font: a named base encoding with optional
+// Differences, which replace codes by glyph names
+func (d *pdfDocument) simpleEncoding(value any) *[256]rune {
+	var encoding [256]rune
+	switch base := d.resolve(value).(type) {
+	case pdfName:
+		encoding = baseEncoding(base)
+	case pdfDict:
+		encoding = baseEncoding(d.name(base["BaseEncoding"]))
+		code := 0
+		for _, item := range d.array(base["Differences"]) {
+			switch item := d.resolve(item).(type) {
+			case float64:
+				code = int(item)
+			case pdfName:
+				if code >= 0 && code < 256 {
+					if r := glyphRune(string(item)); r != 0 {
+						encoding[code] = r
+					}
+				}
+				code++
+			}
+		}
+	default:
+		encoding = winAnsiEncoding
+	}
+	return &encoding
+}
+
+// baseEncoding returns a named encoding; StandardEncoding is close enough to WinAnsi for text
+func baseEncoding(name pdfName) [256]rune {
+	if name == "MacRomanEncoding" {
+		return macRomanEncoding
+	}
+	return winAnsiEncoding
+}
+
+// parseToUnicode reads the mappings of a ToUnicode CMap and the length of its codes
+func parseToUnicode(data []byte, codeLength int) (map[uint32]string, int) {
+	mapping := make(map[uint32]string)
+	l := &lexer{data: data}
+	var operands []any
+	for {
+		value, err := l.object(0)
+		if err != nil {
+			break
+		}
+		op, ok := value.(pdfKeyword)
+		if !ok {
+			operands = append(operands, value)
+			continue
+		}
+
+		// The entries of a section are collected as operands of its end keyword
+		switch op {
+		case "endcodespacerange":
+			if len(operands) > 0 {
+				if low, ok := operands[0].(pdfString); ok && len(low) > 0 && len(low) <= 4 {
+					codeLength = len(low)
+				}
+			}
+		case "endbfchar":
+			for i := 0; i+1 < len(operands); i += 2 {
+				source, ok1 := operands[i].(pdfString)
+				target, ok2 := operands[i+1].(pdfString)
+				if ok1 && ok2 {
+					mapping[codeOf(source)] = decodeUTF16BE(target)
+				}
+			}
+		case "endbfrange":
+			for i := 0; i+2 < len(operands); i += 3 {
+				low, ok1 := operands[i].(pdfString)
+				high, ok2 := operands[i+1].(pdfString)
+				if !ok1 || !ok2 {
+					continue
+				}
+				first, last := codeOf(low), codeOf(high)
+				switch target := operands[i+2].(type) {
+				case pdfString:
+					runes := []rune(decodeUTF16BE(target))
+					for code := first; code <= last && code-first < 65536 && len(runes) > 0; code++ {
+						shifted := append([]rune(nil), runes...)
+						shifted[len(shifted)-1] += rune(code - first)
+						mapping[code] = string(shifted)
+					}
+				case pdfArray:
+					for j, item := range target {
+						if s, ok := item.(pdfString); ok && first+uint32(j) <= last {
+							mapping[first+uint32(j)] = decodeUTF16BE(s)
+						}
+					}
+				}
+			}
+		}
+		operands = operands[:0]
+	}
+	return mapping, codeLength
+}
+
+// codeOf returns a character code from its bytes
+func codeOf(s pdfString) uint32 {
+	var code uint32
+	for _, c := range s {
+		code = code<<8 | uint32(c)
+	}
+	return code
+}
+
+// decodeUTF16BE decodes the UTF-16BE text of a CMap
+func decodeUTF16BE(s pdfString) string {
+	units := make([]uint16, 0, len(s)/2)
+	for i := 0; i+1 < len(s); i += 2 {
+		units = append(units, uint16(s[i])<<8|uint16(s[i+1]))
+	}
+	return string(utf16.Decode(units))
+}
+
+// glyphRune returns the character of a glyph name: a name from the Adobe Glyph List for the
+// Latin characters, uniXXXX or uXXXX[XX]
+func glyphRune(name string) rune {
+	if r, ok := glyphNames[name]; ok {
+		return r
+	}
+	// uniXXXXYYYY names a ligature of several characters, the first one is kept
+	if hexCode, ok := strings.CutPrefix(name, "uni"); ok && len(hexCode) >= 4 {
+		if code, err := strconv.ParseUint(hexCode[:4], 16, 32); err == nil {
+			return rune(code)
+		}
+	}
+	if hexCode, ok := strings.CutPrefix(name, "u"); ok && len(hexCode) >= 4 && len(hexCode) <= 6 {
+		if code, err := strconv.ParseUint(hexCode, 16, 32); err == nil && code <= 0x10FFFF {
+			return rune(code)
+		}
+	}
+	return 0
+}
+
+// glyphNames maps glyph names to characters; built from the names of the ASCII and Latin-1
+// characters in order, plus the extra characters of WinAnsiEncoding
+var glyphNames = func() map[string]rune {
+	names := make(map[string]rune)
+	ascii := strings.Fields(`space exclam quotedbl numbersign dollar percent ampersand quotesingle
+		parenleft parenright asterisk plus comma hyphen period slash zero one two three four five six
+		seven eight nine colon semicolon less equal greater question at`)
+	for i, name := range ascii {
+		names[name] = rune(' ' + i)
+	}
+	for r := 'A'; r <= 'Z'; r++ {
+		names[string(r)] = r
+		names[string(r+'a'-'A')] = r + 'a' - 'A'
+	}
+	for i, name := range strings.Fields(`bracketleft backslash bracketright asciicircum underscore grave`) {
+		names[name] = rune('[' + i)
+	}
+	for i, name := range strings.Fields(`braceleft bar braceright asciitilde`) {
+		names[name] = rune('{' + i)
+	}
+	latin1 := strings.Fields(`exclamdown cent sterling currency yen brokenbar section dieresis
+		copyright ordfeminine guillemotleft logicalnot hyphen registered macron degree plusminus
+		twosuperior threesuperior acute mu paragraph periodcentered cedilla onesuperior ordmasculine
+		guillemotright onequarter onehalf threequarters questiondown Agrave Aacute Acircumflex Atilde
+		Adieresis Aring AE Ccedilla Egrave Eacute Ecircumflex Edieresis Igrave Iacute Icircumflex
+		Idieresis Eth Ntilde Ograve Oacute Ocircumflex Otilde Odieresis multiply Oslash Ugrave Uacute
+		Ucircumflex Udieresis Yacute Thorn germandbls agrave aacute acircumflex atilde adieresis aring
+		ae ccedilla egrave eacute ecircumflex edieresis igrave iacute icircumflex idieresis eth ntilde
+		ograve oacute ocircumflex otilde odieresis divide oslash ugrave uacute ucircumflex udieresis
+		yacute thorn ydieresis`)
+	for i, name := range latin1 {
+		if _, exists := names[name]; !exists {
+			names[name] = rune(0xA1 + i)
+		}
+	}
+	extra := map[string]rune{
+		"Euro": '€', "quotesinglbase": '‚', "florin": 'ƒ', "quotedblbase": '„', "ellipsis": '…',
+		"dagger": '†', "daggerdbl": '‡', "circumflex": 'ˆ', "perthousand": '‰', "Scaron": 'Š',
+		"guilsinglleft": '‹', "OE": 'Œ', "Zcaron": 'Ž', "quoteleft": '‘', "quoteright": '’',
+		"quotedblleft": '“', "quotedblright": '”', "bullet": '•', "endash": '–', "emdash": '—',
+		"tilde": '˜', "trademark": '™', "scaron": 'š', "guilsinglright": '›', "oe": 'œ',
+		"zcaron": 'ž', "Ydieresis": 'Ÿ', "fi": 'ﬁ', "fl": 'ﬂ', "minus": '−', "nbspace": '\u00a0',
+		"dotlessi": 'ı', "fraction": '⁄',
+	}
+	for name, r := range extra {
+		names[name] = r
+	}
+	return names
+}()
+
+// winAnsiEncoding is Windows-1252; codes without a character are 0
+var winAnsiEncoding = func() [256]rune {
+	var encoding [256]rune
+	for i := 0; i < 256; i++ {
+		encoding[i] = rune(i)
+	}
+	for i, r := range []rune("€\u0000‚ƒ„…†‡ˆ‰Š‹Œ\u0000Ž\u0000\u0000‘’“”•–—˜™š›œ\u0000žŸ") {
+		encoding[0x80+i] = r
+	}
+	return encoding
+}()
+
+// macRomanEncoding is Mac OS Roman
+var macRomanEncoding = func() [256]rune {
+	var encoding [256]rune
+	for i := 0; i < 128; i++ {
+		encoding[i] = rune(i)
+	}
+	upper := "ÄÅÇÉÑÖÜáàâäãåçéè" + "êëíìîïñóòôöõúùûü" + "†°¢£§•¶ß®©™´¨≠ÆØ" + "∞±≤≥¥µ∂∑∏π∫ªºΩæø" +
+		"¿¡¬√ƒ≈∆«»…\u00a0ÀÃÕŒœ" + "–—“”‘’÷◊ÿŸ⁄€‹›ﬁﬂ" + "‡·‚„‰ÂÊÁËÈÍÎÏÌÓÔ" + "\uf8ffÒÚÛÙıˆ˜¯˘˙˚¸˝˛ˇ"
+	for i, r := range []rune(upper) {
+		encoding[0x80+i] = r
+	}
+	return encoding
+}()
@@ -0,0 +1,517 @@
+package markdown
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	autolinkPattern = regexp.MustCompile(`^<((?:https?|ftp|tg)://[^\s<>]+|mailto:[^\s<>]+)>`)
+	rawTagPattern   = regexp.MustCompile(`^<(/?)(b|strong|i|em|u|ins|s|strike|del|code)>`)
+	lineBreakTag    = regexp.MustCompile(`^<br\s*/?>`)
+	entityPattern   = regexp.MustCompile(`^&(?:#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6}|[A-Za-z][A-Za-z0-9]{1,31});`)
+	linkSchemes     = []string{"http://", "https://", "ftp://", "tg://", "mailto:"}
+)
+
+// rawTags maps the inline HTML tags models sometimes emit to Telegram's tags.
+// They are kept only when an opening and a closing tag pair up.
+var rawTags = map[string]string{
+	"b": "b", "strong": "b",
+	"i": "i", "em": "i",
+	"u": "u", "ins": "u",
+	"s": "s", "strike": "s", "del": "s",
+	"code": "code",
+}
+
+// inline is a piece of inline content. Plain text is escaped when rendered, HTML is emitted as is.
+// Delimiter runs of *, _ and ~ and raw tags become tags when they pair up and text otherwise.
+type inline struct {
+	text      string
+	html      bool
+	delimiter string // "*", "_", "~" or a raw tag name
+	count     int
+	canOpen   bool
+	canClose  bool
+	before    []string // tags opened before the content of the piece
+	after     []string // tags closed after the content of the piece
+
+	prev, next *inline
+}
+
+// inlineParser splits text into a linked list of pieces
+type inlineParser struct {
+	head, tail *inline
+	text       strings.Builder
+	noLinks    bool // inside a link label, where Telegram doesn't allow nested links
+}
+
+// renderInline renders the inline content of a block
+func renderInline(text string) string {
+	return (&inlineParser{}).render(text)
+}
+
+// render parses text, pairs up delimiters and returns the HTML
+func (p *inlineParser) render(text string) string {
+	p.parse(text)
+	p.processEmphasis()
+
+	var out strings.Builder
+	for n := p.head; n != nil; n = n.next {
+		for _, tag := range n.before {
+			out.WriteString(tag)
+		}
+		if n.html {
+			out.WriteString(n.text)
+		} else {
+			out.WriteString(escapeText(n.text))
+		}
+		for _, tag := range n.after {
+			out.WriteString(tag)
+		}
+	}
+	return out.String()
+}
+
+// append adds a piece to the list
+func (p *inlineParser) append(n *inline) {
+	p.flushText()
+	n.prev = p.tail
+	if p.tail != nil {
+		p.tail.next = n
+	} else {
+		p.head = n
+	}
+	p.tail = n
+}
+
+// flushText turns collected plain text into a piece
+func (p *inlineParser) flushText() {
+	if p.text.Len() == 0 {
+		return
+	}
+	n := &inline{text: p.text.String(), prev: p.tail}
+	p.text.Reset()
+	if p.tail != nil {
+		p.tail.next = n
+	} else {
+		p.head = n
+	}
+	p.tail = n
+}
+
+// parse splits text into plain text, rendered HTML and delimiter runs
+func (p *inlineParser) parse(text string) {
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text) && isASCIIPunct(text[i+1]):
+			p.text.WriteByte(text[i+1])
+			i += 2
+
+		case c == '\\' && i+1 < len(text) && text[i+1] == '\n':
+			p.text.WriteByte('\n')
+			i += 2
+
+		case c == '`':
+			i = p.codeSpan(text, i)
+
+		case c == '!' && i+1 < len(text) && text[i+1] == '[':
+			if end, ok := p.link(text, i+1); ok {
+				i = end
+			} else {
+				p.text.WriteByte(c)
+				i++
+			}
+
+		case c == '[':
+			if end, ok := p.link(text, i); ok {
+				i = end
+			} else {
+				p.text.WriteByte(c)
+				i++
+			}
+
+		case c == '<':
+			i = p.angle(text, i)
+
+		case c == '&':
+			if entity := entityPattern.FindString(text[i:]); entity != "" {
+				p.text.WriteString(html.UnescapeString(entity))
+				i += len(entity)
+			} else {
+				p.text.WriteByte(c)
+				i++
+			}
+
+		case c == '*' || c == '_' || c == '~':
+			i = p.delimiterRun(text, i)
+
+		default:
+			p.text.WriteByte(c)
+			i++
+		}
+	}
+	p.flushText()
+}
+
+// codeSpan parses a code span starting at a backtick run; an unmatched run is literal text
+func (p *inlineParser) codeSpan(text string, i int) int {
+	run := 0
+	for i+run < len(text) && text[i+run] == '`' {
+		run++
+	}
+
+	for j := i + run; j < len(text); {
+		if text[j] != '`' {
+			j++
+			continue
+		}
+		closing := 0
+		for j+closing < len(text) && text[j+closing] == '`' {
+			closing++
+		}
+		if closing == run {
+			code := strings.ReplaceAll(text[i+run:j], "\n", " ")
+			if len(code) > 1 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+				code = code[1 : len(code)-1]
+			}
+			p.append(&inline{text: "<code>" + escapeText(code) + "</code>", html: true})
+			return j + closing
+		}
+		j += closing
+	}
+
+	p.text.WriteString(text[i : i+run])
+	return i + run
+}
+
+// link parses [label](destination) starting at the opening bracket
+func (p *inlineParser) link(text string, i int) (int, bool) {
+	labelEnd := matchingBracket(text, i)
+	if labelEnd < 0 || labelEnd+1 >= len(text) || text[labelEnd+1] != '(' {
+		return 0, false
+	}
+	destination, end, ok := linkDestination(text, labelEnd+2)
+	if !ok {
+		return 0, false
+	}
+
+	labelText := text[i+1 : labelEnd]
+	if labelText == "" {
+		labelText = destination
+	}
+	label := (&inlineParser{noLinks: true}).render(labelText)
+
+	if p.noLinks {
+		p.append(&inline{text: label, html: true})
+		return end, true
+	}
+	if !isLinkURL(destination) {
+		// Telegram rejects links it can't open, so the destination is shown as text
+		if destination == "" || destination == labelText {
+			p.append(&inline{text: label, html: true})
+		} else {
+			p.append(&inline{text: label + " (" + escapeText(destination) + ")", html: true})
+		}
+		return end, true
+	}
+
+	p.append(&inline{text: `<a href="` + escapeAttribute(destination) + `">` + label + "</a>", html: true})
+	return end, true
+}
+
+// matchingBracket returns the index of the bracket closing the one at i, or -1
+func matchingBracket(text string, i int) int {
+	depth := 0
+	for j := i; j < len(text); j++ {
+		switch text[j] {
+		case '\\':
+			j++
+		case '`':
+			// Brackets inside code spans don't count
+			run := 0
+			for j+run < len(text) && text[j+run] == '`' {
+				run++
+			}
+			if end := strings.Index(text[j+run:], strings.Repeat("`", run)); end >= 0 {
+				j += run + end + run - 1
+			} else {
+				j += run - 1
+			}
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				return j
+			}
+		}
+	}
+	return -1
+}
+
+// linkDestination parses the destination and optional title of a link after its opening parenthesis
+func linkDestination(text string, i int) (destination string, end int, ok bool) {
+	for i < len(text) && text[i] == ' ' {
+		i++
+	}
+
+	if i < len(text) && text[i] == '<' {
+		close := strings.IndexAny(text[i:], ">\n")
+		if close < 0 || text[i+close] != '>' {
+			return "", 0, false
+		}
+		destination = text[i+1 : i+close]
+		i += close + 1
+	} else {
+		start, depth := i, 0
+		for ; i < len(text); i++ {
+			c := text[i]
+			if c == '\\' && i+1 < len(text) {
+				i++
+				continue
+			}
+			if c == ' ' || c == '\n' || (c == ')' && depth == 0) {
+				break
+			}
+			if c == '(' {
+				depth++
+			} else if c == ')' {
+				depth--
+			}
+		}
+		destination = text[start:i]
+	}
+
+	for i < len(text) && (text[i] == ' ' || text[i] == '\n') {
+		i++
+	}
+	// The title isn't shown by Telegram and is skipped
+	if i < len(text) && (text[i] == '"' || text[i] == '\'') {
+		close := strings.IndexByte(text[i+1:], text[i])
+		if close < 0 {
+			return "", 0, false
+		}
+		i += close + 2
+		for i < len(text) && text[i] == ' ' {
+			i++
+		}
+	}
+	if i >= len(text) || text[i] != ')' {
+		return "", 0, false
+	}
+	return unescapeBackslashes(destination), i + 1, true
+}
+
+// unescapeBackslashes removes backslashes escaping punctuation
+func unescapeBackslashes(text string) string {
+	if !strings.Contains(text, `\`) {
+		return text
+	}
+	var out strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+1 < len(text) && isASCIIPunct(text[i+1]) {
+			i++
+		}
+		out.WriteByte(text[i])
+	}
+	return out.String()
+}
+
+// isLinkURL reports whether Telegram accepts a URL as link target
+func isLinkURL(url string) bool {
+	lower := strings.ToLower(url)
+	for _, scheme := range linkSchemes {
+		if strings.HasPrefix(lower, scheme) && len(url) > len(scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// angle parses autolinks, line breaks and raw inline tags; any other < is literal text
+func (p *inlineParser) angle(text string, i int) int {
+	rest := text[i:]
+
+	if match := autolinkPattern.FindStringSubmatch(rest); match != nil {
+		url := match[1]
+		if p.noLinks {
+			p.text.WriteString(url)
+		} else {
+			p.append(&inline{text: `<a href="` + escapeAttribute(url) + `">` + escapeText(url) + "</a>", html: true})
+		}
+		return i + len(match[0])
+	}
+
+	if match := lineBreakTag.FindString(rest); match != "" {
+		p.text.WriteByte('\n')
+		return i + len(match)
+	}
+
+	if match := rawTagPattern.FindStringSubmatch(rest); match != nil {
+		closing := match[1] == "/"
+		p.append(&inline{
+			text:      match[0],
+			delimiter: "<" + rawTags[match[2]] + ">",
+			count:     1,
+			canOpen:   !closing,
+			canClose:  closing,
+		})
+		return i + len(match[0])
+	}
+
+	p.text.WriteByte('<')
+	return i + 1
+}
+
+// delimiterRun parses a run of *, _ or ~ and decides whether it can open or close emphasis
+func (p *inlineParser) delimiterRun(text string, i int) int {
+	c := text[i]
+	end := i
+	for end < len(text) && text[end] == c {
+		end++
+	}
+
+	before, _ := utf8.DecodeLastRuneInString(text[:i])
+	after, _ := utf8.DecodeRuneInString(text[end:])
+	if i == 0 {
+		before = ' '
+	}
+	if end == len(text) {
+		after = ' '
+	}
+
+	leftFlanking := !unicode.IsSpace(after) &&
+		(!isPunct(after) || unicode.IsSpace(before) || isPunct(before))
+	rightFlanking := !unicode.IsSpace(before) &&
+		(!isPunct(before) || unicode.IsSpace(after) || isPunct(after))
+
+	n := &inline{text: text[i:end], delimiter: string(c), count: end - i}
+	switch c {
+	case '_':
+		// Underscores inside words, as in snake_case, are never emphasis
+		n.canOpen = leftFlanking && (!rightFlanking || isPunct(before))
+		n.canClose = rightFlanking && (!leftFlanking || isPunct(after))
+	default:
+		n.canOpen = leftFlanking
+		n.canClose = rightFlanking
+	}
+	if c == '~' && n.count != 2 {
+		n.canOpen, n.canClose = false, false
+	}
+
+	p.append(n)
+	return end
+}
+
+// processEmphasis pairs up delimiter runs following CommonMark's algorithm. Delimiters between
+// a matched pair are dropped, so the tags produced are always properly nested.
+func (p *inlineParser) processEmphasis() {
+	for closer := p.head; closer != nil; closer = closer.next {
+		if closer.delimiter == "" || !closer.canClose {
+			continue
+		}
+
+		for closer.count > 0 {
+			opener := findOpener(closer)
+			if opener == nil {
+				break
+			}
+
+			used := 1
+			if closer.delimiter == "~" || (len(closer.delimiter) == 1 && opener.count >= 2 && closer.count >= 2) {
+				used = 2
+			}
+			open, close := emphasisTags(closer.delimiter, used)
+
+			// Tags opened later are nested inside those opened earlier on the same run
+			opener.after = append([]string{open}, opener.after...)
+			closer.before = append(closer.before, close)
+			opener.count -= used
+			closer.count -= used
+			opener.text = opener.text[:literalLength(opener)]
+			closer.text = closer.text[:literalLength(closer)]
+
+			for n := opener.next; n != closer; n = n.next {
+				if n.delimiter != "" {
+					n.delimiter = ""
+				}
+			}
+			if opener.count == 0 {
+				opener.delimiter = ""
+			}
+		}
+		if closer.count == 0 || !closer.canOpen {
+			closer.delimiter = ""
+		}
+	}
+}
+
+// findOpener returns the closest delimiter run before closer that it can close
+func findOpener(closer *inline) *inline {
+	for n := closer.prev; n != nil; n = n.prev {
+		if n.delimiter != closer.delimiter || !n.canOpen || n.count == 0 {
+			continue
+		}
+		// CommonMark's rule of three keeps runs like *foo**bar* from pairing oddly
+		if len(closer.delimiter) == 1 && closer.delimiter != "~" && (n.canClose || closer.canOpen) &&
+			(n.count+closer.count)%3 == 0 && (n.count%3 != 0 || closer.count%3 != 0) {
+			continue
+		}
+		return n
+	}
+	return nil
+}
+
+// literalLength returns how much of a piece's text remains after some delimiters were used
+func literalLength(n *inline) int {
+	if strings.HasPrefix(n.delimiter, "<") {
+		if n.count == 0 {
+			return 0
+		}
+		return len(n.text)
+	}
+	return n.count
+}
+
+// emphasisTags returns the tags for a pair of delimiters
+func emphasisTags(delimiter string, used int) (string, string) {
+	switch {
+	case strings.HasPrefix(delimiter, "<"):
+		return delimiter, "</" + delimiter[1:]
+	case delimiter == "~":
+		return "<s>", "</s>"
+	case used == 2:
+		return "<b>", "</b>"
+	default:
+		return "<i>", "</i>"
+	}
+}
+
+// isASCIIPunct reports whether a byte is ASCII punctuation, which may be escaped with a backslash
+func isASCIIPunct(c byte) bool {
+	return strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) >= 0
+}
+
+// isPunct reports whether a rune is punctuation or a symbol for the flanking rules
+func isPunct(r rune) bool {
+	return unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
+
+// escapeText escapes the characters Telegram's HTML parser treats specially in text
+func escapeText(text string) string {
+	return textEscaper.Replace(text)
+}
+
+// escapeAttribute escapes an attribute value
+func escapeAttribute(text string) string {
+	return attributeEscaper.Replace(text)
+}
+
+var (
+	textEscaper      = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	attributeEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+)
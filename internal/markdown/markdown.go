@@ -0,0 +1,521 @@
+// Package markdown renders Markdown written by language models as the HTML subset Telegram
+// accepts. It implements the parts of CommonMark models actually use — emphasis, code spans,
+// fenced code, links, lists, blockquotes and headings — plus GitHub-style tables and
+// strikethrough. Telegram has no tags for headings, lists or tables, so they are rendered with
+// bold text, bullet characters and one line per row. All text is escaped, so the output is
+// always accepted by Telegram's HTML parser.
+package markdown
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	headingPattern   = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	fencePattern     = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})[ \t]*([^`]*?)[ \t]*$")
+	hrPattern        = regexp.MustCompile(`^ {0,3}(?:(?:-[ \t]*){3,}|(?:\*[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	setextPattern    = regexp.MustCompile(`^ {0,3}(?:=+|-+)[ \t]*$`)
+	listItemPattern  = regexp.MustCompile(`^( *)([-*+]|\d{1,9}[.)])(?:[ \t]+|$)`)
+	quotePattern     = regexp.MustCompile(`^ {0,3}> ?`)
+	tableDelimiter   = regexp.MustCompile(`^ {0,3}\|?[ \t]*:?-+:?[ \t]*(?:\|[ \t]*:?-+:?[ \t]*)*\|?[ \t]*$`)
+	taskPattern      = regexp.MustCompile(`^\[([ xX])\][ \t]+`)
+	fenceLangPattern = regexp.MustCompile(`^[A-Za-z0-9_+#.-]+$`)
+)
+
+// bullets are the list markers of each nesting level; deeper levels use the last one
+var bullets = []string{"•", "◦", "▪"}
+
+// block is a parsed block element
+type block struct {
+	kind     blockKind
+	text     string   // paragraph and heading text, code block content
+	language string   // language of a fenced code block
+	children []*block // blockquote content
+	items    []*listItem
+	ordered  bool
+	start    int        // number of the first item of an ordered list
+	rows     [][]string // table rows, the first one is the header
+}
+
+type blockKind int
+
+const (
+	paragraphBlock blockKind = iota
+	headingBlock
+	codeBlock
+	quoteBlock
+	listBlock
+	tableBlock
+	ruleBlock
+)
+
+// listItem is an item of a list with its own blocks
+type listItem struct {
+	task    bool
+	checked bool
+	blocks  []*block
+}
+
+// ToTelegramHTML renders Markdown as Telegram HTML
+func ToTelegramHTML(source string) string {
+	source = strings.ReplaceAll(source, "\r\n", "\n")
+	source = strings.ReplaceAll(source, "\r", "\n")
+	lines := strings.Split(expandTabs(source), "\n")
+
+	return strings.TrimSpace(renderBlocks(parseBlocks(lines), 0, false, "\n\n"))
+}
+
+// expandTabs replaces leading tabs by four spaces, so indentation can be measured in spaces
+func expandTabs(text string) string {
+	if !strings.Contains(text, "\t") {
+		return text
+	}
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		indent := 0
+		for indent < len(line) && (line[indent] == ' ' || line[indent] == '\t') {
+			indent++
+		}
+		lines[i] = strings.ReplaceAll(line[:indent], "\t", "    ") + line[indent:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// isBlank reports whether a line contains only whitespace
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// indentation returns the number of leading spaces of a line
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// dedent removes up to n leading spaces from a line
+func dedent(line string, n int) string {
+	return line[min(n, indentation(line)):]
+}
+
+// parseBlocks splits lines into block elements
+func parseBlocks(lines []string) []*block {
+	var blocks []*block
+	for i := 0; i < len(lines); {
+		line := lines[i]
+
+		switch {
+		case isBlank(line):
+			i++
+
+		case fencePattern.MatchString(line):
+			var b *block
+			b, i = parseFence(lines, i)
+			blocks = append(blocks, b)
+
+		case headingPattern.MatchString(line):
+			if text := strings.TrimSpace(headingPattern.FindStringSubmatch(line)[2]); text != "" {
+				blocks = append(blocks, &block{kind: headingBlock, text: text})
+			}
+			i++
+
+		case hrPattern.MatchString(line):
+			blocks = append(blocks, &block{kind: ruleBlock})
+			i++
+
+		case quotePattern.MatchString(line):
+			var b *block
+			b, i = parseQuote(lines, i)
+			blocks = append(blocks, b)
+
+		case listItemPattern.MatchString(line):
+			var b *block
+			b, i = parseList(lines, i)
+			blocks = append(blocks, b)
+
+		case isTableStart(lines, i):
+			var b *block
+			b, i = parseTable(lines, i)
+			blocks = append(blocks, b)
+
+		default:
+			var b *block
+			b, i = parseParagraph(lines, i)
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks
+}
+
+// startsBlock reports whether a line interrupts a paragraph
+func startsBlock(lines []string, i int) bool {
+	line := lines[i]
+	return fencePattern.MatchString(line) || headingPattern.MatchString(line) || hrPattern.MatchString(line) ||
+		quotePattern.MatchString(line) || listItemPattern.MatchString(line) || isTableStart(lines, i)
+}
+
+// parseFence parses a fenced code block; an unclosed fence runs to the end
+func parseFence(lines []string, i int) (*block, int) {
+	match := fencePattern.FindStringSubmatch(lines[i])
+	indent, fence, info := len(match[1]), match[2], match[3]
+
+	b := &block{kind: codeBlock, language: fenceLanguage(info)}
+
+	var content []string
+	for i++; i < len(lines); i++ {
+		line := lines[i]
+		if isClosingFence(line, fence) {
+			i++
+			break
+		}
+		content = append(content, dedent(line, indent))
+	}
+
+	b.text = joinCode(content)
+	return b, i
+}
+
+// fenceLanguage returns the language of a code block from the info string of its fence
+func fenceLanguage(info string) string {
+	if language, _, _ := strings.Cut(info, " "); fenceLangPattern.MatchString(language) {
+		return language
+	}
+	return ""
+}
+
+// joinCode joins the lines of a code block without trailing blank lines
+func joinCode(lines []string) string {
+	for len(lines) > 0 && isBlank(lines[len(lines)-1]) {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// isClosingFence reports whether a line closes a code block opened with fence
+func isClosingFence(line, fence string) bool {
+	trimmed := strings.TrimSpace(line)
+	return indentation(line) <= 3 && len(trimmed) >= len(fence) && strings.Trim(trimmed, fence[:1]) == ""
+}
+
+// OpenFence returns the opening line of a fenced code block that is still open at the end of
+// source, or an empty string. Text cut inside a code block can be continued with it.
+func OpenFence(source string) string {
+	open, fence := "", ""
+	for _, line := range strings.Split(expandTabs(source), "\n") {
+		if open == "" {
+			if match := fencePattern.FindStringSubmatch(line); match != nil {
+				open, fence = strings.TrimSpace(line), match[2]
+			}
+			continue
+		}
+		if isClosingFence(line, fence) {
+			open = ""
+		}
+	}
+	return open
+}
+
+// CodeBlock is a fenced code block of a Markdown document
+type CodeBlock struct {
+	Language string
+	Code     string
+	// Start and End are the byte offsets of the block in the source, fences included
+	Start, End int
+}
+
+// FencedCodeBlocks returns the fenced code blocks of a Markdown document in order.
+// An unclosed block runs to the end of the document.
+func FencedCodeBlocks(source string) []CodeBlock {
+	var blocks []CodeBlock
+	var current *CodeBlock
+	var fence string
+	var indent int
+	var code []string
+
+	offset := 0
+	for _, line := range strings.SplitAfter(source, "\n") {
+		content := strings.TrimRight(line, "\r\n")
+		switch {
+		case current == nil:
+			if match := fencePattern.FindStringSubmatch(content); match != nil {
+				current = &CodeBlock{Language: fenceLanguage(match[3]), Start: offset}
+				fence, indent, code = match[2], len(match[1]), nil
+			}
+		case isClosingFence(content, fence):
+			current.Code = joinCode(code)
+			current.End = offset + len(content)
+			blocks = append(blocks, *current)
+			current = nil
+		default:
+			code = append(code, dedent(content, indent))
+		}
+		offset += len(line)
+	}
+
+	if current != nil {
+		current.Code = joinCode(code)
+		current.End = len(source)
+		blocks = append(blocks, *current)
+	}
+	return blocks
+}
+
+// parseQuote parses a blockquote, including lazy continuation lines of its paragraphs
+func parseQuote(lines []string, i int) (*block, int) {
+	var content []string
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if loc := quotePattern.FindStringIndex(line); loc != nil {
+			content = append(content, line[loc[1]:])
+			continue
+		}
+		// A paragraph inside the quote continues on lines without the marker
+		if isBlank(line) || startsBlock(lines, i) || len(content) == 0 || isBlank(content[len(content)-1]) {
+			break
+		}
+		content = append(content, line)
+	}
+	return &block{kind: quoteBlock, children: parseBlocks(content)}, i
+}
+
+// parseList parses a list and its items, which may contain further blocks
+func parseList(lines []string, i int) (*block, int) {
+	first := listItemPattern.FindStringSubmatch(lines[i])
+	baseIndent := len(first[1])
+	marker := first[2]
+
+	b := &block{kind: listBlock}
+	if n, err := strconv.Atoi(strings.TrimRight(marker, ".)")); err == nil {
+		b.ordered = true
+		b.start = n
+	}
+	delimiter := marker[len(marker)-1]
+
+	for i < len(lines) {
+		match := listItemPattern.FindStringSubmatch(lines[i])
+		if match == nil || len(match[1]) > baseIndent+3 {
+			break
+		}
+		itemMarker := match[2]
+		// Ordered lists end where the delimiter changes, as from "1." to "1)"
+		if b.ordered != isOrderedMarker(itemMarker) || (b.ordered && itemMarker[len(itemMarker)-1] != delimiter) {
+			break
+		}
+
+		// Continuation lines are indented at least to the item's content
+		contentIndent := len(match[0])
+		if isBlank(lines[i][len(match[0]):]) {
+			contentIndent = len(match[1]) + len(itemMarker) + 1
+		}
+		content := []string{lines[i][len(match[0]):]}
+
+		for i++; i < len(lines); i++ {
+			line := lines[i]
+			if isBlank(line) {
+				// A blank line ends the item unless indented content follows
+				next := i + 1
+				for next < len(lines) && isBlank(lines[next]) {
+					next++
+				}
+				if next < len(lines) && indentation(lines[next]) >= contentIndent {
+					content = append(content, "")
+					continue
+				}
+				break
+			}
+			if indentation(line) >= contentIndent {
+				content = append(content, dedent(line, contentIndent))
+				continue
+			}
+			if listItemPattern.MatchString(line) || startsBlock(lines, i) || isBlank(content[len(content)-1]) {
+				break
+			}
+			// Lazy continuation of the item's paragraph
+			content = append(content, strings.TrimLeft(line, " "))
+		}
+
+		item := &listItem{}
+		if task := taskPattern.FindStringSubmatch(content[0]); task != nil {
+			item.task = true
+			item.checked = task[1] != " "
+			content[0] = content[0][len(task[0]):]
+		}
+		item.blocks = parseBlocks(content)
+		b.items = append(b.items, item)
+
+		// Blank lines between items keep the list going
+		next := i
+		for next < len(lines) && isBlank(lines[next]) {
+			next++
+		}
+		if next < len(lines) && listItemPattern.MatchString(lines[next]) &&
+			len(listItemPattern.FindStringSubmatch(lines[next])[1]) <= baseIndent+3 {
+			i = next
+			continue
+		}
+		break
+	}
+	return b, i
+}
+
+// isOrderedMarker reports whether a list marker is a number
+func isOrderedMarker(marker string) bool {
+	return marker[0] >= '0' && marker[0] <= '9'
+}
+
+// isTableStart reports whether a table with a header row starts at line i
+func isTableStart(lines []string, i int) bool {
+	return i+1 < len(lines) && strings.Contains(lines[i], "|") &&
+		strings.Contains(lines[i+1], "|") && tableDelimiter.MatchString(lines[i+1])
+}
+
+// parseTable parses a table; it ends at the first line without a pipe
+func parseTable(lines []string, i int) (*block, int) {
+	b := &block{kind: tableBlock, rows: [][]string{splitTableRow(lines[i])}}
+	for i += 2; i < len(lines) && strings.Contains(lines[i], "|") && !isBlank(lines[i]); i++ {
+		b.rows = append(b.rows, splitTableRow(lines[i]))
+	}
+	return b, i
+}
+
+// splitTableRow splits a table row into its cells; escaped pipes and pipes in code spans don't separate cells
+func splitTableRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+
+	var cells []string
+	var cell strings.Builder
+	inCode := false
+	for j := 0; j < len(line); j++ {
+		switch c := line[j]; {
+		case c == '\\' && j+1 < len(line) && line[j+1] == '|':
+			cell.WriteByte('|')
+			j++
+		case c == '`':
+			inCode = !inCode
+			cell.WriteByte(c)
+		case c == '|' && !inCode:
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(c)
+		}
+	}
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+// parseParagraph parses a paragraph, which may turn out to be a setext heading
+func parseParagraph(lines []string, i int) (*block, int) {
+	var content []string
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if isBlank(line) {
+			break
+		}
+		if len(content) > 0 && setextPattern.MatchString(line) {
+			return &block{kind: headingBlock, text: strings.Join(content, "\n")}, i + 1
+		}
+		if len(content) > 0 && startsBlock(lines, i) {
+			break
+		}
+		content = append(content, strings.TrimSpace(line))
+	}
+	return &block{kind: paragraphBlock, text: strings.Join(content, "\n")}, i
+}
+
+// renderBlocks renders a sequence of blocks at a list nesting depth, separated by sep.
+// Telegram doesn't allow nested blockquotes, so quotes inside quotes are rendered without tags.
+func renderBlocks(blocks []*block, depth int, inQuote bool, sep string) string {
+	parts := make([]string, 0, len(blocks))
+	for _, b := range blocks {
+		parts = append(parts, renderBlock(b, depth, inQuote))
+	}
+	return strings.Join(parts, sep)
+}
+
+// renderBlock renders a single block
+func renderBlock(b *block, depth int, inQuote bool) string {
+	switch b.kind {
+	case headingBlock:
+		return "<b>" + renderInline(b.text) + "</b>"
+
+	case codeBlock:
+		code := escapeText(b.text)
+		if b.language != "" {
+			return `<pre><code class="language-` + escapeAttribute(b.language) + `">` + code + "</code></pre>"
+		}
+		return "<pre>" + code + "</pre>"
+
+	case quoteBlock:
+		content := renderBlocks(b.children, depth, true, "\n\n")
+		if inQuote {
+			return content
+		}
+		return "<blockquote>" + content + "</blockquote>"
+
+	case listBlock:
+		return renderList(b, depth, inQuote)
+
+	case tableBlock:
+		return renderTable(b.rows)
+
+	case ruleBlock:
+		return "———"
+
+	default:
+		return renderInline(b.text)
+	}
+}
+
+// renderList renders a list with one line per item, indented by nesting depth
+func renderList(b *block, depth int, inQuote bool) string {
+	indent := strings.Repeat("  ", depth)
+	lines := make([]string, 0, len(b.items))
+	for n, item := range b.items {
+		marker := bullets[min(depth, len(bullets)-1)]
+		if b.ordered {
+			marker = strconv.Itoa(b.start+n) + "."
+		}
+		if item.task {
+			marker = "☐"
+			if item.checked {
+				marker = "☑"
+			}
+		}
+
+		content := renderBlocks(item.blocks, depth+1, inQuote, "\n")
+		// Nested lists start on their own line, other blocks follow the marker
+		if len(item.blocks) > 0 && item.blocks[0].kind == listBlock {
+			content = "\n" + content
+		}
+		lines = append(lines, indent+marker+" "+content)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// renderTable renders a table as a bold header line followed by one bullet per row
+func renderTable(rows [][]string) string {
+	lines := make([]string, 0, len(rows))
+	for n, row := range rows {
+		cells := make([]string, 0, len(row))
+		for _, cell := range row {
+			if n == 0 {
+				if cell != "" {
+					cells = append(cells, "<b>"+renderInline(cell)+"</b>")
+				}
+				continue
+			}
+			cells = append(cells, renderInline(cell))
+		}
+		if n == 0 {
+			lines = append(lines, strings.Join(cells, " | "))
+		} else {
+			lines = append(lines, "• "+strings.Join(cells, " | "))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,144 @@
+package markdown
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestGolden renders every testdata/*.md file and compares the result with the .html file next to it
+func TestGolden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no golden files in testdata")
+	}
+
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".md")
+		t.Run(name, func(t *testing.T) {
+			source, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ToTelegramHTML(string(source)) + "\n"
+
+			golden := strings.TrimSuffix(input, ".md") + ".html"
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("missing golden file, run go test -update: %v", err)
+			}
+			if got != string(want) {
+				t.Errorf("output differs from %s\n--- got ---\n%s--- want ---\n%s", golden, got, want)
+			}
+			if err := checkTelegramHTML(got); err != nil {
+				t.Errorf("invalid Telegram HTML: %v", err)
+			}
+		})
+	}
+}
+
+var (
+	tagPattern   = regexp.MustCompile(`<(/?)([a-z-]+)((?: [a-z]+="[^"<>]*")*)>`)
+	entityInText = regexp.MustCompile(`&(?:amp|lt|gt|quot|#[0-9]+);`)
+	allowedTags  = map[string]bool{"b": true, "i": true, "u": true, "s": true, "code": true, "pre": true, "a": true, "blockquote": true, "tg-spoiler": true}
+)
+
+// checkTelegramHTML verifies that only Telegram's tags are used, properly nested, and that
+// every < and & outside of tags is escaped
+func checkTelegramHTML(text string) error {
+	var stack []string
+	rest := text
+	for {
+		loc := tagPattern.FindStringSubmatchIndex(rest)
+		plain := rest
+		if loc != nil {
+			plain = rest[:loc[0]]
+		}
+		if strings.Contains(plain, "<") || strings.Contains(plain, ">") {
+			return fmt.Errorf("unescaped angle bracket in %q", plain)
+		}
+		if strings.Count(plain, "&") != len(entityInText.FindAllString(plain, -1)) {
+			return fmt.Errorf("unescaped ampersand in %q", plain)
+		}
+		if loc == nil {
+			break
+		}
+
+		closing, name := rest[loc[2]:loc[3]] == "/", rest[loc[4]:loc[5]]
+		if !allowedTags[name] {
+			return fmt.Errorf("tag not supported by Telegram: %q", name)
+		}
+		if closing {
+			if len(stack) == 0 || stack[len(stack)-1] != name {
+				return errors.New("tags are not properly nested")
+			}
+			stack = stack[:len(stack)-1]
+		} else {
+			if name == "blockquote" {
+				for _, open := range stack {
+					if open == "blockquote" {
+						return errors.New("nested blockquote")
+					}
+				}
+			}
+			stack = append(stack, name)
+		}
+		rest = rest[loc[1]:]
+	}
+	if len(stack) > 0 {
+		return errors.New("tags are not properly nested")
+	}
+	return nil
+}
+
+func TestOpenFence(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"no code", ""},
+		{"text\n```go\nfunc main() {", "```go"},
+		{"```go\ncode\n```\nafter", ""},
+		{"~~~~\n```\nstill open", "~~~~"},
+		{"````\n```\n````\n", ""},
+		{"- item\n  ```sh\n  ls", "```sh"},
+	}
+	for _, tt := range tests {
+		if got := OpenFence(tt.source); got != tt.want {
+			t.Errorf("OpenFence(%q) = %q, want %q", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestFencedCodeBlocks(t *testing.T) {
+	source := "Intro\n\n```python\nprint(1)\n\n```\n\n  ~~~\n  indented\n    more\n  ~~~\nText\n```sh\nls"
+	want := []CodeBlock{
+		{Language: "python", Code: "print(1)", Start: 7, End: 30},
+		{Language: "", Code: "indented\n  more", Start: 32, End: 63},
+		{Language: "sh", Code: "ls", Start: 69, End: 77},
+	}
+
+	got := FencedCodeBlocks(source)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("FencedCodeBlocks()\n got %+v\nwant %+v", got, want)
+	}
+	if block := source[got[0].Start:got[0].End]; block != "```python\nprint(1)\n\n```" {
+		t.Errorf("first block spans %q", block)
+	}
+}
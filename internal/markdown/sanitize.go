@@ -0,0 +1,149 @@
+package markdown
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	sanitizeTagPattern = regexp.MustCompile(`^<(/?)([a-zA-Z][a-zA-Z0-9-]*)((?:\s[^<>]*)?)>`)
+	hrefPattern        = regexp.MustCompile(`(?i)\bhref\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	classPattern       = regexp.MustCompile(`(?i)\bclass\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+)
+
+// telegramTags maps the tags Telegram accepts, including their aliases, to the tag written by Sanitize
+var telegramTags = map[string]string{
+	"b": "b", "strong": "b",
+	"i": "i", "em": "i",
+	"u": "u", "ins": "u",
+	"s": "s", "strike": "s", "del": "s",
+	"code": "code", "pre": "pre",
+	"a": "a", "blockquote": "blockquote",
+	"tg-spoiler": "tg-spoiler",
+}
+
+// Sanitize rewrites HTML so Telegram's parser accepts it: unsupported tags and stray angle
+// brackets become text, tags are properly nested and closed, links without a usable URL lose
+// their tag, and only the entities Telegram knows are left encoded.
+func Sanitize(text string) string {
+	var out strings.Builder
+	var stack []element
+
+	for i := 0; i < len(text); {
+		switch text[i] {
+		case '<':
+			match := sanitizeTagPattern.FindStringSubmatch(text[i:])
+			if match == nil {
+				out.WriteString("&lt;")
+				i++
+				continue
+			}
+			name, known := telegramTags[strings.ToLower(match[2])]
+			if !known {
+				out.WriteString(escapeText(match[0]))
+			} else if match[1] == "/" {
+				stack = closeSanitized(&out, stack, name)
+			} else {
+				tag := sanitizedTag(name, match[3], stack)
+				out.WriteString(tag)
+				stack = append(stack, element{name: name, kept: tag != ""})
+			}
+			i += len(match[0])
+
+		case '&':
+			entity := htmlEntityPattern.FindString(text[i:])
+			switch {
+			case entity == "":
+				out.WriteString("&amp;")
+				i++
+			case entity == "&lt;" || entity == "&gt;" || entity == "&amp;" || entity == "&quot;" || entity[1] == '#':
+				out.WriteString(entity)
+				i += len(entity)
+			default:
+				out.WriteString(escapeText(html.UnescapeString(entity)))
+				i += len(entity)
+			}
+
+		case '>':
+			out.WriteString("&gt;")
+			i++
+
+		default:
+			out.WriteByte(text[i])
+			i++
+		}
+	}
+
+	closeElements(&out, stack)
+	return out.String()
+}
+
+// element is an open element; dropped elements are tracked too, so their closing tags are dropped
+type element struct {
+	name string
+	kept bool
+}
+
+// sanitizedTag returns the opening tag to write for an element, or an empty string if
+// Telegram wouldn't accept it at this place
+func sanitizedTag(name, attributes string, stack []element) string {
+	for _, open := range stack {
+		if !open.kept {
+			continue
+		}
+		// Code can't contain formatting, and links and quotes can't be nested
+		if open.name == "pre" && name != "code" || open.name == "code" || open.name == name && (name == "a" || name == "blockquote") {
+			return ""
+		}
+	}
+
+	switch name {
+	case "a":
+		match := hrefPattern.FindStringSubmatch(attributes)
+		if match == nil {
+			return ""
+		}
+		url := html.UnescapeString(match[1] + match[2])
+		if !isLinkURL(url) {
+			return ""
+		}
+		return `<a href="` + escapeAttribute(url) + `">`
+	case "code":
+		if len(stack) > 0 && stack[len(stack)-1].name == "pre" && stack[len(stack)-1].kept {
+			if match := classPattern.FindStringSubmatch(attributes); match != nil {
+				class := match[1] + match[2]
+				if language, ok := strings.CutPrefix(class, "language-"); ok && fenceLangPattern.MatchString(language) {
+					return `<code class="` + class + `">`
+				}
+			}
+		}
+	}
+	return "<" + name + ">"
+}
+
+// closeSanitized closes the innermost open element with the given name and everything opened
+// inside it. A closing tag without an open element is dropped.
+func closeSanitized(out *strings.Builder, stack []element, name string) []element {
+	for j := len(stack) - 1; j >= 0; j-- {
+		if stack[j].name == name {
+			closeElements(out, stack[j:])
+			return stack[:j]
+		}
+	}
+	return stack
+}
+
+// closeElements writes the closing tags of the kept elements, innermost first
+func closeElements(out *strings.Builder, stack []element) {
+	for j := len(stack) - 1; j >= 0; j-- {
+		if stack[j].kept {
+			out.WriteString("</" + stack[j].name + ">")
+		}
+	}
+}
+
+// PlainText returns the text of an HTML message without tags and with entities decoded
+func PlainText(text string) string {
+	return html.UnescapeString(stripTags(text))
+}
@@ -0,0 +1,43 @@
+package markdown
+
+import "testing"
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"valid html is kept", `<b>bold</b> &lt;tag&gt; <a href="https://example.com">link</a>`, `<b>bold</b> &lt;tag&gt; <a href="https://example.com">link</a>`},
+		{"aliases", "<strong>a</strong> <em>b</em> <del>c</del>", "<b>a</b> <i>b</i> <s>c</s>"},
+		{"unknown tags become text", "<div>x</div> <T>", "&lt;div&gt;x&lt;/div&gt; &lt;T&gt;"},
+		{"stray brackets and ampersands", "a < b > c & d", "a &lt; b &gt; c &amp; d"},
+		{"unclosed tags are closed", "<b>bold <i>both", "<b>bold <i>both</i></b>"},
+		{"misnested tags", "<b>a <i>b</b> c</i>", "<b>a <i>b</i></b> c"},
+		{"stray closing tag", "text</b>", "text"},
+		{"formatting in code is dropped", "<pre><code class=\"language-go\">a <b>b</b></code></pre>", "<pre><code class=\"language-go\">a b</code></pre>"},
+		{"nested links", `<a href="https://a.example">x <a href="https://b.example">y</a></a>`, `<a href="https://a.example">x y</a>`},
+		{"unusable link", `<a href="javascript:alert(1)">x</a> <a>y</a>`, "x y"},
+		{"named entities", "&copy; &nbsp;&amp; &#8364; &quot;", "© \u00a0&amp; &#8364; &quot;"},
+		{"dropped element with same name outside", "<b><pre><b>x</b> y</pre></b>", "<b><pre>x y</pre></b>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Sanitize(tt.text)
+			if got != tt.want {
+				t.Errorf("Sanitize(%q)\n got %q\nwant %q", tt.text, got, tt.want)
+			}
+			if err := checkTelegramHTML(got); err != nil {
+				t.Errorf("invalid Telegram HTML %q: %v", got, err)
+			}
+		})
+	}
+}
+
+func TestPlainText(t *testing.T) {
+	got := PlainText(`<b>a &lt; b</b> &amp; <a href="https://example.com">link</a>`)
+	if want := "a < b & link"; got != want {
+		t.Errorf("PlainText() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,273 @@
+package markdown
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	htmlTagPattern    = regexp.MustCompile(`^<(/?)([a-zA-Z][a-zA-Z0-9-]*)[^<>]*>`)
+	htmlEntityPattern = regexp.MustCompile(`^&(?:#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6}|[A-Za-z][A-Za-z0-9]{1,31});`)
+)
+
+// UTF16Length returns the length of text in UTF-16 code units, which is how Telegram
+// measures message length
+func UTF16Length(text string) int {
+	n := 0
+	for _, r := range text {
+		n += runeLength(r)
+	}
+	return n
+}
+
+// runeLength returns the number of UTF-16 code units of a rune
+func runeLength(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+// TextLength returns the length of the text Telegram shows for an HTML message,
+// without tags and with entities decoded, in UTF-16 code units
+func TextLength(text string) int {
+	n := 0
+	for i := 0; i < len(text); {
+		t := nextToken(text, i)
+		n += t.length
+		i = t.end
+	}
+	return n
+}
+
+// token is a tag, an entity or a single rune of HTML text
+type token struct {
+	end     int    // byte offset after the token
+	length  int    // visible length in UTF-16 code units
+	tag     string // name of the tag, empty for text
+	closing bool
+}
+
+// nextToken returns the token starting at byte offset i
+func nextToken(text string, i int) token {
+	rest := text[i:]
+	if rest[0] == '<' {
+		if match := htmlTagPattern.FindStringSubmatch(rest); match != nil {
+			return token{end: i + len(match[0]), tag: strings.ToLower(match[2]), closing: match[1] == "/"}
+		}
+	}
+	if rest[0] == '&' {
+		if entity := htmlEntityPattern.FindString(rest); entity != "" {
+			return token{end: i + len(entity), length: UTF16Length(html.UnescapeString(entity))}
+		}
+	}
+	r, size := utf8.DecodeRuneInString(rest)
+	return token{end: i + size, length: runeLength(r)}
+}
+
+// openTag is an element that is open at some point of the text
+type openTag struct {
+	name string
+	text string // the opening tag as written, with its attributes
+}
+
+// splitPoint is a place where a chunk may end
+type splitPoint struct {
+	end   int // byte offset where the chunk ends
+	next  int // byte offset where the following chunk starts
+	open  []openTag
+	score int // higher is better: paragraph, line, word
+}
+
+const (
+	splitAnywhere = iota
+	splitAtWord
+	splitAtLine
+	splitAtParagraph
+)
+
+// SplitHTML splits an HTML message into chunks of at most limit UTF-16 code units of visible text.
+// It prefers paragraph, line and word boundaries and keeps code blocks that fit into a chunk
+// in one piece. Elements open at a cut are closed at the end of the chunk and opened again at
+// the start of the next one, so a long code block continues as a code block with its language.
+func SplitHTML(text string, limit int) []string {
+	text = strings.TrimSpace(text)
+	if limit <= 0 || TextLength(text) <= limit {
+		return []string{text}
+	}
+
+	var chunks []string
+	var open []openTag
+	start := 0
+	for start < len(text) {
+		point, done := findHTMLSplit(text, start, open, limit)
+		prefix := openingTags(open)
+		if done {
+			chunks = appendChunk(chunks, prefix+text[start:])
+			break
+		}
+		chunks = appendChunk(chunks, prefix+strings.TrimRight(text[start:point.end], " \n")+closingTags(point.open))
+		start, open = point.next, point.open
+	}
+	return chunks
+}
+
+// appendChunk adds a chunk unless it has no visible text
+func appendChunk(chunks []string, chunk string) []string {
+	if strings.TrimSpace(stripTags(chunk)) == "" {
+		return chunks
+	}
+	return append(chunks, chunk)
+}
+
+// findHTMLSplit scans text from start with the given elements open and returns where the chunk
+// should end, or done if the rest fits
+func findHTMLSplit(text string, start int, open []openTag, limit int) (point splitPoint, done bool) {
+	open = clone(open)
+	inPre := isOpen(open, "pre")
+	length := 0
+
+	// Boundaries in the second half of the chunk are ranked, so a paragraph break wins over a
+	// space; in the first half only the last one is kept as a fallback, so chunks don't get too short
+	var best, fallback, beforePre *splitPoint
+	consider := func(candidate splitPoint) {
+		if candidate.end <= start {
+			return
+		}
+		if length <= limit/2 {
+			fallback = &candidate
+			return
+		}
+		if best == nil || candidate.score >= best.score {
+			best = &candidate
+		}
+	}
+
+	for i := start; i < len(text); {
+		t := nextToken(text, i)
+
+		switch {
+		case t.tag != "" && !t.closing:
+			// A code block that fits into a chunk of its own isn't cut
+			if t.tag == "pre" {
+				beforePre = nil
+				if i > start && preLength(text, i) <= limit {
+					beforePre = &splitPoint{end: i, next: i, open: clone(open), score: splitAtParagraph}
+				}
+			}
+			open = append(open, openTag{name: t.tag, text: text[i:t.end]})
+			inPre = inPre || t.tag == "pre"
+
+		case t.tag != "":
+			open = closeTag(open, t.tag)
+			inPre = isOpen(open, "pre")
+
+		default:
+			// A chunk may end before a space or line break, which is dropped
+			switch {
+			case text[i] == '\n' && strings.HasPrefix(text[t.end:], "\n"):
+				consider(splitPoint{end: i, next: skipSpace(text, t.end+1, inPre), open: clone(open), score: splitAtParagraph})
+			case text[i] == '\n':
+				consider(splitPoint{end: i, next: skipSpace(text, t.end, inPre), open: clone(open), score: splitAtLine})
+			case text[i] == ' ' && !inPre:
+				consider(splitPoint{end: i, next: skipSpace(text, t.end, inPre), open: clone(open), score: splitAtWord})
+			}
+
+			if length > 0 && length+t.length > limit {
+				if inPre && beforePre != nil {
+					return *beforePre, false
+				}
+				if best != nil {
+					return *best, false
+				}
+				if fallback != nil {
+					return *fallback, false
+				}
+				// No boundary at all, cut between two characters
+				return splitPoint{end: i, next: i, open: clone(open), score: splitAnywhere}, false
+			}
+			length += t.length
+		}
+		i = t.end
+	}
+	return splitPoint{}, true
+}
+
+// preLength returns the visible length of the code block starting at byte offset i
+func preLength(text string, i int) int {
+	end := strings.Index(text[i:], "</pre>")
+	if end < 0 {
+		return TextLength(text[i:])
+	}
+	return TextLength(text[i : i+end])
+}
+
+// skipSpace returns the offset of the first character after i that isn't a space or a newline.
+// Inside code blocks indentation matters, so only the line break itself is skipped.
+func skipSpace(text string, i int, inPre bool) int {
+	if inPre {
+		return i
+	}
+	for i < len(text) && (text[i] == ' ' || text[i] == '\n') {
+		i++
+	}
+	return i
+}
+
+// closeTag removes the innermost element with the given name and those opened inside it
+func closeTag(open []openTag, name string) []openTag {
+	for j := len(open) - 1; j >= 0; j-- {
+		if open[j].name == name {
+			return open[:j]
+		}
+	}
+	return open
+}
+
+// isOpen reports whether an element with the given name is open
+func isOpen(open []openTag, name string) bool {
+	for _, tag := range open {
+		if tag.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// clone copies the open elements, so later changes don't affect a split point
+func clone(open []openTag) []openTag {
+	return append([]openTag(nil), open...)
+}
+
+// openingTags returns the tags that open the elements again
+func openingTags(open []openTag) string {
+	var out strings.Builder
+	for _, tag := range open {
+		out.WriteString(tag.text)
+	}
+	return out.String()
+}
+
+// closingTags returns the tags that close the elements, innermost first
+func closingTags(open []openTag) string {
+	var out strings.Builder
+	for j := len(open) - 1; j >= 0; j-- {
+		out.WriteString("</" + open[j].name + ">")
+	}
+	return out.String()
+}
+
+// stripTags removes the tags from HTML
+func stripTags(text string) string {
+	var out strings.Builder
+	for i := 0; i < len(text); {
+		t := nextToken(text, i)
+		if t.tag == "" {
+			out.WriteString(text[i:t.end])
+		}
+		i = t.end
+	}
+	return out.String()
+}
@@ -0,0 +1,135 @@
+package markdown
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitHTML(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		want  []string
+	}{
+		{
+			name:  "fits",
+			text:  "<b>short</b> message",
+			limit: 13,
+			want:  []string{"<b>short</b> message"},
+		},
+		{
+			name:  "paragraphs",
+			text:  "first paragraph here\n\nsecond one\nwith lines",
+			limit: 30,
+			want:  []string{"first paragraph here", "second one\nwith lines"},
+		},
+		{
+			name:  "paragraph preferred over line",
+			text:  "aaaa aaaa\n\nbbbb\ncccc dddd",
+			limit: 16,
+			want:  []string{"aaaa aaaa", "bbbb\ncccc dddd"},
+		},
+		{
+			name:  "tags reopened",
+			text:  `<b>bold words <a href="https://example.com">and a link</a> continue</b>`,
+			limit: 18,
+			want: []string{
+				`<b>bold words <a href="https://example.com">and a</a></b>`,
+				`<b><a href="https://example.com">link</a> continue</b>`,
+			},
+		},
+		{
+			name:  "code block kept whole",
+			text:  "intro text\n\n<pre>line one\nline two</pre>",
+			limit: 20,
+			want:  []string{"intro text", "<pre>line one\nline two</pre>"},
+		},
+		{
+			name:  "long code block split with its language",
+			text:  `<pre><code class="language-go">a := 1` + "\n" + `b := 2` + "\n" + `c := 3</code></pre>`,
+			limit: 14,
+			want: []string{
+				`<pre><code class="language-go">a := 1` + "\n" + `b := 2</code></pre>`,
+				`<pre><code class="language-go">c := 3</code></pre>`,
+			},
+		},
+		{
+			name:  "indentation in code is kept",
+			text:  "<pre>if x {\n    y()\n    z()\n}</pre>",
+			limit: 14,
+			want:  []string{"<pre>if x {\n    y()</pre>", "<pre>    z()\n}</pre>"},
+		},
+		{
+			name:  "entities count as one character",
+			text:  "a &lt; b &amp;&amp; c",
+			limit: 10,
+			want:  []string{"a &lt; b &amp;&amp; c"},
+		},
+		{
+			name:  "emoji count as two units",
+			text:  "😀😀😀 😀😀",
+			limit: 6,
+			want:  []string{"😀😀😀", "😀😀"},
+		},
+		{
+			name:  "long word cut between runes",
+			text:  "абвгдежзий",
+			limit: 4,
+			want:  []string{"абвг", "дежз", "ий"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SplitHTML(tt.text, tt.limit)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SplitHTML(%q, %d)\n got %q\nwant %q", tt.text, tt.limit, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSplitHTMLGolden splits the rendered golden files into small chunks, which must all be
+// valid on their own and within the limit
+func TestSplitHTMLGolden(t *testing.T) {
+	outputs, err := filepath.Glob(filepath.Join("testdata", "*.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, output := range outputs {
+		data, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		text := string(data)
+
+		for _, limit := range []int{7, 20, 64} {
+			chunks := SplitHTML(text, limit)
+			var visible strings.Builder
+			for _, chunk := range chunks {
+				if n := TextLength(chunk); n > limit {
+					t.Errorf("%s: chunk of %d units exceeds %d: %q", output, n, limit, chunk)
+				}
+				if !utf8.ValidString(chunk) {
+					t.Errorf("%s: chunk with a cut rune: %q", output, chunk)
+				}
+				if err := checkTelegramHTML(chunk); err != nil {
+					t.Errorf("%s: invalid chunk %q: %v", output, chunk, err)
+				}
+				visible.WriteString(stripTags(chunk))
+			}
+
+			// Only whitespace is dropped at the cuts
+			want := strings.Join(strings.Fields(stripTags(text)), "")
+			if got := strings.Join(strings.Fields(visible.String()), ""); got != want {
+				t.Errorf("%s: text lost when splitting at %d:\n got %q\nwant %q", output, limit, got, want)
+			}
+		}
+	}
+}
@@ -13,31 +13,81 @@
 package openrouter
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"telegrambot/internal/storage"
+	"telegrambot/internal/tokens"
 
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// generationStatsTimeout limits how long the cost of a request is looked up before it is estimated
+	generationStatsTimeout = 5 * time.Second
+
+	// maxRoutedModels is the number of models OpenRouter falls back between within one request
+	maxRoutedModels = 3
+)
+
 // ChatMessage represents a message in the chat completion request
 type ChatMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// Parts replaces Content with multimodal content (text and images) when set
+	Parts []ContentPart `json:"-"`
+}
+
+// ContentPart is one part of a multimodal message
+type ContentPart struct {
+	Type     string    `json:"type"` // "text" or "image_url"
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+// ImageURL references an image by URL or base64 data URL
+type ImageURL struct {
+	URL string `json:"url"`
+}
+
+// MarshalJSON encodes the content as a string, or as an array of parts for multimodal messages
+func (m ChatMessage) MarshalJSON() ([]byte, error) {
+	if len(m.Parts) == 0 {
+		return json.Marshal(struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		}{m.Role, m.Content})
+	}
+
+	return json.Marshal(struct {
+		Role    string        `json:"role"`
+		Content []ContentPart `json:"content"`
+	}{m.Role, m.Parts})
 }
 
 // ChatCompletionRequest represents the request to OpenRouter chat completion API
+// Optional parameters are pointers, so zero values can be sent while unset ones are left out.
 type ChatCompletionRequest struct {
-	Model       string        `json:"model"`
-	Messages    []ChatMessage `json:"messages"`
-	Temperature float64       `json:"temperature,omitempty"`
-	MaxTokens   int           `json:"max_tokens,omitempty"`
-	TopP        float64       `json:"top_p,omitempty"`
+	Model            string        `json:"model"`
+	Messages         []ChatMessage `json:"messages"`
+	Temperature      *float64      `json:"temperature,omitempty"`
+	MaxTokens        *int          `json:"max_tokens,omitempty"`
+	TopP             *float64      `json:"top_p,omitempty"`
+	FrequencyPenalty *float64      `json:"frequency_penalty,omitempty"`
+	PresencePenalty  *float64      `json:"presence_penalty,omitempty"`
+	Seed             *int64        `json:"seed,omitempty"`
+	Stop             []string      `json:"stop,omitempty"`
+	Stream           bool          `json:"stream,omitempty"`
+	// Models lets OpenRouter fall back to the next model in the list when one fails
+	Models []string `json:"models,omitempty"`
 }
 
 // Usage represents token usage information
@@ -68,6 +118,22 @@ type ChatCompletionResponse struct {
 	Error   *OpenRouterError       `json:"error,omitempty"`
 }
 
+// ChatCompletionChunk represents a single server-sent event of a streaming response
+type ChatCompletionChunk struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Index int `json:"index"`
+		Delta struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *Usage           `json:"usage,omitempty"`
+	Error *OpenRouterError `json:"error,omitempty"`
+}
+
 // GenerationStats represents the generation statistics from OpenRouter
 type GenerationStats struct {
 	ID                     string  `json:"id"`
@@ -88,14 +154,18 @@ type GenerationStats struct {
 type OpenRouterError struct {
 	Message string `json:"message"`
 	Type    string `json:"type"`
-	Code    string `json:"code"`
+	// Code is usually the HTTP status as a number, but some providers send strings
+	Code any `json:"code"`
 }
 
 // Client represents the OpenRouter API client
 type Client struct {
-	apiKey  string
-	baseURL string
-	client  *http.Client
+	apiKey       string
+	baseURL      string
+	client       *http.Client
+	streamClient *http.Client
+	catalog      modelCatalog
+	tokens       *tokens.Estimator
 }
 
 // NewClient creates a new OpenRouter client
@@ -106,18 +176,45 @@ func NewClient(apiKey, baseURL string) *Client {
 		client: &http.Client{
 			Timeout: 180 * time.Second, // 3 minutes
 		},
+		streamClient: &http.Client{
+			// Streams deliver tokens as they are generated, so allow long answers to finish
+			Timeout: 10 * time.Minute,
+		},
+		tokens: tokens.NewEstimator(),
 	}
 }
 
-// ChatCompletion makes a chat completion request to OpenRouter
-func (c *Client) ChatCompletion(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
-	// Set default values
-	if req.Temperature == 0 {
-		req.Temperature = 0.7
-	}
-	if req.MaxTokens == 0 {
-		req.MaxTokens = 200_000
+// Tokens returns the token estimator, calibrated with the usage reported for completed requests
+func (c *Client) Tokens() *tokens.Estimator {
+	return c.tokens
+}
+
+// setHeaders sets the headers common to all OpenRouter requests
+func (c *Client) setHeaders(httpReq *http.Request) {
+	httpReq.Header.Set("Authorization", "Bearer "+c.apiKey)
+	httpReq.Header.Set("HTTP-Referer", "https://github.com/your-repo/telegrambot")
+	httpReq.Header.Set("X-Title", "Telegram LLM Bot")
+}
+
+// newChatCompletionRequest creates a request with the given generation parameters
+func newChatCompletionRequest(model string, messages []storage.ChatMessage, params storage.GenerationParams) ChatCompletionRequest {
+	return ChatCompletionRequest{
+		Model:            model,
+		Messages:         toAPIMessages(messages),
+		Temperature:      params.Temperature,
+		MaxTokens:        params.MaxTokens,
+		TopP:             params.TopP,
+		FrequencyPenalty: params.FrequencyPenalty,
+		PresencePenalty:  params.PresencePenalty,
+		Seed:             params.Seed,
+		Stop:             params.Stop,
 	}
+}
+
+// ChatCompletion makes a chat completion request to OpenRouter.
+// Cancelling the context aborts the request.
+func (c *Client) ChatCompletion(ctx context.Context, req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	req.Stream = false
 
 	// Marshal request
 	jsonData, err := json.Marshal(req)
@@ -126,29 +223,32 @@ func (c *Client) ChatCompletion(req ChatCompletionRequest) (*ChatCompletionRespo
 	}
 
 	// Create HTTP request
-	httpReq, err := http.NewRequest("POST", c.baseURL+"/chat/completions", bytes.NewBuffer(jsonData))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/chat/completions", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	// Set headers
 	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Authorization", "Bearer "+c.apiKey)
-	httpReq.Header.Set("HTTP-Referer", "https://github.com/your-repo/telegrambot")
-	httpReq.Header.Set("X-Title", "Telegram LLM Bot")
+	c.setHeaders(httpReq)
 
 	// Make request
 	log.Debugf("Making OpenRouter request to model: %s", req.Model)
 	resp, err := c.client.Do(httpReq)
 	if err != nil {
-		return nil, fmt.Errorf("failed to make request: %w", err)
+		return nil, transportError(ctx, err)
 	}
 	defer resp.Body.Close()
 
 	// Read response body
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+		return nil, transportError(ctx, err)
+	}
+
+	// Check HTTP status
+	if resp.StatusCode != http.StatusOK {
+		return nil, errorResponse(resp.StatusCode, body, resp.Header)
 	}
 
 	// Parse response
@@ -159,33 +259,144 @@ func (c *Client) ChatCompletion(req ChatCompletionRequest) (*ChatCompletionRespo
 
 	// Check for API error
 	if completionResp.Error != nil {
-		return nil, fmt.Errorf("OpenRouter API error: %s", completionResp.Error.Message)
+		return nil, completionResp.Error.toAPIError(resp.StatusCode, resp.Header)
 	}
 
-	// Check HTTP status
+	log.Debugf("OpenRouter response: tokens=%d, model=%s", completionResp.Usage.TotalTokens, completionResp.Model)
+	return &completionResp, nil
+}
+
+// ChatCompletionStream makes a streaming chat completion request to OpenRouter.
+// onDelta is called with every piece of content as it arrives. The returned
+// response contains the assembled message so callers can treat it like a
+// regular completion (including the generation ID for cost tracking).
+// If the context is cancelled mid-stream, the partial response is returned together with the context's error.
+func (c *Client) ChatCompletionStream(ctx context.Context, req ChatCompletionRequest, onDelta func(delta string)) (*ChatCompletionResponse, error) {
+	req.Stream = true
+
+	// Marshal request
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	// Create HTTP request
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/chat/completions", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Set headers
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "text/event-stream")
+	c.setHeaders(httpReq)
+
+	// Make request
+	log.Debugf("Making streaming OpenRouter request to model: %s", req.Model)
+	resp, err := c.streamClient.Do(httpReq)
+	if err != nil {
+		return nil, transportError(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	// Errors before the stream starts are returned as a regular JSON body
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP error %d: %s", resp.StatusCode, string(body))
+		body, _ := io.ReadAll(resp.Body)
+		return nil, errorResponse(resp.StatusCode, body, resp.Header)
 	}
 
-	log.Debugf("OpenRouter response: tokens=%d, model=%s", completionResp.Usage.TotalTokens, completionResp.Model)
-	return &completionResp, nil
+	completionResp := &ChatCompletionResponse{
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+	}
+	var content strings.Builder
+	var finishReason string
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// Skip blank separators and SSE comments (OpenRouter sends ": OPENROUTER PROCESSING" keep-alives)
+		if line == "" || strings.HasPrefix(line, ":") {
+			continue
+		}
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			log.Warnf("Failed to parse stream chunk: %v", err)
+			continue
+		}
+
+		// Errors can also arrive mid-stream
+		if chunk.Error != nil {
+			return nil, chunk.Error.toAPIError(0, nil)
+		}
+
+		if chunk.ID != "" {
+			completionResp.ID = chunk.ID
+		}
+		if chunk.Model != "" {
+			completionResp.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			completionResp.Usage = *chunk.Usage
+		}
+
+		for _, choice := range chunk.Choices {
+			if choice.FinishReason != "" {
+				finishReason = choice.FinishReason
+			}
+			if choice.Delta.Content == "" {
+				continue
+			}
+			content.WriteString(choice.Delta.Content)
+			if onDelta != nil {
+				onDelta(choice.Delta.Content)
+			}
+		}
+	}
+
+	choice := ChatCompletionChoice{FinishReason: finishReason}
+	choice.Message.Role = "assistant"
+	choice.Message.Content = content.String()
+	completionResp.Choices = []ChatCompletionChoice{choice}
+
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			// The tokens generated so far are billed, so keep them for cost tracking
+			return completionResp, ctx.Err()
+		}
+		return nil, newTransportError(fmt.Errorf("failed to read stream: %w", err))
+	}
+
+	log.Debugf("OpenRouter stream finished: id=%s, model=%s, length=%d", completionResp.ID, completionResp.Model, content.Len())
+	return completionResp, nil
 }
 
 // GetGenerationStats queries the generation statistics for a specific generation ID
 // This provides accurate cost and native token counts from OpenRouter API
 // Unlike the normalized token counts in the completion response, these are model-specific
-func (c *Client) GetGenerationStats(generationID string) (*GenerationStats, error) {
+func (c *Client) GetGenerationStats(ctx context.Context, generationID string) (*GenerationStats, error) {
 	// Create HTTP request
 	url := c.baseURL + "/generation?id=" + generationID
-	httpReq, err := http.NewRequest("GET", url, nil)
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	// Set headers
-	httpReq.Header.Set("Authorization", "Bearer "+c.apiKey)
-	httpReq.Header.Set("HTTP-Referer", "https://github.com/your-repo/telegrambot")
-	httpReq.Header.Set("X-Title", "Telegram LLM Bot")
+	c.setHeaders(httpReq)
 
 	// Make request with retry logic
 	var resp *http.Response
@@ -198,7 +409,11 @@ func (c *Client) GetGenerationStats(generationID string) (*GenerationStats, erro
 		// If not ready yet, wait and retry
 		if resp.StatusCode == 202 {
 			resp.Body.Close()
-			time.Sleep(time.Duration(i+1) * time.Second)
+			select {
+			case <-time.After(time.Duration(i+1) * time.Second):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
 			continue
 		}
 
@@ -227,55 +442,27 @@ func (c *Client) GetGenerationStats(generationID string) (*GenerationStats, erro
 	return &stats, nil
 }
 
-// CalculateCost is deprecated - use GetGenerationStats instead for accurate pricing
-// This is kept as fallback for cases where generation stats are not available
+// CalculateCost estimates the cost of a request from the catalog pricing of the model.
+// It is the fallback for when generation stats are not available; GetGenerationStats is accurate.
 func (c *Client) CalculateCost(model string, inputTokens, outputTokens int) float64 {
-	log.Warn("Using estimated cost calculation - use GetGenerationStats for accurate pricing")
-
-	// Basic cost estimation (in USD) - rough estimates only
-	var inputCostPer1K, outputCostPer1K float64
-
-	switch {
-	case contains(model, "gpt-4"):
-		inputCostPer1K = 0.03
-		outputCostPer1K = 0.06
-	case contains(model, "gpt-3.5-turbo"):
-		inputCostPer1K = 0.001
-		outputCostPer1K = 0.002
-	case contains(model, "claude"):
-		inputCostPer1K = 0.008
-		outputCostPer1K = 0.024
-	default:
-		// Default pricing for unknown models
-		inputCostPer1K = 0.002
-		outputCostPer1K = 0.004
-	}
-
-	inputCost := float64(inputTokens) / 1000.0 * inputCostPer1K
-	outputCost := float64(outputTokens) / 1000.0 * outputCostPer1K
-
-	return inputCost + outputCost
-}
-
-// GetChatResponse gets a chat response and tracks the expense
-func (c *Client) GetChatResponse(model string, messages []storage.ChatMessage, userID int64, store storage.Storage) (string, error) {
-	// Convert storage messages to API messages
-	apiMessages := make([]ChatMessage, len(messages))
-	for i, msg := range messages {
-		apiMessages[i] = ChatMessage{
-			Role:    msg.Role,
-			Content: msg.Content,
-		}
+	info, err := c.GetModel(model)
+	if err != nil {
+		log.Warnf("Failed to load model catalog, recording request to %s without cost: %v", model, err)
+		return 0
 	}
-
-	// Create request
-	req := ChatCompletionRequest{
-		Model:    model,
-		Messages: apiMessages,
+	if info == nil {
+		log.Warnf("Model %s is not in the catalog, recording its request without cost", model)
+		return 0
 	}
+	return info.Cost(inputTokens, outputTokens)
+}
 
-	// Make API call
-	resp, err := c.ChatCompletion(req)
+// GetChatResponse gets a chat response and tracks the expense.
+// If the model keeps failing, the fallback models are tried in order.
+func (c *Client) GetChatResponse(ctx context.Context, model string, fallbacks []string, messages []storage.ChatMessage, params storage.GenerationParams, userID int64, store storage.Storage) (string, error) {
+	resp, answeredBy, err := c.complete(ctx, append([]string{model}, fallbacks...), func(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+		return c.ChatCompletion(ctx, req)
+	}, messages, params)
 	if err != nil {
 		return "", err
 	}
@@ -287,11 +474,170 @@ func (c *Client) GetChatResponse(model string, messages []storage.ChatMessage, u
 
 	content := resp.Choices[0].Message.Content
 
+	c.calibrate(answeredBy, messages, resp)
+	c.trackExpense(ctx, answeredBy, resp, userID, store)
+	return content, nil
+}
+
+// GetChatResponseStream gets a streamed chat response and tracks the expense once the stream completes.
+// onDelta receives the content pieces as they arrive. Fallback models are only tried
+// while nothing has been streamed yet. If the context is cancelled mid-stream, the partial
+// content is returned together with the context's error and its cost is tracked.
+func (c *Client) GetChatResponseStream(ctx context.Context, model string, fallbacks []string, messages []storage.ChatMessage, params storage.GenerationParams, userID int64, store storage.Storage, onDelta func(delta string)) (string, error) {
+	streamed := false
+	var partial *ChatCompletionResponse
+	var partialModel string
+	resp, answeredBy, err := c.complete(ctx, append([]string{model}, fallbacks...), func(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+		if streamed {
+			// Retrying would repeat the part of the answer the user has already seen
+			return nil, errStreamInterrupted
+		}
+		resp, err := c.ChatCompletionStream(ctx, req, func(delta string) {
+			streamed = true
+			onDelta(delta)
+		})
+		if err != nil && resp != nil {
+			partial, partialModel = resp, req.Model
+		}
+		if err != nil && streamed {
+			return nil, fmt.Errorf("%w: %w", errStreamInterrupted, err)
+		}
+		return resp, err
+	}, messages, params)
+	if err != nil {
+		if partial == nil || partial.ID == "" {
+			return "", err
+		}
+		c.trackExpense(ctx, partialModel, partial, userID, store)
+		return partial.Choices[0].Message.Content, err
+	}
+
+	content := resp.Choices[0].Message.Content
+
+	c.calibrate(answeredBy, messages, resp)
+	c.trackExpense(ctx, answeredBy, resp, userID, store)
+	return content, nil
+}
+
+// complete sends a request with retries to each model in turn until one succeeds.
+// OpenRouter also receives the next models, so it falls back on its side without another
+// round trip; the client only moves on to models OpenRouter hasn't tried. It returns the
+// response and the model that produced it.
+func (c *Client) complete(ctx context.Context, models []string, send func(req ChatCompletionRequest) (*ChatCompletionResponse, error), messages []storage.ChatMessage, params storage.GenerationParams) (*ChatCompletionResponse, string, error) {
+	var lastErr error
+	for i := 0; i < len(models); {
+		routed := models[i:min(i+maxRoutedModels, len(models))]
+		req := newChatCompletionRequest(routed[0], messages, params)
+		if len(routed) > 1 {
+			req.Models = routed
+		}
+
+		resp, err := withRetry(ctx, routed[0], func() (*ChatCompletionResponse, error) {
+			return send(req)
+		})
+		if err == nil {
+			model := answeredBy(resp, routed)
+			if model != routed[0] {
+				log.Infof("Model %s failed, OpenRouter answered with %s", routed[0], model)
+			}
+			return resp, model, nil
+		}
+
+		lastErr = err
+		if ctx.Err() != nil || errors.Is(err, errStreamInterrupted) || !shouldFallback(err) {
+			break
+		}
+		i += len(routed)
+		if i < len(models) {
+			log.Warnf("Models %s failed, falling back to %s: %v", strings.Join(routed, ", "), models[i], err)
+		}
+	}
+
+	// Return the error of the last attempt without the internal marker
+	var apiErr *APIError
+	if errors.As(lastErr, &apiErr) {
+		return nil, "", apiErr
+	}
+	if ctx.Err() != nil {
+		return nil, "", ctx.Err()
+	}
+	return nil, "", lastErr
+}
+
+// answeredBy returns which of the requested models produced a response.
+// OpenRouter reports the model it routed to, possibly with a version suffix.
+func answeredBy(resp *ChatCompletionResponse, models []string) string {
+	for _, model := range models {
+		if resp.Model == model || strings.HasPrefix(resp.Model, model+"-") {
+			return model
+		}
+	}
+	return models[0]
+}
+
+// calibrate improves the token estimates of a model with the prompt size reported by the API
+func (c *Client) calibrate(model string, messages []storage.ChatMessage, resp *ChatCompletionResponse) {
+	if resp.Usage.PromptTokens > 0 {
+		c.tokens.Calibrate(model, messages, resp.Usage.PromptTokens)
+	}
+}
+
+// toAPIMessages converts storage messages to API messages.
+// Images are sent as image parts if their content has been loaded into DataURL, and the text
+// of documents is put in front of the message.
+func toAPIMessages(messages []storage.ChatMessage) []ChatMessage {
+	apiMessages := make([]ChatMessage, len(messages))
+	for i, msg := range messages {
+		apiMessages[i] = ChatMessage{
+			Role:    msg.Role,
+			Content: withDocuments(msg),
+		}
+
+		var images []ContentPart
+		for _, attachment := range msg.Attachments {
+			if attachment.Type == storage.AttachmentImage && attachment.DataURL != "" {
+				images = append(images, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: attachment.DataURL}})
+			}
+		}
+		if len(images) == 0 {
+			continue
+		}
+
+		if content := apiMessages[i].Content; content != "" {
+			apiMessages[i].Parts = append(apiMessages[i].Parts, ContentPart{Type: "text", Text: content})
+		}
+		apiMessages[i].Parts = append(apiMessages[i].Parts, images...)
+	}
+	return apiMessages
+}
+
+// withDocuments returns the content of a message with the text of its documents in front,
+// each marked with its file name so the model can refer to it
+func withDocuments(msg storage.ChatMessage) string {
+	var content strings.Builder
+	for _, attachment := range msg.Attachments {
+		if attachment.Type != storage.AttachmentDocument {
+			continue
+		}
+		fmt.Fprintf(&content, "<document name=%q>\n%s\n</document>\n\n", attachment.Name, attachment.Text)
+	}
+	if content.Len() == 0 {
+		return msg.Content
+	}
+	content.WriteString(msg.Content)
+	return content.String()
+}
+
+// trackExpense records the cost of a completed request in the user's expense history
+func (c *Client) trackExpense(ctx context.Context, model string, resp *ChatCompletionResponse, userID int64, store storage.Storage) {
 	// Get accurate cost and token counts from generation stats
 	var expense storage.ExpenseRecord
 	if resp.ID != "" {
-		// Query generation stats for accurate pricing
-		stats, err := c.GetGenerationStats(resp.ID)
+		// Query generation stats for accurate pricing. A stopped request was billed as well,
+		// so the stats are still fetched, but only for a short time.
+		statsCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), generationStatsTimeout)
+		stats, err := c.GetGenerationStats(statsCtx, resp.ID)
+		cancel()
 		if err != nil {
 			log.Warnf("Failed to get generation stats, using fallback calculation: %v", err)
 			// Fallback to estimated cost
@@ -334,26 +680,4 @@ func (c *Client) GetChatResponse(model string, messages []storage.ChatMessage, u
 	}
 
 	log.Infof("Chat response generated: model=%s, cost=$%.6f", expense.Model, expense.Cost)
-	return content, nil
-}
-
-// contains checks if a string contains a substring (case-insensitive)
-func contains(s, substr string) bool {
-	s = fmt.Sprintf("%s", s)
-	substr = fmt.Sprintf("%s", substr)
-	return len(s) >= len(substr) &&
-		(s == substr ||
-			len(s) > len(substr) &&
-				(s[:len(substr)] == substr ||
-					s[len(s)-len(substr):] == substr ||
-					findSubstring(s, substr)))
-}
-
-func findSubstring(s, substr string) bool {
-	for i := 0; i <= len(s)-len(substr); i++ {
-		if s[i:i+len(substr)] == substr {
-			return true
-		}
-	}
-	return false
 }
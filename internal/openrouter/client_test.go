@@ -0,0 +1,368 @@
+package openrouter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"telegrambot/internal/storage"
+)
+
+// fakeAPI is an OpenRouter chat completion endpoint that answers requests with respond
+// and records the requests it received
+type fakeAPI struct {
+	mutex    sync.Mutex
+	requests []ChatCompletionRequest
+	respond  func(w http.ResponseWriter, r *http.Request, req ChatCompletionRequest, attempt int)
+}
+
+// newFakeAPI starts a server for respond and returns a client using it
+func newFakeAPI(t *testing.T, respond func(w http.ResponseWriter, r *http.Request, req ChatCompletionRequest, attempt int)) (*fakeAPI, *Client) {
+	api := &fakeAPI{respond: respond}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ChatCompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		api.mutex.Lock()
+		api.requests = append(api.requests, req)
+		attempt := len(api.requests)
+		api.mutex.Unlock()
+
+		api.respond(w, r, req, attempt)
+	}))
+	t.Cleanup(server.Close)
+	return api, NewClient("test-key", server.URL)
+}
+
+// received returns the requests the server received so far
+func (a *fakeAPI) received() []ChatCompletionRequest {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return append([]ChatCompletionRequest(nil), a.requests...)
+}
+
+// writeCompletion answers with a completion of model
+func writeCompletion(w http.ResponseWriter, model, content string) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"id":"gen-1","model":%q,"choices":[{"message":{"role":"assistant","content":%q},"finish_reason":"stop"}],"usage":{"prompt_tokens":10,"completion_tokens":2,"total_tokens":12}}`, model, content)
+}
+
+// writeError answers with an error status and an error object of the API
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"message":%q,"code":%d}}`, message, status)
+}
+
+// completeChat sends a non-streaming request to models like GetChatResponse, without tracking its cost
+func completeChat(c *Client, models ...string) (*ChatCompletionResponse, string, error) {
+	ctx := context.Background()
+	messages := []storage.ChatMessage{{Role: "user", Content: "Hi"}}
+	return c.complete(ctx, models, func(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+		return c.ChatCompletion(ctx, req)
+	}, messages, storage.GenerationParams{})
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		status  int
+		message string
+		want    error
+	}{
+		{402, "Payment required", ErrInsufficientCredits},
+		{400, "Insufficient credits to complete the request", ErrInsufficientCredits},
+		{429, "Too many requests", ErrRateLimited},
+		{400, "Provider returned rate limit", ErrRateLimited},
+		{413, "Payload too large", ErrContextTooLong},
+		{400, "This model's maximum context length is 8192 tokens", ErrContextTooLong},
+		{403, "Input was flagged by moderation", ErrModerated},
+		{502, "Bad gateway", ErrProviderUnavailable},
+		{408, "Request timeout", ErrProviderUnavailable},
+		{400, "Invalid model", nil},
+		{401, "No auth credentials found", nil},
+	}
+	for _, tt := range tests {
+		if got := classifyError(tt.status, tt.message); got != tt.want {
+			t.Errorf("classifyError(%d, %q) = %v, want %v", tt.status, tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	date := time.Now().Add(90 * time.Second).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		value    string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"7", 7 * time.Second, 7 * time.Second},
+		{"0", 0, 0},
+		{"-3", 0, 0},
+		{"soon", 0, 0},
+		{date, 80 * time.Second, 90 * time.Second},
+		{"Mon, 01 Jan 2001 00:00:00 GMT", 0, 0},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.value != "" {
+			header.Set("Retry-After", tt.value)
+		}
+		if got := parseRetryAfter(header); got < tt.min || got > tt.max {
+			t.Errorf("parseRetryAfter(%q) = %v, want between %v and %v", tt.value, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	// Retry-After is honored, but not beyond maxRetryDelay
+	if got := retryDelay(0, &APIError{Kind: ErrRateLimited, RetryAfter: 4 * time.Second}); got != 4*time.Second {
+		t.Errorf("retryDelay with Retry-After 4s = %v", got)
+	}
+	if got := retryDelay(0, &APIError{Kind: ErrRateLimited, RetryAfter: time.Hour}); got != maxRetryDelay {
+		t.Errorf("retryDelay with Retry-After 1h = %v, want %v", got, maxRetryDelay)
+	}
+
+	// Without it the backoff doubles with jitter and is capped as well
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, baseRetryDelay},
+		{1, 2 * baseRetryDelay},
+		{2, 4 * baseRetryDelay},
+		{10, maxRetryDelay},
+	}
+	for _, tt := range tests {
+		got := retryDelay(tt.attempt, ErrProviderUnavailable)
+		if got < tt.want/2 || got > tt.want {
+			t.Errorf("retryDelay(%d) = %v, want between %v and %v", tt.attempt, got, tt.want/2, tt.want)
+		}
+	}
+}
+
+func TestRetryAfterRateLimit(t *testing.T) {
+	api, client := newFakeAPI(t, func(w http.ResponseWriter, r *http.Request, req ChatCompletionRequest, attempt int) {
+		if attempt == 1 {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusTooManyRequests, "Rate limit exceeded")
+			return
+		}
+		writeCompletion(w, req.Model, "Hello")
+	})
+
+	start := time.Now()
+	resp, model, err := completeChat(client, "a/model")
+	if err != nil {
+		t.Fatalf("complete() error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v, want the 1s of Retry-After", elapsed)
+	}
+	if len(api.received()) != 2 || model != "a/model" || resp.Choices[0].Message.Content != "Hello" {
+		t.Errorf("complete() = %q from %s after %d requests, want Hello from a/model after 2", resp.Choices[0].Message.Content, model, len(api.received()))
+	}
+}
+
+func TestRetryServerError(t *testing.T) {
+	api, client := newFakeAPI(t, func(w http.ResponseWriter, r *http.Request, req ChatCompletionRequest, attempt int) {
+		if attempt == 1 {
+			writeError(w, http.StatusBadGateway, "Upstream error")
+			return
+		}
+		writeCompletion(w, req.Model, "Hello")
+	})
+
+	if _, _, err := completeChat(client, "a/model"); err != nil {
+		t.Fatalf("complete() error: %v", err)
+	}
+	if n := len(api.received()); n != 2 {
+		t.Errorf("sent %d requests, want 2", n)
+	}
+}
+
+func TestNoFallbackForCreditsAndModeration(t *testing.T) {
+	tests := []struct {
+		status  int
+		message string
+		want    error
+	}{
+		{http.StatusPaymentRequired, "Insufficient credits", ErrInsufficientCredits},
+		{http.StatusForbidden, "Input was flagged by moderation", ErrModerated},
+	}
+	for _, tt := range tests {
+		api, client := newFakeAPI(t, func(w http.ResponseWriter, r *http.Request, req ChatCompletionRequest, attempt int) {
+			writeError(w, tt.status, tt.message)
+		})
+
+		_, _, err := completeChat(client, "a/one", "a/two", "a/three", "a/four")
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%d: complete() error = %v, want %v", tt.status, err, tt.want)
+		}
+		if n := len(api.received()); n != 1 {
+			t.Errorf("%d: sent %d requests, want 1 without retries or fallbacks", tt.status, n)
+		}
+	}
+}
+
+func TestFallbackOrder(t *testing.T) {
+	api, client := newFakeAPI(t, func(w http.ResponseWriter, r *http.Request, req ChatCompletionRequest, attempt int) {
+		if attempt == 1 {
+			// Not worth retrying, but another model may have a larger context
+			writeError(w, http.StatusRequestEntityTooLarge, "Prompt is too long")
+			return
+		}
+		writeCompletion(w, req.Model, "Hello")
+	})
+
+	_, model, err := completeChat(client, "a/one", "a/two", "a/three", "a/four")
+	if err != nil {
+		t.Fatalf("complete() error: %v", err)
+	}
+
+	// OpenRouter routes between the first models; the client continues with the ones it didn't try
+	requests := api.received()
+	if len(requests) != 2 {
+		t.Fatalf("sent %d requests, want 2", len(requests))
+	}
+	if requests[0].Model != "a/one" || !reflect.DeepEqual(requests[0].Models, []string{"a/one", "a/two", "a/three"}) {
+		t.Errorf("first request to %s with models %v", requests[0].Model, requests[0].Models)
+	}
+	if requests[1].Model != "a/four" || requests[1].Models != nil {
+		t.Errorf("second request to %s with models %v, want a/four alone", requests[1].Model, requests[1].Models)
+	}
+	if model != "a/four" {
+		t.Errorf("answered by %s, want a/four", model)
+	}
+}
+
+func TestFallbackAnsweredByOpenRouter(t *testing.T) {
+	_, client := newFakeAPI(t, func(w http.ResponseWriter, r *http.Request, req ChatCompletionRequest, attempt int) {
+		// OpenRouter reports the model it fell back to, with a version suffix
+		writeCompletion(w, "a/two-20240101", "Hello")
+	})
+
+	_, model, err := completeChat(client, "a/one", "a/two")
+	if err != nil || model != "a/two" {
+		t.Errorf("complete() answered by %s, %v; want a/two", model, err)
+	}
+}
+
+// writeEvents streams server-sent events, flushing after each one
+func writeEvents(w http.ResponseWriter, events ...string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, event := range events {
+		fmt.Fprintf(w, "%s\n\n", event)
+		w.(http.Flusher).Flush()
+	}
+}
+
+// deltaEvent is a chunk with a piece of content
+func deltaEvent(model, content string) string {
+	return fmt.Sprintf(`data: {"id":"gen-2","model":%q,"choices":[{"index":0,"delta":{"content":%q}}]}`, model, content)
+}
+
+func TestChatCompletionStream(t *testing.T) {
+	_, client := newFakeAPI(t, func(w http.ResponseWriter, r *http.Request, req ChatCompletionRequest, attempt int) {
+		if !req.Stream {
+			t.Error("request isn't streamed")
+		}
+		writeEvents(w,
+			": OPENROUTER PROCESSING",
+			deltaEvent("a/model", "Hel"),
+			"data: not json",
+			deltaEvent("a/model", "lo"),
+			`data: {"id":"gen-2","choices":[{"index":0,"delta":{},"finish_reason":"stop"}],"usage":{"prompt_tokens":10,"completion_tokens":2,"total_tokens":12}}`,
+			"data: [DONE]",
+			// Nothing after [DONE] is read
+			deltaEvent("a/model", " again"),
+		)
+	})
+
+	var deltas []string
+	resp, err := client.ChatCompletionStream(context.Background(), ChatCompletionRequest{Model: "a/model"}, func(delta string) {
+		deltas = append(deltas, delta)
+	})
+	if err != nil {
+		t.Fatalf("ChatCompletionStream() error: %v", err)
+	}
+	if !reflect.DeepEqual(deltas, []string{"Hel", "lo"}) {
+		t.Errorf("deltas = %q", deltas)
+	}
+	choice := resp.Choices[0]
+	if choice.Message.Content != "Hello" || choice.FinishReason != "stop" || resp.ID != "gen-2" || resp.Usage.TotalTokens != 12 {
+		t.Errorf("response = %+v", resp)
+	}
+}
+
+func TestChatCompletionStreamError(t *testing.T) {
+	api, client := newFakeAPI(t, func(w http.ResponseWriter, r *http.Request, req ChatCompletionRequest, attempt int) {
+		writeEvents(w,
+			deltaEvent("a/model", "Hel"),
+			`data: {"error":{"message":"Provider disconnected","code":502}}`,
+		)
+	})
+
+	_, err := client.ChatCompletionStream(context.Background(), ChatCompletionRequest{Model: "a/model"}, nil)
+	if !errors.Is(err, ErrProviderUnavailable) {
+		t.Errorf("ChatCompletionStream() error = %v, want ErrProviderUnavailable", err)
+	}
+
+	// Once content was shown, the request is neither retried nor sent to a fallback
+	var shown string
+	_, err = client.GetChatResponseStream(context.Background(), "a/model", []string{"a/other"}, []storage.ChatMessage{{Role: "user", Content: "Hi"}},
+		storage.GenerationParams{}, 1, nil, func(delta string) { shown += delta })
+	if !errors.Is(err, ErrProviderUnavailable) || shown != "Hel" {
+		t.Errorf("GetChatResponseStream() = %q, %v; want the error after Hel", shown, err)
+	}
+	if n := len(api.received()); n != 2 {
+		t.Errorf("sent %d requests, want 1 per call", n)
+	}
+}
+
+func TestChatCompletionStreamCancelled(t *testing.T) {
+	_, client := newFakeAPI(t, func(w http.ResponseWriter, r *http.Request, req ChatCompletionRequest, attempt int) {
+		writeEvents(w, deltaEvent("a/model", "Hel"), deltaEvent("a/model", "lo"))
+		// Keep the stream open until the client goes away
+		<-r.Context().Done()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp, err := client.ChatCompletionStream(ctx, ChatCompletionRequest{Model: "a/model"}, func(delta string) {
+		if delta == "lo" {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("ChatCompletionStream() error = %v, want context.Canceled", err)
+	}
+	if resp == nil || resp.Choices[0].Message.Content != "Hello" || resp.ID != "gen-2" {
+		t.Errorf("partial response = %+v, want Hello with its generation ID", resp)
+	}
+}
+
+func TestCalculateCost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"data":[{"id":"a/priced","pricing":{"prompt":"0.000001","completion":"0.000002"}}]}`)
+	}))
+	t.Cleanup(server.Close)
+	c := NewClient("test-key", server.URL)
+
+	// Prices are USD per token
+	if got, want := c.CalculateCost("a/priced", 1000, 500), 0.002; got != want {
+		t.Errorf("cost of a catalog model = %v, want %v", got, want)
+	}
+	if got := c.CalculateCost("a/unknown", 1000, 500); got != 0 {
+		t.Errorf("cost of an unknown model = %v, want 0", got)
+	}
+}
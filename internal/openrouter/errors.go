@@ -0,0 +1,216 @@
+package openrouter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Classes of failed requests. Errors returned by the client wrap one of them when
+// the failure could be classified, so callers can check them with errors.Is.
+var (
+	ErrRateLimited         = errors.New("rate limited")
+	ErrProviderUnavailable = errors.New("provider unavailable")
+	ErrContextTooLong      = errors.New("context too long")
+	ErrModerated           = errors.New("flagged by moderation")
+	ErrInsufficientCredits = errors.New("insufficient credits")
+)
+
+// errStreamInterrupted marks streams that failed after content was delivered; they are neither retried nor replaced
+var errStreamInterrupted = errors.New("stream interrupted")
+
+const (
+	// maxAttempts is the number of times a request to one model is tried
+	maxAttempts = 3
+
+	// Waits between attempts double from baseRetryDelay up to maxRetryDelay
+	baseRetryDelay = 1 * time.Second
+	maxRetryDelay  = 30 * time.Second
+)
+
+// APIError is a failed request to the OpenRouter API
+type APIError struct {
+	// Kind is one of the Err* classes, or nil if the failure couldn't be classified
+	Kind error
+	// StatusCode is the HTTP status or the error code of the API; 0 for transport errors
+	StatusCode int
+	Message    string
+	// RetryAfter is the wait requested by the server, if any
+	RetryAfter time.Duration
+	// cause is the underlying transport error
+	cause error
+}
+
+// Error returns a description of the failure
+func (e *APIError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("request failed: %s", e.Message)
+	}
+	return fmt.Sprintf("OpenRouter API error %d: %s", e.StatusCode, e.Message)
+}
+
+// Unwrap returns the error class and the underlying transport error
+func (e *APIError) Unwrap() []error {
+	var errs []error
+	if e.Kind != nil {
+		errs = append(errs, e.Kind)
+	}
+	if e.cause != nil {
+		errs = append(errs, e.cause)
+	}
+	return errs
+}
+
+// newAPIError classifies an error response
+func newAPIError(statusCode int, message string, header http.Header) *APIError {
+	return &APIError{
+		Kind:       classifyError(statusCode, message),
+		StatusCode: statusCode,
+		Message:    message,
+		RetryAfter: parseRetryAfter(header),
+	}
+}
+
+// transportError converts an error of the HTTP client. Cancellation is returned as the
+// context's error, anything else as a transport error.
+func transportError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return newTransportError(err)
+}
+
+// newTransportError wraps a network error; the provider is treated as unavailable
+func newTransportError(err error) *APIError {
+	return &APIError{
+		Kind:    ErrProviderUnavailable,
+		Message: err.Error(),
+		cause:   err,
+	}
+}
+
+// errorResponse parses an error response body, falling back to the raw body as message
+func errorResponse(statusCode int, body []byte, header http.Header) *APIError {
+	var resp struct {
+		Error *OpenRouterError `json:"error"`
+	}
+	if json.Unmarshal(body, &resp) == nil && resp.Error != nil {
+		return resp.Error.toAPIError(statusCode, header)
+	}
+	return newAPIError(statusCode, strings.TrimSpace(string(body)), header)
+}
+
+// toAPIError converts an error object of the API; its code takes precedence over the HTTP status
+func (e *OpenRouterError) toAPIError(statusCode int, header http.Header) *APIError {
+	if code, ok := e.Code.(float64); ok && code > 0 {
+		statusCode = int(code)
+	}
+	return newAPIError(statusCode, e.Message, header)
+}
+
+// classifyError maps an error status and message to one of the error classes
+func classifyError(statusCode int, message string) error {
+	message = strings.ToLower(message)
+	containsAny := func(substrings ...string) bool {
+		for _, substring := range substrings {
+			if strings.Contains(message, substring) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case statusCode == http.StatusPaymentRequired || containsAny("insufficient credits", "insufficient balance"):
+		return ErrInsufficientCredits
+	case statusCode == http.StatusTooManyRequests || containsAny("rate limit", "rate-limit"):
+		return ErrRateLimited
+	case statusCode == http.StatusRequestEntityTooLarge ||
+		containsAny("context length", "context window", "maximum context", "too many tokens", "prompt is too long"):
+		return ErrContextTooLong
+	case containsAny("moderation", "flagged"):
+		return ErrModerated
+	case statusCode == http.StatusRequestTimeout || statusCode >= http.StatusInternalServerError:
+		return ErrProviderUnavailable
+	}
+	return nil
+}
+
+// parseRetryAfter reads the Retry-After header, given in seconds or as an HTTP date
+func parseRetryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// isRetryable reports whether repeating the same request may succeed.
+// Timeouts are not retried since the user has already waited for the full timeout.
+func isRetryable(err error) bool {
+	if errors.Is(err, errStreamInterrupted) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	return errors.Is(err, ErrRateLimited) || errors.Is(err, ErrProviderUnavailable)
+}
+
+// shouldFallback reports whether another model may succeed where this one failed.
+// Moderated content is refused by the other models as well, so it doesn't fall back.
+func shouldFallback(err error) bool {
+	return errors.Is(err, ErrRateLimited) || errors.Is(err, ErrProviderUnavailable) ||
+		errors.Is(err, ErrContextTooLong)
+}
+
+// retryDelay returns the wait before the next attempt: the server's Retry-After if given
+// (capped at maxRetryDelay), otherwise an exponential backoff with jitter
+func retryDelay(attempt int, err error) time.Duration {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return min(apiErr.RetryAfter, maxRetryDelay)
+	}
+
+	delay := min(baseRetryDelay<<attempt, maxRetryDelay)
+	// Jitter between half and the whole delay spreads out retries of concurrent requests
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// withRetry calls attempt until it succeeds, fails with an error that isn't worth retrying,
+// maxAttempts is reached or the context is cancelled
+func withRetry(ctx context.Context, model string, attempt func() (*ChatCompletionResponse, error)) (*ChatCompletionResponse, error) {
+	for i := 0; ; i++ {
+		resp, err := attempt()
+		if err == nil {
+			return resp, nil
+		}
+		if i+1 >= maxAttempts || !isRetryable(err) {
+			return nil, err
+		}
+
+		delay := retryDelay(i, err)
+		log.Warnf("Request to %s failed (attempt %d/%d), retrying in %v: %v", model, i+1, maxAttempts, delay.Round(time.Millisecond), err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
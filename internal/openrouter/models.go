@@ -0,0 +1,309 @@
+package openrouter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// modelCatalogTTL is how long the model catalog is cached before it is fetched again
+const modelCatalogTTL = time.Hour
+
+// Model describes a model from the OpenRouter catalog
+type Model struct {
+	ID                  string
+	Name                string
+	ContextLength       int
+	MaxCompletionTokens int
+	// Prices are in USD per token
+	PromptPrice      float64
+	CompletionPrice  float64
+	InputModalities  []string
+	OutputModalities []string
+	// SupportedParameters lists the request parameters the model accepts, e.g. "temperature"
+	SupportedParameters []string
+}
+
+// SupportsInput reports whether the model accepts the given input modality (e.g. "image")
+func (m *Model) SupportsInput(modality string) bool {
+	for _, input := range m.InputModalities {
+		if input == modality {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsParameter reports whether the model accepts a request parameter.
+// Models without parameter information are assumed to accept everything.
+func (m *Model) SupportsParameter(name string) bool {
+	if len(m.SupportedParameters) == 0 {
+		return true
+	}
+	for _, parameter := range m.SupportedParameters {
+		if parameter == name {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxOutputTokens returns the largest max_tokens value the model accepts, or 0 if unknown
+func (m *Model) MaxOutputTokens() int {
+	if m.MaxCompletionTokens > 0 {
+		return m.MaxCompletionTokens
+	}
+	return m.ContextLength
+}
+
+// IsFree reports whether the model has no prompt or completion cost
+func (m *Model) IsFree() bool {
+	return m.PromptPrice == 0 && m.CompletionPrice == 0
+}
+
+// Cost returns the price in USD of a request with the given token counts
+func (m *Model) Cost(promptTokens, completionTokens int) float64 {
+	return float64(promptTokens)*m.PromptPrice + float64(completionTokens)*m.CompletionPrice
+}
+
+// modelsResponse represents the response of the /models endpoint
+type modelsResponse struct {
+	Data []struct {
+		ID            string `json:"id"`
+		Name          string `json:"name"`
+		ContextLength int    `json:"context_length"`
+		Architecture  struct {
+			Modality         string   `json:"modality"`
+			InputModalities  []string `json:"input_modalities"`
+			OutputModalities []string `json:"output_modalities"`
+		} `json:"architecture"`
+		Pricing struct {
+			Prompt     string `json:"prompt"`
+			Completion string `json:"completion"`
+		} `json:"pricing"`
+		SupportedParameters []string `json:"supported_parameters"`
+		TopProvider         struct {
+			ContextLength       int `json:"context_length"`
+			MaxCompletionTokens int `json:"max_completion_tokens"`
+		} `json:"top_provider"`
+	} `json:"data"`
+}
+
+// modelCatalog caches the model list returned by OpenRouter
+type modelCatalog struct {
+	mutex     sync.RWMutex
+	models    []Model
+	byID      map[string]*Model
+	fetchedAt time.Time
+}
+
+// ListModels returns the OpenRouter model catalog, sorted by ID.
+// The catalog is cached; if refreshing fails, the stale copy is returned.
+func (c *Client) ListModels() ([]Model, error) {
+	c.catalog.mutex.RLock()
+	models, fetchedAt := c.catalog.models, c.catalog.fetchedAt
+	c.catalog.mutex.RUnlock()
+
+	if models != nil && time.Since(fetchedAt) < modelCatalogTTL {
+		return models, nil
+	}
+
+	fresh, err := c.fetchModels()
+	if err != nil {
+		if models != nil {
+			log.Warnf("Failed to refresh model catalog, using cached copy: %v", err)
+			return models, nil
+		}
+		return nil, err
+	}
+
+	byID := make(map[string]*Model, len(fresh))
+	for i := range fresh {
+		byID[fresh[i].ID] = &fresh[i]
+	}
+
+	c.catalog.mutex.Lock()
+	c.catalog.models = fresh
+	c.catalog.byID = byID
+	c.catalog.fetchedAt = time.Now()
+	c.catalog.mutex.Unlock()
+
+	log.Infof("Loaded OpenRouter model catalog: %d models", len(fresh))
+	return fresh, nil
+}
+
+// GetModel returns a model from the catalog, or nil if the ID is unknown
+func (c *Client) GetModel(id string) (*Model, error) {
+	if _, err := c.ListModels(); err != nil {
+		return nil, err
+	}
+
+	c.catalog.mutex.RLock()
+	defer c.catalog.mutex.RUnlock()
+	return c.catalog.byID[id], nil
+}
+
+// fetchModels downloads the model catalog from OpenRouter
+func (c *Client) fetchModels() ([]Model, error) {
+	httpReq, err := http.NewRequest("GET", c.baseURL+"/models", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Set headers
+	c.setHeaders(httpReq)
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP error %d: %s", resp.StatusCode, string(body))
+	}
+
+	var modelsResp modelsResponse
+	if err := json.Unmarshal(body, &modelsResp); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	models := make([]Model, 0, len(modelsResp.Data))
+	for _, data := range modelsResp.Data {
+		model := Model{
+			ID:                  data.ID,
+			Name:                data.Name,
+			ContextLength:       data.ContextLength,
+			MaxCompletionTokens: data.TopProvider.MaxCompletionTokens,
+			PromptPrice:         parsePrice(data.Pricing.Prompt),
+			CompletionPrice:     parsePrice(data.Pricing.Completion),
+			InputModalities:     data.Architecture.InputModalities,
+			OutputModalities:    data.Architecture.OutputModalities,
+			SupportedParameters: data.SupportedParameters,
+		}
+		if model.ContextLength == 0 {
+			model.ContextLength = data.TopProvider.ContextLength
+		}
+		// Older responses only have the combined "text+image->text" modality string
+		if len(model.InputModalities) == 0 && data.Architecture.Modality != "" {
+			inputs := strings.SplitN(data.Architecture.Modality, "->", 2)[0]
+			model.InputModalities = strings.Split(inputs, "+")
+		}
+		models = append(models, model)
+	}
+
+	sort.Slice(models, func(i, j int) bool { return models[i].ID < models[j].ID })
+	return models, nil
+}
+
+// parsePrice parses a per-token price string; unknown or dynamic prices count as zero
+func parsePrice(price string) float64 {
+	value, err := strconv.ParseFloat(price, 64)
+	if err != nil || value < 0 {
+		return 0
+	}
+	return value
+}
+
+// SearchModels returns the models whose ID or name contains all words of the query (case-insensitive)
+func SearchModels(models []Model, query string) []Model {
+	words := strings.Fields(strings.ToLower(query))
+	if len(words) == 0 {
+		return models
+	}
+
+	var matches []Model
+	for _, model := range models {
+		haystack := strings.ToLower(model.ID + " " + model.Name)
+		matched := true
+		for _, word := range words {
+			if !strings.Contains(haystack, word) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			matches = append(matches, model)
+		}
+	}
+	return matches
+}
+
+// SuggestModels returns up to limit model IDs that are closest to an unknown ID
+func SuggestModels(models []Model, id string, limit int) []string {
+	type candidate struct {
+		id       string
+		distance int
+	}
+
+	id = strings.ToLower(id)
+	// Compare without the provider prefix too, so "gpt-4o" finds "openai/gpt-4o"
+	_, idName, hasProvider := strings.Cut(id, "/")
+
+	candidates := make([]candidate, 0, len(models))
+	for _, model := range models {
+		modelID := strings.ToLower(model.ID)
+		distance := levenshtein(id, modelID)
+		if !hasProvider {
+			_, modelName, _ := strings.Cut(modelID, "/")
+			distance = min(distance, levenshtein(id, modelName))
+		} else if _, modelName, _ := strings.Cut(modelID, "/"); modelName != "" {
+			distance = min(distance, levenshtein(idName, modelName)+1)
+		}
+		if strings.Contains(modelID, id) {
+			distance = 0
+		}
+		candidates = append(candidates, candidate{id: model.ID, distance: distance})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].distance < candidates[j].distance
+	})
+
+	// Only suggest reasonably close matches
+	maxDistance := len(id)/2 + 1
+	var suggestions []string
+	for _, c := range candidates {
+		if len(suggestions) >= limit || c.distance > maxDistance {
+			break
+		}
+		suggestions = append(suggestions, c.id)
+	}
+	return suggestions
+}
+
+// levenshtein returns the edit distance between two strings
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
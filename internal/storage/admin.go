@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	// accessFileName holds the access rules of the file storage
+	accessFileName = "access.json"
+	// auditFileName holds the audit log of the file storage, one JSON entry per line
+	auditFileName = "audit.log"
+)
+
+// AuditEntry records an action taken by an administrator
+type AuditEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	AdminID   int64     `json:"admin_id"`
+	Action    string    `json:"action"`
+	// TargetID is the user the action applies to; 0 for actions without a target
+	TargetID int64  `json:"target_id,omitempty"`
+	Details  string `json:"details,omitempty"`
+}
+
+// ListUsers returns the IDs of all users with stored settings
+func (fs *FileStorage) ListUsers() ([]int64, error) {
+	return listUserFiles(fs.dataDir)
+}
+
+// ResetExpenses deletes the expense history of a user
+func (fs *FileStorage) ResetExpenses(userID int64) error {
+	// Unknown users have no expenses, and resetting them mustn't create their file
+	if !fs.stored(userID) {
+		return nil
+	}
+	defer fs.forgetExpenses(userID)
+	return fs.update(userID, func(settings *UserSettings) error {
+		settings.ExpenseHistory = []ExpenseRecord{}
+		settings.TotalExpenses = 0
+		return nil
+	})
+}
+
+// GetAccessRules returns the users admins have allowed (true) or removed (false)
+func (fs *FileStorage) GetAccessRules() (map[int64]bool, error) {
+	fs.adminMutex.Lock()
+	defer fs.adminMutex.Unlock()
+
+	return fs.loadAccessRules()
+}
+
+// SetAccess allows or removes a user
+func (fs *FileStorage) SetAccess(userID int64, allowed bool) error {
+	fs.adminMutex.Lock()
+	defer fs.adminMutex.Unlock()
+
+	rules, err := fs.loadAccessRules()
+	if err != nil {
+		return err
+	}
+	rules[userID] = allowed
+
+	// JSON object keys must be strings
+	encoded := make(map[string]bool, len(rules))
+	for id, allowed := range rules {
+		encoded[strconv.FormatInt(id, 10)] = allowed
+	}
+	data, err := json.MarshalIndent(encoded, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal access rules: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(fs.dataDir, accessFileName), data, 0644); err != nil {
+		return fmt.Errorf("failed to write access rules: %w", err)
+	}
+	return nil
+}
+
+// loadAccessRules reads the access rules; the caller holds adminMutex
+func (fs *FileStorage) loadAccessRules() (map[int64]bool, error) {
+	rules := make(map[int64]bool)
+
+	data, err := os.ReadFile(filepath.Join(fs.dataDir, accessFileName))
+	if os.IsNotExist(err) {
+		return rules, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read access rules: %w", err)
+	}
+
+	var encoded map[string]bool
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, fmt.Errorf("failed to parse access rules: %w", err)
+	}
+	for key, allowed := range encoded {
+		id, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse access rules: invalid user ID %q", key)
+		}
+		rules[id] = allowed
+	}
+	return rules, nil
+}
+
+// AddAuditEntry appends an entry to the audit log
+func (fs *FileStorage) AddAuditEntry(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %w", err)
+	}
+
+	fs.adminMutex.Lock()
+	defer fs.adminMutex.Unlock()
+
+	file, err := os.OpenFile(filepath.Join(fs.dataDir, auditFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// GetAuditLog returns the most recent audit entries, oldest first; all of them if limit is 0
+func (fs *FileStorage) GetAuditLog(limit int) ([]AuditEntry, error) {
+	fs.adminMutex.Lock()
+	defer fs.adminMutex.Unlock()
+
+	file, err := os.Open(filepath.Join(fs.dataDir, auditFileName))
+	if os.IsNotExist(err) {
+		return []AuditEntry{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	entries := []AuditEntry{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		// A line cut off by a crash is skipped
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries, nil
+}
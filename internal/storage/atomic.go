@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// backupSuffix is appended to a user file for the copy of its previous version
+	backupSuffix = ".bak"
+	// tempSuffix marks files that are being written
+	tempSuffix = ".tmp-"
+)
+
+// writeFileAtomic replaces a file so that readers and crashes see either the old or the new
+// content: the data is written to a temporary file in the same directory, synced to disk and
+// renamed over the target.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+tempSuffix+"*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	// Fails harmlessly once the file has been renamed
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set permissions of temporary file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+
+	syncDir(dir)
+	return nil
+}
+
+// syncDir flushes a directory, so a rename in it survives a crash.
+// Not all platforms support this, so it is best effort.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	d.Sync()
+}
+
+// backupFile keeps the current content of a user file as its backup before it is replaced.
+// A file that isn't valid JSON doesn't overwrite the last good backup.
+func backupFile(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read user settings for backup: %w", err)
+	}
+	if !json.Valid(data) {
+		return nil
+	}
+
+	if err := writeFileAtomic(path+backupSuffix, data, 0644); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+	return nil
+}
+
+// readUserFile reads and parses a user file
+func readUserFile(path string) (*UserSettings, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read user settings: %w", err)
+	}
+
+	var settings UserSettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("failed to parse user settings: %w", err)
+	}
+	return &settings, nil
+}
+
+// restoreBackup replaces a damaged user file by its backup and returns the restored settings.
+// The damaged file is kept next to it for inspection.
+func (fs *FileStorage) restoreBackup(path string, cause error) (*UserSettings, error) {
+	backupPath := path + backupSuffix
+	settings, err := readUserFile(backupPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w (no usable backup: %v)", cause, err)
+	}
+
+	damagedPath := fmt.Sprintf("%s.damaged-%s", path, time.Now().Format("20060102-150405"))
+	if data, err := os.ReadFile(path); err == nil {
+		if err := os.WriteFile(damagedPath, data, 0644); err != nil {
+			return nil, fmt.Errorf("failed to keep damaged user settings: %w", err)
+		}
+	}
+
+	data, err := os.ReadFile(backupPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup: %w", err)
+	}
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to restore backup: %w", err)
+	}
+
+	log.Warnf("Restored %s from its backup after it could not be read (%v); the damaged file was kept as %s", path, cause, damagedPath)
+	return settings, nil
+}
+
+// removeTempFiles deletes the temporary files of writes that were interrupted
+func removeTempFiles(dataDir string) error {
+	files, err := filepath.Glob(filepath.Join(dataDir, "*"+tempSuffix+"*"))
+	if err != nil {
+		return fmt.Errorf("failed to list temporary files: %w", err)
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			return fmt.Errorf("failed to remove temporary file: %w", err)
+		}
+	}
+	return nil
+}
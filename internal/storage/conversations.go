@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultConversationTitle is the title of the conversation every user starts with
+const DefaultConversationTitle = "Main chat"
+
+// ErrConversationNotFound is returned when a conversation ID doesn't belong to the user
+var ErrConversationNotFound = errors.New("conversation not found")
+
+// ActiveConversation returns the active conversation
+func (s *UserSettings) ActiveConversation() *Conversation {
+	s.ensureActiveConversation()
+	return s.findConversation(s.ActiveConversationID)
+}
+
+// ActiveModel returns the model of the active conversation, falling back to the user's default
+func (s *UserSettings) ActiveModel() string {
+	if model := s.ActiveConversation().Model; model != "" {
+		return model
+	}
+	return s.CurrentModel
+}
+
+// ActiveChatMode returns the chat mode of the active conversation, falling back to the user's default
+func (s *UserSettings) ActiveChatMode() string {
+	if mode := s.ActiveConversation().ChatMode; mode != "" {
+		return mode
+	}
+	return s.ChatMode
+}
+
+// findConversation returns the conversation with the given ID or nil
+func (s *UserSettings) findConversation(id int64) *Conversation {
+	for i := range s.Conversations {
+		if s.Conversations[i].ID == id {
+			return &s.Conversations[i]
+		}
+	}
+	return nil
+}
+
+// newConversation appends a conversation that inherits the user's default model and chat mode
+func (s *UserSettings) newConversation(title string) *Conversation {
+	var nextID int64 = 1
+	for _, conversation := range s.Conversations {
+		if conversation.ID >= nextID {
+			nextID = conversation.ID + 1
+		}
+	}
+
+	now := time.Now()
+	s.Conversations = append(s.Conversations, Conversation{
+		ID:           nextID,
+		Title:        title,
+		Model:        s.CurrentModel,
+		ChatMode:     s.ChatMode,
+		ChatHistory:  []ChatMessage{},
+		CreatedAt:    now,
+		LastActivity: now,
+	})
+	return &s.Conversations[len(s.Conversations)-1]
+}
+
+// ensureActiveConversation makes sure the user has at least one conversation and that
+// the active conversation exists. The legacy flat chat history is moved into the default one.
+func (s *UserSettings) ensureActiveConversation() {
+	if len(s.Conversations) == 0 {
+		conversation := s.newConversation(DefaultConversationTitle)
+		if len(s.ChatHistory) > 0 {
+			conversation.ChatHistory = s.ChatHistory
+			conversation.LastActivity = s.ChatHistory[len(s.ChatHistory)-1].Timestamp
+		}
+		s.ChatHistory = nil
+	}
+
+	if s.findConversation(s.ActiveConversationID) == nil {
+		s.ActiveConversationID = s.mostRecentConversation().ID
+	}
+}
+
+// mostRecentConversation returns the conversation with the latest activity
+func (s *UserSettings) mostRecentConversation() *Conversation {
+	latest := &s.Conversations[0]
+	for i := range s.Conversations {
+		if s.Conversations[i].LastActivity.After(latest.LastActivity) {
+			latest = &s.Conversations[i]
+		}
+	}
+	return latest
+}
+
+// CreateConversation creates a new conversation and makes it active
+func (fs *FileStorage) CreateConversation(userID int64, title string) (*Conversation, error) {
+	var created Conversation
+	err := fs.update(userID, func(settings *UserSettings) error {
+		conversation := settings.newConversation(title)
+		settings.ActiveConversationID = conversation.ID
+		created = *conversation
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// GetConversations returns all conversations of a user
+func (fs *FileStorage) GetConversations(userID int64) ([]Conversation, error) {
+	settings, err := fs.GetUserSettings(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return settings.Conversations, nil
+}
+
+// GetConversationHistory returns the history of a conversation of the user
+func (fs *FileStorage) GetConversationHistory(userID int64, conversationID int64) ([]ChatMessage, error) {
+	settings, err := fs.GetUserSettings(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	conversation := settings.findConversation(conversationID)
+	if conversation == nil {
+		return nil, ErrConversationNotFound
+	}
+	return conversation.ChatHistory, nil
+}
+
+// GetActiveConversation returns the active conversation of a user
+func (fs *FileStorage) GetActiveConversation(userID int64) (*Conversation, error) {
+	settings, err := fs.GetUserSettings(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return settings.ActiveConversation(), nil
+}
+
+// SwitchConversation makes another conversation active
+func (fs *FileStorage) SwitchConversation(userID int64, conversationID int64) error {
+	return fs.update(userID, func(settings *UserSettings) error {
+		if settings.findConversation(conversationID) == nil {
+			return ErrConversationNotFound
+		}
+
+		settings.ActiveConversationID = conversationID
+		return nil
+	})
+}
+
+// UpdateConversation updates the title, model, chat mode, system prompt, parameters and summary of a conversation
+func (fs *FileStorage) UpdateConversation(userID int64, conversation *Conversation) error {
+	return fs.update(userID, func(settings *UserSettings) error {
+		existing := settings.findConversation(conversation.ID)
+		if existing == nil {
+			return ErrConversationNotFound
+		}
+
+		existing.Title = conversation.Title
+		existing.Model = conversation.Model
+		existing.ChatMode = conversation.ChatMode
+		existing.SystemPrompt = conversation.SystemPrompt
+		existing.Persona = conversation.Persona
+		existing.Params = conversation.Params
+		existing.Summary = conversation.Summary
+		existing.SummaryUntil = conversation.SummaryUntil
+		return nil
+	})
+}
+
+// DeleteConversation deletes a conversation and its history.
+// If it was active, the most recently used remaining conversation becomes active.
+func (fs *FileStorage) DeleteConversation(userID int64, conversationID int64) error {
+	return fs.update(userID, func(settings *UserSettings) error {
+		remaining := make([]Conversation, 0, len(settings.Conversations))
+		for _, conversation := range settings.Conversations {
+			if conversation.ID != conversationID {
+				remaining = append(remaining, conversation)
+			}
+		}
+		if len(remaining) == len(settings.Conversations) {
+			return ErrConversationNotFound
+		}
+
+		settings.Conversations = remaining
+		settings.ensureActiveConversation()
+		return nil
+	})
+}
@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// invitesFileName holds the invites of the file storage
+const invitesFileName = "invites.json"
+
+var (
+	// ErrInviteNotFound is returned for invite codes that don't exist or were revoked
+	ErrInviteNotFound = errors.New("invite not found")
+	// ErrInviteExpired is returned for invites past their expiry time
+	ErrInviteExpired = errors.New("invite expired")
+	// ErrInviteUsedUp is returned for invites that have been redeemed as often as allowed
+	ErrInviteUsedUp = errors.New("invite used up")
+)
+
+// Invite is a code admins hand out to let new users in
+type Invite struct {
+	Code      string    `json:"code"`
+	CreatedBy int64     `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is when the invite stops working; zero if it doesn't expire
+	ExpiresAt time.Time `json:"expires_at"`
+	MaxUses   int       `json:"max_uses"`
+	// RedeemedBy lists the users that joined with the invite, in order
+	RedeemedBy []int64 `json:"redeemed_by"`
+	// Model and BudgetLimits are applied to users that join with the invite; empty keeps the defaults
+	Model        string        `json:"model,omitempty"`
+	BudgetLimits *BudgetLimits `json:"budget_limits,omitempty"`
+}
+
+// Uses returns how often the invite has been redeemed
+func (i *Invite) Uses() int {
+	return len(i.RedeemedBy)
+}
+
+// Usable checks whether the invite can still be redeemed
+func (i *Invite) Usable(now time.Time) error {
+	if !i.ExpiresAt.IsZero() && !now.Before(i.ExpiresAt) {
+		return ErrInviteExpired
+	}
+	if i.Uses() >= i.MaxUses {
+		return ErrInviteUsedUp
+	}
+	return nil
+}
+
+// CreateInvite stores a new invite
+func (fs *FileStorage) CreateInvite(invite *Invite) error {
+	fs.adminMutex.Lock()
+	defer fs.adminMutex.Unlock()
+
+	invites, err := fs.loadInvites()
+	if err != nil {
+		return err
+	}
+	for _, existing := range invites {
+		if existing.Code == invite.Code {
+			return fmt.Errorf("invite %s already exists", invite.Code)
+		}
+	}
+	return fs.saveInvites(append(invites, *invite))
+}
+
+// GetInvites returns all invites, oldest first
+func (fs *FileStorage) GetInvites() ([]Invite, error) {
+	fs.adminMutex.Lock()
+	defer fs.adminMutex.Unlock()
+
+	return fs.loadInvites()
+}
+
+// RedeemInvite counts a use of an invite by a user and returns the invite
+func (fs *FileStorage) RedeemInvite(code string, userID int64) (*Invite, error) {
+	fs.adminMutex.Lock()
+	defer fs.adminMutex.Unlock()
+
+	invites, err := fs.loadInvites()
+	if err != nil {
+		return nil, err
+	}
+	for i := range invites {
+		invite := &invites[i]
+		if invite.Code != code {
+			continue
+		}
+		if err := invite.Usable(time.Now()); err != nil {
+			return nil, err
+		}
+		invite.RedeemedBy = append(invite.RedeemedBy, userID)
+		if err := fs.saveInvites(invites); err != nil {
+			return nil, err
+		}
+		return invite, nil
+	}
+	return nil, ErrInviteNotFound
+}
+
+// DeleteInvite revokes an invite
+func (fs *FileStorage) DeleteInvite(code string) error {
+	fs.adminMutex.Lock()
+	defer fs.adminMutex.Unlock()
+
+	invites, err := fs.loadInvites()
+	if err != nil {
+		return err
+	}
+	for i := range invites {
+		if invites[i].Code == code {
+			return fs.saveInvites(append(invites[:i], invites[i+1:]...))
+		}
+	}
+	return ErrInviteNotFound
+}
+
+// loadInvites reads the invites; the caller holds adminMutex
+func (fs *FileStorage) loadInvites() ([]Invite, error) {
+	invites := []Invite{}
+
+	data, err := os.ReadFile(filepath.Join(fs.dataDir, invitesFileName))
+	if os.IsNotExist(err) {
+		return invites, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read invites: %w", err)
+	}
+	if err := json.Unmarshal(data, &invites); err != nil {
+		return nil, fmt.Errorf("failed to parse invites: %w", err)
+	}
+	return invites, nil
+}
+
+// saveInvites writes the invites atomically; the caller holds adminMutex
+func (fs *FileStorage) saveInvites(invites []Invite) error {
+	data, err := json.MarshalIndent(invites, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal invites: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(fs.dataDir, invitesFileName), data, 0644); err != nil {
+		return fmt.Errorf("failed to write invites: %w", err)
+	}
+	return nil
+}
+
+// CreateInvite stores a new invite
+func (s *SQLiteStorage) CreateInvite(invite *Invite) error {
+	redeemedBy, budgetLimits, err := marshalInviteLists(invite)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		`INSERT INTO invites (code, created_by, created_at, expires_at, max_uses, redeemed_by, model, budget_limits)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		invite.Code, invite.CreatedBy, toUnixNano(invite.CreatedAt), toOptionalUnixNano(invite.ExpiresAt),
+		invite.MaxUses, redeemedBy, invite.Model, budgetLimits,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create invite: %w", err)
+	}
+	return nil
+}
+
+// GetInvites returns all invites, oldest first
+func (s *SQLiteStorage) GetInvites() ([]Invite, error) {
+	rows, err := s.db.Query(
+		`SELECT code, created_by, created_at, expires_at, max_uses, redeemed_by, model, budget_limits
+		 FROM invites ORDER BY created_at, code`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read invites: %w", err)
+	}
+	defer rows.Close()
+
+	invites := []Invite{}
+	for rows.Next() {
+		invite, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, *invite)
+	}
+	return invites, rows.Err()
+}
+
+// RedeemInvite counts a use of an invite by a user and returns the invite
+func (s *SQLiteStorage) RedeemInvite(code string, userID int64) (*Invite, error) {
+	var invite *Invite
+	err := s.inTx(func(tx *sql.Tx) error {
+		var err error
+		invite, err = scanInvite(tx.QueryRow(
+			`SELECT code, created_by, created_at, expires_at, max_uses, redeemed_by, model, budget_limits
+			 FROM invites WHERE code = ?`,
+			code,
+		))
+		if err == sql.ErrNoRows {
+			return ErrInviteNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := invite.Usable(time.Now()); err != nil {
+			return err
+		}
+
+		invite.RedeemedBy = append(invite.RedeemedBy, userID)
+		redeemedBy, _, err := marshalInviteLists(invite)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE invites SET redeemed_by = ? WHERE code = ?`, redeemedBy, code); err != nil {
+			return fmt.Errorf("failed to redeem invite: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+// DeleteInvite revokes an invite
+func (s *SQLiteStorage) DeleteInvite(code string) error {
+	result, err := s.db.Exec(`DELETE FROM invites WHERE code = ?`, code)
+	if err != nil {
+		return fmt.Errorf("failed to delete invite: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// marshalInviteLists encodes the JSON columns of an invite
+func marshalInviteLists(invite *Invite) (redeemedBy, budgetLimits string, err error) {
+	users := invite.RedeemedBy
+	if users == nil {
+		users = []int64{}
+	}
+	usersJSON, err := json.Marshal(users)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to marshal invite users: %w", err)
+	}
+	limitsJSON, err := json.Marshal(invite.BudgetLimits)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to marshal invite budget: %w", err)
+	}
+	return string(usersJSON), string(limitsJSON), nil
+}
+
+// scanInvite reads an invite row; sql.ErrNoRows is returned unwrapped
+func scanInvite(row interface{ Scan(dest ...any) error }) (*Invite, error) {
+	var (
+		invite       Invite
+		createdAt    int64
+		expiresAt    int64
+		redeemedBy   string
+		budgetLimits string
+	)
+	err := row.Scan(&invite.Code, &invite.CreatedBy, &createdAt, &expiresAt, &invite.MaxUses,
+		&redeemedBy, &invite.Model, &budgetLimits)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read invite: %w", err)
+	}
+
+	invite.CreatedAt = fromUnixNano(createdAt)
+	invite.ExpiresAt = fromOptionalUnixNano(expiresAt)
+	if err := json.Unmarshal([]byte(redeemedBy), &invite.RedeemedBy); err != nil {
+		return nil, fmt.Errorf("failed to parse invite users: %w", err)
+	}
+	if err := json.Unmarshal([]byte(budgetLimits), &invite.BudgetLimits); err != nil {
+		return nil, fmt.Errorf("failed to parse invite budget: %w", err)
+	}
+	return &invite, nil
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"fmt"
+)
+
+// MigrateFileStorage imports all user_*.json files found in dataDir into the SQLite storage,
+// together with the access rules, invites, forum topics and the audit log.
+// Users that already exist in the database are overwritten. It returns the number of imported users.
+func MigrateFileStorage(dataDir string, dst *SQLiteStorage) (int, error) {
+	userIDs, err := listUserFiles(dataDir)
+	if err != nil {
+		return 0, err
+	}
+
+	src, err := NewFileStorage(dataDir)
+	if err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	for _, userID := range userIDs {
+		settings, err := src.GetUserSettings(userID)
+		if err != nil {
+			return imported, fmt.Errorf("failed to read settings of user %d: %w", userID, err)
+		}
+		// Files may have been written by hand or by an older version
+		if settings.UserID == 0 {
+			settings.UserID = userID
+		}
+
+		if err := dst.ImportUserSettings(settings); err != nil {
+			return imported, fmt.Errorf("failed to import user %d: %w", userID, err)
+		}
+		imported++
+	}
+
+	rules, err := src.GetAccessRules()
+	if err != nil {
+		return imported, err
+	}
+	for userID, allowed := range rules {
+		if err := dst.SetAccess(userID, allowed); err != nil {
+			return imported, err
+		}
+	}
+
+	invites, err := src.GetInvites()
+	if err != nil {
+		return imported, err
+	}
+	for i := range invites {
+		if err := dst.DeleteInvite(invites[i].Code); err != nil && err != ErrInviteNotFound {
+			return imported, err
+		}
+		if err := dst.CreateInvite(&invites[i]); err != nil {
+			return imported, err
+		}
+	}
+
+	topics, err := src.GetTopics()
+	if err != nil {
+		return imported, err
+	}
+	for key, topic := range topics {
+		if err := dst.SaveTopic(key, topic); err != nil {
+			return imported, err
+		}
+	}
+
+	// The audit log is only appended to, so it is imported once
+	existing, err := dst.GetAuditLog(1)
+	if err != nil || len(existing) > 0 {
+		return imported, err
+	}
+	entries, err := src.GetAuditLog(0)
+	if err != nil {
+		return imported, err
+	}
+	for _, entry := range entries {
+		if err := dst.AddAuditEntry(entry); err != nil {
+			return imported, err
+		}
+	}
+
+	return imported, nil
+}
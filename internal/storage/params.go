@@ -0,0 +1,45 @@
+package storage
+
+// GenerationParams are optional sampling parameters sent with chat requests.
+// Nil fields are left out of the request, so the model's own defaults apply.
+type GenerationParams struct {
+	Temperature      *float64 `json:"temperature,omitempty"`
+	TopP             *float64 `json:"top_p,omitempty"`
+	MaxTokens        *int     `json:"max_tokens,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	Seed             *int64   `json:"seed,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+}
+
+// Merge returns the parameters with every field that is set in override replaced
+func (p GenerationParams) Merge(override GenerationParams) GenerationParams {
+	if override.Temperature != nil {
+		p.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		p.TopP = override.TopP
+	}
+	if override.MaxTokens != nil {
+		p.MaxTokens = override.MaxTokens
+	}
+	if override.FrequencyPenalty != nil {
+		p.FrequencyPenalty = override.FrequencyPenalty
+	}
+	if override.PresencePenalty != nil {
+		p.PresencePenalty = override.PresencePenalty
+	}
+	if override.Seed != nil {
+		p.Seed = override.Seed
+	}
+	if override.Stop != nil {
+		p.Stop = override.Stop
+	}
+	return p
+}
+
+// IsEmpty reports whether no parameter is set
+func (p GenerationParams) IsEmpty() bool {
+	return p.Temperature == nil && p.TopP == nil && p.MaxTokens == nil && p.FrequencyPenalty == nil &&
+		p.PresencePenalty == nil && p.Seed == nil && p.Stop == nil
+}
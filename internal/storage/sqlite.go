@@ -0,0 +1,1083 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite" // pure Go SQLite driver, works with CGO_ENABLED=0
+)
+
+// sqliteMigrations contains the schema changes, applied in order.
+// The index of the last applied migration is stored in PRAGMA user_version.
+var sqliteMigrations = []string{
+	`CREATE TABLE users (
+		user_id       INTEGER PRIMARY KEY,
+		current_model TEXT    NOT NULL,
+		chat_mode     TEXT    NOT NULL,
+		custom_models TEXT    NOT NULL DEFAULT '[]',
+		last_updated  INTEGER NOT NULL
+	);
+	CREATE TABLE messages (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id    INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+		role       TEXT    NOT NULL,
+		content    TEXT    NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+	CREATE INDEX idx_messages_user ON messages(user_id, id);
+	CREATE TABLE expenses (
+		id            INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id       INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+		model         TEXT    NOT NULL,
+		input_tokens  INTEGER NOT NULL,
+		output_tokens INTEGER NOT NULL,
+		cost          REAL    NOT NULL,
+		created_at    INTEGER NOT NULL
+	);
+	CREATE INDEX idx_expenses_user ON expenses(user_id, created_at);`,
+
+	// Named conversations; existing history becomes each user's default conversation
+	`CREATE TABLE conversations (
+		id            INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id       INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+		title         TEXT    NOT NULL,
+		model         TEXT    NOT NULL,
+		chat_mode     TEXT    NOT NULL,
+		created_at    INTEGER NOT NULL,
+		last_activity INTEGER NOT NULL
+	);
+	CREATE INDEX idx_conversations_user ON conversations(user_id);
+	ALTER TABLE users ADD COLUMN active_conversation_id INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE messages ADD COLUMN conversation_id INTEGER REFERENCES conversations(id) ON DELETE CASCADE;
+	INSERT INTO conversations (user_id, title, model, chat_mode, created_at, last_activity)
+		SELECT user_id, 'Main chat', current_model, chat_mode, last_updated, last_updated FROM users;
+	UPDATE users SET active_conversation_id = (SELECT id FROM conversations c WHERE c.user_id = users.user_id);
+	UPDATE messages SET conversation_id = (SELECT active_conversation_id FROM users u WHERE u.user_id = messages.user_id);
+	CREATE INDEX idx_messages_conversation ON messages(conversation_id, id);`,
+
+	// Admin budget overrides
+	`ALTER TABLE users ADD COLUMN budget_override_until INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX idx_expenses_created ON expenses(created_at);`,
+
+	// Attachment references of chat messages, as JSON
+	`ALTER TABLE messages ADD COLUMN attachments TEXT NOT NULL DEFAULT '[]';`,
+
+	// Personas and per-conversation system prompts
+	`ALTER TABLE users ADD COLUMN personas TEXT NOT NULL DEFAULT '[]';
+	ALTER TABLE conversations ADD COLUMN system_prompt TEXT NOT NULL DEFAULT '';
+	ALTER TABLE conversations ADD COLUMN persona TEXT NOT NULL DEFAULT '';`,
+
+	// Generation parameters of users and conversations, as JSON
+	`ALTER TABLE users ADD COLUMN params TEXT NOT NULL DEFAULT '{}';
+	ALTER TABLE conversations ADD COLUMN params TEXT NOT NULL DEFAULT '{}';`,
+
+	// Rolling summaries of conversations
+	`ALTER TABLE conversations ADD COLUMN summary TEXT NOT NULL DEFAULT '';
+	ALTER TABLE conversations ADD COLUMN summary_until INTEGER NOT NULL DEFAULT 0;`,
+
+	// Fallback models of users, as JSON
+	`ALTER TABLE users ADD COLUMN fallback_models TEXT NOT NULL DEFAULT '[]';`,
+
+	// Access rules set by admins and the audit log of admin actions
+	`CREATE TABLE access (
+		user_id    INTEGER PRIMARY KEY,
+		allowed    INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+	CREATE TABLE audit_log (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at INTEGER NOT NULL,
+		admin_id   INTEGER NOT NULL,
+		action     TEXT    NOT NULL,
+		target_id  INTEGER NOT NULL DEFAULT 0,
+		details    TEXT    NOT NULL DEFAULT ''
+	);`,
+
+	// Invites and the budget limits they give users, as JSON
+	`CREATE TABLE invites (
+		code          TEXT    PRIMARY KEY,
+		created_by    INTEGER NOT NULL,
+		created_at    INTEGER NOT NULL,
+		expires_at    INTEGER NOT NULL DEFAULT 0,
+		max_uses      INTEGER NOT NULL,
+		redeemed_by   TEXT    NOT NULL DEFAULT '[]',
+		model         TEXT    NOT NULL DEFAULT '',
+		budget_limits TEXT    NOT NULL DEFAULT 'null'
+	);
+	ALTER TABLE users ADD COLUMN budget_limits TEXT NOT NULL DEFAULT 'null';`,
+
+	// Delivery of long answers as files, as JSON
+	`ALTER TABLE users ADD COLUMN file_delivery TEXT NOT NULL DEFAULT '{}';`,
+
+	// Forum topics of the chat keys derived from them
+	`CREATE TABLE topics (
+		chat_key  INTEGER PRIMARY KEY,
+		chat_id   INTEGER NOT NULL,
+		thread_id INTEGER NOT NULL
+	);`,
+}
+
+// SQLiteStorage implements Storage interface using a SQLite database.
+// Settings, chat messages and expenses live in separate tables, so adding a
+// message or an expense is a single insert instead of a full rewrite.
+type SQLiteStorage struct {
+	db *sql.DB
+}
+
+// NewSQLiteStorage opens (or creates) a SQLite database and applies pending migrations
+func NewSQLiteStorage(path string) (*SQLiteStorage, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	// SQLite allows a single writer; one connection avoids "database is locked" errors
+	db.SetMaxOpenConns(1)
+
+	pragmas := []string{
+		"PRAGMA journal_mode = WAL",
+		"PRAGMA busy_timeout = 5000",
+		"PRAGMA foreign_keys = ON",
+	}
+	for _, pragma := range pragmas {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to configure database: %w", err)
+		}
+	}
+
+	store := &SQLiteStorage{db: db}
+	if err := store.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// migrate applies schema migrations that haven't been applied yet
+func (s *SQLiteStorage) migrate() error {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin migration: %w", err)
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to update schema version: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// toUnixNano converts a time to the integer representation stored in the database
+func toUnixNano(t time.Time) int64 {
+	return t.UnixNano()
+}
+
+// fromUnixNano converts a stored integer back to a time
+func fromUnixNano(n int64) time.Time {
+	return time.Unix(0, n)
+}
+
+// toOptionalUnixNano stores the zero time as 0
+func toOptionalUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromOptionalUnixNano converts 0 back to the zero time
+func fromOptionalUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// dbtx is implemented by both *sql.DB and *sql.Tx
+type dbtx interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// ensureUser creates the settings row for a user if it doesn't exist yet
+func ensureUser(db dbtx, userID int64) error {
+	defaults := newDefaultUserSettings(userID)
+	_, err := db.Exec(
+		`INSERT OR IGNORE INTO users (user_id, current_model, chat_mode, custom_models, last_updated)
+		 VALUES (?, ?, ?, '[]', ?)`,
+		userID, defaults.CurrentModel, defaults.ChatMode, toUnixNano(defaults.LastUpdated),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create user: %w", err)
+	}
+	return nil
+}
+
+// activeConversationID returns the active conversation of a user without changing anything:
+// the stored one if it is valid, otherwise the most recently used one, or 0 if there is none
+func activeConversationID(db dbtx, userID int64) (int64, error) {
+	var activeID int64
+	err := db.QueryRow(
+		`SELECT c.id FROM users u JOIN conversations c ON c.id = u.active_conversation_id AND c.user_id = u.user_id
+		 WHERE u.user_id = ?`,
+		userID,
+	).Scan(&activeID)
+	if err == nil {
+		return activeID, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to read active conversation: %w", err)
+	}
+
+	// Fall back to the most recently used conversation, the way settings loaded from a file do
+	err = db.QueryRow(
+		`SELECT id FROM conversations WHERE user_id = ? ORDER BY last_activity DESC, id LIMIT 1`,
+		userID,
+	).Scan(&activeID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read conversations: %w", err)
+	}
+	return activeID, nil
+}
+
+// prepareUser makes sure the user row exists and has a valid active conversation,
+// creating the default conversation when needed. It returns the active conversation ID.
+// Only writes call it; reads leave users that haven't been stored yet alone.
+func prepareUser(db dbtx, userID int64) (int64, error) {
+	if err := ensureUser(db, userID); err != nil {
+		return 0, err
+	}
+
+	activeID, err := activeConversationID(db, userID)
+	if err != nil {
+		return 0, err
+	}
+	if activeID == 0 {
+		conversation, err := insertConversation(db, userID, DefaultConversationTitle)
+		if err != nil {
+			return 0, err
+		}
+		activeID = conversation.ID
+	}
+
+	if err := setActiveConversation(db, userID, activeID); err != nil {
+		return 0, err
+	}
+	return activeID, nil
+}
+
+// pendingConversationID is the ID of the default conversation of a user that has no stored
+// conversation yet. The first write to it creates the conversation.
+const pendingConversationID = 0
+
+// resolveConversation returns the stored conversation a write to conversationID applies to,
+// creating the default conversation for pendingConversationID
+func resolveConversation(db dbtx, userID, conversationID int64) (int64, error) {
+	if conversationID == pendingConversationID {
+		return prepareUser(db, userID)
+	}
+
+	var exists int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM conversations WHERE id = ? AND user_id = ?`,
+		conversationID, userID,
+	).Scan(&exists)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read conversation: %w", err)
+	}
+	if exists == 0 {
+		return 0, ErrConversationNotFound
+	}
+	return conversationID, nil
+}
+
+// withPendingConversation gives settings without stored conversations their default conversation,
+// which is created by the first write to it
+func withPendingConversation(settings *UserSettings) {
+	settings.Conversations = nil
+	settings.ensureActiveConversation()
+	settings.Conversations[0].ID = pendingConversationID
+	settings.ActiveConversationID = pendingConversationID
+}
+
+// inTx runs fn inside a transaction
+func (s *SQLiteStorage) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetUserSettings retrieves user settings together with their conversations and total expenses.
+// Chat and expense history are not loaded; they are read with GetConversationHistory and GetExpenses.
+// Users that haven't been seen before get default settings, which are only stored once
+// something is written for them.
+func (s *SQLiteStorage) GetUserSettings(userID int64) (*UserSettings, error) {
+	var (
+		customModels        string
+		fallbackModels      string
+		personas            string
+		params              string
+		lastUpdated         int64
+		budgetOverrideUntil int64
+		budgetLimits        string
+		fileDelivery        string
+	)
+
+	settings := &UserSettings{UserID: userID}
+	err := s.db.QueryRow(
+		`SELECT current_model, chat_mode, custom_models, fallback_models, personas, params, last_updated,
+			budget_override_until, budget_limits, file_delivery, active_conversation_id
+		 FROM users WHERE user_id = ?`,
+		userID,
+	).Scan(&settings.CurrentModel, &settings.ChatMode, &customModels, &fallbackModels, &personas, &params,
+		&lastUpdated, &budgetOverrideUntil, &budgetLimits, &fileDelivery, &settings.ActiveConversationID)
+	if err == sql.ErrNoRows {
+		settings = newDefaultUserSettings(userID)
+		withPendingConversation(settings)
+		return settings, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read user settings: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(customModels), &settings.CustomModels); err != nil {
+		return nil, fmt.Errorf("failed to parse custom models: %w", err)
+	}
+	if err := json.Unmarshal([]byte(fallbackModels), &settings.FallbackModels); err != nil {
+		return nil, fmt.Errorf("failed to parse fallback models: %w", err)
+	}
+	if err := json.Unmarshal([]byte(personas), &settings.Personas); err != nil {
+		return nil, fmt.Errorf("failed to parse personas: %w", err)
+	}
+	if err := json.Unmarshal([]byte(params), &settings.Params); err != nil {
+		return nil, fmt.Errorf("failed to parse generation parameters: %w", err)
+	}
+	if err := json.Unmarshal([]byte(budgetLimits), &settings.BudgetLimits); err != nil {
+		return nil, fmt.Errorf("failed to parse budget limits: %w", err)
+	}
+	if err := json.Unmarshal([]byte(fileDelivery), &settings.FileDelivery); err != nil {
+		return nil, fmt.Errorf("failed to parse file delivery: %w", err)
+	}
+	settings.LastUpdated = fromUnixNano(lastUpdated)
+	settings.BudgetOverrideUntil = fromOptionalUnixNano(budgetOverrideUntil)
+
+	if settings.TotalExpenses, err = s.GetTotalExpenses(userID); err != nil {
+		return nil, err
+	}
+
+	if settings.Conversations, err = s.getConversations(userID); err != nil {
+		return nil, err
+	}
+	if len(settings.Conversations) == 0 {
+		withPendingConversation(settings)
+	} else {
+		// An active conversation that no longer exists falls back to the most recent one
+		settings.ensureActiveConversation()
+	}
+
+	return settings, nil
+}
+
+// SaveUserSettings saves user settings.
+// Chat and expense history are managed through their own methods and are not rewritten here.
+func (s *SQLiteStorage) SaveUserSettings(settings *UserSettings) error {
+	settings.LastUpdated = time.Now()
+	return saveUserRow(s.db, settings)
+}
+
+// saveUserRow upserts the settings row of a user
+func saveUserRow(db dbtx, settings *UserSettings) error {
+	customModels := settings.CustomModels
+	if customModels == nil {
+		customModels = []string{}
+	}
+	customModelsJSON, err := json.Marshal(customModels)
+	if err != nil {
+		return fmt.Errorf("failed to marshal custom models: %w", err)
+	}
+
+	fallbackModels := settings.FallbackModels
+	if fallbackModels == nil {
+		fallbackModels = []string{}
+	}
+	fallbackModelsJSON, err := json.Marshal(fallbackModels)
+	if err != nil {
+		return fmt.Errorf("failed to marshal fallback models: %w", err)
+	}
+
+	personas := settings.Personas
+	if personas == nil {
+		personas = []Persona{}
+	}
+	personasJSON, err := json.Marshal(personas)
+	if err != nil {
+		return fmt.Errorf("failed to marshal personas: %w", err)
+	}
+
+	paramsJSON, err := json.Marshal(settings.Params)
+	if err != nil {
+		return fmt.Errorf("failed to marshal generation parameters: %w", err)
+	}
+
+	budgetLimitsJSON, err := json.Marshal(settings.BudgetLimits)
+	if err != nil {
+		return fmt.Errorf("failed to marshal budget limits: %w", err)
+	}
+
+	fileDeliveryJSON, err := json.Marshal(settings.FileDelivery)
+	if err != nil {
+		return fmt.Errorf("failed to marshal file delivery: %w", err)
+	}
+
+	_, err = db.Exec(
+		`INSERT INTO users (user_id, current_model, chat_mode, custom_models, fallback_models, personas, params,
+			last_updated, budget_override_until, budget_limits, file_delivery)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		 ON CONFLICT(user_id) DO UPDATE SET
+			current_model         = excluded.current_model,
+			chat_mode             = excluded.chat_mode,
+			custom_models         = excluded.custom_models,
+			fallback_models       = excluded.fallback_models,
+			personas              = excluded.personas,
+			params                = excluded.params,
+			last_updated          = excluded.last_updated,
+			budget_override_until = excluded.budget_override_until,
+			budget_limits         = excluded.budget_limits,
+			file_delivery         = excluded.file_delivery`,
+		settings.UserID, settings.CurrentModel, settings.ChatMode, string(customModelsJSON), string(fallbackModelsJSON),
+		string(personasJSON), string(paramsJSON), toUnixNano(settings.LastUpdated), toOptionalUnixNano(settings.BudgetOverrideUntil),
+		string(budgetLimitsJSON), string(fileDeliveryJSON),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to write user settings: %w", err)
+	}
+
+	return nil
+}
+
+// AddExpense adds an expense record to user's history
+func (s *SQLiteStorage) AddExpense(userID int64, expense ExpenseRecord) error {
+	if err := ensureUser(s.db, userID); err != nil {
+		return err
+	}
+	return insertExpense(s.db, userID, expense)
+}
+
+// insertExpense inserts a single expense row
+func insertExpense(db dbtx, userID int64, expense ExpenseRecord) error {
+	_, err := db.Exec(
+		`INSERT INTO expenses (user_id, model, input_tokens, output_tokens, cost, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		userID, expense.Model, expense.InputTokens, expense.OutputTokens, expense.Cost, toUnixNano(expense.Timestamp),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add expense: %w", err)
+	}
+	return nil
+}
+
+// GetExpenses returns the expense history of a user in chronological order
+func (s *SQLiteStorage) GetExpenses(userID int64) ([]ExpenseRecord, error) {
+	rows, err := s.db.Query(
+		`SELECT model, input_tokens, output_tokens, cost, created_at
+		 FROM expenses WHERE user_id = ? ORDER BY created_at, id`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read expenses: %w", err)
+	}
+	defer rows.Close()
+
+	expenses := []ExpenseRecord{}
+	for rows.Next() {
+		var (
+			expense   ExpenseRecord
+			createdAt int64
+		)
+		if err := rows.Scan(&expense.Model, &expense.InputTokens, &expense.OutputTokens, &expense.Cost, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to read expense: %w", err)
+		}
+		expense.Timestamp = fromUnixNano(createdAt)
+		expenses = append(expenses, expense)
+	}
+
+	return expenses, rows.Err()
+}
+
+// GetTotalExpenses returns total expenses for a user
+func (s *SQLiteStorage) GetTotalExpenses(userID int64) (float64, error) {
+	var total float64
+	err := s.db.QueryRow(`SELECT COALESCE(SUM(cost), 0) FROM expenses WHERE user_id = ?`, userID).Scan(&total)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read total expenses: %w", err)
+	}
+	return total, nil
+}
+
+// GetExpensesSince returns the expenses of a user since the given time
+func (s *SQLiteStorage) GetExpensesSince(userID int64, since time.Time) (float64, error) {
+	var total float64
+	err := s.db.QueryRow(
+		`SELECT COALESCE(SUM(cost), 0) FROM expenses WHERE user_id = ? AND created_at >= ?`,
+		userID, toUnixNano(since),
+	).Scan(&total)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read expenses: %w", err)
+	}
+	return total, nil
+}
+
+// GetAllExpensesSince returns the expenses of all users since the given time
+func (s *SQLiteStorage) GetAllExpensesSince(since time.Time) (float64, error) {
+	var total float64
+	err := s.db.QueryRow(
+		`SELECT COALESCE(SUM(cost), 0) FROM expenses WHERE created_at >= ?`,
+		toUnixNano(since),
+	).Scan(&total)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read expenses: %w", err)
+	}
+	return total, nil
+}
+
+// AddChatMessage adds a message to the history of a conversation. Answers are added to the
+// conversation they were asked in, even if the user has switched to another one meanwhile.
+func (s *SQLiteStorage) AddChatMessage(userID int64, conversationID int64, message ChatMessage) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		conversationID, err := resolveConversation(tx, userID, conversationID)
+		if err != nil {
+			return err
+		}
+		if err := insertChatMessage(tx, userID, conversationID, message); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(
+			`UPDATE conversations SET last_activity = ? WHERE id = ?`,
+			toUnixNano(time.Now()), conversationID,
+		); err != nil {
+			return fmt.Errorf("failed to update conversation: %w", err)
+		}
+
+		// Keep only the most recent messages, like the file storage does
+		_, err = tx.Exec(
+			`DELETE FROM messages WHERE conversation_id = ? AND id NOT IN (
+				SELECT id FROM messages WHERE conversation_id = ? ORDER BY id DESC LIMIT ?
+			)`,
+			conversationID, conversationID, maxChatHistory,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to trim chat history: %w", err)
+		}
+		return nil
+	})
+}
+
+// insertChatMessage inserts a single chat message row
+func insertChatMessage(db dbtx, userID, conversationID int64, message ChatMessage) error {
+	attachments := message.Attachments
+	if attachments == nil {
+		attachments = []Attachment{}
+	}
+	attachmentsJSON, err := json.Marshal(attachments)
+	if err != nil {
+		return fmt.Errorf("failed to marshal attachments: %w", err)
+	}
+
+	_, err = db.Exec(
+		`INSERT INTO messages (user_id, conversation_id, role, content, attachments, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		userID, conversationID, message.Role, message.Content, string(attachmentsJSON), toUnixNano(message.Timestamp),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add chat message: %w", err)
+	}
+	return nil
+}
+
+// GetChatHistory returns the history of the active conversation
+func (s *SQLiteStorage) GetChatHistory(userID int64) ([]ChatMessage, error) {
+	conversationID, err := activeConversationID(s.db, userID)
+	if err != nil {
+		return nil, err
+	}
+	if conversationID == pendingConversationID {
+		return []ChatMessage{}, nil
+	}
+
+	return getConversationHistory(s.db, conversationID)
+}
+
+// GetConversationHistory returns the history of a conversation of the user
+func (s *SQLiteStorage) GetConversationHistory(userID int64, conversationID int64) ([]ChatMessage, error) {
+	// The pending conversation of a user that hasn't been stored yet has no messages
+	if conversationID == pendingConversationID {
+		return []ChatMessage{}, nil
+	}
+
+	var exists bool
+	err := s.db.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM conversations WHERE id = ? AND user_id = ?)`, conversationID, userID,
+	).Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read conversation: %w", err)
+	}
+	if !exists {
+		return nil, ErrConversationNotFound
+	}
+
+	return getConversationHistory(s.db, conversationID)
+}
+
+// getConversationHistory returns the messages of a conversation in chronological order
+func getConversationHistory(db dbtx, conversationID int64) ([]ChatMessage, error) {
+	rows, err := db.Query(
+		`SELECT role, content, attachments, created_at FROM messages WHERE conversation_id = ? ORDER BY id`,
+		conversationID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chat history: %w", err)
+	}
+	defer rows.Close()
+
+	history := []ChatMessage{}
+	for rows.Next() {
+		var (
+			message     ChatMessage
+			attachments string
+			createdAt   int64
+		)
+		if err := rows.Scan(&message.Role, &message.Content, &attachments, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to read chat message: %w", err)
+		}
+		if err := json.Unmarshal([]byte(attachments), &message.Attachments); err != nil {
+			return nil, fmt.Errorf("failed to parse attachments: %w", err)
+		}
+		if len(message.Attachments) == 0 {
+			message.Attachments = nil
+		}
+		message.Timestamp = fromUnixNano(createdAt)
+		history = append(history, message)
+	}
+
+	return history, rows.Err()
+}
+
+// ClearChatHistory clears the history and summary of the active conversation
+func (s *SQLiteStorage) ClearChatHistory(userID int64) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		// There is nothing to clear for users without conversations
+		conversationID, err := activeConversationID(tx, userID)
+		if err != nil || conversationID == pendingConversationID {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM messages WHERE conversation_id = ?`, conversationID); err != nil {
+			return fmt.Errorf("failed to clear chat history: %w", err)
+		}
+		if _, err := tx.Exec(`UPDATE conversations SET summary = '', summary_until = 0 WHERE id = ?`, conversationID); err != nil {
+			return fmt.Errorf("failed to clear summary: %w", err)
+		}
+		return nil
+	})
+}
+
+// insertConversation creates a conversation that inherits the user's default model and chat mode
+func insertConversation(db dbtx, userID int64, title string) (*Conversation, error) {
+	conversation := &Conversation{
+		Title:        title,
+		ChatHistory:  []ChatMessage{},
+		CreatedAt:    time.Now(),
+		LastActivity: time.Now(),
+	}
+
+	err := db.QueryRow(
+		`SELECT current_model, chat_mode FROM users WHERE user_id = ?`, userID,
+	).Scan(&conversation.Model, &conversation.ChatMode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read user settings: %w", err)
+	}
+
+	result, err := db.Exec(
+		`INSERT INTO conversations (user_id, title, model, chat_mode, created_at, last_activity)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		userID, conversation.Title, conversation.Model, conversation.ChatMode,
+		toUnixNano(conversation.CreatedAt), toUnixNano(conversation.LastActivity),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create conversation: %w", err)
+	}
+
+	if conversation.ID, err = result.LastInsertId(); err != nil {
+		return nil, fmt.Errorf("failed to create conversation: %w", err)
+	}
+	return conversation, nil
+}
+
+// setActiveConversation stores the active conversation of a user
+func setActiveConversation(db dbtx, userID, conversationID int64) error {
+	if _, err := db.Exec(
+		`UPDATE users SET active_conversation_id = ? WHERE user_id = ?`,
+		conversationID, userID,
+	); err != nil {
+		return fmt.Errorf("failed to switch conversation: %w", err)
+	}
+	return nil
+}
+
+// CreateConversation creates a new conversation and makes it active
+func (s *SQLiteStorage) CreateConversation(userID int64, title string) (*Conversation, error) {
+	var conversation *Conversation
+	err := s.inTx(func(tx *sql.Tx) error {
+		if err := ensureUser(tx, userID); err != nil {
+			return err
+		}
+
+		var err error
+		if conversation, err = insertConversation(tx, userID, title); err != nil {
+			return err
+		}
+		return setActiveConversation(tx, userID, conversation.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conversation, nil
+}
+
+// GetConversations returns all conversations of a user without their history
+func (s *SQLiteStorage) GetConversations(userID int64) ([]Conversation, error) {
+	settings, err := s.GetUserSettings(userID)
+	if err != nil {
+		return nil, err
+	}
+	return settings.Conversations, nil
+}
+
+// getConversations reads the stored conversations of a user and counts their messages
+func (s *SQLiteStorage) getConversations(userID int64) ([]Conversation, error) {
+	rows, err := s.db.Query(
+		`SELECT id, title, model, chat_mode, system_prompt, persona, params, summary, summary_until, created_at, last_activity,
+			(SELECT COUNT(*) FROM messages WHERE conversation_id = conversations.id)
+		 FROM conversations WHERE user_id = ? ORDER BY id`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read conversations: %w", err)
+	}
+
+	defer rows.Close()
+
+	conversations := []Conversation{}
+	for rows.Next() {
+		var (
+			conversation                          Conversation
+			params                                string
+			summaryUntil, createdAt, lastActivity int64
+		)
+		if err := rows.Scan(&conversation.ID, &conversation.Title, &conversation.Model, &conversation.ChatMode,
+			&conversation.SystemPrompt, &conversation.Persona, &params, &conversation.Summary, &summaryUntil,
+			&createdAt, &lastActivity, &conversation.MessageCount); err != nil {
+			return nil, fmt.Errorf("failed to read conversation: %w", err)
+		}
+		if err := json.Unmarshal([]byte(params), &conversation.Params); err != nil {
+			return nil, fmt.Errorf("failed to parse generation parameters: %w", err)
+		}
+		conversation.SummaryUntil = fromOptionalUnixNano(summaryUntil)
+		conversation.CreatedAt = fromUnixNano(createdAt)
+		conversation.LastActivity = fromUnixNano(lastActivity)
+		conversations = append(conversations, conversation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read conversations: %w", err)
+	}
+
+	return conversations, nil
+}
+
+// GetActiveConversation returns the active conversation of a user
+func (s *SQLiteStorage) GetActiveConversation(userID int64) (*Conversation, error) {
+	settings, err := s.GetUserSettings(userID)
+	if err != nil {
+		return nil, err
+	}
+	return settings.ActiveConversation(), nil
+}
+
+// SwitchConversation makes another conversation active
+func (s *SQLiteStorage) SwitchConversation(userID int64, conversationID int64) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		conversationID, err := resolveConversation(tx, userID, conversationID)
+		if err != nil {
+			return err
+		}
+		return setActiveConversation(tx, userID, conversationID)
+	})
+}
+
+// UpdateConversation updates the title, model, chat mode, system prompt, parameters and summary of a conversation
+func (s *SQLiteStorage) UpdateConversation(userID int64, conversation *Conversation) error {
+	params, err := json.Marshal(conversation.Params)
+	if err != nil {
+		return fmt.Errorf("failed to marshal generation parameters: %w", err)
+	}
+
+	return s.inTx(func(tx *sql.Tx) error {
+		conversationID, err := resolveConversation(tx, userID, conversation.ID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			`UPDATE conversations SET title = ?, model = ?, chat_mode = ?, system_prompt = ?, persona = ?, params = ?,
+			 summary = ?, summary_until = ?
+			 WHERE id = ? AND user_id = ?`,
+			conversation.Title, conversation.Model, conversation.ChatMode, conversation.SystemPrompt, conversation.Persona,
+			string(params), conversation.Summary, toOptionalUnixNano(conversation.SummaryUntil), conversationID, userID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update conversation: %w", err)
+		}
+
+		// A pending conversation has been created with its real ID
+		conversation.ID = conversationID
+		return nil
+	})
+}
+
+// DeleteConversation deletes a conversation and its history.
+// If it was active, the most recently used remaining conversation becomes active.
+func (s *SQLiteStorage) DeleteConversation(userID int64, conversationID int64) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		conversationID, err := resolveConversation(tx, userID, conversationID)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM conversations WHERE id = ? AND user_id = ?`, conversationID, userID); err != nil {
+			return fmt.Errorf("failed to delete conversation: %w", err)
+		}
+
+		if _, err := tx.Exec(`DELETE FROM messages WHERE conversation_id = ?`, conversationID); err != nil {
+			return fmt.Errorf("failed to delete conversation history: %w", err)
+		}
+
+		_, err = prepareUser(tx, userID)
+		return err
+	})
+}
+
+// ImportUserSettings replaces everything stored for a user with the given settings,
+// including all conversations and the full expense history. It is used by the JSON migration.
+func (s *SQLiteStorage) ImportUserSettings(settings *UserSettings) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Keep the original modification time rather than the import time
+	if settings.LastUpdated.IsZero() {
+		settings.LastUpdated = time.Now()
+	}
+	if err := saveUserRow(tx, settings); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM messages WHERE user_id = ?`, settings.UserID); err != nil {
+		return fmt.Errorf("failed to clear chat history: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM conversations WHERE user_id = ?`, settings.UserID); err != nil {
+		return fmt.Errorf("failed to clear conversations: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM expenses WHERE user_id = ?`, settings.UserID); err != nil {
+		return fmt.Errorf("failed to clear expenses: %w", err)
+	}
+
+	// Conversation IDs are assigned by the database, so map the active one from its original ID
+	settings.ensureActiveConversation()
+	for _, conversation := range settings.Conversations {
+		params, err := json.Marshal(conversation.Params)
+		if err != nil {
+			return fmt.Errorf("failed to marshal generation parameters: %w", err)
+		}
+
+		result, err := tx.Exec(
+			`INSERT INTO conversations (user_id, title, model, chat_mode, system_prompt, persona, params,
+			 summary, summary_until, created_at, last_activity)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			settings.UserID, conversation.Title, conversation.Model, conversation.ChatMode,
+			conversation.SystemPrompt, conversation.Persona, string(params),
+			conversation.Summary, toOptionalUnixNano(conversation.SummaryUntil),
+			toUnixNano(conversation.CreatedAt), toUnixNano(conversation.LastActivity),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to import conversation: %w", err)
+		}
+		conversationID, err := result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("failed to import conversation: %w", err)
+		}
+
+		if conversation.ID == settings.ActiveConversationID {
+			if err := setActiveConversation(tx, settings.UserID, conversationID); err != nil {
+				return err
+			}
+		}
+
+		for _, message := range conversation.ChatHistory {
+			if err := insertChatMessage(tx, settings.UserID, conversationID, message); err != nil {
+				return err
+			}
+		}
+	}
+	for _, expense := range settings.ExpenseHistory {
+		if err := insertExpense(tx, settings.UserID, expense); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ListUsers returns the IDs of all users with stored settings
+func (s *SQLiteStorage) ListUsers() ([]int64, error) {
+	rows, err := s.db.Query(`SELECT user_id FROM users ORDER BY user_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer rows.Close()
+
+	userIDs := []int64{}
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("failed to read user: %w", err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
+
+// ResetExpenses deletes the expense history of a user
+func (s *SQLiteStorage) ResetExpenses(userID int64) error {
+	if _, err := s.db.Exec(`DELETE FROM expenses WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("failed to reset expenses: %w", err)
+	}
+	return nil
+}
+
+// GetAccessRules returns the users admins have allowed (true) or removed (false)
+func (s *SQLiteStorage) GetAccessRules() (map[int64]bool, error) {
+	rows, err := s.db.Query(`SELECT user_id, allowed FROM access`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read access rules: %w", err)
+	}
+	defer rows.Close()
+
+	rules := make(map[int64]bool)
+	for rows.Next() {
+		var (
+			userID  int64
+			allowed bool
+		)
+		if err := rows.Scan(&userID, &allowed); err != nil {
+			return nil, fmt.Errorf("failed to read access rule: %w", err)
+		}
+		rules[userID] = allowed
+	}
+	return rules, rows.Err()
+}
+
+// SetAccess allows or removes a user
+func (s *SQLiteStorage) SetAccess(userID int64, allowed bool) error {
+	_, err := s.db.Exec(
+		`INSERT INTO access (user_id, allowed, updated_at) VALUES (?, ?, ?)
+		 ON CONFLICT(user_id) DO UPDATE SET allowed = excluded.allowed, updated_at = excluded.updated_at`,
+		userID, allowed, toUnixNano(time.Now()),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to write access rule: %w", err)
+	}
+	return nil
+}
+
+// AddAuditEntry appends an entry to the audit log
+func (s *SQLiteStorage) AddAuditEntry(entry AuditEntry) error {
+	_, err := s.db.Exec(
+		`INSERT INTO audit_log (created_at, admin_id, action, target_id, details) VALUES (?, ?, ?, ?, ?)`,
+		toUnixNano(entry.Timestamp), entry.AdminID, entry.Action, entry.TargetID, entry.Details,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// GetAuditLog returns the most recent audit entries, oldest first; all of them if limit is 0
+func (s *SQLiteStorage) GetAuditLog(limit int) ([]AuditEntry, error) {
+	if limit <= 0 {
+		limit = -1 // no limit in SQLite
+	}
+	rows, err := s.db.Query(
+		`SELECT created_at, admin_id, action, target_id, details FROM (
+			SELECT * FROM audit_log ORDER BY id DESC LIMIT ?
+		 ) ORDER BY id`,
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var (
+			entry     AuditEntry
+			createdAt int64
+		)
+		if err := rows.Scan(&createdAt, &entry.AdminID, &entry.Action, &entry.TargetID, &entry.Details); err != nil {
+			return nil, fmt.Errorf("failed to read audit entry: %w", err)
+		}
+		entry.Timestamp = fromUnixNano(createdAt)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// Close closes the database
+func (s *SQLiteStorage) Close() error {
+	return s.db.Close()
+}
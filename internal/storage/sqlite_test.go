@@ -0,0 +1,646 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestSQLiteStorage creates a SQLite storage in a temporary directory
+func newTestSQLiteStorage(t *testing.T) *SQLiteStorage {
+	t.Helper()
+
+	store, err := NewSQLiteStorage(filepath.Join(t.TempDir(), "bot.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteStorage: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// backends are the storage implementations that have to behave the same
+var backends = []struct {
+	name string
+	open func(t *testing.T) Storage
+}{
+	{"file", func(t *testing.T) Storage {
+		fs, _ := newTestFileStorage(t)
+		return fs
+	}},
+	{"sqlite", func(t *testing.T) Storage {
+		return newTestSQLiteStorage(t)
+	}},
+}
+
+// forEachBackend runs a test against every storage implementation
+func forEachBackend(t *testing.T, test func(t *testing.T, store Storage)) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			test(t, backend.open(t))
+		})
+	}
+}
+
+// historyContents returns the contents of the messages of a history
+func historyContents(history []ChatMessage) []string {
+	contents := []string{}
+	for _, message := range history {
+		contents = append(contents, message.Content)
+	}
+	return contents
+}
+
+// addMessage adds a message to the active conversation of a user
+func addMessage(store Storage, userID int64, role, content string) error {
+	conversation, err := store.GetActiveConversation(userID)
+	if err != nil {
+		return err
+	}
+	return store.AddChatMessage(userID, conversation.ID, ChatMessage{Role: role, Content: content, Timestamp: time.Now()})
+}
+
+func TestStorageReadsDoNotCreateUsers(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		const userID = 123
+
+		settings, err := store.GetUserSettings(userID)
+		if err != nil {
+			t.Fatalf("GetUserSettings: %v", err)
+		}
+		if settings.UserID != userID || settings.ActiveConversation() == nil || settings.TotalExpenses != 0 {
+			t.Errorf("settings of an unknown user = %+v, want defaults", settings)
+		}
+		if history, err := store.GetChatHistory(userID); err != nil || len(history) != 0 {
+			t.Errorf("GetChatHistory = %v, %v; want no messages", history, err)
+		}
+		if conversations, err := store.GetConversations(userID); err != nil || len(conversations) != 1 {
+			t.Errorf("GetConversations = %v, %v; want the default conversation", conversations, err)
+		}
+		if _, err := store.GetActiveConversation(userID); err != nil {
+			t.Errorf("GetActiveConversation: %v", err)
+		}
+		if total, err := store.GetTotalExpenses(userID); err != nil || total != 0 {
+			t.Errorf("GetTotalExpenses = %v, %v; want 0", total, err)
+		}
+		if err := store.ClearChatHistory(userID); err != nil {
+			t.Errorf("ClearChatHistory: %v", err)
+		}
+		if err := store.ResetExpenses(userID); err != nil {
+			t.Errorf("ResetExpenses: %v", err)
+		}
+
+		users, err := store.ListUsers()
+		if err != nil {
+			t.Fatalf("ListUsers: %v", err)
+		}
+		if len(users) != 0 {
+			t.Errorf("ListUsers = %v after reads only, want no users", users)
+		}
+	})
+}
+
+func TestStorageSettingsRoundTrip(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		const userID = 1
+		temperature := 0.3
+		override := time.Now().Add(time.Hour)
+
+		settings, err := store.GetUserSettings(userID)
+		if err != nil {
+			t.Fatalf("GetUserSettings: %v", err)
+		}
+		settings.CurrentModel = "anthropic/claude-3-haiku"
+		settings.ChatMode = "with_history"
+		settings.CustomModels = []string{"a/b"}
+		settings.FallbackModels = []string{"c/d", "e/f"}
+		settings.Personas = []Persona{{Name: "poet", Prompt: "Answer in verse."}}
+		settings.Params = GenerationParams{Temperature: &temperature, Stop: []string{"END"}}
+		settings.BudgetOverrideUntil = override
+		settings.BudgetLimits = &BudgetLimits{Daily: 1, Monthly: 10}
+		settings.FileDelivery = FileDelivery{CodeFiles: "off", AnswerFiles: "md"}
+		if err := store.SaveUserSettings(settings); err != nil {
+			t.Fatalf("SaveUserSettings: %v", err)
+		}
+
+		got, err := store.GetUserSettings(userID)
+		if err != nil {
+			t.Fatalf("GetUserSettings: %v", err)
+		}
+		if got.CurrentModel != settings.CurrentModel || got.ChatMode != settings.ChatMode {
+			t.Errorf("model and mode = %q, %q; want %q, %q", got.CurrentModel, got.ChatMode, settings.CurrentModel, settings.ChatMode)
+		}
+		if !reflect.DeepEqual(got.CustomModels, settings.CustomModels) || !reflect.DeepEqual(got.FallbackModels, settings.FallbackModels) {
+			t.Errorf("models = %v, %v; want %v, %v", got.CustomModels, got.FallbackModels, settings.CustomModels, settings.FallbackModels)
+		}
+		if !reflect.DeepEqual(got.Personas, settings.Personas) {
+			t.Errorf("personas = %v, want %v", got.Personas, settings.Personas)
+		}
+		if !reflect.DeepEqual(got.Params, settings.Params) {
+			t.Errorf("params = %+v, want %+v", got.Params, settings.Params)
+		}
+		if !got.BudgetOverrideUntil.Equal(override) {
+			t.Errorf("budget override = %v, want %v", got.BudgetOverrideUntil, override)
+		}
+		if !reflect.DeepEqual(got.BudgetLimits, settings.BudgetLimits) {
+			t.Errorf("budget limits = %+v, want %+v", got.BudgetLimits, settings.BudgetLimits)
+		}
+		if got.FileDelivery != settings.FileDelivery {
+			t.Errorf("file delivery = %+v, want %+v", got.FileDelivery, settings.FileDelivery)
+		}
+
+		if users, err := store.ListUsers(); err != nil || !reflect.DeepEqual(users, []int64{userID}) {
+			t.Errorf("ListUsers = %v, %v; want [%d]", users, err, userID)
+		}
+	})
+}
+
+func TestStorageConversations(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		const userID = 2
+
+		if err := addMessage(store, userID, "user", "main"); err != nil {
+			t.Fatalf("AddChatMessage: %v", err)
+		}
+		main, err := store.GetActiveConversation(userID)
+		if err != nil {
+			t.Fatalf("GetActiveConversation: %v", err)
+		}
+		if main.Title != DefaultConversationTitle {
+			t.Errorf("first conversation is %q, want %q", main.Title, DefaultConversationTitle)
+		}
+
+		second, err := store.CreateConversation(userID, "Second")
+		if err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+		if err := addMessage(store, userID, "user", "second"); err != nil {
+			t.Fatalf("AddChatMessage: %v", err)
+		}
+		if history, _ := store.GetChatHistory(userID); !reflect.DeepEqual(historyContents(history), []string{"second"}) {
+			t.Errorf("history of the new conversation = %v, want [second]", historyContents(history))
+		}
+
+		second.Title = "Renamed"
+		second.SystemPrompt = "Be brief."
+		second.Summary = "summary"
+		second.SummaryUntil = time.Now()
+		if err := store.UpdateConversation(userID, second); err != nil {
+			t.Fatalf("UpdateConversation: %v", err)
+		}
+
+		if err := store.SwitchConversation(userID, main.ID); err != nil {
+			t.Fatalf("SwitchConversation: %v", err)
+		}
+		if history, _ := store.GetChatHistory(userID); !reflect.DeepEqual(historyContents(history), []string{"main"}) {
+			t.Errorf("history after switching back = %v, want [main]", historyContents(history))
+		}
+
+		conversations, err := store.GetConversations(userID)
+		if err != nil || len(conversations) != 2 {
+			t.Fatalf("GetConversations = %v, %v; want 2 conversations", conversations, err)
+		}
+		if renamed := conversations[1]; renamed.Title != "Renamed" || renamed.SystemPrompt != "Be brief." || renamed.Summary != "summary" {
+			t.Errorf("updated conversation = %+v", renamed)
+		}
+
+		if err := store.SwitchConversation(userID, second.ID+100); !errors.Is(err, ErrConversationNotFound) {
+			t.Errorf("SwitchConversation to an unknown conversation = %v, want ErrConversationNotFound", err)
+		}
+
+		// Deleting the active conversation activates the remaining one
+		if err := store.DeleteConversation(userID, main.ID); err != nil {
+			t.Fatalf("DeleteConversation: %v", err)
+		}
+		active, err := store.GetActiveConversation(userID)
+		if err != nil || active.ID != second.ID {
+			t.Errorf("active conversation after deleting = %+v, %v; want %d", active, err, second.ID)
+		}
+
+		if err := store.ClearChatHistory(userID); err != nil {
+			t.Fatalf("ClearChatHistory: %v", err)
+		}
+		active, _ = store.GetActiveConversation(userID)
+		if active.MessageCount != 0 || active.Summary != "" || !active.SummaryUntil.IsZero() {
+			t.Errorf("conversation after clearing = %+v, want no history and summary", active)
+		}
+	})
+}
+
+func TestStorageAddsMessagesToTheirConversation(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		const userID = 4
+
+		// The question is asked in the default conversation of a new user
+		asked, err := store.GetActiveConversation(userID)
+		if err != nil {
+			t.Fatalf("GetActiveConversation: %v", err)
+		}
+		if err := store.AddChatMessage(userID, asked.ID, ChatMessage{Role: "user", Content: "question"}); err != nil {
+			t.Fatalf("AddChatMessage: %v", err)
+		}
+		asked, _ = store.GetActiveConversation(userID)
+
+		// The user starts another conversation while the answer is generated
+		if _, err := store.CreateConversation(userID, "New"); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+		if err := store.AddChatMessage(userID, asked.ID, ChatMessage{Role: "assistant", Content: "answer"}); err != nil {
+			t.Fatalf("AddChatMessage: %v", err)
+		}
+
+		if history, _ := store.GetChatHistory(userID); len(history) != 0 {
+			t.Errorf("new conversation has messages %v, want none", historyContents(history))
+		}
+		conversations, err := store.GetConversations(userID)
+		if err != nil || len(conversations) != 2 {
+			t.Fatalf("GetConversations = %v, %v; want 2 conversations", conversations, err)
+		}
+		if conversations[0].MessageCount != 2 || conversations[1].MessageCount != 0 {
+			t.Errorf("message counts = %d and %d, want 2 and 0", conversations[0].MessageCount, conversations[1].MessageCount)
+		}
+		history, err := store.GetConversationHistory(userID, asked.ID)
+		if got := historyContents(history); err != nil || !reflect.DeepEqual(got, []string{"question", "answer"}) {
+			t.Errorf("history of the conversation the question was asked in = %v, %v; want [question answer]", got, err)
+		}
+
+		// Answers to deleted conversations are not filed anywhere else
+		if err := store.DeleteConversation(userID, asked.ID); err != nil {
+			t.Fatalf("DeleteConversation: %v", err)
+		}
+		if err := store.AddChatMessage(userID, asked.ID, ChatMessage{Role: "assistant", Content: "late"}); !errors.Is(err, ErrConversationNotFound) {
+			t.Errorf("AddChatMessage to a deleted conversation = %v, want ErrConversationNotFound", err)
+		}
+	})
+}
+
+func TestStorageUpdateDefaultConversationOfNewUser(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		const userID = 3
+
+		conversation, err := store.GetActiveConversation(userID)
+		if err != nil {
+			t.Fatalf("GetActiveConversation: %v", err)
+		}
+		conversation.SystemPrompt = "Be brief."
+		if err := store.UpdateConversation(userID, conversation); err != nil {
+			t.Fatalf("UpdateConversation: %v", err)
+		}
+
+		active, err := store.GetActiveConversation(userID)
+		if err != nil || active.SystemPrompt != "Be brief." {
+			t.Errorf("active conversation = %+v, %v; want the updated default conversation", active, err)
+		}
+		if conversations, _ := store.GetConversations(userID); len(conversations) != 1 {
+			t.Errorf("user has %d conversations, want 1", len(conversations))
+		}
+	})
+}
+
+func TestStorageExpenses(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		now := time.Now()
+		expenses := []struct {
+			userID int64
+			at     time.Time
+			cost   float64
+		}{
+			{1, now.Add(-48 * time.Hour), 1},
+			{1, now.Add(-time.Hour), 2},
+			{2, now.Add(-time.Minute), 4},
+		}
+		for _, e := range expenses {
+			if err := store.AddExpense(e.userID, ExpenseRecord{Timestamp: e.at, Model: "m", Cost: e.cost}); err != nil {
+				t.Fatalf("AddExpense: %v", err)
+			}
+		}
+
+		since := now.Add(-24 * time.Hour)
+		checks := []struct {
+			name string
+			get  func() (float64, error)
+			want float64
+		}{
+			{"total of user 1", func() (float64, error) { return store.GetTotalExpenses(1) }, 3},
+			{"user 1 since yesterday", func() (float64, error) { return store.GetExpensesSince(1, since) }, 2},
+			{"all since yesterday", func() (float64, error) { return store.GetAllExpensesSince(since) }, 6},
+		}
+		for _, check := range checks {
+			if got, err := check.get(); err != nil || got != check.want {
+				t.Errorf("%s = %v, %v; want %v", check.name, got, err, check.want)
+			}
+		}
+
+		if expenses, err := store.GetExpenses(1); err != nil || len(expenses) != 2 {
+			t.Errorf("expense history = %+v, %v; want 2 records", expenses, err)
+		}
+		if settings, err := store.GetUserSettings(1); err != nil || settings.TotalExpenses != 3 {
+			t.Errorf("total expenses in the settings = %+v, %v; want 3", settings, err)
+		}
+
+		if err := store.ResetExpenses(1); err != nil {
+			t.Fatalf("ResetExpenses: %v", err)
+		}
+		if total, _ := store.GetTotalExpenses(1); total != 0 {
+			t.Errorf("total after reset = %v, want 0", total)
+		}
+		if total, _ := store.GetTotalExpenses(2); total != 4 {
+			t.Errorf("total of another user after reset = %v, want 4", total)
+		}
+
+		// Expenses after the global total has been read once are counted as well
+		if err := store.AddExpense(3, ExpenseRecord{Timestamp: now, Model: "m", Cost: 8}); err != nil {
+			t.Fatalf("AddExpense: %v", err)
+		}
+		if err := store.AddExpense(2, ExpenseRecord{Timestamp: now, Model: "m", Cost: 16}); err != nil {
+			t.Fatalf("AddExpense: %v", err)
+		}
+		if total, err := store.GetAllExpensesSince(since); err != nil || total != 28 {
+			t.Errorf("all since yesterday after reset = %v, %v; want 28", total, err)
+		}
+	})
+}
+
+func TestStorageAccessAndAuditLog(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		if err := store.SetAccess(10, true); err != nil {
+			t.Fatalf("SetAccess: %v", err)
+		}
+		if err := store.SetAccess(11, false); err != nil {
+			t.Fatalf("SetAccess: %v", err)
+		}
+		rules, err := store.GetAccessRules()
+		if err != nil || !reflect.DeepEqual(rules, map[int64]bool{10: true, 11: false}) {
+			t.Errorf("GetAccessRules = %v, %v", rules, err)
+		}
+
+		for i, action := range []string{"allow", "remove", "reset"} {
+			entry := AuditEntry{Timestamp: time.Now(), AdminID: 1, Action: action, TargetID: int64(10 + i)}
+			if err := store.AddAuditEntry(entry); err != nil {
+				t.Fatalf("AddAuditEntry: %v", err)
+			}
+		}
+		entries, err := store.GetAuditLog(2)
+		if err != nil || len(entries) != 2 || entries[0].Action != "remove" || entries[1].Action != "reset" {
+			t.Errorf("GetAuditLog(2) = %+v, %v; want the last two entries, oldest first", entries, err)
+		}
+	})
+}
+
+func TestStorageTopics(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		if topics, err := store.GetTopics(); err != nil || len(topics) != 0 {
+			t.Fatalf("GetTopics of an empty storage = %v, %v; want none", topics, err)
+		}
+
+		if err := store.SaveTopic(-5, Topic{ChatID: -100, ThreadID: 3}); err != nil {
+			t.Fatalf("SaveTopic: %v", err)
+		}
+		if err := store.SaveTopic(-6, Topic{ChatID: -100, ThreadID: 4}); err != nil {
+			t.Fatalf("SaveTopic: %v", err)
+		}
+		// Saving a known topic again replaces it
+		if err := store.SaveTopic(-6, Topic{ChatID: -200, ThreadID: 4}); err != nil {
+			t.Fatalf("SaveTopic: %v", err)
+		}
+
+		want := map[int64]Topic{-5: {ChatID: -100, ThreadID: 3}, -6: {ChatID: -200, ThreadID: 4}}
+		if topics, err := store.GetTopics(); err != nil || !reflect.DeepEqual(topics, want) {
+			t.Errorf("GetTopics = %v, %v; want %v", topics, err, want)
+		}
+	})
+}
+
+func TestStorageInvites(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		invite := &Invite{Code: "abc", CreatedBy: 1, CreatedAt: time.Now(), MaxUses: 1, Model: "a/b"}
+		if err := store.CreateInvite(invite); err != nil {
+			t.Fatalf("CreateInvite: %v", err)
+		}
+
+		redeemed, err := store.RedeemInvite("abc", 5)
+		if err != nil || !reflect.DeepEqual(redeemed.RedeemedBy, []int64{5}) || redeemed.Model != "a/b" {
+			t.Fatalf("RedeemInvite = %+v, %v", redeemed, err)
+		}
+		if _, err := store.RedeemInvite("abc", 6); !errors.Is(err, ErrInviteUsedUp) {
+			t.Errorf("second RedeemInvite = %v, want ErrInviteUsedUp", err)
+		}
+		if _, err := store.RedeemInvite("nope", 6); !errors.Is(err, ErrInviteNotFound) {
+			t.Errorf("RedeemInvite of an unknown code = %v, want ErrInviteNotFound", err)
+		}
+
+		if err := store.DeleteInvite("abc"); err != nil {
+			t.Fatalf("DeleteInvite: %v", err)
+		}
+		if invites, err := store.GetInvites(); err != nil || len(invites) != 0 {
+			t.Errorf("GetInvites after deleting = %v, %v; want none", invites, err)
+		}
+	})
+}
+
+func TestSQLiteMigrationsUpgradeOldDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bot.db")
+
+	// A database as the first version created it
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	statements := []string{
+		sqliteMigrations[0],
+		"PRAGMA user_version = 1",
+		`INSERT INTO users (user_id, current_model, chat_mode, custom_models, last_updated) VALUES (9, 'a/b', 'with_history', '["c/d"]', 1)`,
+		`INSERT INTO messages (user_id, role, content, created_at) VALUES (9, 'user', 'hello', 2), (9, 'assistant', 'hi', 3)`,
+		`INSERT INTO expenses (user_id, model, input_tokens, output_tokens, cost, created_at) VALUES (9, 'a/b', 10, 20, 0.5, 4)`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+	db.Close()
+
+	store, err := NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatalf("NewSQLiteStorage: %v", err)
+	}
+
+	var version int
+	if err := store.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil || version != len(sqliteMigrations) {
+		t.Fatalf("schema version = %d, %v; want %d", version, err, len(sqliteMigrations))
+	}
+
+	settings, err := store.GetUserSettings(9)
+	if err != nil {
+		t.Fatalf("GetUserSettings: %v", err)
+	}
+	conversation := settings.ActiveConversation()
+	if len(settings.Conversations) != 1 || conversation.Title != DefaultConversationTitle || conversation.Model != "a/b" {
+		t.Errorf("conversations = %+v, want the history in the default conversation", settings.Conversations)
+	}
+	history, err := store.GetChatHistory(9)
+	if got := historyContents(history); err != nil || !reflect.DeepEqual(got, []string{"hello", "hi"}) {
+		t.Errorf("history = %v, want [hello hi]", got)
+	}
+	if settings.TotalExpenses != 0.5 || !reflect.DeepEqual(settings.CustomModels, []string{"c/d"}) {
+		t.Errorf("settings = %+v, want the expense and custom models kept", settings)
+	}
+	if settings.BudgetLimits != nil || settings.FileDelivery != (FileDelivery{}) || len(settings.FallbackModels) != 0 {
+		t.Errorf("added settings = %+v, want their defaults", settings)
+	}
+
+	// Opening the upgraded database again applies nothing
+	store.Close()
+	if store, err = NewSQLiteStorage(path); err != nil {
+		t.Fatalf("reopening the database: %v", err)
+	}
+	store.Close()
+}
+
+func TestSQLiteImportRemapsConversations(t *testing.T) {
+	store := newTestSQLiteStorage(t)
+
+	// Another user takes the conversation IDs the imported ones had in their file
+	for i := 0; i < 3; i++ {
+		if _, err := store.CreateConversation(50, "other"); err != nil {
+			t.Fatalf("CreateConversation: %v", err)
+		}
+	}
+
+	settings := newDefaultUserSettings(7)
+	settings.ActiveConversation().ChatHistory = []ChatMessage{{Role: "user", Content: "first"}}
+	second := settings.newConversation("Second")
+	second.ChatHistory = []ChatMessage{{Role: "user", Content: "second"}}
+	settings.ActiveConversationID = second.ID
+	settings.ExpenseHistory = []ExpenseRecord{{Timestamp: time.Now(), Model: "m", Cost: 1.5}}
+	if err := store.ImportUserSettings(settings); err != nil {
+		t.Fatalf("ImportUserSettings: %v", err)
+	}
+
+	// Importing again replaces instead of duplicating
+	if err := store.ImportUserSettings(settings); err != nil {
+		t.Fatalf("second ImportUserSettings: %v", err)
+	}
+
+	got, err := store.GetUserSettings(7)
+	if err != nil {
+		t.Fatalf("GetUserSettings: %v", err)
+	}
+	if len(got.Conversations) != 2 {
+		t.Fatalf("imported %d conversations, want 2", len(got.Conversations))
+	}
+	active := got.ActiveConversation()
+	history, err := store.GetChatHistory(7)
+	if active.Title != "Second" || err != nil || !reflect.DeepEqual(historyContents(history), []string{"second"}) {
+		t.Errorf("active conversation = %+v with history %v, %v; want the imported active one", active, historyContents(history), err)
+	}
+	if got.TotalExpenses != 1.5 {
+		t.Errorf("total expenses = %v, want 1.5", got.TotalExpenses)
+	}
+
+	other, err := store.GetConversations(50)
+	if err != nil || len(other) != 3 {
+		t.Errorf("conversations of the other user = %v, %v; want 3 untouched", other, err)
+	}
+	for _, conversation := range other {
+		if conversation.MessageCount != 0 {
+			t.Errorf("conversation %d of the other user got %d messages", conversation.ID, conversation.MessageCount)
+		}
+	}
+}
+
+func TestMigrateFileStorage(t *testing.T) {
+	src, dir := newTestFileStorage(t)
+
+	if err := addMessage(src, 1, "user", "one"); err != nil {
+		t.Fatalf("AddChatMessage: %v", err)
+	}
+	if _, err := src.CreateConversation(1, "Work"); err != nil {
+		t.Fatalf("CreateConversation: %v", err)
+	}
+	if err := addMessage(src, 1, "assistant", "two"); err != nil {
+		t.Fatalf("AddChatMessage: %v", err)
+	}
+	if err := src.AddExpense(1, ExpenseRecord{Timestamp: time.Now(), Model: "m", Cost: 0.25}); err != nil {
+		t.Fatalf("AddExpense: %v", err)
+	}
+	settings, _ := src.GetUserSettings(1)
+	settings.Personas = []Persona{{Name: "poet", Prompt: "Answer in verse."}}
+	settings.FileDelivery = FileDelivery{AnswerFiles: "html"}
+	if err := src.SaveUserSettings(settings); err != nil {
+		t.Fatalf("SaveUserSettings: %v", err)
+	}
+	if err := addMessage(src, 2, "user", "other"); err != nil {
+		t.Fatalf("AddChatMessage: %v", err)
+	}
+	if err := src.SetAccess(2, true); err != nil {
+		t.Fatalf("SetAccess: %v", err)
+	}
+	if err := src.CreateInvite(&Invite{Code: "abc", CreatedBy: 1, CreatedAt: time.Now(), MaxUses: 2}); err != nil {
+		t.Fatalf("CreateInvite: %v", err)
+	}
+	if err := src.AddAuditEntry(AuditEntry{Timestamp: time.Now(), AdminID: 1, Action: "allow", TargetID: 2}); err != nil {
+		t.Fatalf("AddAuditEntry: %v", err)
+	}
+	if err := src.SaveTopic(-5, Topic{ChatID: -100, ThreadID: 3}); err != nil {
+		t.Fatalf("SaveTopic: %v", err)
+	}
+
+	dst := newTestSQLiteStorage(t)
+	// Migrating twice overwrites users and imports the audit log once
+	for i := 0; i < 2; i++ {
+		imported, err := MigrateFileStorage(dir, dst)
+		if err != nil || imported != 2 {
+			t.Fatalf("MigrateFileStorage = %d, %v; want 2 users", imported, err)
+		}
+	}
+
+	for _, userID := range []int64{1, 2} {
+		want, err := src.GetUserSettings(userID)
+		if err != nil {
+			t.Fatalf("GetUserSettings from the files: %v", err)
+		}
+		got, err := dst.GetUserSettings(userID)
+		if err != nil {
+			t.Fatalf("GetUserSettings from the database: %v", err)
+		}
+
+		if len(got.Conversations) != len(want.Conversations) {
+			t.Fatalf("user %d has %d conversations, want %d", userID, len(got.Conversations), len(want.Conversations))
+		}
+		for i := range want.Conversations {
+			history, err := dst.GetConversationHistory(userID, got.Conversations[i].ID)
+			if err != nil {
+				t.Fatalf("GetConversationHistory: %v", err)
+			}
+			if got.Conversations[i].Title != want.Conversations[i].Title ||
+				!reflect.DeepEqual(historyContents(history), historyContents(want.Conversations[i].ChatHistory)) {
+				t.Errorf("conversation %d of user %d = %+v with history %v, want %+v",
+					i, userID, got.Conversations[i], historyContents(history), want.Conversations[i])
+			}
+		}
+		if got.ActiveConversation().Title != want.ActiveConversation().Title {
+			t.Errorf("active conversation of user %d = %q, want %q", userID, got.ActiveConversation().Title, want.ActiveConversation().Title)
+		}
+		// The database reads empty lists that the files leave out as empty slices
+		if got.TotalExpenses != want.TotalExpenses || fmt.Sprint(got.Personas) != fmt.Sprint(want.Personas) || got.FileDelivery != want.FileDelivery {
+			t.Errorf("settings of user %d = %+v, want %+v", userID, got, want)
+		}
+	}
+
+	if rules, err := dst.GetAccessRules(); err != nil || !reflect.DeepEqual(rules, map[int64]bool{2: true}) {
+		t.Errorf("access rules = %v, %v", rules, err)
+	}
+	if invites, err := dst.GetInvites(); err != nil || len(invites) != 1 || invites[0].Code != "abc" {
+		t.Errorf("invites = %+v, %v", invites, err)
+	}
+	if entries, err := dst.GetAuditLog(0); err != nil || len(entries) != 1 {
+		t.Errorf("audit log = %+v, %v; want 1 entry", entries, err)
+	}
+	if topics, err := dst.GetTopics(); err != nil || !reflect.DeepEqual(topics, map[int64]Topic{-5: {ChatID: -100, ThreadID: 3}}) {
+		t.Errorf("topics = %v, %v", topics, err)
+	}
+}
@@ -11,9 +11,33 @@ import (
 
 // ChatMessage represents a message in chat history
 type ChatMessage struct {
-	Role      string    `json:"role"` // "user" or "assistant"
-	Content   string    `json:"content"`
-	Timestamp time.Time `json:"timestamp"`
+	Role        string       `json:"role"` // "user" or "assistant"
+	Content     string       `json:"content"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	Timestamp   time.Time    `json:"timestamp"`
+}
+
+// Attachment types
+const (
+	// AttachmentImage is the attachment type of photos and image documents
+	AttachmentImage = "image"
+	// AttachmentDocument is the attachment type of text, code and PDF files
+	AttachmentDocument = "document"
+)
+
+// Attachment references a file sent with a chat message.
+// Images are stored by their Telegram file ID and downloaded again when they're needed;
+// documents keep their extracted text, so they stay part of the conversation.
+type Attachment struct {
+	Type     string `json:"type"`
+	FileID   string `json:"file_id"`
+	MimeType string `json:"mime_type,omitempty"`
+	// Name is the file name of a document
+	Name string `json:"name,omitempty"`
+	// Text is the text extracted from a document
+	Text string `json:"text,omitempty"`
+	// DataURL holds the downloaded content while a request is built and is never persisted
+	DataURL string `json:"-"`
 }
 
 // ExpenseRecord represents an expense record for API calls
@@ -25,34 +49,154 @@ type ExpenseRecord struct {
 	Cost         float64   `json:"cost"`
 }
 
+// Conversation represents a named chat thread with its own history, model and chat mode
+type Conversation struct {
+	ID           int64  `json:"id"`
+	Title        string `json:"title"`
+	Model        string `json:"model"`
+	ChatMode     string `json:"chat_mode"`
+	SystemPrompt string `json:"system_prompt,omitempty"` // custom system prompt
+	Persona      string `json:"persona,omitempty"`       // name of the persona in use
+	// Params override the user's generation parameters in this conversation
+	Params GenerationParams `json:"params"`
+	// Summary condenses the messages up to SummaryUntil, which are no longer sent to the model
+	Summary      string    `json:"summary,omitempty"`
+	SummaryUntil time.Time `json:"summary_until"`
+	// ChatHistory is only loaded by the file storage; read it with GetConversationHistory
+	ChatHistory []ChatMessage `json:"chat_history"`
+	// MessageCount is the number of messages in the history
+	MessageCount int       `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// Persona is a named, reusable system prompt
+type Persona struct {
+	Name   string `json:"name"`
+	Prompt string `json:"prompt"`
+}
+
 // UserSettings represents user-specific settings
 type UserSettings struct {
-	UserID         int64           `json:"user_id"`
-	CurrentModel   string          `json:"current_model"`
-	ChatMode       string          `json:"chat_mode"` // "with_history" or "without_history"
-	CustomModels   []string        `json:"custom_models"`
-	TotalExpenses  float64         `json:"total_expenses"`
+	UserID       int64    `json:"user_id"`
+	CurrentModel string   `json:"current_model"` // default model for new conversations
+	ChatMode     string   `json:"chat_mode"`     // "with_history" or "without_history"
+	CustomModels []string `json:"custom_models"`
+	// FallbackModels are tried in order when the model of a conversation fails
+	FallbackModels []string  `json:"fallback_models,omitempty"`
+	Personas       []Persona `json:"personas,omitempty"`
+	// Params are the generation parameters used in all conversations
+	Params        GenerationParams `json:"params"`
+	TotalExpenses float64          `json:"total_expenses"`
+	// ExpenseHistory is only loaded by the file storage; read it with GetExpenses
 	ExpenseHistory []ExpenseRecord `json:"expense_history"`
-	ChatHistory    []ChatMessage   `json:"chat_history"`
-	LastUpdated    time.Time       `json:"last_updated"`
+	// ChatHistory is the single-thread history of older versions.
+	// It is moved into the default conversation when settings are loaded.
+	ChatHistory          []ChatMessage  `json:"chat_history,omitempty"`
+	Conversations        []Conversation `json:"conversations"`
+	ActiveConversationID int64          `json:"active_conversation_id"`
+	// Budget limits don't apply until this time (set by an admin)
+	BudgetOverrideUntil time.Time `json:"budget_override_until"`
+	// BudgetLimits replace the configured per-user limits (set by an invite); nil uses the config
+	BudgetLimits *BudgetLimits `json:"budget_limits,omitempty"`
+	// FileDelivery controls which long answers are sent as files
+	FileDelivery FileDelivery `json:"file_delivery"`
+	LastUpdated  time.Time    `json:"last_updated"`
+}
+
+// FileDelivery holds a user's choices for sending long answers as files; empty fields use the config
+type FileDelivery struct {
+	// CodeFiles sends long code blocks as files: "on" or "off"
+	CodeFiles string `json:"code_files,omitempty"`
+	// AnswerFiles sends answers that need many messages as a single file: "md", "html" or "off"
+	AnswerFiles string `json:"answer_files,omitempty"`
+}
+
+// BudgetLimits are the daily and monthly spending limits of a user in USD; zero disables a limit
+type BudgetLimits struct {
+	Daily   float64 `json:"daily"`
+	Monthly float64 `json:"monthly"`
 }
 
-// Storage interface defines methods for data persistence
+// maxChatHistory is the number of most recent chat messages kept per conversation.
+// How many of them are sent to the model depends on its context length.
+const maxChatHistory = 200
+
+// newDefaultUserSettings returns the settings for a user that has not been seen before
+func newDefaultUserSettings(userID int64) *UserSettings {
+	settings := &UserSettings{
+		UserID:         userID,
+		CurrentModel:   "openai/gpt-3.5-turbo",
+		ChatMode:       "without_history",
+		CustomModels:   []string{},
+		TotalExpenses:  0,
+		ExpenseHistory: []ExpenseRecord{},
+		LastUpdated:    time.Now(),
+	}
+	settings.ensureActiveConversation()
+	return settings
+}
+
+// Storage interface defines methods for data persistence.
+// User settings come with conversations and total expenses, but callers must not rely on
+// them including chat or expense history; those are read through their own methods.
 type Storage interface {
 	GetUserSettings(userID int64) (*UserSettings, error)
 	SaveUserSettings(settings *UserSettings) error
 	AddExpense(userID int64, expense ExpenseRecord) error
+	GetExpenses(userID int64) ([]ExpenseRecord, error)
 	GetTotalExpenses(userID int64) (float64, error)
-	AddChatMessage(userID int64, message ChatMessage) error
+	GetExpensesSince(userID int64, since time.Time) (float64, error)
+	GetAllExpensesSince(since time.Time) (float64, error)
+	AddChatMessage(userID int64, conversationID int64, message ChatMessage) error
 	GetChatHistory(userID int64) ([]ChatMessage, error)
 	ClearChatHistory(userID int64) error
+
+	// Conversations; reading and clearing the chat history above operate on the active conversation
+	CreateConversation(userID int64, title string) (*Conversation, error)
+	GetConversations(userID int64) ([]Conversation, error)
+	GetConversationHistory(userID int64, conversationID int64) ([]ChatMessage, error)
+	GetActiveConversation(userID int64) (*Conversation, error)
+	SwitchConversation(userID int64, conversationID int64) error
+	UpdateConversation(userID int64, conversation *Conversation) error
+	DeleteConversation(userID int64, conversationID int64) error
+
+	// Administration
+	ListUsers() ([]int64, error)
+	ResetExpenses(userID int64) error
+	GetAccessRules() (map[int64]bool, error)
+	SetAccess(userID int64, allowed bool) error
+	AddAuditEntry(entry AuditEntry) error
+	GetAuditLog(limit int) ([]AuditEntry, error)
+
+	// Invites
+	CreateInvite(invite *Invite) error
+	GetInvites() ([]Invite, error)
+	RedeemInvite(code string, userID int64) (*Invite, error)
+	DeleteInvite(code string) error
+
+	// Forum topics
+	GetTopics() (map[int64]Topic, error)
+	SaveTopic(key int64, topic Topic) error
+
 	Close() error
 }
 
 // FileStorage implements Storage interface using file system
 type FileStorage struct {
 	dataDir string
-	mutex   sync.RWMutex
+
+	// locks holds a mutex per user that covers the full read-modify-write of the user's file
+	locks      map[int64]*sync.Mutex
+	locksMutex sync.Mutex
+	// adminMutex guards the access rules, the audit log, the invites and the forum topics
+	adminMutex sync.Mutex
+
+	// expenses caches the expense history of every user whose file has been read for the global
+	// budget, so checking it doesn't parse all files again. It is only changed while holding the
+	// user's lock, and users missing from it are read on the next check.
+	expenses      map[int64][]ExpenseRecord
+	expensesMutex sync.Mutex
 }
 
 // NewFileStorage creates a new file-based storage
@@ -62,8 +206,15 @@ func NewFileStorage(dataDir string) (*FileStorage, error) {
 		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
 
+	// Temporary files are left behind by writes that were interrupted by a crash
+	if err := removeTempFiles(dataDir); err != nil {
+		return nil, err
+	}
+
 	return &FileStorage{
-		dataDir: dataDir,
+		dataDir:  dataDir,
+		locks:    make(map[int64]*sync.Mutex),
+		expenses: make(map[int64][]ExpenseRecord),
 	}, nil
 }
 
@@ -72,46 +223,97 @@ func (fs *FileStorage) getUserFilePath(userID int64) string {
 	return filepath.Join(fs.dataDir, fmt.Sprintf("user_%d.json", userID))
 }
 
+// stored reports whether a user has a settings file. Users without one get default settings
+// from reads, and are only stored by the first write that changes something.
+func (fs *FileStorage) stored(userID int64) bool {
+	_, err := os.Stat(fs.getUserFilePath(userID))
+	return !os.IsNotExist(err)
+}
+
+// lockUser locks the file of a user and returns the function that unlocks it
+func (fs *FileStorage) lockUser(userID int64) func() {
+	fs.locksMutex.Lock()
+	lock, ok := fs.locks[userID]
+	if !ok {
+		lock = &sync.Mutex{}
+		fs.locks[userID] = lock
+	}
+	fs.locksMutex.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
 // GetUserSettings retrieves user settings
 func (fs *FileStorage) GetUserSettings(userID int64) (*UserSettings, error) {
-	fs.mutex.RLock()
-	defer fs.mutex.RUnlock()
+	defer fs.lockUser(userID)()
+
+	return fs.load(userID)
+}
 
+// SaveUserSettings saves the user's own settings. Like in the SQLite storage, conversations and
+// expenses are managed through their own methods and are kept as they are in the file, so saving
+// settings that were read earlier can't undo messages or expenses added in the meantime.
+func (fs *FileStorage) SaveUserSettings(settings *UserSettings) error {
+	return fs.update(settings.UserID, func(current *UserSettings) error {
+		current.CurrentModel = settings.CurrentModel
+		current.ChatMode = settings.ChatMode
+		current.CustomModels = settings.CustomModels
+		current.FallbackModels = settings.FallbackModels
+		current.Personas = settings.Personas
+		current.Params = settings.Params
+		current.BudgetOverrideUntil = settings.BudgetOverrideUntil
+		current.BudgetLimits = settings.BudgetLimits
+		current.FileDelivery = settings.FileDelivery
+		return nil
+	})
+}
+
+// update applies a change to the settings of a user while holding the user's lock,
+// so concurrent changes can't overwrite each other
+func (fs *FileStorage) update(userID int64, change func(settings *UserSettings) error) error {
+	defer fs.lockUser(userID)()
+
+	settings, err := fs.load(userID)
+	if err != nil {
+		return err
+	}
+	if err := change(settings); err != nil {
+		return err
+	}
+	return fs.save(settings)
+}
+
+// load reads the settings of a user; the caller must hold the user's lock.
+// A file that can't be parsed is replaced by its backup if there is a valid one.
+func (fs *FileStorage) load(userID int64) (*UserSettings, error) {
 	filePath := fs.getUserFilePath(userID)
 
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		// Return default settings for new user
-		return &UserSettings{
-			UserID:         userID,
-			CurrentModel:   "openai/gpt-3.5-turbo",
-			ChatMode:       "without_history",
-			CustomModels:   []string{},
-			TotalExpenses:  0,
-			ExpenseHistory: []ExpenseRecord{},
-			ChatHistory:    []ChatMessage{},
-			LastUpdated:    time.Now(),
-		}, nil
-	}
-
-	data, err := os.ReadFile(filePath)
+	// Return default settings for new user
+	if !fs.stored(userID) {
+		return newDefaultUserSettings(userID), nil
+	}
+
+	settings, err := readUserFile(filePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read user settings: %w", err)
+		settings, err = fs.restoreBackup(filePath, err)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	var settings UserSettings
-	if err := json.Unmarshal(data, &settings); err != nil {
-		return nil, fmt.Errorf("failed to parse user settings: %w", err)
+	// Files written before conversations existed only have a flat chat history
+	settings.ensureActiveConversation()
+	for i := range settings.Conversations {
+		settings.Conversations[i].MessageCount = len(settings.Conversations[i].ChatHistory)
 	}
 
-	return &settings, nil
+	return settings, nil
 }
 
-// SaveUserSettings saves user settings to file
-func (fs *FileStorage) SaveUserSettings(settings *UserSettings) error {
-	fs.mutex.Lock()
-	defer fs.mutex.Unlock()
-
+// save writes the settings of a user atomically; the caller must hold the user's lock.
+// The previous version of the file is kept as a backup.
+func (fs *FileStorage) save(settings *UserSettings) error {
 	settings.LastUpdated = time.Now()
 
 	data, err := json.MarshalIndent(settings, "", "  ")
@@ -120,7 +322,10 @@ func (fs *FileStorage) SaveUserSettings(settings *UserSettings) error {
 	}
 
 	filePath := fs.getUserFilePath(settings.UserID)
-	if err := os.WriteFile(filePath, data, 0644); err != nil {
+	if err := backupFile(filePath); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filePath, data, 0644); err != nil {
 		return fmt.Errorf("failed to write user settings: %w", err)
 	}
 
@@ -129,15 +334,34 @@ func (fs *FileStorage) SaveUserSettings(settings *UserSettings) error {
 
 // AddExpense adds an expense record to user's history
 func (fs *FileStorage) AddExpense(userID int64, expense ExpenseRecord) error {
-	settings, err := fs.GetUserSettings(userID)
+	defer fs.lockUser(userID)()
+
+	settings, err := fs.load(userID)
 	if err != nil {
 		return err
 	}
-
 	settings.ExpenseHistory = append(settings.ExpenseHistory, expense)
 	settings.TotalExpenses += expense.Cost
+	if err := fs.save(settings); err != nil {
+		return err
+	}
 
-	return fs.SaveUserSettings(settings)
+	fs.expensesMutex.Lock()
+	defer fs.expensesMutex.Unlock()
+	if expenses, cached := fs.expenses[userID]; cached {
+		fs.expenses[userID] = append(expenses, expense)
+	}
+	return nil
+}
+
+// GetExpenses returns the expense history of a user in chronological order
+func (fs *FileStorage) GetExpenses(userID int64) ([]ExpenseRecord, error) {
+	settings, err := fs.GetUserSettings(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return settings.ExpenseHistory, nil
 }
 
 // GetTotalExpenses returns total expenses for a user
@@ -150,42 +374,134 @@ func (fs *FileStorage) GetTotalExpenses(userID int64) (float64, error) {
 	return settings.TotalExpenses, nil
 }
 
-// AddChatMessage adds a message to chat history
-func (fs *FileStorage) AddChatMessage(userID int64, message ChatMessage) error {
+// GetExpensesSince returns the expenses of a user since the given time
+func (fs *FileStorage) GetExpensesSince(userID int64, since time.Time) (float64, error) {
 	settings, err := fs.GetUserSettings(userID)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	settings.ChatHistory = append(settings.ChatHistory, message)
+	return sumExpensesSince(settings.ExpenseHistory, since), nil
+}
 
-	// Keep only last 50 messages to avoid too large files
-	if len(settings.ChatHistory) > 50 {
-		settings.ChatHistory = settings.ChatHistory[len(settings.ChatHistory)-50:]
+// GetAllExpensesSince returns the expenses of all users since the given time
+func (fs *FileStorage) GetAllExpensesSince(since time.Time) (float64, error) {
+	userIDs, err := listUserFiles(fs.dataDir)
+	if err != nil {
+		return 0, err
 	}
 
-	return fs.SaveUserSettings(settings)
+	var total float64
+	for _, userID := range userIDs {
+		expenses, err := fs.cachedExpenses(userID)
+		if err != nil {
+			return 0, err
+		}
+		total += sumExpensesSince(expenses, since)
+	}
+	return total, nil
 }
 
-// GetChatHistory returns chat history for a user
-func (fs *FileStorage) GetChatHistory(userID int64) ([]ChatMessage, error) {
-	settings, err := fs.GetUserSettings(userID)
+// cachedExpenses returns the expense history of a user from the cache, reading the user's file
+// if the user isn't cached yet
+func (fs *FileStorage) cachedExpenses(userID int64) ([]ExpenseRecord, error) {
+	fs.expensesMutex.Lock()
+	expenses, cached := fs.expenses[userID]
+	fs.expensesMutex.Unlock()
+	if cached {
+		return expenses, nil
+	}
+
+	defer fs.lockUser(userID)()
+	settings, err := fs.load(userID)
 	if err != nil {
 		return nil, err
 	}
 
-	return settings.ChatHistory, nil
+	fs.expensesMutex.Lock()
+	defer fs.expensesMutex.Unlock()
+	fs.expenses[userID] = settings.ExpenseHistory
+	return settings.ExpenseHistory, nil
 }
 
-// ClearChatHistory clears chat history for a user
-func (fs *FileStorage) ClearChatHistory(userID int64) error {
+// forgetExpenses removes a user from the expense cache, so the next check reads the user's file
+func (fs *FileStorage) forgetExpenses(userID int64) {
+	fs.expensesMutex.Lock()
+	defer fs.expensesMutex.Unlock()
+	delete(fs.expenses, userID)
+}
+
+// sumExpensesSince sums the cost of the expenses recorded since the given time
+func sumExpensesSince(expenses []ExpenseRecord, since time.Time) float64 {
+	var total float64
+	for _, expense := range expenses {
+		if !expense.Timestamp.Before(since) {
+			total += expense.Cost
+		}
+	}
+	return total
+}
+
+// listUserFiles returns the IDs of the users that have a user_<id>.json file in dataDir
+func listUserFiles(dataDir string) ([]int64, error) {
+	files, err := filepath.Glob(filepath.Join(dataDir, "user_*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list user files: %w", err)
+	}
+
+	userIDs := make([]int64, 0, len(files))
+	for _, file := range files {
+		var userID int64
+		if _, err := fmt.Sscanf(filepath.Base(file), "user_%d.json", &userID); err != nil {
+			continue
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, nil
+}
+
+// AddChatMessage adds a message to the history of a conversation. Answers are added to the
+// conversation they were asked in, even if the user has switched to another one meanwhile.
+func (fs *FileStorage) AddChatMessage(userID int64, conversationID int64, message ChatMessage) error {
+	return fs.update(userID, func(settings *UserSettings) error {
+		conversation := settings.findConversation(conversationID)
+		if conversation == nil {
+			return ErrConversationNotFound
+		}
+		conversation.ChatHistory = append(conversation.ChatHistory, message)
+		conversation.LastActivity = time.Now()
+
+		// Keep only the most recent messages to avoid too large files
+		if len(conversation.ChatHistory) > maxChatHistory {
+			conversation.ChatHistory = conversation.ChatHistory[len(conversation.ChatHistory)-maxChatHistory:]
+		}
+		return nil
+	})
+}
+
+// GetChatHistory returns the history of the active conversation
+func (fs *FileStorage) GetChatHistory(userID int64) ([]ChatMessage, error) {
 	settings, err := fs.GetUserSettings(userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	settings.ChatHistory = []ChatMessage{}
-	return fs.SaveUserSettings(settings)
+	return settings.ActiveConversation().ChatHistory, nil
+}
+
+// ClearChatHistory clears the history and summary of the active conversation
+func (fs *FileStorage) ClearChatHistory(userID int64) error {
+	// There is nothing to clear for unknown users
+	if !fs.stored(userID) {
+		return nil
+	}
+	return fs.update(userID, func(settings *UserSettings) error {
+		conversation := settings.ActiveConversation()
+		conversation.ChatHistory = []ChatMessage{}
+		conversation.Summary = ""
+		conversation.SummaryUntil = time.Time{}
+		return nil
+	})
 }
 
 // Close closes the storage (no-op for file storage)
@@ -0,0 +1,362 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// firstConversationID is the ID of the default conversation in a new user file
+const firstConversationID = 1
+
+// newTestFileStorage creates a file storage in a temporary directory
+func newTestFileStorage(t *testing.T) (*FileStorage, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	fs, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatalf("NewFileStorage: %v", err)
+	}
+	return fs, dir
+}
+
+func TestFileStorageConcurrentUpdatesAreNotLost(t *testing.T) {
+	fs, _ := newTestFileStorage(t)
+	const userID = 42
+	const workers = 8
+	const perWorker = 20
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*workers*perWorker)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				message := ChatMessage{Role: "user", Content: fmt.Sprintf("%d-%d", w, i), Timestamp: time.Now()}
+				if err := fs.AddChatMessage(userID, firstConversationID, message); err != nil {
+					errs <- err
+				}
+				if err := fs.AddExpense(userID, ExpenseRecord{Timestamp: time.Now(), Model: "m", Cost: 0.5}); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent update: %v", err)
+	}
+
+	settings, err := fs.GetUserSettings(userID)
+	if err != nil {
+		t.Fatalf("GetUserSettings: %v", err)
+	}
+
+	const total = workers * perWorker
+	if got := len(settings.ActiveConversation().ChatHistory); got != total {
+		t.Errorf("chat history has %d messages, want %d", got, total)
+	}
+	if got := len(settings.ExpenseHistory); got != total {
+		t.Errorf("expense history has %d records, want %d", got, total)
+	}
+	if want := 0.5 * total; settings.TotalExpenses != want {
+		t.Errorf("total expenses = %v, want %v", settings.TotalExpenses, want)
+	}
+}
+
+func TestStorageSaveOfStaleSettingsKeepsHistory(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		const userID = 9
+		const writes = 20
+
+		conversation, err := store.GetActiveConversation(userID)
+		if err != nil {
+			t.Fatalf("GetActiveConversation: %v", err)
+		}
+		if err := store.AddChatMessage(userID, conversation.ID, ChatMessage{Role: "user", Content: "first"}); err != nil {
+			t.Fatalf("AddChatMessage: %v", err)
+		}
+		conversation, _ = store.GetActiveConversation(userID)
+
+		// Commands read the settings, change them and save them while answers are being saved
+		var wg sync.WaitGroup
+		errs := make(chan error, 3*writes)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				if err := store.AddChatMessage(userID, conversation.ID, ChatMessage{Role: "assistant", Content: fmt.Sprint(i)}); err != nil {
+					errs <- err
+				}
+				if err := store.AddExpense(userID, ExpenseRecord{Timestamp: time.Now(), Model: "m", Cost: 1}); err != nil {
+					errs <- err
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				settings, err := store.GetUserSettings(userID)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				// Let the other writer get ahead of this read
+				time.Sleep(time.Millisecond)
+				settings.CurrentModel = fmt.Sprintf("model/%d", i)
+				if err := store.SaveUserSettings(settings); err != nil {
+					errs <- err
+				}
+			}
+		}()
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("concurrent update: %v", err)
+		}
+
+		settings, err := store.GetUserSettings(userID)
+		if err != nil {
+			t.Fatalf("GetUserSettings: %v", err)
+		}
+		if history, err := store.GetChatHistory(userID); err != nil || len(history) != writes+1 {
+			t.Errorf("chat history has %d messages, %v; want %d", len(history), err, writes+1)
+		}
+		expenses, err := store.GetExpenses(userID)
+		if err != nil || len(expenses) != writes || settings.TotalExpenses != writes {
+			t.Errorf("expenses = %d records costing %v, %v; want %d costing %d", len(expenses), settings.TotalExpenses, err, writes, writes)
+		}
+		if want := fmt.Sprintf("model/%d", writes-1); settings.CurrentModel != want {
+			t.Errorf("current model = %q, want %q", settings.CurrentModel, want)
+		}
+	})
+}
+
+func TestFileStorageKeepsMessageOrderPerWriter(t *testing.T) {
+	fs, _ := newTestFileStorage(t)
+	const userID = 7
+	const workers = 4
+	const perWorker = 25
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				message := ChatMessage{Role: "user", Content: fmt.Sprintf("%d-%d", w, i), Timestamp: time.Now()}
+				if err := fs.AddChatMessage(userID, firstConversationID, message); err != nil {
+					t.Errorf("AddChatMessage: %v", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	history, err := fs.GetChatHistory(userID)
+	if err != nil {
+		t.Fatalf("GetChatHistory: %v", err)
+	}
+
+	next := make(map[int]int)
+	for _, message := range history {
+		var w, i int
+		if _, err := fmt.Sscanf(message.Content, "%d-%d", &w, &i); err != nil {
+			t.Fatalf("unexpected message %q", message.Content)
+		}
+		if i != next[w] {
+			t.Fatalf("message %d of writer %d appears where %d was expected", i, w, next[w])
+		}
+		next[w]++
+	}
+}
+
+func TestFileStorageReadersNeverSeePartialWrites(t *testing.T) {
+	fs, _ := newTestFileStorage(t)
+	const userID = 1
+
+	// A large history makes a torn write likely if writes were not atomic
+	settings := newDefaultUserSettings(userID)
+	for i := 0; i < maxChatHistory; i++ {
+		settings.ActiveConversation().ChatHistory = append(settings.ActiveConversation().ChatHistory,
+			ChatMessage{Role: "assistant", Content: strings.Repeat("x", 1000), Timestamp: time.Now()})
+	}
+	unlock := fs.lockUser(userID)
+	err := fs.save(settings)
+	unlock()
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			if err := fs.AddExpense(userID, ExpenseRecord{Timestamp: time.Now(), Cost: 0.01}); err != nil {
+				t.Errorf("AddExpense: %v", err)
+			}
+		}
+		close(done)
+	}()
+
+	// Read the file directly, bypassing the lock, as a crash or another process would see it
+	path := fs.getUserFilePath(userID)
+	for {
+		select {
+		case <-done:
+			wg.Wait()
+			return
+		default:
+		}
+		if _, err := readUserFile(path); err != nil {
+			t.Fatalf("file was readable only partially: %v", err)
+		}
+	}
+}
+
+func TestFileStorageRestoresBackupOfDamagedFile(t *testing.T) {
+	fs, dir := newTestFileStorage(t)
+	const userID = 5
+
+	if err := fs.AddChatMessage(userID, firstConversationID, ChatMessage{Role: "user", Content: "first", Timestamp: time.Now()}); err != nil {
+		t.Fatalf("AddChatMessage: %v", err)
+	}
+	if err := fs.AddChatMessage(userID, firstConversationID, ChatMessage{Role: "user", Content: "second", Timestamp: time.Now()}); err != nil {
+		t.Fatalf("AddChatMessage: %v", err)
+	}
+
+	// Damage the file as a crash during a non-atomic write would
+	path := fs.getUserFilePath(userID)
+	if err := os.WriteFile(path, []byte(`{"user_id": 5, "chat_mo`), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	history, err := fs.GetChatHistory(userID)
+	if err != nil {
+		t.Fatalf("GetChatHistory after damage: %v", err)
+	}
+	if len(history) != 1 || history[0].Content != "first" {
+		t.Fatalf("restored history = %+v, want the version before the last write", history)
+	}
+
+	// The restored file is valid again and the damaged one is kept
+	if _, err := readUserFile(path); err != nil {
+		t.Errorf("user file was not restored: %v", err)
+	}
+	damaged, _ := filepath.Glob(filepath.Join(dir, "user_5.json.damaged-*"))
+	if len(damaged) != 1 {
+		t.Errorf("found %d copies of the damaged file, want 1", len(damaged))
+	}
+
+	// Writing works again
+	if err := fs.AddChatMessage(userID, firstConversationID, ChatMessage{Role: "user", Content: "third", Timestamp: time.Now()}); err != nil {
+		t.Fatalf("AddChatMessage after restore: %v", err)
+	}
+	history, err = fs.GetChatHistory(userID)
+	if err != nil || len(history) != 2 {
+		t.Fatalf("history after restore = %+v, %v; want 2 messages", history, err)
+	}
+}
+
+func TestFileStorageDamagedFileWithoutBackup(t *testing.T) {
+	fs, _ := newTestFileStorage(t)
+	const userID = 6
+
+	if err := os.WriteFile(fs.getUserFilePath(userID), []byte("not json"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if _, err := fs.GetUserSettings(userID); err == nil {
+		t.Fatal("GetUserSettings returned no error for a damaged file without backup")
+	}
+
+	// A failed read must not be mistaken for a new user and overwrite the file
+	if err := fs.AddChatMessage(userID, firstConversationID, ChatMessage{Role: "user", Content: "hello"}); err == nil {
+		t.Fatal("AddChatMessage overwrote a damaged file")
+	}
+}
+
+func TestFileStorageDamagedFileDoesNotReplaceBackup(t *testing.T) {
+	fs, _ := newTestFileStorage(t)
+	const userID = 8
+	path := fs.getUserFilePath(userID)
+
+	for _, content := range []string{"one", "two"} {
+		if err := fs.AddChatMessage(userID, firstConversationID, ChatMessage{Role: "user", Content: content}); err != nil {
+			t.Fatalf("AddChatMessage: %v", err)
+		}
+	}
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	// Saving over a damaged file keeps the last good backup
+	if err := fs.SaveUserSettings(newDefaultUserSettings(userID)); err != nil {
+		t.Fatalf("SaveUserSettings: %v", err)
+	}
+	backup, err := readUserFile(path + backupSuffix)
+	if err != nil {
+		t.Fatalf("backup is not readable: %v", err)
+	}
+	if got := len(backup.ActiveConversation().ChatHistory); got != 1 {
+		t.Errorf("backup has %d messages, want 1", got)
+	}
+}
+
+func TestFileStorageLeavesNoTemporaryFiles(t *testing.T) {
+	fs, dir := newTestFileStorage(t)
+
+	var wg sync.WaitGroup
+	for userID := int64(1); userID <= 4; userID++ {
+		wg.Add(1)
+		go func(userID int64) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if err := fs.AddChatMessage(userID, firstConversationID, ChatMessage{Role: "user", Content: "hi"}); err != nil {
+					t.Errorf("AddChatMessage: %v", err)
+				}
+			}
+		}(userID)
+	}
+	wg.Wait()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".json") && !strings.HasSuffix(name, ".json"+backupSuffix) {
+			t.Errorf("unexpected file %s", name)
+		}
+	}
+
+	userIDs, err := listUserFiles(dir)
+	if err != nil || len(userIDs) != 4 {
+		t.Errorf("listUserFiles = %v, %v; want 4 users", userIDs, err)
+	}
+}
+
+func TestNewFileStorageRemovesInterruptedWrites(t *testing.T) {
+	dir := t.TempDir()
+	leftover := filepath.Join(dir, "user_1.json"+tempSuffix+"123")
+	if err := os.WriteFile(leftover, []byte("{"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if _, err := NewFileStorage(dir); err != nil {
+		t.Fatalf("NewFileStorage: %v", err)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("temporary file of an interrupted write was not removed")
+	}
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// topicsFileName holds the forum topics of the file storage
+const topicsFileName = "topics.json"
+
+// Topic is a forum topic of a group. Its settings are stored under a chat key derived from
+// chat and topic, which can't be turned back into them, so the topic is stored alongside.
+type Topic struct {
+	ChatID   int64 `json:"chat_id"`
+	ThreadID int   `json:"thread_id"`
+}
+
+// GetTopics returns the known forum topics by chat key
+func (fs *FileStorage) GetTopics() (map[int64]Topic, error) {
+	fs.adminMutex.Lock()
+	defer fs.adminMutex.Unlock()
+
+	return fs.loadTopics()
+}
+
+// SaveTopic records the forum topic of a chat key
+func (fs *FileStorage) SaveTopic(key int64, topic Topic) error {
+	fs.adminMutex.Lock()
+	defer fs.adminMutex.Unlock()
+
+	topics, err := fs.loadTopics()
+	if err != nil {
+		return err
+	}
+	topics[key] = topic
+
+	// JSON object keys must be strings
+	encoded := make(map[string]Topic, len(topics))
+	for key, topic := range topics {
+		encoded[strconv.FormatInt(key, 10)] = topic
+	}
+	data, err := json.MarshalIndent(encoded, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal topics: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(fs.dataDir, topicsFileName), data, 0644); err != nil {
+		return fmt.Errorf("failed to write topics: %w", err)
+	}
+	return nil
+}
+
+// loadTopics reads the forum topics; the caller holds adminMutex
+func (fs *FileStorage) loadTopics() (map[int64]Topic, error) {
+	topics := make(map[int64]Topic)
+
+	data, err := os.ReadFile(filepath.Join(fs.dataDir, topicsFileName))
+	if os.IsNotExist(err) {
+		return topics, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read topics: %w", err)
+	}
+
+	var encoded map[string]Topic
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, fmt.Errorf("failed to parse topics: %w", err)
+	}
+	for key, topic := range encoded {
+		id, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse topics: invalid chat key %q", key)
+		}
+		topics[id] = topic
+	}
+	return topics, nil
+}
+
+// GetTopics returns the known forum topics by chat key
+func (s *SQLiteStorage) GetTopics() (map[int64]Topic, error) {
+	rows, err := s.db.Query(`SELECT chat_key, chat_id, thread_id FROM topics`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read topics: %w", err)
+	}
+	defer rows.Close()
+
+	topics := make(map[int64]Topic)
+	for rows.Next() {
+		var (
+			key   int64
+			topic Topic
+		)
+		if err := rows.Scan(&key, &topic.ChatID, &topic.ThreadID); err != nil {
+			return nil, fmt.Errorf("failed to read topic: %w", err)
+		}
+		topics[key] = topic
+	}
+	return topics, rows.Err()
+}
+
+// SaveTopic records the forum topic of a chat key
+func (s *SQLiteStorage) SaveTopic(key int64, topic Topic) error {
+	_, err := s.db.Exec(
+		`INSERT INTO topics (chat_key, chat_id, thread_id) VALUES (?, ?, ?)
+		 ON CONFLICT(chat_key) DO UPDATE SET chat_id = excluded.chat_id, thread_id = excluded.thread_id`,
+		key, topic.ChatID, topic.ThreadID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to write topic: %w", err)
+	}
+	return nil
+}
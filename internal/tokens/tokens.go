@@ -0,0 +1,172 @@
+// Package tokens estimates how many tokens a text uses.
+//
+// Exact counts depend on each model's tokenizer, which isn't available for most
+// OpenRouter models. The Estimator uses a script-aware heuristic instead and
+// calibrates it per model with the prompt token counts reported by the API.
+package tokens
+
+import (
+	"math"
+	"sync"
+	"unicode"
+
+	"telegrambot/internal/storage"
+)
+
+const (
+	// MessageOverhead is the number of tokens added per message for role and separators
+	MessageOverhead = 4
+
+	// ImageTokens is the assumed size of one image in a prompt
+	ImageTokens = 1000
+
+	// documentOverhead is the number of tokens of the tags around the text of a document
+	documentOverhead = 10
+
+	// calibrationWeight is how much a new observation moves a model's correction factor
+	calibrationWeight = 0.2
+
+	// Correction factors are kept within these bounds so a single odd response can't skew them
+	minCorrection = 0.5
+	maxCorrection = 2.0
+)
+
+// Estimator estimates token counts with per-model calibration. It is safe for concurrent use.
+type Estimator struct {
+	mutex       sync.RWMutex
+	corrections map[string]float64
+}
+
+// NewEstimator creates an estimator without calibration data
+func NewEstimator() *Estimator {
+	return &Estimator{
+		corrections: make(map[string]float64),
+	}
+}
+
+// Count estimates the number of tokens of a text for a model
+func (e *Estimator) Count(model, text string) int {
+	return e.correct(model, float64(countText(text)))
+}
+
+// CountMessages estimates the prompt size of messages for a model, including images and overhead
+func (e *Estimator) CountMessages(model string, messages []storage.ChatMessage) int {
+	return e.correct(model, float64(countMessages(messages)))
+}
+
+// CountMessage estimates the size of a single message for a model
+func (e *Estimator) CountMessage(model string, message storage.ChatMessage) int {
+	return e.correct(model, float64(countMessage(message)))
+}
+
+// Calibrate records the prompt token count the API reported for messages,
+// improving future estimates for the model. Prompts with images are ignored
+// because the size of an image varies too much between providers.
+func (e *Estimator) Calibrate(model string, messages []storage.ChatMessage, actualTokens int) {
+	for _, message := range messages {
+		for _, attachment := range message.Attachments {
+			if attachment.Type == storage.AttachmentImage {
+				return
+			}
+		}
+	}
+
+	estimated := countMessages(messages)
+	if estimated == 0 || actualTokens <= 0 {
+		return
+	}
+
+	ratio := math.Max(minCorrection, math.Min(maxCorrection, float64(actualTokens)/float64(estimated)))
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if current, ok := e.corrections[model]; ok {
+		ratio = current + (ratio-current)*calibrationWeight
+	}
+	e.corrections[model] = ratio
+}
+
+// Correction returns the calibration factor of a model (1 if it hasn't been calibrated)
+func (e *Estimator) Correction(model string) float64 {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	if correction, ok := e.corrections[model]; ok {
+		return correction
+	}
+	return 1
+}
+
+// correct applies the model's calibration factor to a raw estimate
+func (e *Estimator) correct(model string, estimate float64) int {
+	return int(math.Ceil(estimate * e.Correction(model)))
+}
+
+// countMessages returns the uncalibrated estimate for messages
+func countMessages(messages []storage.ChatMessage) int {
+	total := 0
+	for _, message := range messages {
+		total += countMessage(message)
+	}
+	return total
+}
+
+// countMessage returns the uncalibrated estimate for one message. Documents are sent as text
+// with their file name.
+func countMessage(message storage.ChatMessage) int {
+	total := countText(message.Content) + MessageOverhead
+	for _, attachment := range message.Attachments {
+		if attachment.Type == storage.AttachmentDocument {
+			total += countText(attachment.Name) + countText(attachment.Text) + documentOverhead
+		} else {
+			total += ImageTokens
+		}
+	}
+	return total
+}
+
+// countText estimates tokens with rules of thumb that hold for common BPE tokenizers:
+// about four characters per token for Latin words, one token per ASCII punctuation
+// character, about two characters per token for other alphabets (Cyrillic, Greek, Arabic, ...)
+// and one token per CJK character.
+func countText(text string) int {
+	var (
+		total      float64
+		latinRun   int
+		foreignRun int
+	)
+
+	flush := func() {
+		if latinRun > 0 {
+			total += math.Max(1, math.Round(float64(latinRun)/4))
+		}
+		total += math.Ceil(float64(foreignRun) / 2)
+		latinRun, foreignRun = 0, 0
+	}
+
+	for _, r := range text {
+		switch {
+		case unicode.IsSpace(r):
+			flush()
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			latinRun++
+		case r < unicode.MaxASCII:
+			// Punctuation and symbols are usually tokens of their own
+			flush()
+			total++
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			flush()
+			total++
+		case unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsDigit(r):
+			foreignRun++
+		default:
+			// Emoji and other symbols often take several tokens
+			flush()
+			total += 2
+		}
+	}
+	flush()
+
+	return int(total)
+}
@@ -0,0 +1,121 @@
+// Package transcribe converts voice messages to text.
+//
+// The Client talks to any server implementing the OpenAI-compatible
+// /audio/transcriptions endpoint: OpenAI itself, Groq, or a local
+// whisper server such as faster-whisper-server or whisper.cpp.
+package transcribe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Transcriber converts recorded speech to text
+type Transcriber interface {
+	// Transcribe returns the text spoken in an audio file.
+	// The filename's extension tells the server the audio format.
+	Transcribe(ctx context.Context, audio []byte, filename string) (string, error)
+}
+
+// Client implements Transcriber using an OpenAI-compatible /audio/transcriptions endpoint
+type Client struct {
+	apiKey   string
+	baseURL  string
+	model    string
+	language string
+	client   *http.Client
+}
+
+// transcriptionResponse represents the JSON response of the transcription endpoint
+type transcriptionResponse struct {
+	Text  string `json:"text"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// NewClient creates a new transcription client.
+// The API key may be empty for local servers; an empty language lets the server detect it.
+func NewClient(baseURL, apiKey, model, language string) *Client {
+	return &Client{
+		apiKey:   apiKey,
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		model:    model,
+		language: language,
+		client: &http.Client{
+			Timeout: 120 * time.Second,
+		},
+	}
+}
+
+// Transcribe uploads an audio file and returns its transcript
+func (c *Client) Transcribe(ctx context.Context, audio []byte, filename string) (string, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to create form file: %w", err)
+	}
+	if _, err := part.Write(audio); err != nil {
+		return "", fmt.Errorf("failed to write audio: %w", err)
+	}
+
+	fields := map[string]string{
+		"model":           c.model,
+		"response_format": "json",
+	}
+	if c.language != "" {
+		fields["language"] = c.language
+	}
+	for name, value := range fields {
+		if err := writer.WriteField(name, value); err != nil {
+			return "", fmt.Errorf("failed to write form field: %w", err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", fmt.Errorf("failed to finish form: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/audio/transcriptions", &body)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", writer.FormDataContentType())
+	if c.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HTTP error %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var transcription transcriptionResponse
+	if err := json.Unmarshal(respBody, &transcription); err != nil {
+		return "", fmt.Errorf("failed to parse response: %w", err)
+	}
+	if transcription.Error != nil {
+		return "", fmt.Errorf("API error: %s", transcription.Error.Message)
+	}
+
+	return strings.TrimSpace(transcription.Text), nil
+}
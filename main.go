@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"flag"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"telegrambot/internal/bot"
 	"telegrambot/internal/config"
@@ -14,6 +16,9 @@ import (
 )
 
 func main() {
+	migrateJSON := flag.Bool("migrate-json", false, "import user_*.json files from the data directory into the SQLite database and exit")
+	flag.Parse()
+
 	// Set up logging
 	log.SetFormatter(&log.TextFormatter{
 		FullTimestamp: true,
@@ -26,11 +31,28 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	// One-shot migration from file storage to SQLite
+	if *migrateJSON {
+		sqliteStore, err := storage.NewSQLiteStorage(cfg.SQLitePath)
+		if err != nil {
+			log.Fatalf("Failed to open SQLite database: %v", err)
+		}
+		defer sqliteStore.Close()
+
+		count, err := storage.MigrateFileStorage(cfg.DataDirectory, sqliteStore)
+		if err != nil {
+			log.Fatalf("Migration failed after %d users: %v", count, err)
+		}
+		log.Infof("Imported %d users into %s. Set \"storage_backend\": \"sqlite\" in config.json to use it.", count, cfg.SQLitePath)
+		return
+	}
+
 	// Initialize storage
-	store, err := storage.NewFileStorage("data")
+	store, err := newStorage(cfg)
 	if err != nil {
 		log.Fatalf("Failed to initialize storage: %v", err)
 	}
+	defer store.Close()
 
 	// Create context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -64,6 +86,22 @@ func main() {
 	}
 
 	cancel()
-	telegramBot.Stop()
+
+	// Let running requests finish, then cancel what is left
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout)*time.Second)
+	defer cancelShutdown()
+	telegramBot.Stop(shutdownCtx)
 	log.Info("Bot stopped.")
 }
+
+// newStorage creates the storage backend selected in the configuration
+func newStorage(cfg *config.Config) (storage.Storage, error) {
+	switch cfg.StorageBackend {
+	case "sqlite":
+		log.Infof("Using SQLite storage: %s", cfg.SQLitePath)
+		return storage.NewSQLiteStorage(cfg.SQLitePath)
+	default:
+		log.Infof("Using file storage: %s", cfg.DataDirectory)
+		return storage.NewFileStorage(cfg.DataDirectory)
+	}
+}